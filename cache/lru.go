@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultShardNum default number of shards in a LRUCache.
+	DefaultShardNum = 16
+
+	// entryOverhead approximate memory used by a cached entry besides its key and value.
+	entryOverhead = 64
+)
+
+type (
+	// LRUCache is a size-bounded and sharded LRU cache, the key is a byte slice.
+	// Each shard has its own lock and memory budget, so concurrent access to different keys won't block each other.
+	LRUCache struct {
+		shards []*lruShard
+		hits   uint64
+		misses uint64
+	}
+
+	// Stats is the statistics of a LRUCache.
+	Stats struct {
+		Hits    uint64
+		Misses  uint64
+		Entries int
+		Size    int64
+	}
+
+	lruShard struct {
+		sync.Mutex
+		capacity  int64
+		size      int64
+		items     map[string]*list.Element
+		evictList *list.List
+	}
+
+	lruEntry struct {
+		key   string
+		value []byte
+	}
+)
+
+// NewLRUCache create a new LRUCache, capacity is the max memory in bytes used by all shards.
+// If shardNum is not positive, DefaultShardNum will be used.
+func NewLRUCache(capacity int64, shardNum int) *LRUCache {
+	if shardNum <= 0 {
+		shardNum = DefaultShardNum
+	}
+	c := &LRUCache{shards: make([]*lruShard, shardNum)}
+	for i := range c.shards {
+		c.shards[i] = &lruShard{
+			capacity:  capacity / int64(shardNum),
+			items:     make(map[string]*list.Element),
+			evictList: list.New(),
+		}
+	}
+	return c
+}
+
+// Get the value of key, and mark the key as recently used.
+// The returned slice is shared with the cache, so don't modify it.
+func (c *LRUCache) Get(key []byte) ([]byte, bool) {
+	shard := c.getShard(key)
+	shard.Lock()
+	elem, ok := shard.items[string(key)]
+	if !ok {
+		shard.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	shard.evictList.MoveToFront(elem)
+	value := elem.Value.(*lruEntry).value
+	shard.Unlock()
+
+	atomic.AddUint64(&c.hits, 1)
+	return value, true
+}
+
+// Set key to hold the value, the least recently used keys will be evicted if the shard is full.
+// The value is kept as it is, so don't modify it after calling Set.
+func (c *LRUCache) Set(key, value []byte) {
+	shard := c.getShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	cost := entryCost(len(key), len(value))
+	// too large to be cached.
+	if cost > shard.capacity {
+		shard.remove(key)
+		return
+	}
+
+	if elem, ok := shard.items[string(key)]; ok {
+		ent := elem.Value.(*lruEntry)
+		shard.size += cost - entryCost(len(key), len(ent.value))
+		ent.value = value
+		shard.evictList.MoveToFront(elem)
+	} else {
+		ent := &lruEntry{key: string(key), value: value}
+		shard.items[ent.key] = shard.evictList.PushFront(ent)
+		shard.size += cost
+	}
+
+	for shard.size > shard.capacity {
+		shard.removeElement(shard.evictList.Back())
+	}
+}
+
+// Delete the key from cache.
+func (c *LRUCache) Delete(key []byte) {
+	shard := c.getShard(key)
+	shard.Lock()
+	shard.remove(key)
+	shard.Unlock()
+}
+
+// Stats returns hits, misses and the memory usage of the cache.
+func (c *LRUCache) Stats() Stats {
+	stats := Stats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+	for _, shard := range c.shards {
+		shard.Lock()
+		stats.Entries += len(shard.items)
+		stats.Size += shard.size
+		shard.Unlock()
+	}
+	return stats
+}
+
+func (c *LRUCache) getShard(key []byte) *lruShard {
+	// fnv-1a hash.
+	var hash uint32 = 2166136261
+	for _, b := range key {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	return c.shards[hash%uint32(len(c.shards))]
+}
+
+func (s *lruShard) remove(key []byte) {
+	if elem, ok := s.items[string(key)]; ok {
+		s.removeElement(elem)
+	}
+}
+
+func (s *lruShard) removeElement(elem *list.Element) {
+	ent := s.evictList.Remove(elem).(*lruEntry)
+	delete(s.items, ent.key)
+	s.size -= entryCost(len(ent.key), len(ent.value))
+}
+
+func entryCost(keySize, valueSize int) int64 {
+	return int64(keySize+valueSize) + entryOverhead
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestLRUCache_Get(t *testing.T) {
+	c := NewLRUCache(1<<20, 4)
+	c.Set([]byte("k1"), []byte("v1"))
+	c.Set([]byte("k2"), []byte("v2"))
+	c.Set([]byte("k2"), []byte("v2-updated"))
+
+	tests := []struct {
+		name   string
+		key    []byte
+		want   []byte
+		wantOk bool
+	}{
+		{"normal", []byte("k1"), []byte("v1"), true},
+		{"updated", []byte("k2"), []byte("v2-updated"), true},
+		{"not-exist", []byte("k3"), nil, false},
+		{"nil-key", nil, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := c.Get(tt.key)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, 2, stats.Entries)
+}
+
+func TestLRUCache_Evict(t *testing.T) {
+	// only one shard, which can hold 4 entries.
+	c := NewLRUCache(entryCost(2, 2)*4, 1)
+	for i := 0; i < 4; i++ {
+		c.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+	}
+	// k0 is the most recently used now.
+	_, ok := c.Get([]byte("k0"))
+	assert.True(t, ok)
+
+	c.Set([]byte("k4"), []byte("v4"))
+	_, ok = c.Get([]byte("k1"))
+	assert.False(t, ok)
+	_, ok = c.Get([]byte("k0"))
+	assert.True(t, ok)
+	assert.Equal(t, 4, c.Stats().Entries)
+	assert.Equal(t, entryCost(2, 2)*4, c.Stats().Size)
+
+	// too large to be cached.
+	c.Set([]byte("k5"), make([]byte, 1024))
+	_, ok = c.Get([]byte("k5"))
+	assert.False(t, ok)
+}
+
+func TestLRUCache_Delete(t *testing.T) {
+	c := NewLRUCache(1<<20, 0)
+	c.Set([]byte("k1"), []byte("v1"))
+	c.Delete([]byte("k1"))
+	c.Delete([]byte("not-exist"))
+
+	_, ok := c.Get([]byte("k1"))
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), c.Stats().Size)
+}
+
+func TestLRUCache_Concurrent(t *testing.T) {
+	c := NewLRUCache(1<<10, DefaultShardNum)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				key := []byte(fmt.Sprintf("key-%d-%d", n, j%50))
+				c.Set(key, []byte("value"))
+				c.Get(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, c.Stats().Size, int64(1<<10))
+}
@@ -0,0 +1,413 @@
+// Package cluster routes keys to multiple dbs by consistent hashing, so that the data can be spread over disks
+// and machines. The dbs can be embedded in the process or served by yoimiya-servers, see Node.
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"sort"
+	"sync"
+	"yoimiya/db"
+)
+
+var (
+	// ErrNoNode the cluster has no node to route keys to.
+	ErrNoNode = errors.New("cluster: no node in cluster")
+
+	// ErrNodeExists a node with the same name is in the cluster.
+	ErrNodeExists = errors.New("cluster: node already exists")
+
+	// ErrNodeNotFound the node is not in the cluster.
+	ErrNodeNotFound = errors.New("cluster: node not found")
+
+	// ErrRebalancing another node is being added or removed.
+	ErrRebalancing = errors.New("cluster: rebalancing is in progress")
+)
+
+const (
+	// keyLockNum number of locks guarding the keys being migrated.
+	keyLockNum = 256
+
+	// migrateBatchSize number of keys scanned at a time when migrating.
+	migrateBatchSize = 256
+)
+
+// Options of cluster.
+type Options struct {
+	// VirtualNodes number of points of each node on the hash ring, more points spread the keys more evenly.
+	VirtualNodes int
+}
+
+// DefaultOptions returns the default options of cluster.
+func DefaultOptions() Options {
+	return Options{VirtualNodes: DefaultVirtualNodes}
+}
+
+// Cluster routes the keys to nodes by consistent hashing with virtual nodes.
+// Keys with the same hash tag, like "{user1}.name" and "{user1}.age", are always on the same node.
+//
+// When a node is added or removed, the keys whose owner changes are migrated online:
+// reads fall back to the previous owner until the migration finishes, and writes go to the new owner.
+// A key is locked while it is migrated, so writes of this Cluster won't be lost by the migration,
+// but writes of other clients to the nodes during a migration may be.
+type Cluster struct {
+	mu    sync.RWMutex
+	nodes map[string]Node
+	ring  *ring
+	prev  *ring // the ring before the rebalancing, nil if no rebalancing is in progress.
+	keyMu [keyLockNum]sync.Mutex
+
+	rebalanceMu sync.Mutex // only one rebalancing at a time.
+}
+
+// NewCluster creates a cluster without nodes, add nodes by AddNode.
+func NewCluster(opts Options) *Cluster {
+	if opts.VirtualNodes <= 0 {
+		opts.VirtualNodes = DefaultVirtualNodes
+	}
+	return &Cluster{
+		nodes: make(map[string]Node),
+		ring:  newRing(opts.VirtualNodes, nil),
+	}
+}
+
+// Nodes returns the names of nodes in order.
+func (c *Cluster) Nodes() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.ring.names...)
+}
+
+// NodeOf returns the name of the node which key belongs to.
+func (c *Cluster) NodeOf(key []byte) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	name := c.ring.owner(key)
+	if name == "" {
+		return "", ErrNoNode
+	}
+	return name, nil
+}
+
+// AddNode adds a node to the cluster, and migrates the keys which belong to it from the other nodes.
+// It blocks until the migration finishes, the cluster serves requests meanwhile.
+func (c *Cluster) AddNode(name string, node Node) error {
+	if !c.rebalanceMu.TryLock() {
+		return ErrRebalancing
+	}
+	defer c.rebalanceMu.Unlock()
+
+	c.mu.Lock()
+	if c.prev != nil {
+		c.mu.Unlock()
+		return ErrRebalancing
+	}
+	if _, ok := c.nodes[name]; ok {
+		c.mu.Unlock()
+		return ErrNodeExists
+	}
+	c.nodes[name] = node
+	c.prev, c.ring = c.ring, c.ring.with(name)
+	sources := c.prev.names
+	c.mu.Unlock()
+	return c.migrate(sources)
+}
+
+// RemoveNode migrates the keys of a node to the other nodes, and removes it from the cluster.
+// The node is not closed, and can be removed only if there are other nodes to hold its keys.
+func (c *Cluster) RemoveNode(name string) error {
+	if !c.rebalanceMu.TryLock() {
+		return ErrRebalancing
+	}
+	defer c.rebalanceMu.Unlock()
+
+	c.mu.Lock()
+	if c.prev != nil {
+		c.mu.Unlock()
+		return ErrRebalancing
+	}
+	if _, ok := c.nodes[name]; !ok || !c.ring.has(name) {
+		c.mu.Unlock()
+		return ErrNodeNotFound
+	}
+	if len(c.nodes) == 1 {
+		c.mu.Unlock()
+		return ErrNoNode
+	}
+	c.prev, c.ring = c.ring, c.ring.without(name)
+	c.mu.Unlock()
+	return c.migrate([]string{name})
+}
+
+// Rebalance migrates the keys of all nodes to their owners, it finishes a rebalancing
+// after AddNode or RemoveNode failed, otherwise there is nothing to migrate.
+func (c *Cluster) Rebalance() error {
+	if !c.rebalanceMu.TryLock() {
+		return ErrRebalancing
+	}
+	defer c.rebalanceMu.Unlock()
+
+	c.mu.RLock()
+	sources := make([]string, 0, len(c.nodes))
+	for name := range c.nodes {
+		sources = append(sources, name)
+	}
+	c.mu.RUnlock()
+	sort.Strings(sources)
+	return c.migrate(sources)
+}
+
+// migrate moves the keys of sources to their owners in the new ring, and finishes the rebalancing,
+// the removed nodes are dropped then. If it fails, the rebalancing is still in progress,
+// reads keep falling back to the previous owners, and Rebalance should be called to finish it.
+func (c *Cluster) migrate(sources []string) error {
+	for _, name := range sources {
+		c.mu.RLock()
+		node := c.nodes[name]
+		c.mu.RUnlock()
+
+		var after []byte
+		for {
+			keys, err := node.Keys(nil, after, migrateBatchSize)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err := c.migrateKey(name, node, key); err != nil {
+					return err
+				}
+			}
+			if len(keys) < migrateBatchSize {
+				break
+			}
+			after = keys[len(keys)-1]
+		}
+	}
+
+	c.mu.Lock()
+	c.prev = nil
+	for name := range c.nodes {
+		if !c.ring.has(name) {
+			delete(c.nodes, name)
+		}
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// migrateKey moves key from node to its owner, if the owner is another node.
+// The value written to the owner during the migration is newer, so it is kept.
+func (c *Cluster) migrateKey(name string, node Node, key []byte) error {
+	unlock := c.lockKey(key)
+	defer unlock()
+
+	c.mu.RLock()
+	owner := c.ring.owner(key)
+	target := c.nodes[owner]
+	c.mu.RUnlock()
+	if owner == name {
+		return nil
+	}
+
+	value, err := node.Get(key)
+	if err == db.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := target.Get(key); err == db.ErrKeyNotFound {
+		if err := target.Set(key, value); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return node.Delete(key)
+}
+
+func (c *Cluster) lockKey(key []byte) func() {
+	mu := &c.keyMu[crc32.ChecksumIEEE(key)%keyLockNum]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (c *Cluster) rebalancing() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.prev != nil
+}
+
+// route returns the owner of key, and its previous owner if it is different during a rebalancing.
+func (c *Cluster) route(key []byte) (Node, Node, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	owner := c.ring.owner(key)
+	if owner == "" {
+		return nil, nil, ErrNoNode
+	}
+	var prev Node
+	if c.prev != nil {
+		if name := c.prev.owner(key); name != owner {
+			prev = c.nodes[name]
+		}
+	}
+	return c.nodes[owner], prev, nil
+}
+
+// Get returns the value of key, or db.ErrKeyNotFound if it doesn't exist.
+func (c *Cluster) Get(key []byte) ([]byte, error) {
+	node, prev, err := c.route(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := node.Get(key)
+	if err != db.ErrKeyNotFound || prev == nil {
+		return value, err
+	}
+	if value, err = prev.Get(key); err != db.ErrKeyNotFound {
+		return value, err
+	}
+	// the key may be migrated between the two reads.
+	return node.Get(key)
+}
+
+// Set sets the value of key on its node.
+func (c *Cluster) Set(key, value []byte) error {
+	unlock := c.lockKey(key)
+	defer unlock()
+	node, _, err := c.route(key)
+	if err != nil {
+		return err
+	}
+	return node.Set(key, value)
+}
+
+// Delete deletes key, from its previous node too during a rebalancing, so that it won't be migrated back.
+func (c *Cluster) Delete(key []byte) error {
+	unlock := c.lockKey(key)
+	defer unlock()
+	node, prev, err := c.route(key)
+	if err != nil {
+		return err
+	}
+	if err := node.Delete(key); err != nil {
+		return err
+	}
+	if prev != nil {
+		return prev.Delete(key)
+	}
+	return nil
+}
+
+// MGet returns the values of keys in order, nil for the keys not found.
+// The keys are grouped by their nodes, and the nodes are read concurrently.
+func (c *Cluster) MGet(keys [][]byte) ([][]byte, error) {
+	batches := make(map[Node][]int)
+	for i, key := range keys {
+		node, _, err := c.route(key)
+		if err != nil {
+			return nil, err
+		}
+		batches[node] = append(batches[node], i)
+	}
+
+	values := make([][]byte, len(keys))
+	errs := make(chan error, len(batches))
+	for node, indexes := range batches {
+		go func(node Node, indexes []int) {
+			errs <- c.mget(node, keys, indexes, values)
+		}(node, indexes)
+	}
+	var err error
+	for range batches {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// mget reads the keys of indexes from node into values,
+// the keys not found are read from their previous owners during a rebalancing.
+func (c *Cluster) mget(node Node, keys [][]byte, indexes []int, values [][]byte) error {
+	batch := make([][]byte, len(indexes))
+	for j, i := range indexes {
+		batch[j] = keys[i]
+	}
+	batchValues, err := node.MGet(batch)
+	if err != nil {
+		return err
+	}
+	for j, i := range indexes {
+		if batchValues[j] != nil {
+			values[i] = batchValues[j]
+			continue
+		}
+		if !c.rebalancing() {
+			continue
+		}
+		value, err := c.Get(keys[i])
+		if err != nil && err != db.ErrKeyNotFound {
+			return err
+		}
+		values[i] = value
+	}
+	return nil
+}
+
+// Scan returns at most count keys with prefix in lexicographical order across all nodes,
+// if after is not nil, only the keys greater than after are returned, the same as db.YoimiyaDB.Keys.
+// Each node is scanned concurrently, and the keys are merged.
+// During a rebalancing, a key being migrated may be missed.
+func (c *Cluster) Scan(prefix, after []byte, count int) ([][]byte, error) {
+	c.mu.RLock()
+	nodes := make([]Node, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		nodes = append(nodes, node)
+	}
+	c.mu.RUnlock()
+
+	results := make([][][]byte, len(nodes))
+	errs := make(chan error, len(nodes))
+	for i, node := range nodes {
+		go func(i int, node Node) {
+			var err error
+			results[i], err = node.Keys(prefix, after, count)
+			errs <- err
+		}(i, node)
+	}
+	var err error
+	for range nodes {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	for _, result := range results {
+		keys = append(keys, result...)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	// a key may be on two nodes during a rebalancing.
+	merged := keys[:0]
+	for _, key := range keys {
+		if len(merged) > 0 && bytes.Equal(merged[len(merged)-1], key) {
+			continue
+		}
+		merged = append(merged, key)
+	}
+	if len(merged) > count {
+		merged = merged[:count]
+	}
+	return merged, nil
+}
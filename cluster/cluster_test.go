@@ -0,0 +1,199 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"yoimiya/db"
+	"yoimiya/server"
+)
+
+func openNodes(t *testing.T, num int) ([]*db.YoimiyaDB, func()) {
+	path := filepath.Join("/tmp", "yoimiya-cluster")
+	var dbs []*db.YoimiyaDB
+	for i := 0; i < num; i++ {
+		d, err := db.Open(db.DefaultOptions(filepath.Join(path, fmt.Sprint(i))))
+		assert.Nil(t, err)
+		dbs = append(dbs, d)
+	}
+	return dbs, func() {
+		for _, d := range dbs {
+			_ = d.Close()
+		}
+		_ = os.RemoveAll(path)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	dbs, cleanup := openNodes(t, 3)
+	defer cleanup()
+	c := NewCluster(DefaultOptions())
+	_, err := c.Get([]byte("k"))
+	assert.Equal(t, ErrNoNode, err)
+	assert.Nil(t, c.AddNode("n0", Embedded(dbs[0])))
+	assert.Nil(t, c.AddNode("n1", Embedded(dbs[1])))
+	assert.Equal(t, ErrNodeExists, c.AddNode("n1", Embedded(dbs[1])))
+
+	keyNum := 500
+	keys := make([][]byte, keyNum)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%03d", i))
+		assert.Nil(t, c.Set(keys[i], keys[i]))
+	}
+	assert.Nil(t, c.Set([]byte("{user1}.name"), []byte("yoimiya")))
+	assert.Nil(t, c.Set([]byte("{user1}.age"), []byte("18")))
+	// the keys are spread over nodes, except the ones with the same hash tag.
+	assert.Greater(t, len(dbs[0].Keys(nil, nil, keyNum)), keyNum/4)
+	assert.Greater(t, len(dbs[1].Keys(nil, nil, keyNum)), keyNum/4)
+	n0, _ := c.NodeOf([]byte("{user1}.name"))
+	n1, _ := c.NodeOf([]byte("{user1}.age"))
+	assert.Equal(t, n0, n1)
+
+	check := func(t *testing.T) {
+		for _, key := range keys {
+			value, err := c.Get(key)
+			assert.Nil(t, err)
+			assert.Equal(t, key, value)
+		}
+		values, err := c.MGet([][]byte{keys[0], []byte("missing"), keys[1], []byte("{user1}.name")})
+		assert.Nil(t, err)
+		assert.Equal(t, [][]byte{keys[0], nil, keys[1], []byte("yoimiya")}, values)
+
+		scanned, err := c.Scan([]byte("key-"), nil, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, keys[:10], scanned)
+		scanned, err = c.Scan([]byte("key-"), keys[10], keyNum)
+		assert.Nil(t, err)
+		assert.Equal(t, keys[11:], scanned)
+	}
+	check(t)
+
+	t.Run("add", func(t *testing.T) {
+		assert.Nil(t, c.AddNode("n2", Embedded(dbs[2])))
+		assert.Equal(t, []string{"n0", "n1", "n2"}, c.Nodes())
+		check(t)
+		// each key is on its owner only.
+		var total int
+		for i, d := range dbs {
+			for _, key := range d.Keys(nil, nil, keyNum+2) {
+				owner, _ := c.NodeOf(key)
+				assert.Equal(t, fmt.Sprintf("n%d", i), owner)
+				total++
+			}
+		}
+		assert.Equal(t, keyNum+2, total)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		assert.Nil(t, c.Delete(keys[0]))
+		_, err := c.Get(keys[0])
+		assert.Equal(t, db.ErrKeyNotFound, err)
+		assert.Nil(t, c.Set(keys[0], keys[0]))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		assert.Nil(t, c.RemoveNode("n0"))
+		assert.Equal(t, ErrNodeNotFound, c.RemoveNode("n0"))
+		assert.Equal(t, []string{"n1", "n2"}, c.Nodes())
+		assert.Empty(t, dbs[0].Keys(nil, nil, 1))
+		check(t)
+	})
+}
+
+func TestCluster_Migrating(t *testing.T) {
+	dbs, cleanup := openNodes(t, 2)
+	defer cleanup()
+	c := NewCluster(DefaultOptions())
+	assert.Nil(t, c.AddNode("n0", Embedded(dbs[0])))
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%03d", i))
+		assert.Nil(t, c.Set(keys[i], []byte("v1")))
+	}
+
+	// simulate a migration which failed before moving any key.
+	c.mu.Lock()
+	c.nodes["n1"] = Embedded(dbs[1])
+	c.prev, c.ring = c.ring, c.ring.with("n1")
+	c.mu.Unlock()
+	var moving [][]byte
+	for _, key := range keys {
+		if owner, _ := c.NodeOf(key); owner == "n1" {
+			moving = append(moving, key)
+		}
+	}
+	assert.NotEmpty(t, moving)
+	assert.Equal(t, ErrRebalancing, c.AddNode("n2", Embedded(dbs[1])))
+
+	// reads fall back to the previous owner, writes go to the new owner.
+	value, err := c.Get(moving[0])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), value)
+	values, err := c.MGet(moving[:2])
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("v1"), []byte("v1")}, values)
+	assert.Nil(t, c.Set(moving[0], []byte("v2")))
+	assert.Nil(t, c.Delete(moving[1]))
+	scanned, err := c.Scan(nil, nil, len(keys))
+	assert.Nil(t, err)
+	assert.Len(t, scanned, len(keys)-1)
+
+	assert.Nil(t, c.Rebalance())
+	value, err = c.Get(moving[0])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), value)
+	_, err = c.Get(moving[1])
+	assert.Equal(t, db.ErrKeyNotFound, err)
+	assert.Len(t, dbs[1].Keys(nil, nil, len(keys)), len(moving)-1)
+}
+
+func TestCluster_Remote(t *testing.T) {
+	dbs, cleanup := openNodes(t, 2)
+	defer cleanup()
+	srv, err := server.NewServer(dbs)
+	assert.Nil(t, err)
+	defer srv.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+
+	c := NewCluster(DefaultOptions())
+	for i := range dbs {
+		node, err := Dial(ln.Addr().String(), i)
+		assert.Nil(t, err)
+		defer node.Close()
+		assert.Nil(t, c.AddNode(fmt.Sprintf("n%d", i), node))
+	}
+	keys := make([][]byte, 50)
+	for i := range keys {
+		// special characters of glob patterns are scanned literally.
+		keys[i] = []byte(fmt.Sprintf("k*[%02d]", i))
+		assert.Nil(t, c.Set(keys[i], keys[i]))
+	}
+	assert.Nil(t, c.Set([]byte("other"), nil))
+	assert.NotEmpty(t, dbs[0].Keys(nil, nil, 1))
+	assert.NotEmpty(t, dbs[1].Keys(nil, nil, 1))
+
+	value, err := c.Get(keys[0])
+	assert.Nil(t, err)
+	assert.Equal(t, keys[0], value)
+	_, err = c.Get([]byte("missing"))
+	assert.Equal(t, db.ErrKeyNotFound, err)
+	values, err := c.MGet([][]byte{keys[1], []byte("missing")})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{keys[1], nil}, values)
+	scanned, err := c.Scan([]byte("k*["), keys[4], 20)
+	assert.Nil(t, err)
+	assert.Equal(t, keys[5:25], scanned)
+
+	assert.Nil(t, c.RemoveNode("n1"))
+	assert.Empty(t, dbs[1].Keys(nil, nil, 1))
+	scanned, err = c.Scan([]byte("k*["), nil, len(keys))
+	assert.Nil(t, err)
+	assert.Equal(t, keys, scanned)
+}
@@ -0,0 +1,291 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"yoimiya/db"
+)
+
+// ErrProtocol the reply of a remote node can't be parsed.
+var ErrProtocol = errors.New("cluster: invalid reply from remote node")
+
+// dialTimeout timeout of connecting to a remote node.
+const dialTimeout = 5 * time.Second
+
+// Node is a db in the cluster, either an embedded *db.YoimiyaDB or a remote one served in RESP.
+// Get returns db.ErrKeyNotFound if the key doesn't exist, and MGet returns nil for the keys not found.
+type Node interface {
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	MGet(keys [][]byte) ([][]byte, error)
+
+	// Keys returns at most count keys with prefix in lexicographical order, which are greater than after if it is not nil.
+	Keys(prefix, after []byte, count int) ([][]byte, error)
+}
+
+// embeddedNode is a db in the same process.
+type embeddedNode struct {
+	*db.YoimiyaDB
+}
+
+// Embedded returns the node of a db in the same process, the db is not closed by the cluster.
+func Embedded(d *db.YoimiyaDB) Node {
+	return embeddedNode{d}
+}
+
+func (n embeddedNode) Keys(prefix, after []byte, count int) ([][]byte, error) {
+	return n.YoimiyaDB.Keys(prefix, after, count), nil
+}
+
+// RemoteNode is a db served by a yoimiya-server, the commands are sent over one connection in turn,
+// which is dialed again after a network error.
+type RemoteNode struct {
+	addr    string
+	dbIndex int
+
+	mu sync.Mutex
+	nc net.Conn
+	rd *bufio.Reader
+	wr *bufio.Writer
+}
+
+// Dial connects to the db of dbIndex on the yoimiya-server at addr.
+func Dial(addr string, dbIndex int) (*RemoteNode, error) {
+	n := &RemoteNode{addr: addr, dbIndex: dbIndex}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.connect(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Close closes the connection.
+func (n *RemoteNode) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.nc == nil {
+		return nil
+	}
+	err := n.nc.Close()
+	n.nc = nil
+	return err
+}
+
+func (n *RemoteNode) Get(key []byte) ([]byte, error) {
+	reply, err := n.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, db.ErrKeyNotFound
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, ErrProtocol
+	}
+	return value, nil
+}
+
+func (n *RemoteNode) Set(key, value []byte) error {
+	_, err := n.do("SET", key, value)
+	return err
+}
+
+func (n *RemoteNode) Delete(key []byte) error {
+	_, err := n.do("DEL", key)
+	return err
+}
+
+func (n *RemoteNode) MGet(keys [][]byte) ([][]byte, error) {
+	reply, err := n.do("MGET", keys...)
+	if err != nil {
+		return nil, err
+	}
+	elems, ok := reply.([]interface{})
+	if !ok || len(elems) != len(keys) {
+		return nil, ErrProtocol
+	}
+	values := make([][]byte, len(keys))
+	for i, elem := range elems {
+		if elem == nil {
+			continue
+		}
+		if values[i], ok = elem.([]byte); !ok {
+			return nil, ErrProtocol
+		}
+	}
+	return values, nil
+}
+
+// Keys scans the keys by SCAN, until count keys are found or the scan is finished.
+func (n *RemoteNode) Keys(prefix, after []byte, count int) ([][]byte, error) {
+	cursor := "0"
+	if len(after) > 0 {
+		cursor = hex.EncodeToString(after)
+	}
+	// escape the special characters, so that the pattern matches the prefix literally.
+	var pattern strings.Builder
+	for _, c := range prefix {
+		if strings.IndexByte("*?[]\\", c) >= 0 {
+			pattern.WriteByte('\\')
+		}
+		pattern.WriteByte(c)
+	}
+	pattern.WriteByte('*')
+
+	var keys [][]byte
+	for len(keys) < count {
+		reply, err := n.do("SCAN", []byte(cursor), []byte("MATCH"), []byte(pattern.String()),
+			[]byte("COUNT"), []byte(strconv.Itoa(count-len(keys))))
+		if err != nil {
+			return nil, err
+		}
+		elems, ok := reply.([]interface{})
+		if !ok || len(elems) != 2 {
+			return nil, ErrProtocol
+		}
+		next, ok1 := elems[0].([]byte)
+		page, ok2 := elems[1].([]interface{})
+		if !ok1 || !ok2 {
+			return nil, ErrProtocol
+		}
+		for _, elem := range page {
+			key, ok := elem.([]byte)
+			if !ok {
+				return nil, ErrProtocol
+			}
+			keys = append(keys, key)
+		}
+		if cursor = string(next); cursor == "0" {
+			break
+		}
+	}
+	return keys, nil
+}
+
+// do sends a command and reads its reply, the connection is dropped on network errors,
+// and dialed again by the next command.
+func (n *RemoteNode) do(name string, args ...[]byte) (interface{}, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.nc == nil {
+		if err := n.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := n.roundTrip(name, args)
+	if err != nil {
+		if _, ok := err.(replyError); !ok {
+			_ = n.nc.Close()
+			n.nc = nil
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (n *RemoteNode) connect() error {
+	nc, err := net.DialTimeout("tcp", n.addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	n.nc, n.rd, n.wr = nc, bufio.NewReader(nc), bufio.NewWriter(nc)
+	if n.dbIndex != 0 {
+		if _, err := n.roundTrip("SELECT", [][]byte{[]byte(strconv.Itoa(n.dbIndex))}); err != nil {
+			_ = nc.Close()
+			n.nc = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *RemoteNode) roundTrip(name string, args [][]byte) (interface{}, error) {
+	fmt.Fprintf(n.wr, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(name), name)
+	for _, arg := range args {
+		fmt.Fprintf(n.wr, "$%d\r\n", len(arg))
+		_, _ = n.wr.Write(arg)
+		_, _ = n.wr.WriteString("\r\n")
+	}
+	if err := n.wr.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(n.rd)
+}
+
+// replyError is an error reply of the remote node.
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+// readReply reads a RESP2 reply: a string for simple strings, int64 for integers, []byte for bulk strings,
+// []interface{} for arrays, nil for null, and replyError for errors.
+func readReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if len(line) == 0 {
+		return nil, ErrProtocol
+	}
+	kind, payload := line[0], line[1:]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, replyError(payload)
+	case ':':
+		v, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		return v, nil
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	case '*':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		elems := make([]interface{}, size)
+		for i := range elems {
+			if elems[i], err = readReply(rd); err != nil {
+				// error replies in arrays are not expected from the commands used, the connection is dropped.
+				if _, ok := err.(replyError); ok {
+					err = ErrProtocol
+				}
+				return nil, err
+			}
+		}
+		return elems, nil
+	}
+	return nil, ErrProtocol
+}
@@ -0,0 +1,99 @@
+package cluster
+
+import (
+	"bytes"
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes the default number of virtual nodes of each node on the hash ring.
+const DefaultVirtualNodes = 160
+
+// ring is a consistent hash ring, each node has vnodes points on it,
+// and a key belongs to the node of the first point not less than its hash.
+// It is immutable, a new ring is created when nodes are changed.
+type ring struct {
+	vnodes int
+	hashes []uint32 // sorted hashes of the points.
+	owners []string // owners[i] is the node of hashes[i].
+	names  []string // sorted names of the nodes.
+}
+
+type point struct {
+	hash  uint32
+	owner string
+}
+
+func newRing(vnodes int, names []string) *ring {
+	r := &ring{vnodes: vnodes, names: append([]string(nil), names...)}
+	sort.Strings(r.names)
+	points := make([]point, 0, vnodes*len(names))
+	for _, name := range r.names {
+		for i := 0; i < vnodes; i++ {
+			points = append(points, point{hash: crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i))), owner: name})
+		}
+	}
+	// the names break ties, so that the ring is the same no matter the order of nodes.
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+	r.hashes = make([]uint32, len(points))
+	r.owners = make([]string, len(points))
+	for i, p := range points {
+		r.hashes[i], r.owners[i] = p.hash, p.owner
+	}
+	return r
+}
+
+// with returns a new ring with the node added.
+func (r *ring) with(name string) *ring {
+	return newRing(r.vnodes, append(append([]string(nil), r.names...), name))
+}
+
+// without returns a new ring with the node removed.
+func (r *ring) without(name string) *ring {
+	names := make([]string, 0, len(r.names))
+	for _, n := range r.names {
+		if n != name {
+			names = append(names, n)
+		}
+	}
+	return newRing(r.vnodes, names)
+}
+
+func (r *ring) has(name string) bool {
+	i := sort.SearchStrings(r.names, name)
+	return i < len(r.names) && r.names[i] == name
+}
+
+// owner returns the node which key belongs to, it is empty if the ring has no node.
+func (r *ring) owner(key []byte) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE(hashTag(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// hashTag returns the part of key which is hashed, the same as redis cluster:
+// if key has a non-empty substring between the first '{' and the first '}' after it, only the substring is hashed,
+// so that keys like "{user1}.name" and "{user1}.age" are on the same node.
+func hashTag(key []byte) []byte {
+	start := bytes.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+	end := bytes.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
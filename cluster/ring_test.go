@@ -0,0 +1,57 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHashTag(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"user1", "user1"},
+		{"{user1}.name", "user1"},
+		{"a{user1}b{user2}", "user1"},
+		{"{}.name", "{}.name"},
+		{"{user1", "{user1"},
+		{"}{user1}", "user1"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, string(hashTag([]byte(tt.key))), tt.key)
+	}
+}
+
+func TestRing(t *testing.T) {
+	r := newRing(DefaultVirtualNodes, nil)
+	assert.Equal(t, "", r.owner([]byte("k")))
+
+	r = newRing(DefaultVirtualNodes, []string{"n1", "n2", "n3"})
+	// the ring doesn't depend on the order of nodes.
+	assert.Equal(t, r, newRing(DefaultVirtualNodes, []string{"n3", "n1", "n2"}))
+	assert.Equal(t, r.owner([]byte("{user1}.name")), r.owner([]byte("{user1}.age")))
+
+	counts := make(map[string]int)
+	keyNum := 30000
+	for i := 0; i < keyNum; i++ {
+		counts[r.owner([]byte(fmt.Sprintf("key-%d", i)))]++
+	}
+	for _, name := range r.names {
+		assert.InDelta(t, keyNum/3, counts[name], float64(keyNum)/10, name)
+	}
+
+	// only the keys of the new node are moved.
+	added := r.with("n4")
+	assert.True(t, added.has("n4"))
+	var moved int
+	for i := 0; i < keyNum; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if owner := added.owner(key); owner != r.owner(key) {
+			assert.Equal(t, "n4", owner)
+			moved++
+		}
+	}
+	assert.InDelta(t, keyNum/4, moved, float64(keyNum)/10)
+	assert.Equal(t, r, added.without("n4"))
+}
@@ -0,0 +1,64 @@
+// Command yoimiya-check verifies the log files of a yoimiya db directory, and optionally repairs them.
+//
+// Usage:
+//
+//	yoimiya-check [-repair] [-size bytes] <db path>
+//
+// Encrypted log files can't be verified without their keys, they are reported as "encrypted, cannot verify".
+// The db must not be opened by other processes. It exits with status 1 if any problem is found(or left after repairing).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"yoimiya/db"
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "rewrite the valid entries into new log files, and remove orphan and invalid hint files")
+	size := flag.Int64("size", db.DefaultOptions("").LogFileSizeThreshold, "log file size threshold of the db")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: yoimiya-check [-repair] [-size bytes] <db path>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := db.DefaultOptions(flag.Arg(0))
+	opts.LogFileSizeThreshold = *size
+	if _, err := os.Stat(opts.DBPath); err != nil {
+		fmt.Fprintf(os.Stderr, "yoimiya-check: %v\n", err)
+		os.Exit(2)
+	}
+
+	var report *db.CheckReport
+	var err error
+	if *repair {
+		report, err = db.Repair(opts)
+	} else {
+		report, err = db.Check(opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "yoimiya-check: %v\n", err)
+		os.Exit(2)
+	}
+
+	for _, f := range report.Files {
+		fmt.Println(f)
+	}
+	for _, name := range report.Orphans {
+		fmt.Printf("%s: orphan file\n", name)
+	}
+	for _, name := range report.InvalidHints {
+		fmt.Printf("%s: invalid hint file\n", name)
+	}
+	if !report.Healthy() {
+		fmt.Println("problems found, run with -repair to fix them")
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// errProtocol the reply can't be parsed as RESP.
+var errProtocol = errors.New("invalid reply from server")
+
+// reply is a RESP2 or RESP3 reply, kind is the type byte of RESP, like '+' and '*'.
+// Null replies have kind '_', no matter which protocol version they are from.
+type reply struct {
+	kind  byte
+	str   string
+	elems []*reply // elements of array, set and push, keys and values in turn for map.
+}
+
+// client sends commands to the server in RESP and reads the replies.
+type client struct {
+	nc net.Conn
+	rd *bufio.Reader
+	wr *bufio.Writer
+}
+
+func newClient(nc net.Conn) *client {
+	return &client{nc: nc, rd: bufio.NewReader(nc), wr: bufio.NewWriter(nc)}
+}
+
+// Do sends a command and reads its reply.
+func (c *client) Do(args []string) (*reply, error) {
+	fmt.Fprintf(c.wr, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.wr, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := c.wr.Flush(); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *client) Close() error {
+	return c.nc.Close()
+}
+
+func (c *client) readReply() (*reply, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if len(line) == 0 {
+		return nil, errProtocol
+	}
+	kind, payload := line[0], line[1:]
+
+	switch kind {
+	case '+', '-', ':', ',', '#', '(':
+		return &reply{kind: kind, str: payload}, nil
+	case '_':
+		return &reply{kind: '_'}, nil
+	case '$', '=', '!':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return &reply{kind: '_'}, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			return nil, err
+		}
+		str := string(buf[:n])
+		switch kind {
+		case '=':
+			// verbatim string, the first 4 bytes is the format like "txt:".
+			if len(str) >= 4 {
+				str = str[4:]
+			}
+			kind = '$'
+		case '!':
+			kind = '-'
+		}
+		return &reply{kind: kind, str: str}, nil
+	case '*', '~', '>', '%', '|':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return &reply{kind: '_'}, nil
+		}
+		if kind == '%' || kind == '|' {
+			n *= 2
+		}
+		r := &reply{kind: kind, elems: make([]*reply, n)}
+		for i := range r.elems {
+			if r.elems[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		// attributes are the metadata of the next reply, they are skipped.
+		if kind == '|' {
+			return c.readReply()
+		}
+		return r, nil
+	}
+	return nil, errProtocol
+}
+
+// format formats the reply in the style of redis-cli, nested elements are indented.
+func (r *reply) format() string {
+	switch r.kind {
+	case '+':
+		return r.str
+	case '-':
+		return "(error) " + r.str
+	case ':':
+		return "(integer) " + r.str
+	case ',':
+		return "(double) " + r.str
+	case '(':
+		return "(big number) " + r.str
+	case '#':
+		if r.str == "t" {
+			return "(true)"
+		}
+		return "(false)"
+	case '$':
+		return strconv.Quote(r.str)
+	case '_':
+		return "(nil)"
+	case '%':
+		if len(r.elems) == 0 {
+			return "(empty hash)"
+		}
+		return formatElems(len(r.elems)/2, "# ", func(i int) string {
+			key := r.elems[2*i].format() + " => "
+			return key + indent(r.elems[2*i+1].format(), len(key))
+		})
+	}
+	if len(r.elems) == 0 {
+		return "(empty array)"
+	}
+	return formatElems(len(r.elems), ") ", func(i int) string {
+		return r.elems[i].format()
+	})
+}
+
+// formatElems formats n elements as numbered lines, the numbers are right aligned like redis-cli.
+func formatElems(n int, sep string, elem func(i int) string) string {
+	width := len(strconv.Itoa(n))
+	lines := make([]string, n)
+	for i := range lines {
+		label := fmt.Sprintf("%*d%s", width, i+1, sep)
+		lines[i] = label + indent(elem(i), len(label))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// indent indents the lines of s except the first one with n spaces.
+func indent(s string, n int) string {
+	return strings.ReplaceAll(s, "\n", "\n"+strings.Repeat(" ", n))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// maxHistory max number of lines kept in history.
+const maxHistory = 1000
+
+// errInterrupt the line is discarded by Ctrl-C.
+var errInterrupt = errors.New("interrupted")
+
+// lineEditor reads lines from a terminal, with basic emacs-like editing keys, history and tab completion.
+type lineEditor struct {
+	in       *os.File
+	rd       *bufio.Reader
+	out      io.Writer
+	history  []string
+	complete func(prefix string) []string
+}
+
+func newLineEditor(in *os.File, out io.Writer, complete func(prefix string) []string) *lineEditor {
+	return &lineEditor{in: in, rd: bufio.NewReader(in), out: out, complete: complete}
+}
+
+// AddHistory appends a line to history, empty lines and duplicates of the last line are ignored.
+func (e *lineEditor) AddHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+}
+
+// ReadLine shows the prompt and reads a line.
+// It returns io.EOF if Ctrl-D is pressed on an empty line, and errInterrupt if Ctrl-C is pressed.
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+	restore, err := makeRaw(int(e.in.Fd()))
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	var line []rune
+	pos := 0
+	histIdx := len(e.history)
+	saved := "" // the editing line before browsing history.
+	refresh := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	setLine := func(s string) {
+		line = []rune(s)
+		pos = len(line)
+		refresh()
+	}
+	refresh()
+
+	for {
+		r, _, err := e.rd.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupt
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+				refresh()
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+				refresh()
+			}
+		case 1: // Ctrl-A
+			pos = 0
+			refresh()
+		case 5: // Ctrl-E
+			pos = len(line)
+			refresh()
+		case 11: // Ctrl-K
+			line = line[:pos]
+			refresh()
+		case 21: // Ctrl-U
+			line = line[pos:]
+			pos = 0
+			refresh()
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+			refresh()
+		case '\t':
+			if completed, ok := e.completeLine(line, pos); ok {
+				setLine(completed)
+			} else {
+				refresh()
+			}
+		case 27: // escape sequences of arrow keys and so on.
+			seq := e.readEscape()
+			switch seq {
+			case "[A", "OA": // Up
+				if histIdx > 0 {
+					if histIdx == len(e.history) {
+						saved = string(line)
+					}
+					histIdx--
+					setLine(e.history[histIdx])
+				}
+			case "[B", "OB": // Down
+				if histIdx < len(e.history) {
+					histIdx++
+					if histIdx == len(e.history) {
+						setLine(saved)
+					} else {
+						setLine(e.history[histIdx])
+					}
+				}
+			case "[C", "OC": // Right
+				if pos < len(line) {
+					pos++
+					refresh()
+				}
+			case "[D", "OD": // Left
+				if pos > 0 {
+					pos--
+					refresh()
+				}
+			case "[H", "OH", "[1~": // Home
+				pos = 0
+				refresh()
+			case "[F", "OF", "[4~": // End
+				pos = len(line)
+				refresh()
+			case "[3~": // Delete
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+					refresh()
+				}
+			}
+		default:
+			if unicode.IsPrint(r) {
+				line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+				pos++
+				refresh()
+			}
+		}
+	}
+}
+
+// readEscape reads the rest of an escape sequence like "[A" or "[3~".
+func (e *lineEditor) readEscape() string {
+	var seq []rune
+	for {
+		r, _, err := e.rd.ReadRune()
+		if err != nil {
+			return string(seq)
+		}
+		seq = append(seq, r)
+		// the sequence ends with a letter or '~', except the leading '[' and 'O'.
+		if len(seq) > 1 && (unicode.IsLetter(r) || r == '~') || len(seq) == 1 && r != '[' && r != 'O' {
+			return string(seq)
+		}
+	}
+}
+
+// completeLine completes the command name when the cursor is at the end of the first word.
+// If there are several candidates, they are listed and the common prefix is completed.
+func (e *lineEditor) completeLine(line []rune, pos int) (string, bool) {
+	word := string(line[:pos])
+	if e.complete == nil || pos != len(line) || strings.ContainsAny(word, " \t") {
+		return "", false
+	}
+	candidates := e.complete(word)
+	switch len(candidates) {
+	case 0:
+		return "", false
+	case 1:
+		return candidates[0] + " ", true
+	}
+	fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+	return commonPrefix(candidates), true
+}
+
+func commonPrefix(strs []string) string {
+	prefix := strs[0]
+	for _, s := range strs[1:] {
+		for !strings.HasPrefix(s, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,371 @@
+// Command yoimiya-cli is a command line client of yoimiya-server, it can also open a db directory directly.
+//
+// Usage:
+//
+//	yoimiya-cli [-h 127.0.0.1] [-p 6379] [-s unix socket] [-n db] [-3] [-eval commands]
+//	yoimiya-cli -dir <db path> [-databases 16] [-n db] [-eval commands]
+//
+// Commands are separated by new lines or ';', and arguments can be quoted by " or '.
+// Without -eval, commands are read from stdin, with line editing, history and tab completion if it is a terminal.
+// It exits with status 1 if any command replies an error in non-interactive mode.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"yoimiya/db"
+	"yoimiya/pubsub"
+	"yoimiya/server"
+)
+
+// historyFileName the file in home directory to keep history of interactive mode.
+const historyFileName = ".yoimiya_history"
+
+func main() {
+	host := flag.String("h", "127.0.0.1", "server host")
+	port := flag.Int("p", 6379, "server port")
+	socket := flag.String("s", "", "server unix socket, overrides host and port")
+	dir := flag.String("dir", "", "open the db directory directly instead of connecting to a server")
+	databases := flag.Int("databases", 16, "number of dbs in the directory, only used with -dir")
+	dbIndex := flag.Int("n", 0, "db number")
+	resp3 := flag.Bool("3", false, "use RESP3")
+	eval := flag.String("eval", "", "run the commands and exit")
+	flag.Parse()
+
+	c, name, closeFn, err := connect(*host, *port, *socket, *dir, *databases)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "yoimiya-cli: %v\n", err)
+		os.Exit(1)
+	}
+	defer closeFn()
+
+	s := &session{c: c, name: name, out: os.Stdout}
+	if *dbIndex != 0 {
+		s.run([]string{"SELECT", strconv.Itoa(*dbIndex)}, false)
+	}
+	if *resp3 {
+		s.run([]string{"HELLO", "3"}, false)
+	}
+	if s.failed {
+		closeFn()
+		os.Exit(1)
+	}
+
+	switch {
+	case *eval != "":
+		err = s.runScript(strings.NewReader(*eval))
+	case isTerminal(int(os.Stdin.Fd())):
+		err = s.interact()
+	default:
+		err = s.runScript(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "yoimiya-cli: %v\n", err)
+		closeFn()
+		os.Exit(1)
+	}
+	if s.failed {
+		closeFn()
+		os.Exit(1)
+	}
+}
+
+// connect connects to the server, or opens the dbs in dir and serves them through a pipe.
+// It returns the client, the name used in prompt, and a func to close everything.
+func connect(host string, port int, socket, dir string, databases int) (*client, string, func(), error) {
+	if dir == "" {
+		network, addr := "tcp", net.JoinHostPort(host, strconv.Itoa(port))
+		if socket != "" {
+			network, addr = "unix", socket
+		}
+		nc, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		c := newClient(nc)
+		return c, addr, func() { _ = c.Close() }, nil
+	}
+
+	var dbs []*db.YoimiyaDB
+	closeDBs := func() {
+		for _, d := range dbs {
+			_ = d.Close()
+		}
+	}
+	hub := pubsub.NewHub(pubsub.DefaultBufferSize, pubsub.DropMessages)
+	for i := 0; i < databases; i++ {
+		opts := db.DefaultOptions(filepath.Join(dir, strconv.Itoa(i)))
+		opts.PubSub = hub
+		opts.DBIndex = i
+		d, err := db.Open(opts)
+		if err != nil {
+			closeDBs()
+			return nil, "", nil, err
+		}
+		dbs = append(dbs, d)
+	}
+	srv, err := server.NewServer(dbs)
+	if err != nil {
+		closeDBs()
+		return nil, "", nil, err
+	}
+	clientConn, serverConn := net.Pipe()
+	if err := srv.ServeConn(serverConn); err != nil {
+		closeDBs()
+		return nil, "", nil, err
+	}
+	c := newClient(clientConn)
+	var closed bool
+	return c, dir, func() {
+		if closed {
+			return
+		}
+		closed = true
+		_ = c.Close()
+		_ = srv.Close()
+		closeDBs()
+	}, nil
+}
+
+// session runs commands and prints the replies.
+type session struct {
+	c      *client
+	name   string
+	db     int
+	out    io.Writer
+	failed bool // some command replied an error.
+}
+
+// run runs a command and prints the reply if show is true, error replies are always printed.
+// It returns false if the connection is broken.
+func (s *session) run(args []string, show bool) bool {
+	r, err := s.c.Do(args)
+	if err != nil {
+		fmt.Fprintf(s.out, "(error) %v\n", err)
+		s.failed = true
+		return false
+	}
+	if r.kind == '-' {
+		s.failed = true
+	} else if strings.EqualFold(args[0], "select") && len(args) == 2 {
+		s.db, _ = strconv.Atoi(args[1])
+	}
+	if show || r.kind == '-' {
+		fmt.Fprintln(s.out, r.format())
+	}
+	if r.kind != '-' && (strings.EqualFold(args[0], "subscribe") || strings.EqualFold(args[0], "psubscribe")) {
+		return s.listen(len(args) - 2)
+	}
+	return true
+}
+
+// listen prints the rest of n replies of SUBSCRIBE, and then the messages until the connection is closed.
+func (s *session) listen(n int) bool {
+	fmt.Fprintln(s.out, "Reading messages... (press Ctrl-C to quit)")
+	for i := 0; ; i++ {
+		r, err := s.c.readReply()
+		if err != nil {
+			if i < n || err != io.EOF {
+				fmt.Fprintf(s.out, "(error) %v\n", err)
+				s.failed = true
+			}
+			return false
+		}
+		fmt.Fprintln(s.out, r.format())
+	}
+}
+
+// runScript runs the commands read from r.
+func (s *session) runScript(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		cmds, err := splitCommands(scanner.Text())
+		if err != nil {
+			return err
+		}
+		for _, args := range cmds {
+			if !s.run(args, true) {
+				return nil
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// interact reads commands from terminal until "quit", "exit" or Ctrl-D.
+func (s *session) interact() error {
+	editor := newLineEditor(os.Stdin, os.Stdout, completeCommand)
+	historyPath := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyPath = filepath.Join(home, historyFileName)
+		loadHistory(editor, historyPath)
+	}
+
+	for {
+		prompt := s.name
+		if s.db != 0 {
+			prompt += fmt.Sprintf("[%d]", s.db)
+		}
+		line, err := editor.ReadLine(prompt + "> ")
+		if err == errInterrupt {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		editor.AddHistory(line)
+		if historyPath != "" {
+			appendHistory(historyPath, line)
+		}
+
+		cmds, err := splitCommands(line)
+		if err != nil {
+			fmt.Fprintf(s.out, "(error) %v\n", err)
+			continue
+		}
+		for _, args := range cmds {
+			switch strings.ToLower(args[0]) {
+			case "exit", "quit":
+				return nil
+			case "help":
+				fmt.Fprintf(s.out, "commands: %s\n", strings.Join(server.CommandNames(), " "))
+				continue
+			}
+			if !s.run(args, true) {
+				return errors.New("connection closed")
+			}
+		}
+		// errors are only counted in non-interactive mode.
+		s.failed = false
+	}
+}
+
+// completeCommand returns the command names with the prefix, in upper case like redis-cli.
+func completeCommand(prefix string) []string {
+	var names []string
+	for _, name := range append(server.CommandNames(), "exit", "help") {
+		if strings.HasPrefix(name, strings.ToLower(prefix)) {
+			names = append(names, strings.ToUpper(name))
+		}
+	}
+	return names
+}
+
+func loadHistory(editor *lineEditor, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		editor.AddHistory(line)
+	}
+}
+
+func appendHistory(path, line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	_, _ = f.WriteString(line + "\n")
+	_ = f.Close()
+}
+
+// splitCommands splits a line into commands separated by ';', and the commands into arguments.
+// Arguments can be quoted by " with escapes like \n and \x41, or by ' without escapes except \'.
+func splitCommands(line string) ([][]string, error) {
+	var (
+		cmds    [][]string
+		args    []string
+		arg     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	endArg := func() {
+		if inArg {
+			args = append(args, arg.String())
+			arg.Reset()
+			inArg = false
+		}
+	}
+	endCmd := func() {
+		endArg()
+		if len(args) > 0 {
+			cmds = append(cmds, args)
+			args = nil
+		}
+	}
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case escaped:
+			escaped = false
+			if quote == '\'' {
+				if r != '\'' {
+					arg.WriteRune('\\')
+				}
+				arg.WriteRune(r)
+				continue
+			}
+			switch r {
+			case 'n':
+				arg.WriteByte('\n')
+			case 'r':
+				arg.WriteByte('\r')
+			case 't':
+				arg.WriteByte('\t')
+			case 'x':
+				if i+2 < len(runes) {
+					if b, err := strconv.ParseUint(string(runes[i+1:i+3]), 16, 8); err == nil {
+						arg.WriteByte(byte(b))
+						i += 2
+						continue
+					}
+				}
+				arg.WriteRune(r)
+			default:
+				arg.WriteRune(r)
+			}
+		case quote != 0:
+			switch r {
+			case '\\':
+				escaped = true
+			case quote:
+				quote = 0
+			default:
+				arg.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inArg = r, true
+		case r == ';' || r == '\n':
+			endCmd()
+		case r == ' ' || r == '\t' || r == '\r':
+			endArg()
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unbalanced quotes")
+	}
+	endCmd()
+	return cmds, nil
+}
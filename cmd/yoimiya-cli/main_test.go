@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestSplitCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    [][]string
+		wantErr bool
+	}{
+		{"simple", "SET k v", [][]string{{"SET", "k", "v"}}, false},
+		{"spaces", "  GET   k  ", [][]string{{"GET", "k"}}, false},
+		{"empty", "  ", nil, false},
+		{"double-quotes", `SET k "hello world"`, [][]string{{"SET", "k", "hello world"}}, false},
+		{"escapes", `SET k "a\n\x41\"b"`, [][]string{{"SET", "k", "a\nA\"b"}}, false},
+		{"single-quotes", `SET k 'it\'s \n'`, [][]string{{"SET", "k", `it's \n`}}, false},
+		{"empty-arg", `SET k ""`, [][]string{{"SET", "k", ""}}, false},
+		{"multi-commands", "SET k v; GET k;;", [][]string{{"SET", "k", "v"}, {"GET", "k"}}, false},
+		{"quoted-separator", `SET k "a;b"`, [][]string{{"SET", "k", "a;b"}}, false},
+		{"unbalanced", `SET k "v`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitCommands(tt.line)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestReply_Format(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  string
+	}{
+		{"simple", "+OK\r\n", "OK"},
+		{"error", "-ERR oops\r\n", "(error) ERR oops"},
+		{"integer", ":10\r\n", "(integer) 10"},
+		{"bulk", "$5\r\na\"b\nc\r\n", `"a\"b\nc"`},
+		{"null-bulk", "$-1\r\n", "(nil)"},
+		{"null", "_\r\n", "(nil)"},
+		{"double", ",1.5\r\n", "(double) 1.5"},
+		{"bool", "#t\r\n", "(true)"},
+		{"empty-array", "*0\r\n", "(empty array)"},
+		{"array", "*2\r\n$1\r\na\r\n$-1\r\n", "1) \"a\"\n2) (nil)"},
+		// members with scores, like ZRANGE WITHSCORES in RESP3.
+		{"pairs", "*2\r\n*2\r\n$1\r\na\r\n,1\r\n*2\r\n$1\r\nb\r\n,2\r\n",
+			"1) 1) \"a\"\n   2) (double) 1\n2) 1) \"b\"\n   2) (double) 2"},
+		{"map", "%2\r\n$1\r\nk\r\n:1\r\n$2\r\nk2\r\n*1\r\n$1\r\nv\r\n", "1# \"k\" => (integer) 1\n2# \"k2\" => 1) \"v\""},
+		{"verbatim", "=8\r\ntxt:abcd\r\n", `"abcd"`},
+		{"attribute", "|1\r\n+ttl\r\n:3\r\n+OK\r\n", "OK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			go func() {
+				_, _ = serverConn.Write([]byte(tt.reply))
+				_ = serverConn.Close()
+			}()
+			r, err := newClient(clientConn).readReply()
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, r.format())
+		})
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	assert.Equal(t, "SE", commonPrefix([]string{"SET", "SELECT"}))
+	assert.Equal(t, "GET", commonPrefix([]string{"GET"}))
+	assert.Equal(t, "", commonPrefix([]string{"GET", "SET"}))
+}
@@ -0,0 +1,148 @@
+// Command yoimiya-dump prints the entries of a log file, for debugging.
+//
+// Usage:
+//
+//	yoimiya-dump [-json] [-prefix key] [-from offset] [-to offset] [-type name] [-preview n] <log file>
+//
+// Entries which can't pass the crc check are always printed if they are in the offset range,
+// since their keys and types are unknown. Encrypted log files are not supported.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"yoimiya/logfile"
+)
+
+// entryTypes the names accepted by -type.
+var entryTypes = []string{"normal", "delete", "list-meta", "chunk", "chunk-manifest"}
+
+// entryInfo is an entry printed by the dump.
+type entryInfo struct {
+	Offset    int64  `json:"offset"`
+	Size      int64  `json:"size"`
+	Type      string `json:"type,omitempty"`
+	Key       string `json:"key,omitempty"`
+	ValueSize int    `json:"value_size"`
+	Value     string `json:"value,omitempty"`
+	ExpiredAt int64  `json:"expired_at,omitempty"`
+	Crc       string `json:"crc"`
+	Err       string `json:"err,omitempty"`
+}
+
+func main() {
+	asJSON := flag.Bool("json", false, "print entries in JSON lines")
+	prefix := flag.String("prefix", "", "only print entries whose key has the prefix")
+	from := flag.Int64("from", 0, "only print entries at or after the offset")
+	to := flag.Int64("to", -1, "only print entries before the offset, -1 means the end of file")
+	typ := flag.String("type", "", "only print entries of the type: "+strings.Join(entryTypes, ", "))
+	preview := flag.Int("preview", 32, "max bytes of value to print, -1 prints the whole value")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: yoimiya-dump [flags] <log file>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *typ != "" && !validType(*typ) {
+		fmt.Fprintf(flag.CommandLine.Output(), "yoimiya-dump: unknown entry type %q\n", *typ)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := dump(os.Stdout, flag.Arg(0), *asJSON, []byte(*prefix), *from, *to, *typ, *preview); err != nil {
+		fmt.Fprintf(os.Stderr, "yoimiya-dump: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func validType(typ string) bool {
+	for _, t := range entryTypes {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// dump writes the entries of the log file at path to w.
+func dump(w io.Writer, path string, asJSON bool, prefix []byte, from, to int64, typ string, preview int) error {
+	ftype, fid, ok := logfile.ParseFileName(filepath.Base(path))
+	if !ok {
+		return fmt.Errorf("%s is not a log file", path)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	lf, err := logfile.OpenLogFileWithOptions(filepath.Dir(path), fid, stat.Size(), ftype,
+		logfile.FileIo, logfile.FileOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = lf.Close()
+	}()
+	if to < 0 || to > stat.Size() {
+		to = stat.Size()
+	}
+
+	encoder := json.NewEncoder(w)
+	printEntry := func(info *entryInfo) error {
+		if asJSON {
+			return encoder.Encode(info)
+		}
+		if info.Err != "" {
+			_, err := fmt.Fprintf(w, "%d\tsize=%d\tcrc=%s\terr=%s\n", info.Offset, info.Size, info.Crc, info.Err)
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%d\tsize=%d\ttype=%s\tkey=%s\tvalue(%d)=%s\texpiredAt=%d\tcrc=%s\n", info.Offset,
+			info.Size, info.Type, strconv.Quote(info.Key), info.ValueSize, strconv.Quote(info.Value), info.ExpiredAt, info.Crc)
+		return err
+	}
+
+	offset := lf.HeaderSize()
+	for offset < to {
+		size, err := lf.ReadEntrySize(offset)
+		if err == logfile.ErrEndOfEntry {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("entries can't be located from offset %d: %v", offset, err)
+		}
+		if offset < from {
+			offset += size
+			continue
+		}
+
+		info := &entryInfo{Offset: offset, Size: size, Crc: "ok"}
+		ent, _, err := lf.ReadLogEntry(offset)
+		if err != nil {
+			info.Crc, info.Err = "invalid", err.Error()
+		} else {
+			if typ != "" && ent.Type.String() != typ || !strings.HasPrefix(string(ent.Key), string(prefix)) {
+				offset += size
+				continue
+			}
+			value := ent.Value
+			if preview >= 0 && len(value) > preview {
+				value = value[:preview]
+			}
+			info.Type, info.Key, info.Value = ent.Type.String(), string(ent.Key), string(value)
+			info.ValueSize, info.ExpiredAt = len(ent.Value), ent.ExpiredAt
+		}
+		if err := printEntry(info); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
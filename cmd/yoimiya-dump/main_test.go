@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"yoimiya/logfile"
+)
+
+// writeTestLogFile writes the entries into a new log file, and returns its path and the offsets of the entries.
+func writeTestLogFile(t *testing.T, entries []*logfile.LogEntry) (string, []int64) {
+	path := filepath.Join("/tmp", "yoimiya-dump")
+	_ = os.RemoveAll(path)
+	assert.Nil(t, os.MkdirAll(path, os.ModePerm))
+	t.Cleanup(func() {
+		_ = os.RemoveAll(path)
+	})
+
+	lf, err := logfile.OpenLogFile(path, 0, 1<<20, logfile.Strs, logfile.FileIo)
+	assert.Nil(t, err)
+	var offsets []int64
+	for _, e := range entries {
+		offsets = append(offsets, lf.WriteAt)
+		buf, _ := lf.EncodeEntry(e)
+		assert.Nil(t, lf.Write(buf))
+	}
+	assert.Nil(t, lf.Close())
+	return filepath.Join(path, logfile.FileNamesMap[logfile.Strs]+"000000000"), offsets
+}
+
+func dumpKeys(t *testing.T, path string, prefix string, from, to int64, typ string) []string {
+	var buf bytes.Buffer
+	assert.Nil(t, dump(&buf, path, true, []byte(prefix), from, to, typ, -1))
+	var keys []string
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var info entryInfo
+		assert.Nil(t, decoder.Decode(&info))
+		keys = append(keys, info.Key)
+	}
+	return keys
+}
+
+func TestDump(t *testing.T) {
+	path, offsets := writeTestLogFile(t, []*logfile.LogEntry{
+		{Key: []byte("user:1"), Value: []byte("a")},
+		{Key: []byte("user:2"), Value: []byte("b")},
+		{Key: []byte("order:1"), Value: []byte("c")},
+		{Key: []byte("user:1"), Type: logfile.TypeDelete},
+		{Key: []byte("order:2"), Value: []byte("d")},
+	})
+
+	tests := []struct {
+		name     string
+		prefix   string
+		from, to int64
+		typ      string
+		want     []string
+	}{
+		{"all", "", 0, -1, "", []string{"user:1", "user:2", "order:1", "user:1", "order:2"}},
+		{"prefix", "user:", 0, -1, "", []string{"user:1", "user:2", "user:1"}},
+		{"from", "", offsets[2], -1, "", []string{"order:1", "user:1", "order:2"}},
+		{"to", "", 0, offsets[2], "", []string{"user:1", "user:2"}},
+		{"range", "", offsets[1], offsets[3], "", []string{"user:2", "order:1"}},
+		{"type-normal", "", 0, -1, "normal", []string{"user:1", "user:2", "order:1", "order:2"}},
+		{"type-delete", "", 0, -1, "delete", []string{"user:1"}},
+		{"combined", "order:", offsets[3], -1, "normal", []string{"order:2"}},
+		{"none", "missing", 0, -1, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, dumpKeys(t, path, tt.prefix, tt.from, tt.to, tt.typ))
+		})
+	}
+
+	t.Run("not-log-file", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NotNil(t, dump(&buf, filepath.Join(filepath.Dir(path), "data"), false, nil, 0, -1, "", 32))
+	})
+}
+
+func TestValidType(t *testing.T) {
+	for _, typ := range entryTypes {
+		assert.True(t, validType(typ))
+	}
+	assert.False(t, validType("nomral"))
+	assert.False(t, validType("unknown(9)"))
+}
@@ -0,0 +1,152 @@
+// Command yoimiya-server serves yoimiya dbs in the redis protocol.
+//
+// Usage:
+//
+//	yoimiya-server [-addr :6379] [-unix path] [-http addr] [-dir /tmp/yoimiya] [-databases 16]
+//	               [-pubsub-buffer 1024] [-disconnect-slow-subscribers] [-notify-keyspace-events KEA]
+//	               [-replicaof host:port]
+//
+// The db i is stored in the sub directory "<dir>/<i>", and can be switched by SELECT.
+// Pub/sub channels are shared by all dbs, keyspace events of db i are published to "__keyspace@<i>__:<key>"
+// and "__keyevent@<i>__:<event>" as configured by -notify-keyspace-events, see db.Options.NotifyKeyspaceEvents.
+// With -http, the dbs are also served by the HTTP/JSON gateway, see package gateway.
+// With -replicaof, the db i is a read-only follower of the db i of the leader, see db.YoimiyaDB.Follow.
+// It shuts down gracefully on SIGINT or SIGTERM.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+	"yoimiya/db"
+	"yoimiya/gateway"
+	"yoimiya/logger"
+	"yoimiya/pubsub"
+	"yoimiya/server"
+)
+
+func main() {
+	addr := flag.String("addr", ":6379", "tcp address to listen on, empty to disable")
+	unixPath := flag.String("unix", "", "unix socket path to listen on, empty to disable")
+	httpAddr := flag.String("http", "", "address of the HTTP gateway, empty to disable")
+	dir := flag.String("dir", filepath.Join(os.TempDir(), "yoimiya"), "directory of the dbs")
+	databases := flag.Int("databases", 16, "number of dbs")
+	pubSubBuffer := flag.Int("pubsub-buffer", pubsub.DefaultBufferSize, "max number of messages buffered for each subscriber")
+	disconnectSlow := flag.Bool("disconnect-slow-subscribers", false,
+		"disconnect subscribers whose buffer is full, instead of dropping messages")
+	notifyEvents := flag.String("notify-keyspace-events", "", "classes of keyspace events to publish, like KEA")
+	replicaOf := flag.String("replicaof", "", "address of the leader to replicate from, empty to be a leader")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "max time to wait for connections on shutdown")
+	flag.Parse()
+	if *databases <= 0 || (*addr == "" && *unixPath == "" && *httpAddr == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dbs := make([]*db.YoimiyaDB, 0, *databases)
+	closeDBs := func() {
+		for _, d := range dbs {
+			if err := d.Close(); err != nil {
+				logger.Error("close db err: %v", err)
+			}
+		}
+	}
+	policy := pubsub.DropMessages
+	if *disconnectSlow {
+		policy = pubsub.DisconnectSlowConsumer
+	}
+	hub := pubsub.NewHub(*pubSubBuffer, policy)
+	for i := 0; i < *databases; i++ {
+		opts := db.DefaultOptions(filepath.Join(*dir, strconv.Itoa(i)))
+		opts.PubSub = hub
+		opts.NotifyKeyspaceEvents = *notifyEvents
+		opts.DBIndex = i
+		d, err := db.Open(opts)
+		if err != nil {
+			closeDBs()
+			fmt.Fprintf(os.Stderr, "yoimiya-server: open db %d: %v\n", i, err)
+			os.Exit(1)
+		}
+		dbs = append(dbs, d)
+		if *replicaOf != "" {
+			d.Follow(*replicaOf, i)
+		}
+	}
+	defer closeDBs()
+
+	srv, err := server.NewServer(dbs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "yoimiya-server: %v\n", err)
+		os.Exit(1)
+	}
+	var listeners []net.Listener
+	if *addr != "" {
+		ln, err := net.Listen("tcp", *addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "yoimiya-server: %v\n", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, ln)
+	}
+	if *unixPath != "" {
+		// remove the socket file left by last run.
+		_ = os.Remove(*unixPath)
+		ln, err := net.Listen("unix", *unixPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "yoimiya-server: %v\n", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	var httpServer *http.Server
+	if *httpAddr != "" {
+		gw, err := gateway.NewGateway(dbs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "yoimiya-server: %v\n", err)
+			os.Exit(1)
+		}
+		httpServer = &http.Server{Addr: *httpAddr, Handler: gw}
+	}
+
+	errs := make(chan error, len(listeners)+1)
+	for _, ln := range listeners {
+		logger.Info("serving on %s %s", ln.Addr().Network(), ln.Addr())
+		go func(ln net.Listener) {
+			errs <- srv.Serve(ln)
+		}(ln)
+	}
+	if httpServer != nil {
+		logger.Info("serving http on %s", httpServer.Addr)
+		go func() {
+			errs <- httpServer.ListenAndServe()
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case s := <-sig:
+		logger.Info("received %v, shutting down", s)
+	case err := <-errs:
+		logger.Error("serve err: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Error("shutdown err: %v", err)
+	}
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			logger.Error("shutdown http err: %v", err)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"yoimiya/logfile"
+)
+
+// ErrPositionUnavailable the log file of the position to read changes from doesn't exist.
+var ErrPositionUnavailable = errors.New("position of change stream is unavailable")
+
+// Position is a position in the log files of a data type, changes are read from it in order.
+// The zero Position is the beginning of the first log file.
+type Position struct {
+	Fid    uint32
+	Offset int64
+}
+
+// ChangeEvent is a change decoded from a log entry.
+type ChangeEvent struct {
+	DataType DataType
+	Key      []byte
+
+	// Field the field of hash or the member of set and sorted set, it is nil for strings.
+	Field []byte
+
+	// Value the new value, large values written in chunks are read into it as a whole.
+	Value []byte
+
+	// Delete the key or field is deleted.
+	Delete bool
+
+	// ExpiredAt the unix time when the key expires, 0 means never.
+	ExpiredAt int64
+
+	// Pos the position of the log entry, and Next the position after it, which a consumer resumes from.
+	Pos  Position
+	Next Position
+}
+
+// ChangeStream tails the log files of a data type, see NewChangeStream.
+// It is not safe for concurrent use.
+type ChangeStream struct {
+	db       *YoimiyaDB
+	dataType DataType
+	pos      Position
+}
+
+// changeSignal wakes up the change streams waiting for new log entries.
+type changeSignal struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// checkpoint is the position saved by a consumer of change streams.
+type checkpoint struct {
+	Name     string   `json:"name"`
+	DataType DataType `json:"type"`
+	Fid      uint32   `json:"fid"`
+	Offset   int64    `json:"offset"`
+}
+
+// checkpoints are saved in the checkpoint file of db path, except in MemIO.
+type checkpoints struct {
+	mu   sync.Mutex
+	list []checkpoint
+}
+
+// NewChangeStream creates a stream of the changes of dataType from pos, see ChangeStream Next.
+// A consumer can save the Next position of the last change it handled by SaveCheckpoint,
+// and resume from it by ResumeChangeStream after restarting.
+func (db *YoimiyaDB) NewChangeStream(dataType DataType, pos Position) (*ChangeStream, error) {
+	fids := db.logFileIds(dataType)
+	if pos == (Position{}) && len(fids) > 0 {
+		pos.Fid = fids[0]
+	}
+	if len(fids) > 0 && pos.Fid < fids[0] {
+		return nil, ErrPositionUnavailable
+	}
+	return &ChangeStream{db: db, dataType: dataType, pos: pos}, nil
+}
+
+// ResumeChangeStream creates a stream of the changes of dataType from the checkpoint saved by name,
+// or from the beginning if there is no checkpoint.
+func (db *YoimiyaDB) ResumeChangeStream(name string, dataType DataType) (*ChangeStream, error) {
+	pos, _ := db.Checkpoint(name, dataType)
+	return db.NewChangeStream(dataType, pos)
+}
+
+// LatestPosition returns the position after the last log entry of dataType,
+// a stream from it only reads the changes from now on.
+func (db *YoimiyaDB) LatestPosition(dataType DataType) Position {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	lf := db.activeLogFiles[dataType]
+	if lf == nil {
+		return Position{}
+	}
+	return Position{Fid: lf.Fid, Offset: atomic.LoadInt64(&lf.WriteAt)}
+}
+
+// Position returns the position of the next change to read.
+func (cs *ChangeStream) Position() Position {
+	return cs.pos
+}
+
+// Next returns the next change, it blocks until there is a new change, ctx is done or the db is closed.
+// Chunks of large values are skipped, their values are in the change of the key.
+func (cs *ChangeStream) Next(ctx context.Context) (*ChangeEvent, error) {
+	for {
+		if cs.db.isClosed() {
+			return nil, ErrDBClosed
+		}
+		// get the signal before reading, so that a write after reading can't be missed.
+		wait := cs.db.changes.wait()
+		event, err := cs.read()
+		if err != nil || event != nil {
+			return event, err
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// read returns the next change, or nil if there is no more change now.
+func (cs *ChangeStream) read() (*ChangeEvent, error) {
+	for {
+		lf, writeAt := cs.db.changeLogFile(cs.dataType, cs.pos.Fid)
+		if lf == nil {
+			// no log file is created until the first write.
+			fids := cs.db.logFileIds(cs.dataType)
+			if len(fids) == 0 {
+				return nil, nil
+			}
+			if next, ok := nextFid(fids, cs.pos.Fid); ok && cs.pos.Fid > fids[0] {
+				cs.pos = Position{Fid: next}
+				continue
+			}
+			return nil, ErrPositionUnavailable
+		}
+		if cs.pos.Offset < lf.HeaderSize() {
+			cs.pos.Offset = lf.HeaderSize()
+		}
+
+		// entries beyond WriteAt of the active log file may be being written.
+		if writeAt < 0 || cs.pos.Offset < writeAt {
+			entry, esize, err := lf.ReadLogEntry(cs.pos.Offset)
+			if err == nil {
+				pos := cs.pos
+				cs.pos.Offset += esize
+				if entry.Type == logfile.TypeChunk || entry.Type == logfile.TypeListMeta {
+					continue
+				}
+				return cs.newEvent(entry, pos)
+			}
+			if err != io.EOF && err != logfile.ErrEndOfEntry {
+				return nil, err
+			}
+		}
+
+		// the end of an archived log file, move to the next one.
+		next, ok := nextFid(cs.db.logFileIds(cs.dataType), cs.pos.Fid)
+		if writeAt >= 0 || !ok {
+			return nil, nil
+		}
+		cs.pos = Position{Fid: next}
+	}
+}
+
+func (cs *ChangeStream) newEvent(entry *logfile.LogEntry, pos Position) (*ChangeEvent, error) {
+	event := &ChangeEvent{
+		DataType:  cs.dataType,
+		Key:       entry.Key,
+		Value:     entry.Value,
+		Delete:    entry.Type == logfile.TypeDelete,
+		ExpiredAt: entry.ExpiredAt,
+		Pos:       pos,
+		Next:      cs.pos,
+	}
+	if entry.Type == logfile.TypeChunkManifest {
+		value, err := cs.db.readChunks(entry.Key, entry.Value, cs.dataType)
+		if err != nil {
+			return nil, err
+		}
+		event.Value = value
+	}
+	return event, nil
+}
+
+// changeLogFile returns the log file of fid, and its WriteAt if it is the active one, otherwise -1.
+func (db *YoimiyaDB) changeLogFile(dataType DataType, fid uint32) (*logfile.LogFile, int64) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if lf := db.activeLogFiles[dataType]; lf != nil && lf.Fid == fid {
+		return lf, atomic.LoadInt64(&lf.WriteAt)
+	}
+	if lf := db.archivedLogFiles[dataType][fid]; lf != nil {
+		return lf, -1
+	}
+	return nil, -1
+}
+
+// logFileIds returns the fids of the log files of dataType in order.
+func (db *YoimiyaDB) logFileIds(dataType DataType) []uint32 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var fids []uint32
+	for fid := range db.archivedLogFiles[dataType] {
+		fids = append(fids, fid)
+	}
+	if lf := db.activeLogFiles[dataType]; lf != nil {
+		fids = append(fids, lf.Fid)
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	return fids
+}
+
+// nextFid returns the smallest fid greater than fid.
+func nextFid(fids []uint32, fid uint32) (uint32, bool) {
+	i := sort.Search(len(fids), func(i int) bool { return fids[i] > fid })
+	if i == len(fids) {
+		return 0, false
+	}
+	return fids[i], true
+}
+
+// wait returns a channel which is closed by the next broadcast.
+func (s *changeSignal) wait() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan struct{})
+	}
+	return s.ch
+}
+
+// broadcast wakes up all waiting streams, it is called after writing log entries and closing db.
+func (s *changeSignal) broadcast() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch != nil {
+		close(s.ch)
+		s.ch = nil
+	}
+}
+
+// SaveCheckpoint saves pos as the checkpoint of the consumer name for dataType, it is usually the Next of a change.
+// Checkpoints are kept across restarts, and the log files from the oldest checkpoint are retained, see RetainedPosition.
+// Delete the checkpoint if the consumer is gone, otherwise those log files are retained forever.
+func (db *YoimiyaDB) SaveCheckpoint(name string, dataType DataType, pos Position) error {
+	db.checkpoints.mu.Lock()
+	defer db.checkpoints.mu.Unlock()
+	list := db.checkpoints.removed(name, dataType)
+	list = append(list, checkpoint{Name: name, DataType: dataType, Fid: pos.Fid, Offset: pos.Offset})
+	return db.saveCheckpoints(list)
+}
+
+// DeleteCheckpoint deletes the checkpoint of the consumer name for dataType.
+func (db *YoimiyaDB) DeleteCheckpoint(name string, dataType DataType) error {
+	db.checkpoints.mu.Lock()
+	defer db.checkpoints.mu.Unlock()
+	return db.saveCheckpoints(db.checkpoints.removed(name, dataType))
+}
+
+// Checkpoint returns the checkpoint of the consumer name for dataType, and reports whether it exists.
+func (db *YoimiyaDB) Checkpoint(name string, dataType DataType) (Position, bool) {
+	db.checkpoints.mu.Lock()
+	defer db.checkpoints.mu.Unlock()
+	for _, cp := range db.checkpoints.list {
+		if cp.Name == name && cp.DataType == dataType {
+			return Position{Fid: cp.Fid, Offset: cp.Offset}, true
+		}
+	}
+	return Position{}, false
+}
+
+// RetainedPosition returns the oldest checkpoint of dataType, and reports whether there is any checkpoint.
+// The log files from its fid haven't been consumed by all consumers, so they must not be deleted,
+// a log file GC must only reclaim files whose fid is less than it.
+func (db *YoimiyaDB) RetainedPosition(dataType DataType) (Position, bool) {
+	db.checkpoints.mu.Lock()
+	defer db.checkpoints.mu.Unlock()
+	var oldest Position
+	var found bool
+	for _, cp := range db.checkpoints.list {
+		pos := Position{Fid: cp.Fid, Offset: cp.Offset}
+		if cp.DataType == dataType && (!found || pos.Fid < oldest.Fid ||
+			(pos.Fid == oldest.Fid && pos.Offset < oldest.Offset)) {
+			oldest, found = pos, true
+		}
+	}
+	return oldest, found
+}
+
+// removed returns a copy of checkpoints without the one of name and dataType, the lock must be held.
+func (c *checkpoints) removed(name string, dataType DataType) []checkpoint {
+	list := make([]checkpoint, 0, len(c.list)+1)
+	for _, cp := range c.list {
+		if cp.Name != name || cp.DataType != dataType {
+			list = append(list, cp)
+		}
+	}
+	return list
+}
+
+// saveCheckpoints writes the checkpoint file by renaming a temporary file, and then replaces checkpoints in memory.
+func (db *YoimiyaDB) saveCheckpoints(list []checkpoint) error {
+	if db.opts.IoType != logfile.MemIO {
+		data, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(db.opts.DBPath, checkpointFile)
+		if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	db.checkpoints.list = list
+	return nil
+}
+
+// loadCheckpoints reads the checkpoint file at startup, it is fine if the file doesn't exist.
+func (db *YoimiyaDB) loadCheckpoints() error {
+	if db.opts.IoType == logfile.MemIO {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(db.opts.DBPath, checkpointFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &db.checkpoints.list)
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestYoimiyaDB_ChangeStream(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 256
+	opts.ValueChunkSize = 64
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	large := bytes.Repeat([]byte("a"), 200)
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v1")))
+	assert.Nil(t, db.Set([]byte("large"), large))
+	assert.Nil(t, db.Delete([]byte("k1")))
+	assert.Greater(t, len(db.logFileIds(String)), 1)
+
+	cs, err := db.NewChangeStream(String, Position{})
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var events []*ChangeEvent
+	for i := 0; i < 3; i++ {
+		event, err := cs.Next(ctx)
+		assert.Nil(t, err)
+		events = append(events, event)
+	}
+	assert.Equal(t, []byte("k1"), events[0].Key)
+	assert.Equal(t, []byte("v1"), events[0].Value)
+	assert.False(t, events[0].Delete)
+	assert.Equal(t, []byte("large"), events[1].Key)
+	assert.Equal(t, large, events[1].Value)
+	assert.Equal(t, []byte("k1"), events[2].Key)
+	assert.True(t, events[2].Delete)
+	assert.Equal(t, db.LatestPosition(String), cs.Position())
+
+	t.Run("tail", func(t *testing.T) {
+		got := make(chan *ChangeEvent)
+		go func() {
+			event, err := cs.Next(ctx)
+			assert.Nil(t, err)
+			got <- event
+		}()
+		time.Sleep(10 * time.Millisecond)
+		assert.Nil(t, db.Set([]byte("k2"), []byte("v2")))
+		event := <-got
+		assert.Equal(t, []byte("k2"), event.Key)
+
+		short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err := cs.Next(short)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("latest", func(t *testing.T) {
+		latest, err := db.NewChangeStream(String, db.LatestPosition(String))
+		assert.Nil(t, err)
+		assert.Nil(t, db.Set([]byte("k3"), nil))
+		event, err := latest.Next(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("k3"), event.Key)
+	})
+}
+
+func TestYoimiyaDB_Checkpoint(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		assert.Nil(t, db.Set([]byte(key), nil))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cs, err := db.ResumeChangeStream("search", String)
+	assert.Nil(t, err)
+	event, err := cs.Next(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, db.SaveCheckpoint("search", String, event.Next))
+	assert.Nil(t, db.SaveCheckpoint("audit", String, event.Pos))
+
+	pos, ok := db.RetainedPosition(String)
+	assert.True(t, ok)
+	assert.Equal(t, event.Pos, pos)
+	_, ok = db.RetainedPosition(List)
+	assert.False(t, ok)
+
+	// checkpoints are kept after reopening.
+	assert.Nil(t, db.Close())
+	db, err = Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	pos, ok = db.Checkpoint("search", String)
+	assert.True(t, ok)
+	assert.Equal(t, event.Next, pos)
+
+	cs, err = db.ResumeChangeStream("search", String)
+	assert.Nil(t, err)
+	event, err = cs.Next(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("k2"), event.Key)
+
+	assert.Nil(t, db.DeleteCheckpoint("audit", String))
+	pos, _ = db.RetainedPosition(String)
+	assert.Equal(t, cs.Position().Fid, pos.Fid)
+	_, ok = db.Checkpoint("audit", String)
+	assert.False(t, ok)
+
+	assert.Nil(t, db.Close())
+	_, err = cs.Next(ctx)
+	assert.Equal(t, ErrDBClosed, err)
+}
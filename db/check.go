@@ -0,0 +1,394 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"yoimiya/flock"
+	"yoimiya/logfile"
+)
+
+// repairDirName the temporary directory in db path for writing repaired log files.
+const repairDirName = "repair"
+
+// corruptFileSuffix the suffix of log files which can't be opened and are moved aside by Repair.
+const corruptFileSuffix = ".corrupt"
+
+type (
+	// CheckReport is the result of Check and Repair.
+	CheckReport struct {
+		Files []*FileReport
+
+		// Orphans files which look like db files but are useless, such as hint files whose log files are missing.
+		Orphans []string
+
+		// InvalidHints hint files which can't be read, they are ignored by Open and will be written again.
+		InvalidHints []string
+	}
+
+	// FileReport is the check result of a log file.
+	FileReport struct {
+		Name     string
+		DataType DataType
+		Fid      uint32
+		Size     int64
+
+		// Entries number of valid entries.
+		Entries int
+
+		// CrcErrors number of entries which can't pass the crc check, or can't be decrypted or decompressed.
+		CrcErrors int
+
+		// Truncated the last entry is incomplete, usually it is written partially before a crash.
+		Truncated bool
+
+		// UnreadableAt offset where the following entries can't be located because of corruption, -1 if none.
+		UnreadableAt int64
+
+		// DroppedValues number of large values dropped by Repair, because some of their chunks are lost.
+		DroppedValues int
+
+		// Encrypted the log file is encrypted and no key provider is given, so its entries are not verified.
+		Encrypted bool
+
+		// Err the log file can't be opened, e.g. its header block is corrupted.
+		Err error
+	}
+)
+
+// Healthy reports whether all entries of the log file can be read.
+// An encrypted log file which can't be verified is not reported as unhealthy.
+func (r *FileReport) Healthy() bool {
+	return r.Err == nil && r.CrcErrors == 0 && !r.Truncated && r.UnreadableAt < 0
+}
+
+// String returns a one line summary of the report.
+func (r *FileReport) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s: can't be opened: %v", r.Name, r.Err)
+	}
+	if r.Encrypted {
+		return fmt.Sprintf("%s: encrypted, cannot verify", r.Name)
+	}
+	s := fmt.Sprintf("%s: %d entries", r.Name, r.Entries)
+	if r.CrcErrors > 0 {
+		s += fmt.Sprintf(", %d crc errors", r.CrcErrors)
+	}
+	if r.Truncated {
+		s += ", truncated tail"
+	}
+	if r.UnreadableAt >= 0 {
+		s += fmt.Sprintf(", unreadable from offset %d", r.UnreadableAt)
+	}
+	if r.DroppedValues > 0 {
+		s += fmt.Sprintf(", %d large values dropped", r.DroppedValues)
+	}
+	return s
+}
+
+// Healthy reports whether all the log files are healthy, and there is no orphan or invalid hint file.
+func (r *CheckReport) Healthy() bool {
+	for _, f := range r.Files {
+		if !f.Healthy() {
+			return false
+		}
+	}
+	return len(r.Orphans) == 0 && len(r.InvalidHints) == 0
+}
+
+// Check reads every entry of the log files in opts.DBPath and reports the problems found.
+// It holds a shared file lock, so it can't run with an opened db, and it never writes to log files.
+// Encrypted log files can only be checked if opts.KeyProvider is set, otherwise they are reported as Encrypted.
+func Check(opts Options) (*CheckReport, error) {
+	lockGuard, err := flock.AcquireFileLock(filepath.Join(opts.DBPath, lockFileName), true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = lockGuard.Release()
+	}()
+	return check(opts)
+}
+
+// Repair checks the db just like Check, and repairs the problems found.
+// All log files of a data type which has unhealthy log files are rewritten with their valid entries,
+// log files that can't be opened are renamed with suffix ".corrupt", orphans and invalid hint files are removed.
+// It returns the report of checking the repaired db.
+func Repair(opts Options) (*CheckReport, error) {
+	lockGuard, err := flock.AcquireFileLock(filepath.Join(opts.DBPath, lockFileName), false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = lockGuard.Release()
+	}()
+
+	report, err := check(opts)
+	if err != nil {
+		return nil, err
+	}
+	filesByType := make(map[DataType][]*FileReport)
+	for _, f := range report.Files {
+		filesByType[f.DataType] = append(filesByType[f.DataType], f)
+	}
+	for dataType, files := range filesByType {
+		healthy := true
+		for _, f := range files {
+			healthy = healthy && f.Healthy()
+		}
+		if healthy {
+			continue
+		}
+		// the entries of encrypted log files can't be rewritten without the keys.
+		for _, f := range files {
+			if f.Encrypted {
+				return nil, logfile.ErrKeyProviderRequired
+			}
+		}
+		if err := repairLogFiles(opts, dataType, files); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range append(report.Orphans, report.InvalidHints...) {
+		if err := os.Remove(filepath.Join(opts.DBPath, name)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	repaired, err := check(opts)
+	if err != nil {
+		return nil, err
+	}
+	// keep the dropped values found in repairing.
+	dropped := make(map[string]int)
+	for _, f := range report.Files {
+		dropped[f.Name] = f.DroppedValues
+	}
+	for _, f := range repaired.Files {
+		f.DroppedValues = dropped[f.Name]
+	}
+	return repaired, nil
+}
+
+func check(opts Options) (*CheckReport, error) {
+	entries, err := os.ReadDir(opts.DBPath)
+	if err != nil {
+		return nil, err
+	}
+	report := &CheckReport{}
+	logFiles := make(map[string]bool)
+	var hintFiles []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(strings.ToLower(name), logfile.FilePrefix) {
+			continue
+		}
+		if strings.HasSuffix(name, logfile.HintFileSuffix) {
+			hintFiles = append(hintFiles, name)
+			continue
+		}
+		ftype, fid, ok := logfile.ParseFileName(name)
+		if !ok {
+			if !strings.HasSuffix(name, corruptFileSuffix) {
+				report.Orphans = append(report.Orphans, name)
+			}
+			continue
+		}
+		logFiles[name] = true
+		report.Files = append(report.Files, checkLogFile(opts, DataType(ftype), fid, nil))
+	}
+	sort.Slice(report.Files, func(i, j int) bool {
+		fi, fj := report.Files[i], report.Files[j]
+		return fi.DataType < fj.DataType || (fi.DataType == fj.DataType && fi.Fid < fj.Fid)
+	})
+
+	for _, name := range hintFiles {
+		logName := strings.TrimSuffix(name, logfile.HintFileSuffix)
+		ftype, fid, ok := logfile.ParseFileName(logName)
+		if !ok || !logFiles[logName] {
+			report.Orphans = append(report.Orphans, name)
+			continue
+		}
+		if _, err := logfile.ReadHintFile(opts.DBPath, fid, ftype); err != nil {
+			report.InvalidHints = append(report.InvalidHints, name)
+		}
+	}
+	return report, nil
+}
+
+// checkLogFile reads all entries of a log file, fn is called with every valid entry if it is not nil.
+func checkLogFile(opts Options, dataType DataType, fid uint32,
+	fn func(ent *logfile.LogEntry, offset int64) error) *FileReport {
+
+	report := &FileReport{DataType: dataType, Fid: fid, UnreadableAt: -1}
+	fileOpts := logfile.FileOptions{KeyProvider: opts.KeyProvider, ReadOnly: true}
+	lf, err := logfile.OpenLogFileWithOptions(opts.DBPath, fid, opts.LogFileSizeThreshold,
+		logfile.FileType(dataType), logfile.FileIo, fileOpts)
+	report.Name = logFileName(dataType, fid)
+	if err == logfile.ErrKeyProviderRequired {
+		report.Encrypted = true
+		return report
+	}
+	if err != nil {
+		report.Err = err
+		return report
+	}
+	defer func() {
+		_ = lf.Close()
+	}()
+	stat, err := os.Stat(filepath.Join(opts.DBPath, report.Name))
+	if err != nil {
+		report.Err = err
+		return report
+	}
+	report.Size = stat.Size()
+
+	offset := lf.HeaderSize()
+	lastCrcError := false
+	for offset < report.Size {
+		// locate the entry first, a corrupted header may have a huge size.
+		esize, err := lf.ReadEntrySize(offset)
+		if err == logfile.ErrEndOfEntry {
+			break
+		}
+		if err != nil || offset+esize > report.Size {
+			if err == nil {
+				report.Truncated = true
+			} else {
+				report.UnreadableAt = offset
+			}
+			break
+		}
+
+		ent, _, err := lf.ReadLogEntry(offset)
+		lastCrcError = err != nil
+		if err != nil {
+			report.CrcErrors++
+		} else {
+			report.Entries++
+			if fn != nil {
+				if err := fn(ent, offset); err != nil {
+					report.Err = err
+					return report
+				}
+			}
+		}
+		offset += esize
+	}
+	// the last entry is written partially before crash, and the rest of the file is not written.
+	if lastCrcError && report.UnreadableAt < 0 {
+		report.CrcErrors--
+		report.Truncated = true
+	}
+	return report
+}
+
+// repairLogFiles rewrites the valid entries of log files into new files with the same fids, in fid order.
+// Chunks may move to other offsets, so the manifests of large values are rewritten with the new offsets,
+// and large values are dropped if any of their chunks is lost.
+func repairLogFiles(opts Options, dataType DataType, files []*FileReport) error {
+	repairDir := filepath.Join(opts.DBPath, repairDirName)
+	if err := os.RemoveAll(repairDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(repairDir, os.ModePerm); err != nil {
+		return err
+	}
+	var compressor logfile.Compressor
+	if opts.Compression != logfile.NoCompression {
+		var err error
+		if compressor, err = logfile.GetCompressor(opts.Compression); err != nil {
+			return err
+		}
+	}
+	// encode entries just like an opened db.
+	db := &YoimiyaDB{opts: opts, compressor: compressor}
+	fileOpts := logfile.FileOptions{KeyProvider: opts.KeyProvider, Compression: opts.Compression, Checksum: opts.Checksum}
+
+	// new offsets of the chunks, by fid and old offset.
+	chunks := make(map[uint32]map[int64]*valuePos)
+	var repaired []*FileReport
+	for _, f := range files {
+		if f.Err != nil {
+			continue
+		}
+		newFile, err := logfile.OpenLogFileWithOptions(repairDir, f.Fid, opts.LogFileSizeThreshold,
+			logfile.FileType(dataType), logfile.FileIo, fileOpts)
+		if err != nil {
+			return err
+		}
+		chunks[f.Fid] = make(map[int64]*valuePos)
+
+		r := checkLogFile(opts, dataType, f.Fid, func(ent *logfile.LogEntry, offset int64) error {
+			if ent.Type == logfile.TypeChunkManifest {
+				manifest, err := decodeChunkManifest(ent.Value)
+				if err != nil {
+					f.DroppedValues++
+					return nil
+				}
+				for i, pos := range manifest.chunks {
+					newPos := chunks[pos.fid][pos.offset]
+					if newPos == nil {
+						f.DroppedValues++
+						return nil
+					}
+					manifest.chunks[i] = newPos
+				}
+				ent.Value = manifest.encode()
+			}
+
+			buf, esize, err := db.encodeLogEntry(ent, newFile)
+			if err != nil {
+				return err
+			}
+			newOffset := newFile.WriteAt
+			if err := newFile.Write(buf); err != nil {
+				return err
+			}
+			if ent.Type == logfile.TypeChunk {
+				chunks[f.Fid][offset] = &valuePos{fid: f.Fid, offset: newOffset, entrySize: esize}
+			}
+			return nil
+		})
+		if err := newFile.Sync(); err != nil {
+			return err
+		}
+		if err := newFile.Close(); err != nil {
+			return err
+		}
+		if r.Err != nil {
+			return r.Err
+		}
+		repaired = append(repaired, f)
+	}
+
+	// replace the log files, hint files are removed first since the offsets are changed,
+	// Open trusts hint files, so a crash must not leave a stale one with the new log file.
+	for _, f := range repaired {
+		if err := logfile.DeleteHintFile(opts.DBPath, f.Fid, logfile.FileType(dataType)); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(repairDir, f.Name), filepath.Join(opts.DBPath, f.Name)); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if f.Err == nil {
+			continue
+		}
+		if err := logfile.DeleteHintFile(opts.DBPath, f.Fid, logfile.FileType(dataType)); err != nil {
+			return err
+		}
+		path := filepath.Join(opts.DBPath, f.Name)
+		if err := os.Rename(path, path+corruptFileSuffix); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(repairDir)
+}
+
+func logFileName(dataType DataType, fid uint32) string {
+	return logfile.FileNamesMap[logfile.FileType(dataType)] + fmt.Sprintf("%09d", fid)
+}
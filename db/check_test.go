@@ -0,0 +1,227 @@
+package db
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"yoimiya/logfile"
+)
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 4 << 10
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	writeCount := 300
+	for i := 0; i < writeCount; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	report, err := Check(opts)
+	assert.Nil(t, err)
+	assert.True(t, report.Healthy())
+	assert.Equal(t, len(db.archivedLogFiles[String])+1, len(report.Files))
+	var entries int
+	for _, f := range report.Files {
+		entries += f.Entries
+	}
+	assert.Equal(t, writeCount, entries)
+
+	// the db can't be checked while it is opened.
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = Check(opts)
+	assert.NotNil(t, err)
+	assert.Nil(t, db.Close())
+
+	// flip a byte of an entry in the first log file.
+	offsets := logEntryOffsets(t, opts, 0)
+	corrupted := readEntryKey(t, opts, 0, offsets[3])
+	flipByte(t, opts, 0, offsets[4]-1)
+
+	// a partially written entry at the end of the active log file.
+	activeFid := report.Files[len(report.Files)-1].Fid
+	offsets = logEntryOffsets(t, opts, activeFid)
+	last := len(offsets) - 2
+	lost := readEntryKey(t, opts, activeFid, offsets[last])
+	zeroBytes(t, opts, activeFid, (offsets[last]+offsets[last+1])/2, offsets[last+1])
+
+	// a hint file without log file.
+	orphan := logFileName(String, 1000) + logfile.HintFileSuffix
+	assert.Nil(t, os.WriteFile(filepath.Join(path, orphan), []byte("orphan"), 0644))
+
+	report, err = Check(opts)
+	assert.Nil(t, err)
+	assert.False(t, report.Healthy())
+	assert.Equal(t, 1, report.Files[0].CrcErrors)
+	assert.False(t, report.Files[0].Truncated)
+	activeReport := report.Files[len(report.Files)-1]
+	assert.Equal(t, 0, activeReport.CrcErrors)
+	assert.True(t, activeReport.Truncated)
+	assert.Equal(t, []string{orphan}, report.Orphans)
+
+	report, err = Repair(opts)
+	assert.Nil(t, err)
+	assert.True(t, report.Healthy())
+	_, err = os.Stat(filepath.Join(path, orphan))
+	assert.True(t, os.IsNotExist(err))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < writeCount; i++ {
+		v, err := db.Get(GetKey(i))
+		if string(GetKey(i)) == string(corrupted) || string(GetKey(i)) == string(lost) {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, GetValue16B(i), v)
+	}
+}
+
+func TestRepair_LargeValue(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 64 << 10
+	opts.ValueChunkSize = 10 << 10
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	small := []byte("small-value")
+	large := make([]byte, 100<<10)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	assert.Nil(t, db.Set([]byte("small"), small))
+	assert.Nil(t, db.Set([]byte("large-broken"), large))
+	assert.Nil(t, db.Set([]byte("large"), large))
+	assert.Nil(t, db.Close())
+
+	// corrupt the first chunk of "large-broken", the chunks of "large" are moved by repairing.
+	offsets := logEntryOffsets(t, opts, 0)
+	var i int
+	for i = range offsets {
+		if string(readEntryKey(t, opts, 0, offsets[i])) == "large-broken" {
+			break
+		}
+	}
+	flipByte(t, opts, 0, offsets[i+1]-1)
+
+	report, err := Repair(opts)
+	assert.Nil(t, err)
+	assert.True(t, report.Healthy())
+	var dropped int
+	for _, f := range report.Files {
+		dropped += f.DroppedValues
+	}
+	assert.Equal(t, 1, dropped)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	v, err := db.Get([]byte("small"))
+	assert.Nil(t, err)
+	assert.Equal(t, small, v)
+	v, err = db.Get([]byte("large"))
+	assert.Nil(t, err)
+	assert.Equal(t, large, v)
+	_, err = db.Get([]byte("large-broken"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestCheck_Encrypted(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 4 << 10
+	opts.KeyProvider = logfile.NewStaticKeyProvider(1, bytes.Repeat([]byte{1}, 32))
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	report, err := Check(opts)
+	assert.Nil(t, err)
+	assert.True(t, report.Healthy())
+	var entries int
+	for _, f := range report.Files {
+		assert.False(t, f.Encrypted)
+		entries += f.Entries
+	}
+	assert.Equal(t, 100, entries)
+
+	// the log files can't be verified without the key, but they are not corrupted.
+	opts.KeyProvider = nil
+	report, err = Check(opts)
+	assert.Nil(t, err)
+	assert.True(t, report.Healthy())
+	for _, f := range report.Files {
+		assert.True(t, f.Encrypted)
+		assert.Nil(t, f.Err)
+		assert.Equal(t, f.Name+": encrypted, cannot verify", f.String())
+	}
+}
+
+// logEntryOffsets returns the offsets of entries in a log file, and the end of entries.
+func logEntryOffsets(t *testing.T, opts Options, fid uint32) []int64 {
+	lf, err := logfile.OpenLogFile(opts.DBPath, fid, opts.LogFileSizeThreshold, logfile.Strs, logfile.FileIo)
+	assert.Nil(t, err)
+	defer func() {
+		_ = lf.Close()
+	}()
+
+	var offsets []int64
+	offset := lf.HeaderSize()
+	for {
+		offsets = append(offsets, offset)
+		_, size, err := lf.ReadLogEntry(offset)
+		if err != nil {
+			return offsets
+		}
+		offset += size
+	}
+}
+
+func readEntryKey(t *testing.T, opts Options, fid uint32, offset int64) []byte {
+	lf, err := logfile.OpenLogFile(opts.DBPath, fid, opts.LogFileSizeThreshold, logfile.Strs, logfile.FileIo)
+	assert.Nil(t, err)
+	defer func() {
+		_ = lf.Close()
+	}()
+	ent, _, err := lf.ReadLogEntry(offset)
+	assert.Nil(t, err)
+	return ent.Key
+}
+
+func flipByte(t *testing.T, opts Options, fid uint32, offset int64) {
+	f, err := os.OpenFile(filepath.Join(opts.DBPath, logFileName(String, fid)), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+	}()
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, offset)
+	assert.Nil(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, offset)
+	assert.Nil(t, err)
+}
+
+func zeroBytes(t *testing.T, opts Options, fid uint32, from, to int64) {
+	f, err := os.OpenFile(filepath.Join(opts.DBPath, logFileName(String, fid)), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+	}()
+	_, err = f.WriteAt(make([]byte, to-from), from)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,212 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"yoimiya/logfile"
+)
+
+// chunkManifest lists the chunk entries of a large value in order, it is the value of a TypeChunkManifest entry.
+// The encoded manifest look like: value size | chunk count | (fid | offset | entry size) of each chunk, all in varint.
+type chunkManifest struct {
+	size   int64
+	chunks []*valuePos
+}
+
+// chunkReader reads a large value chunk by chunk.
+type chunkReader struct {
+	db       *YoimiyaDB
+	dataType DataType
+	key      []byte
+	size     int64 // size of the whole value.
+	chunks   []*valuePos
+	cur      []byte // the unread part of current chunk.
+}
+
+// SetFromReader set key to hold the value read from r until io.EOF. If key already holds a value, it is overwritten.
+// The value is read and written in chunks of ValueChunkSize, so it can be larger than the memory and a log file.
+// If the value is shorter than ValueChunkSize, it is the same as Set.
+func (db *YoimiyaDB) SetFromReader(key []byte, r io.Reader) error {
+	_, err := db.setFromReader(key, r, nil)
+	return err
+}
+
+// setFromReader writes the value read from r, cond is checked when the manifest is written after all chunks,
+// the chunks written are left as garbage if cond is false.
+func (db *YoimiyaDB) setFromReader(key []byte, r io.Reader, cond func(old []byte, exist bool) bool) (bool, error) {
+	buf := make([]byte, db.chunkSize())
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return db.SetIf(key, buf[:n], cond)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// chunks are written before the manifest, they are not visible until the manifest is written.
+	manifest := &chunkManifest{}
+	for n > 0 {
+		pos, err := db.writeChunk(key, buf[:n])
+		if err != nil {
+			return false, err
+		}
+		manifest.size += int64(n)
+		manifest.chunks = append(manifest.chunks, pos)
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return false, err
+		}
+	}
+	valuePos, err := db.setChunkManifest(key, manifest, cond)
+	if err != nil || valuePos == nil {
+		return false, err
+	}
+	for _, pos := range append(manifest.chunks, valuePos) {
+		if err := db.waitForSync(pos); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// GetReader returns a reader of the value of key.
+// A large value written in chunks is read lazily chunk by chunk, so it won't be loaded into memory at once.
+// If the key does not exist the error ErrKeyNotFound is returned.
+func (db *YoimiyaDB) GetReader(key []byte) (io.Reader, error) {
+	db.strIndex.mu.RLock()
+	val, idxNode, err := db.getRawVal(db.strIndex.idxTree, key, String)
+	db.strIndex.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if !idxNode.chunked {
+		return bytes.NewReader(val), nil
+	}
+	return db.newChunkReader(key, val, String)
+}
+
+func (db *YoimiyaDB) writeChunk(key, data []byte) (*valuePos, error) {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+	return db.writeLogEntry(&logfile.LogEntry{Key: key, Value: data, Type: logfile.TypeChunk}, String)
+}
+
+func (db *YoimiyaDB) setChunkManifest(key []byte, manifest *chunkManifest,
+	cond func(old []byte, exist bool) bool) (*valuePos, error) {
+
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	if ok, err := db.checkStrCond(key, cond); err != nil || !ok {
+		return nil, err
+	}
+	entry := &logfile.LogEntry{Key: key, Value: manifest.encode(), Type: logfile.TypeChunkManifest}
+	valuePos, err := db.writeLogEntry(entry, String)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.updateIndexTree(db.strIndex.idxTree, entry, valuePos, String); err != nil {
+		return nil, err
+	}
+	db.notify(EventString, "set", key)
+	return valuePos, nil
+}
+
+// chunkSize returns the max size of a chunk, which must fit into one log file.
+func (db *YoimiyaDB) chunkSize() int {
+	size := int64(db.opts.ValueChunkSize)
+	if limit := db.opts.LogFileSizeThreshold / 2; size <= 0 || size > limit {
+		size = limit
+	}
+	return int(size)
+}
+
+// readChunks reads the whole large value of the encoded manifest.
+func (db *YoimiyaDB) readChunks(key, manifest []byte, dataType DataType) ([]byte, error) {
+	cr, err := db.newChunkReader(key, manifest, dataType)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, cr.size)
+	if _, err := io.ReadFull(cr, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (db *YoimiyaDB) newChunkReader(key, manifest []byte, dataType DataType) (*chunkReader, error) {
+	m, err := decodeChunkManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{db: db, dataType: dataType, key: key, size: m.size, chunks: m.chunks}, nil
+}
+
+// Read reads the chunks in order, the next chunk is read from log file when the current one is consumed.
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.cur) == 0 {
+		if len(cr.chunks) == 0 {
+			return 0, io.EOF
+		}
+		pos := cr.chunks[0]
+		logFile := cr.db.getLogFile(cr.dataType, pos.fid)
+		if logFile == nil {
+			return 0, ErrLogFileNotFound
+		}
+		ent, _, err := logFile.ReadLogEntry(pos.offset)
+		if err != nil {
+			return 0, err
+		}
+		if ent.Type != logfile.TypeChunk || !bytes.Equal(ent.Key, cr.key) {
+			return 0, ErrInvalidChunk
+		}
+		cr.cur, cr.chunks = ent.Value, cr.chunks[1:]
+	}
+	n := copy(p, cr.cur)
+	cr.cur = cr.cur[n:]
+	return n, nil
+}
+
+func (m *chunkManifest) encode() []byte {
+	buf := make([]byte, binary.MaxVarintLen64*(2+3*len(m.chunks)))
+	index := binary.PutVarint(buf, m.size)
+	index += binary.PutVarint(buf[index:], int64(len(m.chunks)))
+	for _, pos := range m.chunks {
+		index += binary.PutVarint(buf[index:], int64(pos.fid))
+		index += binary.PutVarint(buf[index:], pos.offset)
+		index += binary.PutVarint(buf[index:], int64(pos.entrySize))
+	}
+	return buf[:index]
+}
+
+func decodeChunkManifest(buf []byte) (*chunkManifest, error) {
+	var index int
+	readVarint := func() (int64, bool) {
+		v, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			return 0, false
+		}
+		index += n
+		return v, true
+	}
+
+	size, ok1 := readVarint()
+	count, ok2 := readVarint()
+	// each chunk takes 3 bytes at least.
+	if !ok1 || !ok2 || count < 0 || count > int64(len(buf)/3) {
+		return nil, ErrInvalidChunk
+	}
+	m := &chunkManifest{size: size, chunks: make([]*valuePos, count)}
+	for i := range m.chunks {
+		fid, ok1 := readVarint()
+		offset, ok2 := readVarint()
+		entrySize, ok3 := readVarint()
+		if !ok1 || !ok2 || !ok3 {
+			return nil, ErrInvalidChunk
+		}
+		m.chunks[i] = &valuePos{fid: uint32(fid), offset: offset, entrySize: int(entrySize)}
+	}
+	return m, nil
+}
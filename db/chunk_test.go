@@ -0,0 +1,123 @@
+package db
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"yoimiya/logfile"
+)
+
+func TestYoimiyaDB_LargeValue(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		testYoimiyaDBLargeValue(t, logfile.FileIo, KeyOnlyMemMode)
+	})
+
+	t.Run("mmap", func(t *testing.T) {
+		testYoimiyaDBLargeValue(t, logfile.MMap, KeyOnlyMemMode)
+	})
+
+	t.Run("key-val-mem-mode", func(t *testing.T) {
+		testYoimiyaDBLargeValue(t, logfile.FileIo, KeyValueMemMode)
+	})
+}
+
+func testYoimiyaDBLargeValue(t *testing.T, ioType logfile.IOType, mode DataIndexMode) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.IoType = ioType
+	opts.IndexMode = mode
+	opts.LogFileSizeThreshold = 64 << 10
+	opts.ValueChunkSize = 10 << 10
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// the values are much larger than a log file.
+	large := make([]byte, 1<<20)
+	rand.Read(large)
+	large2 := make([]byte, 300<<10+7)
+	rand.Read(large2)
+	assert.Nil(t, db.Set([]byte("large"), large))
+	assert.Nil(t, db.SetFromReader([]byte("large2"), bytes.NewReader(large2)))
+	assert.Nil(t, db.SetFromReader([]byte("small"), bytes.NewReader([]byte("small-value"))))
+	assert.Nil(t, db.Set([]byte("large-deleted"), large2))
+	assert.Nil(t, db.Delete([]byte("large-deleted")))
+
+	check := func(db *YoimiyaDB) {
+		v, err := db.Get([]byte("large"))
+		assert.Nil(t, err)
+		assert.Equal(t, large, v)
+
+		r, err := db.GetReader([]byte("large2"))
+		assert.Nil(t, err)
+		v, err = ioutil.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, large2, v)
+
+		r, err = db.GetReader([]byte("small"))
+		assert.Nil(t, err)
+		v, err = ioutil.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("small-value"), v)
+
+		_, err = db.GetReader([]byte("large-deleted"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		values, err := db.MGet([][]byte{[]byte("large"), []byte("small"), []byte("large-deleted")})
+		assert.Nil(t, err)
+		assert.Equal(t, [][]byte{large, []byte("small-value"), nil}, values)
+	}
+	check(db)
+
+	// chunks are not indexed, and the manifests are loaded from log files and hint files.
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+	assert.Equal(t, 3, db.strIndex.idxTree.Size())
+
+	// overwrite a large value with a small one.
+	assert.Nil(t, db.Set([]byte("large"), []byte("not-large")))
+	v, err := db.Get([]byte("large"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("not-large"), v)
+}
+
+func TestYoimiyaDB_SetFromReader_Err(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.ValueChunkSize = 1 << 10
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	// the value is not visible if the reader fails.
+	r := io.MultiReader(bytes.NewReader(make([]byte, 5<<10)), iotest.ErrReader(io.ErrClosedPipe))
+	assert.Equal(t, io.ErrClosedPipe, db.SetFromReader([]byte("key"), r))
+	_, err = db.Get([]byte("key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestChunkManifest(t *testing.T) {
+	m := &chunkManifest{
+		size: 1<<20 + 3,
+		chunks: []*valuePos{
+			{fid: 0, offset: 64, entrySize: 1 << 19},
+			{fid: 1, offset: 1 << 30, entrySize: 1<<19 + 3},
+		},
+	}
+	got, err := decodeChunkManifest(m.encode())
+	assert.Nil(t, err)
+	assert.Equal(t, m, got)
+
+	buf := m.encode()
+	_, err = decodeChunkManifest(buf[:len(buf)-1])
+	assert.Equal(t, ErrInvalidChunk, err)
+	_, err = decodeChunkManifest(nil)
+	assert.Equal(t, ErrInvalidChunk, err)
+}
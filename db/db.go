@@ -2,8 +2,22 @@ package db
 
 import (
 	"errors"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"yoimiya/cache"
+	"yoimiya/ds"
+	"yoimiya/flock"
+	"yoimiya/ioselector"
 	"yoimiya/logfile"
+	"yoimiya/logger"
+	"yoimiya/pubsub"
 )
 
 var (
@@ -27,6 +41,12 @@ var (
 
 	// ErrGCRunning log file gc is running.
 	ErrGCRunning = errors.New("log file gc is running, retry later")
+
+	// ErrInvalidChunk a chunk of large value is missing or corrupted.
+	ErrInvalidChunk = errors.New("invalid chunk of large value")
+
+	// ErrDBClosed the db is closed.
+	ErrDBClosed = errors.New("db is closed")
 )
 
 const (
@@ -35,23 +55,428 @@ const (
 	initialListSeq   = math.MaxUint32 / 2
 	discardFilePath  = "DISCARD"
 	lockFileName     = "FLOCK"
+	checkpointFile   = "CHECKPOINT"
+	replicationFile  = "REPLICATION"
 )
 
 type (
+	// YoimiyaDB a db instance.
 	YoimiyaDB struct {
 		activeLogFiles   map[DataType]*logfile.LogFile
 		archivedLogFiles map[DataType]archivesFiles
-		fidMap           map[DataType][]uint32
+		fidMap           map[DataType][]uint32 // only used at startup, never update even though log files changed.
 		discards         map[DataType]*discard
+		opts             Options
+		strIndex         *strIndex // String indexes(adaptive-radix-tree).
+		valueCache       *cache.LRUCache
+		compressor       logfile.Compressor // nil if compression is disabled.
+		mu               sync.RWMutex
+		fileLock         *flock.FileLockGuard
+		closed           uint32
+		hintWg           sync.WaitGroup // wait for the hint files being written in background.
+		syncer           *syncer        // nil unless SyncPolicy is SyncGroup or SyncEverySec.
+		pubSub           *pubsub.Hub
+		notifier         *notifier
+		changes          changeSignal // wakes up change streams.
+		checkpoints      checkpoints  // checkpoints of change stream consumers.
+		repl             replication
+		readOnly         uint32 // 1 if the db is a follower.
 	}
 
 	archivesFiles map[uint32]*logfile.LogFile
 
+	valuePos struct {
+		fid       uint32
+		offset    int64
+		entrySize int
+		syncBatch *syncBatch // not nil if the write has to wait for group commit.
+	}
+
+	strIndex struct {
+		mu      *sync.RWMutex
+		idxTree *ds.AdaptiveRadixTree
+	}
+
 	indexNode struct {
 		value     []byte
 		fid       uint32
 		offset    int64
 		entrySize int
 		expiredAt int64
+		chunked   bool // value is a chunk manifest, see chunkManifest.
 	}
 )
+
+func newStrsIndex() *strIndex {
+	return &strIndex{idxTree: ds.NewART(), mu: new(sync.RWMutex)}
+}
+
+// Open a yoimiya instance. You must call Close after using it.
+func Open(opts Options) (*YoimiyaDB, error) {
+	// create the dir path if not exists.
+	if err := os.MkdirAll(opts.DBPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	var compressor logfile.Compressor
+	if opts.Compression != logfile.NoCompression {
+		var err error
+		if compressor, err = logfile.GetCompressor(opts.Compression); err != nil {
+			return nil, err
+		}
+	}
+
+	notifier, err := newNotifier(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// acquire file lock to prevent multiple processes from accessing the same directory.
+	lockPath := filepath.Join(opts.DBPath, lockFileName)
+	lockGuard, err := flock.AcquireFileLock(lockPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &YoimiyaDB{
+		activeLogFiles:   make(map[DataType]*logfile.LogFile),
+		archivedLogFiles: make(map[DataType]archivesFiles),
+		opts:             opts,
+		fileLock:         lockGuard,
+		strIndex:         newStrsIndex(),
+		compressor:       compressor,
+		pubSub:           opts.PubSub,
+		notifier:         notifier,
+	}
+	if db.pubSub == nil {
+		db.pubSub = pubsub.NewHub(opts.PubSubBufferSize, opts.SlowConsumerPolicy)
+	}
+	if opts.IndexMode == KeyOnlyMemMode && opts.ValueCacheSize > 0 {
+		db.valueCache = cache.NewLRUCache(opts.ValueCacheSize, cache.DefaultShardNum)
+	}
+
+	if err := db.loadReplicationID(); err != nil {
+		_ = lockGuard.Release()
+		return nil, err
+	}
+	if err := db.loadCheckpoints(); err != nil {
+		_ = lockGuard.Release()
+		return nil, err
+	}
+
+	// load the log files from disk.
+	if err := db.loadLogFiles(); err != nil {
+		_ = lockGuard.Release()
+		return nil, err
+	}
+
+	// load indexes from log files.
+	if err := db.loadIndexFromLogFiles(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	// sync log files in background if necessary.
+	db.syncer = newSyncer(opts)
+	return db, nil
+}
+
+// Close db and save relative configs.
+func (db *YoimiyaDB) Close() error {
+	db.stopFollowing()
+	// archived log files can't be closed until their hint files are written.
+	db.hintWg.Wait()
+	if db.syncer != nil {
+		db.syncer.close()
+	}
+
+	db.closeEventSubscriptions()
+	defer db.changes.broadcast()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.fileLock != nil {
+		_ = db.fileLock.Release()
+	}
+	// close and sync the active file.
+	for _, activeFile := range db.activeLogFiles {
+		_ = activeFile.Sync()
+		_ = activeFile.Close()
+	}
+	// close the archived files.
+	for _, archived := range db.archivedLogFiles {
+		for _, file := range archived {
+			_ = file.Close()
+		}
+	}
+	atomic.StoreUint32(&db.closed, 1)
+	return nil
+}
+
+// Sync persist the db files to stable storage.
+func (db *YoimiyaDB) Sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// iterate and sync all the active files.
+	for _, activeFile := range db.activeLogFiles {
+		if err := activeFile.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValueCacheStats returns the statistics of the value cache.
+// It returns zero values if the value cache is disabled.
+func (db *YoimiyaDB) ValueCacheStats() cache.Stats {
+	if db.valueCache == nil {
+		return cache.Stats{}
+	}
+	return db.valueCache.Stats()
+}
+
+func (db *YoimiyaDB) isClosed() bool {
+	return atomic.LoadUint32(&db.closed) == 1
+}
+
+func (db *YoimiyaDB) getActiveLogFile(dataType DataType) *logfile.LogFile {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.activeLogFiles[dataType]
+}
+
+func (db *YoimiyaDB) getArchivedLogFile(dataType DataType, fid uint32) *logfile.LogFile {
+	var lf *logfile.LogFile
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.archivedLogFiles[dataType] != nil {
+		lf = db.archivedLogFiles[dataType][fid]
+	}
+	return lf
+}
+
+// getLogFile returns the log file that holds fid, the active one is checked first.
+func (db *YoimiyaDB) getLogFile(dataType DataType, fid uint32) *logfile.LogFile {
+	logFile := db.getActiveLogFile(dataType)
+	if logFile == nil || logFile.Fid != fid {
+		logFile = db.getArchivedLogFile(dataType, fid)
+	}
+	return logFile
+}
+
+// write entry to log file.
+func (db *YoimiyaDB) writeLogEntry(ent *logfile.LogEntry, dataType DataType) (*valuePos, error) {
+	if atomic.LoadUint32(&db.readOnly) == 1 {
+		return nil, ErrReadOnly
+	}
+	if err := db.initLogFile(dataType); err != nil {
+		return nil, err
+	}
+	activeLogFile := db.getActiveLogFile(dataType)
+	if activeLogFile == nil {
+		return nil, ErrLogFileNotFound
+	}
+
+	opts := db.opts
+	entBuf, esize, err := db.encodeLogEntry(ent, activeLogFile)
+	if err != nil {
+		return nil, err
+	}
+	if activeLogFile.WriteAt+int64(esize) > opts.LogFileSizeThreshold {
+		if err := activeLogFile.Sync(); err != nil {
+			return nil, err
+		}
+
+		lf, err := db.rotateLogFile(dataType, activeLogFile, activeLogFile.Fid+1, nil)
+		if err != nil {
+			return nil, err
+		}
+		activeLogFile = lf
+
+		// the entry is encrypted with the position in log file, so encode it again for the new log file.
+		if entBuf, esize, err = db.encodeLogEntry(ent, activeLogFile); err != nil {
+			return nil, err
+		}
+	}
+
+	writeAt := atomic.LoadInt64(&activeLogFile.WriteAt)
+	// write entry and sync(if necessary).
+	if err := activeLogFile.Write(entBuf); err != nil {
+		return nil, err
+	}
+	db.changes.broadcast()
+	pos := &valuePos{fid: activeLogFile.Fid, offset: writeAt, entrySize: esize}
+	switch {
+	case opts.SyncPolicy == SyncAlways:
+		if err := activeLogFile.Sync(); err != nil {
+			return nil, err
+		}
+	case db.syncer != nil:
+		pos.syncBatch = db.syncer.add(activeLogFile, esize)
+	}
+	return pos, nil
+}
+
+// rotateLogFile archives the active log file, and opens the log file of fid as the new active one.
+// header is the header block of the new log file, nil to create a new one.
+func (db *YoimiyaDB) rotateLogFile(dataType DataType, active *logfile.LogFile, fid uint32,
+	header []byte) (*logfile.LogFile, error) {
+
+	db.mu.Lock()
+	// save the old log file in archived files.
+	if active != nil {
+		if db.archivedLogFiles[dataType] == nil {
+			db.archivedLogFiles[dataType] = make(archivesFiles)
+		}
+		db.archivedLogFiles[dataType][active.Fid] = active
+	}
+
+	// open a new log file.
+	lf, err := db.openLogFileWithHeader(dataType, fid, header)
+	if err != nil {
+		db.mu.Unlock()
+		return nil, err
+	}
+	db.activeLogFiles[dataType] = lf
+	db.mu.Unlock()
+
+	// write hint file of the archived log file in background, for fast startup.
+	if active != nil && db.hintFileEnabled() {
+		db.hintWg.Add(1)
+		go func(archived *logfile.LogFile) {
+			defer db.hintWg.Done()
+			if err := db.writeHintFile(dataType, archived); err != nil {
+				logger.Warn("write hint file err, fid: %d, err: %v", archived.Fid, err)
+			}
+		}(active)
+	}
+	return lf, nil
+}
+
+// encodeLogEntry compresses and encrypts the entry if necessary, and encodes it for writing at the end of lf.
+func (db *YoimiyaDB) encodeLogEntry(ent *logfile.LogEntry, lf *logfile.LogFile) ([]byte, int, error) {
+	// the original entry is still used by indexes.
+	encEnt, err := logfile.CompressEntry(ent, db.compressor, db.opts.CompressionThreshold)
+	if err != nil {
+		return nil, 0, err
+	}
+	if encEnt, err = lf.EncryptEntry(encEnt, atomic.LoadInt64(&lf.WriteAt)); err != nil {
+		return nil, 0, err
+	}
+	entBuf, esize := lf.EncodeEntry(encEnt)
+	return entBuf, esize, nil
+}
+
+func (db *YoimiyaDB) openLogFile(dataType DataType, fid uint32) (*logfile.LogFile, error) {
+	return db.openLogFileWithHeader(dataType, fid, nil)
+}
+
+// openLogFileWithHeader opens a log file, a new log file is initialized with header if it is not nil.
+func (db *YoimiyaDB) openLogFileWithHeader(dataType DataType, fid uint32, header []byte) (*logfile.LogFile, error) {
+	opts := db.opts
+	ftype := logfile.FileType(dataType)
+	fileOpts := logfile.FileOptions{
+		KeyProvider:    opts.KeyProvider,
+		Compression:    opts.Compression,
+		Checksum:       opts.Checksum,
+		Header:         header,
+		WrapIOSelector: opts.WrapIOSelector,
+	}
+	return logfile.OpenLogFileWithOptions(opts.DBPath, fid, opts.LogFileSizeThreshold, ftype, opts.IoType, fileOpts)
+}
+
+// hintFileEnabled hint files contain keys in plaintext, so they are disabled if log files are encrypted.
+// They are also disabled in MemIO, which shouldn't write anything to disk.
+func (db *YoimiyaDB) hintFileEnabled() bool {
+	return db.opts.KeyProvider == nil && db.opts.IoType != logfile.MemIO
+}
+
+// logFileNames returns the names of files in db path, in MemIO they are the in-memory files.
+func (db *YoimiyaDB) logFileNames() ([]string, error) {
+	if db.opts.IoType == logfile.MemIO {
+		return ioselector.MemFileNames(db.opts.DBPath), nil
+	}
+	fileInfos, err := ioutil.ReadDir(db.opts.DBPath)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(fileInfos))
+	for i, file := range fileInfos {
+		names[i] = file.Name()
+	}
+	return names, nil
+}
+
+func (db *YoimiyaDB) loadLogFiles() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	fileNames, err := db.logFileNames()
+	if err != nil {
+		return err
+	}
+
+	fidMap := make(map[DataType][]uint32)
+	for _, name := range fileNames {
+		if !strings.HasPrefix(name, logfile.FilePrefix) {
+			continue
+		}
+		splitNames := strings.Split(name, ".")
+		if len(splitNames) != 3 {
+			continue
+		}
+		typ, ok := logfile.FileTypesMap[splitNames[1]]
+		if !ok {
+			continue
+		}
+		fid, err := strconv.Atoi(splitNames[2])
+		if err != nil {
+			return err
+		}
+		fidMap[DataType(typ)] = append(fidMap[DataType(typ)], uint32(fid))
+	}
+	db.fidMap = fidMap
+
+	for dataType, fids := range fidMap {
+		if db.archivedLogFiles[dataType] == nil {
+			db.archivedLogFiles[dataType] = make(archivesFiles)
+		}
+		if len(fids) == 0 {
+			continue
+		}
+		// load log file in order.
+		sort.Slice(fids, func(i, j int) bool {
+			return fids[i] < fids[j]
+		})
+
+		for i, fid := range fids {
+			lf, err := db.openLogFile(dataType, fid)
+			if err != nil {
+				return err
+			}
+			// latest one is active log file.
+			if i == len(fids)-1 {
+				db.activeLogFiles[dataType] = lf
+			} else {
+				db.archivedLogFiles[dataType][fid] = lf
+			}
+		}
+	}
+	return nil
+}
+
+func (db *YoimiyaDB) initLogFile(dataType DataType) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.activeLogFiles[dataType] != nil {
+		return nil
+	}
+	lf, err := db.openLogFile(dataType, logfile.InitialLogFailed)
+	if err != nil {
+		return err
+	}
+	db.activeLogFiles[dataType] = lf
+	return nil
+}
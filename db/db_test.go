@@ -0,0 +1,348 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"yoimiya/ioselector"
+	"yoimiya/logfile"
+	"yoimiya/logger"
+)
+
+func TestOpen(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		opts := DefaultOptions(filepath.Join("/tmp", "yoimiya"))
+		db, err := Open(opts)
+		defer destroyDB(db)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+	})
+
+	t.Run("mmap", func(t *testing.T) {
+		opts := DefaultOptions(filepath.Join("/tmp", "yoimiya"))
+		opts.IoType = logfile.MMap
+		db, err := Open(opts)
+		defer destroyDB(db)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+	})
+}
+
+func TestYoimiyaDB_Reopen(t *testing.T) {
+	t.Run("key-only-mem-mode", func(t *testing.T) {
+		testYoimiyaDBReopen(t, logfile.FileIo, KeyOnlyMemMode)
+	})
+
+	t.Run("key-val-mem-mode", func(t *testing.T) {
+		testYoimiyaDBReopen(t, logfile.MMap, KeyValueMemMode)
+	})
+}
+
+func testYoimiyaDBReopen(t *testing.T, ioType logfile.IOType, mode DataIndexMode) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.IoType = ioType
+	opts.IndexMode = mode
+	opts.LogFileSizeThreshold = 4 << 10
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	// write enough entries to rotate some log files.
+	writeCount := 500
+	for i := 0; i < writeCount; i++ {
+		err := db.Set(GetKey(i), GetValue16B(i))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(GetKey(0))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	_, err = db.Get(GetKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i < writeCount; i++ {
+		v, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetValue16B(i), v)
+	}
+}
+
+func TestYoimiyaDB_Reopen_HintFile(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 4 << 10
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	writeCount := 500
+	for i := 0; i < writeCount; i++ {
+		err := db.Set(GetKey(i), GetValue16B(i))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(GetKey(0))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// every archived log file has a hint file.
+	hintFiles, err := filepath.Glob(filepath.Join(path, "*"+logfile.HintFileSuffix))
+	assert.Nil(t, err)
+	assert.Equal(t, len(db.archivedLogFiles[String]), len(hintFiles))
+	assert.NotEqual(t, 0, len(hintFiles))
+
+	// corrupt a hint file, the log file will be read instead.
+	err = os.WriteFile(hintFiles[0], []byte("corrupted hint file"), 0644)
+	assert.Nil(t, err)
+	// and remove another one.
+	err = os.Remove(hintFiles[1])
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	_, err = db.Get(GetKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i < writeCount; i++ {
+		v, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetValue16B(i), v)
+	}
+	// the hint files have been rewritten.
+	for _, name := range hintFiles[:2] {
+		_, err := os.Stat(name)
+		assert.Nil(t, err)
+	}
+}
+
+func destroyDB(db *YoimiyaDB) {
+	if db != nil {
+		_ = db.Close()
+		ioselector.RemoveMemFiles(db.opts.DBPath)
+		if err := os.RemoveAll(db.opts.DBPath); err != nil {
+			logger.Error("destroy db err: %v", err)
+		}
+	}
+}
+
+func GetKey(n int) []byte {
+	return []byte("yoimiya-test-key-" + fmt.Sprintf("%09d", n))
+}
+
+func GetValue16B(n int) []byte {
+	return []byte(fmt.Sprintf("value-%010d", n))
+}
+
+func TestYoimiyaDB_Reopen_Encrypted(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 4 << 10
+	opts.KeyProvider = logfile.NewStaticKeyProvider(1, bytes.Repeat([]byte{1}, 32))
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	writeCount := 500
+	for i := 0; i < writeCount; i++ {
+		err := db.Set(GetKey(i), GetValue16B(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// no hint files and no plaintext on disk.
+	hintFiles, err := filepath.Glob(filepath.Join(path, "*"+logfile.HintFileSuffix))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(hintFiles))
+	logFiles, err := filepath.Glob(filepath.Join(path, logfile.FileNamesMap[logfile.Strs]+"*"))
+	assert.Nil(t, err)
+	for _, name := range logFiles {
+		data, err := os.ReadFile(name)
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(data, []byte("yoimiya-test-key")))
+	}
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	for i := 0; i < writeCount; i++ {
+		v, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetValue16B(i), v)
+	}
+}
+
+func TestYoimiyaDB_Crash(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	fi := ioselector.NewFaultInjector()
+	opts := DefaultOptions(path)
+	opts.IoType = logfile.MemIO
+	opts.WrapIOSelector = fi.Wrap
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B(i)))
+	}
+	assert.Nil(t, db.Sync())
+	for i := 100; i < 200; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B(i)))
+	}
+
+	// the failed write can be retried.
+	fi.FailWrites(1)
+	assert.Equal(t, ioselector.ErrInjectedFault, db.Set(GetKey(200), GetValue16B(200)))
+	assert.Nil(t, db.Set(GetKey(200), GetValue16B(200)))
+	_, err = db.Get(GetKey(200))
+	assert.Nil(t, err)
+
+	assert.Nil(t, fi.Crash())
+	_ = db.Close()
+
+	// writes after the last sync are lost.
+	opts.WrapIOSelector = nil
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	for i := 0; i < 100; i++ {
+		v, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetValue16B(i), v)
+	}
+	for i := 100; i <= 200; i++ {
+		_, err := db.Get(GetKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+}
+
+func TestOpen_CorruptedLogFile(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	fi := ioselector.NewFaultInjector()
+	opts := DefaultOptions(path)
+	opts.IoType = logfile.MemIO
+	opts.WrapIOSelector = fi.Wrap
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer ioselector.RemoveMemFiles(path)
+
+	assert.Nil(t, db.Set(GetKey(0), GetValue16B(0)))
+	fi.CorruptWrites(1)
+	assert.Nil(t, db.Set(GetKey(1), GetValue16B(1)))
+	assert.Nil(t, db.Set(GetKey(2), GetValue16B(2)))
+	assert.Nil(t, db.Close())
+
+	// an entry corrupted in the middle of log file can't be discarded, Open fails instead of losing the rest.
+	opts.WrapIOSelector = nil
+	_, err = Open(opts)
+	assert.Equal(t, logfile.ErrInvalidCrc, err)
+	// the db is closed by the failed Open, so it can be opened again.
+	_, err = Open(opts)
+	assert.Equal(t, logfile.ErrInvalidCrc, err)
+}
+
+func TestOpen_CorruptedEntrySize(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 1 << 20
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	// the value size of an entry in the middle claims the entry ends after all the written entries.
+	offsets := logEntryOffsets(t, opts, 0)
+	f, err := os.OpenFile(filepath.Join(path, logFileName(String, 0)), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xfe, 0x7f}, offsets[10]+4+1+1)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	_, err = Open(opts)
+	assert.Equal(t, logfile.ErrInvalidCrc, err)
+	// the entries after it are not discarded.
+	for i := 11; i < 100; i++ {
+		assert.Equal(t, GetKey(i), readEntryKey(t, opts, 0, offsets[i]))
+	}
+}
+
+func TestYoimiyaDB_CorruptWrite(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	fi := ioselector.NewFaultInjector()
+	opts := DefaultOptions(path)
+	opts.IoType = logfile.MemIO
+	opts.WrapIOSelector = fi.Wrap
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	// the log file and its header are created by the first write.
+	assert.Nil(t, db.Set(GetKey(0), GetValue16B(0)))
+	fi.CorruptWrites(1)
+	assert.Nil(t, db.Set(GetKey(1), GetValue16B(1)))
+	_, err = db.Get(GetKey(1))
+	assert.Equal(t, logfile.ErrInvalidCrc, err)
+	assert.Nil(t, db.Close())
+
+	// the corrupted entry is the last one, it is discarded as a torn tail after reopening.
+	opts.WrapIOSelector = nil
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	v, err := db.Get(GetKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, GetValue16B(0), v)
+	_, err = db.Get(GetKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestYoimiyaDB_ShortWrite(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	fi := ioselector.NewFaultInjector()
+	opts := DefaultOptions(path)
+	opts.IoType = logfile.MemIO
+	opts.WrapIOSelector = fi.Wrap
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		destroyDB(db)
+	}()
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set(GetKey(i), GetValue16B(i)))
+	}
+	// half of the entry is written, and the write is not acknowledged.
+	fi.ShortWrites(1)
+	assert.NotNil(t, db.Set([]byte("torn"), bytes.Repeat([]byte("v"), 1024)))
+	assert.Nil(t, db.Close())
+
+	opts.WrapIOSelector = nil
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		v, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetValue16B(i), v)
+	}
+	_, err = db.Get([]byte("torn"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the space of the torn entry is reused, and the new entry is read after reopening again.
+	assert.Nil(t, db.Set([]byte("after"), []byte("v")))
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	v, err := db.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), v)
+}
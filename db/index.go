@@ -1,5 +1,21 @@
 package db
 
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"yoimiya/ds"
+	"yoimiya/logfile"
+	"yoimiya/logger"
+)
+
+// valueCacheKeySize size of the key in value cache.
+const valueCacheKeySize = 13
+
 // DataType define the data structure type.
 type DataType = int8
 
@@ -11,3 +27,357 @@ const (
 	Set
 	ZSet
 )
+
+func (db *YoimiyaDB) buildIndex(dataType DataType, ent *logfile.LogEntry, pos *valuePos) {
+	switch dataType {
+	case String:
+		db.buildStrsIndex(ent, pos)
+	}
+}
+
+func (db *YoimiyaDB) buildStrsIndex(ent *logfile.LogEntry, pos *valuePos) {
+	// chunks are only reachable from the manifest of large value.
+	if ent.Type == logfile.TypeChunk {
+		return
+	}
+	ts := time.Now().Unix()
+	if ent.Type == logfile.TypeDelete || (ent.ExpiredAt != 0 && ent.ExpiredAt < ts) {
+		db.strIndex.idxTree.Delete(ent.Key)
+		return
+	}
+	_ = db.updateIndexTree(db.strIndex.idxTree, ent, pos, String)
+}
+
+func (db *YoimiyaDB) loadIndexFromLogFiles() error {
+	iterateAndHandle := func(dataType DataType) error {
+		fids := db.fidMap[dataType]
+		if len(fids) == 0 {
+			return nil
+		}
+		sort.Slice(fids, func(i, j int) bool {
+			return fids[i] < fids[j]
+		})
+
+		for i, fid := range fids {
+			var logFile *logfile.LogFile
+			if i == len(fids)-1 {
+				logFile = db.activeLogFiles[dataType]
+			} else {
+				logFile = db.archivedLogFiles[dataType][fid]
+			}
+			if logFile == nil {
+				return ErrLogFileNotFound
+			}
+
+			// archived log files won't change, so load indexes from their hint files if possible.
+			archived := i < len(fids)-1
+			if archived && db.loadIndexFromHintFile(dataType, fid) {
+				continue
+			}
+
+			offset := logFile.HeaderSize()
+			var hints []*logfile.HintEntry
+			for {
+				entry, esize, err := logFile.ReadLogEntry(offset)
+				if err == logfile.ErrEndOfEntry || (err == io.EOF && archived) {
+					break
+				}
+				if err != nil {
+					torn := false
+					if !archived {
+						var terr error
+						if torn, terr = logFile.IsTornTail(offset); terr != nil {
+							return terr
+						}
+					}
+					if !torn {
+						logger.Error("read log entry err, fid: %d, offset: %d, err: %v", fid, offset, err)
+						return err
+					}
+					// the last entry of the active log file is written partially before a crash,
+					// it was never acknowledged, so it is discarded just like Repair does.
+					logger.Warn("discard the torn entry at the end of log file, fid: %d, offset: %d, err: %v",
+						fid, offset, err)
+					if err := logFile.DiscardTail(offset); err != nil {
+						return err
+					}
+					break
+				}
+				pos := &valuePos{fid: fid, offset: offset, entrySize: int(esize)}
+				db.buildIndex(dataType, entry, pos)
+				if archived && entry.Type != logfile.TypeChunk {
+					hints = append(hints, newHintEntry(entry, pos))
+				}
+				offset += esize
+			}
+			if archived && db.hintFileEnabled() {
+				// the hint file is missing or invalid, rewrite it for the next startup.
+				if err := logfile.WriteHintFile(db.opts.DBPath, fid, logfile.FileType(dataType), hints); err != nil {
+					logger.Warn("write hint file err, fid: %d, err: %v", fid, err)
+				}
+			} else {
+				// set latest log file`s WriteAt.
+				atomic.StoreInt64(&logFile.WriteAt, offset)
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, logFileTypeNum)
+	wg := new(sync.WaitGroup)
+	wg.Add(logFileTypeNum)
+	for i := 0; i < logFileTypeNum; i++ {
+		go func(dataType DataType) {
+			defer wg.Done()
+			errs[dataType] = iterateAndHandle(dataType)
+		}(DataType(i))
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadIndexFromHintFile builds indexes from the hint file of an archived log file.
+// Values are not in hint files, so it returns false in KeyValueMemMode,
+// and also returns false if the hint file is missing or invalid, the log file should be read instead.
+func (db *YoimiyaDB) loadIndexFromHintFile(dataType DataType, fid uint32) bool {
+	if db.opts.IndexMode != KeyOnlyMemMode || !db.hintFileEnabled() {
+		return false
+	}
+	hints, err := logfile.ReadHintFile(db.opts.DBPath, fid, logfile.FileType(dataType))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("read hint file err, fid: %d, err: %v", fid, err)
+		}
+		return false
+	}
+	for _, h := range hints {
+		entry := &logfile.LogEntry{Key: h.Key, ExpiredAt: h.ExpiredAt, Type: h.Type}
+		pos := &valuePos{fid: h.Fid, offset: h.Offset, entrySize: int(h.EntrySize)}
+		db.buildIndex(dataType, entry, pos)
+	}
+	return true
+}
+
+// writeHintFile reads all entries of an archived log file and writes its hint file.
+func (db *YoimiyaDB) writeHintFile(dataType DataType, lf *logfile.LogFile) error {
+	offset := lf.HeaderSize()
+	var hints []*logfile.HintEntry
+	for {
+		entry, esize, err := lf.ReadLogEntry(offset)
+		if err != nil {
+			if err == io.EOF || err == logfile.ErrEndOfEntry {
+				break
+			}
+			return err
+		}
+		if entry.Type != logfile.TypeChunk {
+			pos := &valuePos{fid: lf.Fid, offset: offset, entrySize: int(esize)}
+			hints = append(hints, newHintEntry(entry, pos))
+		}
+		offset += esize
+	}
+	return logfile.WriteHintFile(db.opts.DBPath, lf.Fid, logfile.FileType(dataType), hints)
+}
+
+func newHintEntry(ent *logfile.LogEntry, pos *valuePos) *logfile.HintEntry {
+	return &logfile.HintEntry{
+		Key:       ent.Key,
+		Fid:       pos.fid,
+		Offset:    pos.offset,
+		EntrySize: int64(pos.entrySize),
+		ExpiredAt: ent.ExpiredAt,
+		Type:      ent.Type,
+	}
+}
+
+func (db *YoimiyaDB) updateIndexTree(idxTree *ds.AdaptiveRadixTree,
+	ent *logfile.LogEntry, pos *valuePos, dType DataType) error {
+
+	idxNode := &indexNode{
+		fid:       pos.fid,
+		offset:    pos.offset,
+		entrySize: pos.entrySize,
+		chunked:   ent.Type == logfile.TypeChunkManifest,
+	}
+	// in KeyValueMemMode, both key and value will store in memory.
+	if db.opts.IndexMode == KeyValueMemMode {
+		idxNode.value = ent.Value
+	}
+	if ent.ExpiredAt != 0 {
+		idxNode.expiredAt = ent.ExpiredAt
+	}
+	oldVal, _ := idxTree.Put(ent.Key, idxNode)
+	db.invalidateValueCache(oldVal, dType)
+	return nil
+}
+
+func (db *YoimiyaDB) getVal(idxTree *ds.AdaptiveRadixTree, key []byte, dataType DataType) ([]byte, error) {
+	val, idxNode, err := db.getRawVal(idxTree, key, dataType)
+	if err != nil {
+		return nil, err
+	}
+	if idxNode.chunked {
+		return db.readChunks(key, val, dataType)
+	}
+	return val, nil
+}
+
+// getRawVal get the value of key and its index node, the value is a chunk manifest if the index node is chunked.
+func (db *YoimiyaDB) getRawVal(idxTree *ds.AdaptiveRadixTree, key []byte,
+	dataType DataType) ([]byte, *indexNode, error) {
+
+	ts := time.Now().Unix()
+	idxNode := getIndexNode(idxTree, key, ts)
+	if idxNode == nil {
+		return nil, nil, ErrKeyNotFound
+	}
+	// in KeyValueMemMode, the value will be stored in memory.
+	// so get the value from the index info.
+	if db.opts.IndexMode == KeyValueMemMode {
+		return idxNode.value, idxNode, nil
+	}
+
+	// in KeyOnlyMemMode, the value not in memory, try the value cache first.
+	var cacheKey [valueCacheKeySize]byte
+	if db.valueCache != nil {
+		encodeValueCacheKey(cacheKey[:], dataType, idxNode)
+		if val, ok := db.valueCache.Get(cacheKey[:]); ok {
+			return val, idxNode, nil
+		}
+	}
+
+	// get the value from log file at the offset.
+	logFile := db.getLogFile(dataType, idxNode.fid)
+	if logFile == nil {
+		return nil, nil, ErrLogFileNotFound
+	}
+	// the entry is read without copying in MMap, only the value is copied out.
+	ent, _, err := logFile.ReadLogEntryView(idxNode.offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ent.Release()
+	// key exists, but is invalid(deleted or expired).
+	if ent.Type == logfile.TypeDelete || (ent.ExpiredAt != 0 && ent.ExpiredAt < ts) {
+		return nil, nil, ErrKeyNotFound
+	}
+	value := ent.Value
+	if ent.Aliased() {
+		value = make([]byte, len(ent.Value))
+		copy(value, ent.Value)
+	}
+	if db.valueCache != nil {
+		db.valueCache.Set(cacheKey[:], value)
+	}
+	return value, idxNode, nil
+}
+
+// getVals get the values of keys, the value of a key which doesn't exist is nil.
+// In KeyOnlyMemMode, values not in the value cache are read from log files in one batch per log file.
+func (db *YoimiyaDB) getVals(idxTree *ds.AdaptiveRadixTree, keys [][]byte, dataType DataType) ([][]byte, error) {
+	ts := time.Now().Unix()
+	values := make([][]byte, len(keys))
+	// indexes of the keys to read from each log file.
+	pending := make(map[uint32][]int)
+	nodes := make([]*indexNode, len(keys))
+	for i, key := range keys {
+		idxNode := getIndexNode(idxTree, key, ts)
+		if idxNode == nil {
+			continue
+		}
+		nodes[i] = idxNode
+		if db.opts.IndexMode == KeyValueMemMode {
+			values[i] = idxNode.value
+			continue
+		}
+		if db.valueCache != nil {
+			var cacheKey [valueCacheKeySize]byte
+			encodeValueCacheKey(cacheKey[:], dataType, idxNode)
+			if val, ok := db.valueCache.Get(cacheKey[:]); ok {
+				values[i] = val
+				continue
+			}
+		}
+		pending[idxNode.fid] = append(pending[idxNode.fid], i)
+	}
+
+	for fid, indexes := range pending {
+		logFile := db.getLogFile(dataType, fid)
+		if logFile == nil {
+			return nil, ErrLogFileNotFound
+		}
+		offsets, sizes := make([]int64, len(indexes)), make([]int64, len(indexes))
+		for j, i := range indexes {
+			offsets[j], sizes[j] = nodes[i].offset, int64(nodes[i].entrySize)
+		}
+		entries, err := logFile.ReadLogEntries(offsets, sizes)
+		if err != nil {
+			return nil, err
+		}
+		for j, ent := range entries {
+			// key exists, but is invalid(deleted or expired).
+			if ent.Type == logfile.TypeDelete || (ent.ExpiredAt != 0 && ent.ExpiredAt < ts) {
+				continue
+			}
+			i := indexes[j]
+			values[i] = ent.Value
+			if db.valueCache != nil {
+				var cacheKey [valueCacheKeySize]byte
+				encodeValueCacheKey(cacheKey[:], dataType, nodes[i])
+				db.valueCache.Set(cacheKey[:], ent.Value)
+			}
+		}
+	}
+
+	// the values of large values are chunk manifests now.
+	for i, idxNode := range nodes {
+		if idxNode == nil || !idxNode.chunked || values[i] == nil {
+			continue
+		}
+		var err error
+		if values[i], err = db.readChunks(keys[i], values[i], dataType); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// getIndexNode returns the index node of key, or nil if the key doesn't exist or is expired at ts.
+func getIndexNode(idxTree *ds.AdaptiveRadixTree, key []byte, ts int64) *indexNode {
+	rawValue := idxTree.Get(key)
+	if rawValue == nil {
+		return nil
+	}
+	idxNode, _ := rawValue.(*indexNode)
+	if idxNode == nil || (idxNode.expiredAt != 0 && idxNode.expiredAt <= ts) {
+		return nil
+	}
+	return idxNode
+}
+
+// invalidateValueCache removes the value of an outdated index node from the value cache.
+// It must be called when the entry of a key is updated, deleted or moved to another position.
+func (db *YoimiyaDB) invalidateValueCache(oldVal interface{}, dataType DataType) {
+	if db.valueCache == nil || oldVal == nil {
+		return
+	}
+	node, _ := oldVal.(*indexNode)
+	if node == nil {
+		return
+	}
+	var cacheKey [valueCacheKeySize]byte
+	encodeValueCacheKey(cacheKey[:], dataType, node)
+	db.valueCache.Delete(cacheKey[:])
+}
+
+// encodeValueCacheKey encodes data type(1 byte), fid(4 bytes) and offset(8 bytes) as the key in value cache.
+func encodeValueCacheKey(buf []byte, dataType DataType, node *indexNode) {
+	buf[0] = byte(dataType)
+	binary.LittleEndian.PutUint32(buf[1:5], node.fid)
+	binary.LittleEndian.PutUint64(buf[5:], uint64(node.offset))
+}
@@ -0,0 +1,210 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"yoimiya/pubsub"
+)
+
+// ErrInvalidKeyspaceEvents NotifyKeyspaceEvents contains an unknown flag.
+var ErrInvalidKeyspaceEvents = errors.New("invalid keyspace events flags")
+
+// EventClass the class of keyspace events, classes can be combined as a filter.
+// The classes and their flags in NotifyKeyspaceEvents are the same as redis.
+// Only EventGeneric and EventString events are emitted now, the others are reserved for the data types to come.
+type EventClass uint16
+
+const (
+	// EventGeneric events of commands for all types, like "del", flag 'g'.
+	EventGeneric EventClass = 1 << iota
+
+	// EventString events of strings, like "set", flag '$'.
+	EventString
+
+	// EventList events of lists, flag 'l'.
+	EventList
+
+	// EventSet events of sets, flag 's'.
+	EventSet
+
+	// EventHash events of hashes, flag 'h'.
+	EventHash
+
+	// EventZSet events of sorted sets, flag 'z'.
+	EventZSet
+
+	// EventExpired events of expired keys, flag 'x'.
+	EventExpired
+
+	// EventEvicted events of evicted keys, flag 'e'.
+	EventEvicted
+
+	// EventAll all classes of events, flag 'A'.
+	EventAll = EventGeneric | EventString | EventList | EventSet | EventHash | EventZSet | EventExpired | EventEvicted
+)
+
+const (
+	// notifyKeyspace events are published to "__keyspace@<db>__:<key>", flag 'K'.
+	notifyKeyspace EventClass = 1 << (iota + 14)
+
+	// notifyKeyevent events are published to "__keyevent@<db>__:<event>", flag 'E'.
+	notifyKeyevent
+)
+
+var eventClassFlags = map[rune]EventClass{
+	'g': EventGeneric,
+	'$': EventString,
+	'l': EventList,
+	's': EventSet,
+	'h': EventHash,
+	'z': EventZSet,
+	'x': EventExpired,
+	'e': EventEvicted,
+	'A': EventAll,
+	'K': notifyKeyspace,
+	'E': notifyKeyevent,
+}
+
+// Event is a keyspace event, it is emitted after a write is applied.
+// A follower emits the events of the writes it receives from leader, including the entries sent by a full sync,
+// but the keys dropped before a full sync emit nothing.
+type Event struct {
+	// Name the name of event, the same as the command in redis, like "set" and "del".
+	Name  string
+	Class EventClass
+	Key   []byte
+}
+
+// EventSubscription receives the keyspace events of a db which match its filter.
+type EventSubscription struct {
+	db     *YoimiyaDB
+	filter EventClass
+	buf    *pubsub.Buffer[*Event]
+}
+
+// notifier dispatches keyspace events to event subscriptions and pub/sub channels.
+type notifier struct {
+	mu   sync.RWMutex
+	subs map[*EventSubscription]struct{}
+
+	flags          EventClass // parsed from NotifyKeyspaceEvents.
+	keyspacePrefix string
+	keyeventPrefix string
+}
+
+func newNotifier(opts Options) (*notifier, error) {
+	flags, err := parseKeyspaceEvents(opts.NotifyKeyspaceEvents)
+	if err != nil {
+		return nil, err
+	}
+	db := strconv.Itoa(opts.DBIndex)
+	return &notifier{
+		subs:           make(map[*EventSubscription]struct{}),
+		flags:          flags,
+		keyspacePrefix: "__keyspace@" + db + "__:",
+		keyeventPrefix: "__keyevent@" + db + "__:",
+	}, nil
+}
+
+// parseKeyspaceEvents parses the flags like "KEA", nothing is published if neither 'K' nor 'E' is given.
+func parseKeyspaceEvents(flags string) (EventClass, error) {
+	var classes EventClass
+	for _, flag := range flags {
+		class, ok := eventClassFlags[flag]
+		if !ok {
+			return 0, ErrInvalidKeyspaceEvents
+		}
+		classes |= class
+	}
+	if classes&(notifyKeyspace|notifyKeyevent) == 0 {
+		return 0, nil
+	}
+	return classes, nil
+}
+
+// SubscribeEvents subscribes the keyspace events whose class is in filter.
+// Events are buffered by PubSubBufferSize, and handled by SlowConsumerPolicy if the buffer is full.
+// You must call Close of the subscription after using it, it is also closed when the db is closed.
+func (db *YoimiyaDB) SubscribeEvents(filter EventClass) *EventSubscription {
+	s := &EventSubscription{
+		db:     db,
+		filter: filter,
+		buf:    pubsub.NewBuffer[*Event](db.opts.PubSubBufferSize, db.opts.SlowConsumerPolicy),
+	}
+	db.notifier.mu.Lock()
+	db.notifier.subs[s] = struct{}{}
+	db.notifier.mu.Unlock()
+	return s
+}
+
+// C returns the channel of events, it is closed when the subscription is closed.
+func (s *EventSubscription) C() <-chan *Event {
+	return s.buf.C()
+}
+
+// Dropped returns the number of events dropped since the buffer is full, in pubsub.DropMessages policy.
+func (s *EventSubscription) Dropped() uint64 {
+	return s.buf.Dropped()
+}
+
+// Err returns pubsub.ErrSlowConsumer if the subscription is closed for slow consumer, otherwise nil.
+func (s *EventSubscription) Err() error {
+	return s.buf.Err()
+}
+
+// Close stops receiving events and closes the channel of events.
+func (s *EventSubscription) Close() {
+	s.db.notifier.mu.Lock()
+	delete(s.db.notifier.subs, s)
+	s.db.notifier.mu.Unlock()
+	s.buf.Close(nil)
+}
+
+// notify emits a keyspace event, it is called with the lock of index held, so events are in the order of writes.
+func (db *YoimiyaDB) notify(class EventClass, name string, key []byte) {
+	n := db.notifier
+	publish := n.flags&class != 0
+	n.mu.RLock()
+	if len(n.subs) == 0 && !publish {
+		n.mu.RUnlock()
+		return
+	}
+	// the key may be modified by the caller after the write.
+	event := &Event{Name: name, Class: class, Key: append([]byte(nil), key...)}
+	var slow []*EventSubscription
+	for s := range n.subs {
+		if s.filter&class == 0 {
+			continue
+		}
+		if _, disconnected := s.buf.Deliver(event); disconnected {
+			slow = append(slow, s)
+		}
+	}
+	n.mu.RUnlock()
+
+	if len(slow) > 0 {
+		n.mu.Lock()
+		for _, s := range slow {
+			delete(n.subs, s)
+		}
+		n.mu.Unlock()
+	}
+	if publish && n.flags&notifyKeyspace != 0 {
+		db.pubSub.Publish(n.keyspacePrefix+string(key), []byte(name))
+	}
+	if publish && n.flags&notifyKeyevent != 0 {
+		db.pubSub.Publish(n.keyeventPrefix+name, event.Key)
+	}
+}
+
+// closeEventSubscriptions closes all event subscriptions when the db is closed.
+func (db *YoimiyaDB) closeEventSubscriptions() {
+	db.notifier.mu.Lock()
+	subs := db.notifier.subs
+	db.notifier.subs = make(map[*EventSubscription]struct{})
+	db.notifier.mu.Unlock()
+	for s := range subs {
+		s.buf.Close(nil)
+	}
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"yoimiya/pubsub"
+)
+
+func TestParseKeyspaceEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   string
+		want    EventClass
+		wantErr bool
+	}{
+		{"empty", "", 0, false},
+		{"no-channel", "g$", 0, false},
+		{"keyspace", "K$", notifyKeyspace | EventString, false},
+		{"all", "KEA", notifyKeyspace | notifyKeyevent | EventAll, false},
+		{"unknown", "KEq", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKeyspaceEvents(tt.flags)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestYoimiyaDB_SubscribeEvents(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.ValueChunkSize = 16
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	all := db.SubscribeEvents(EventAll)
+	generic := db.SubscribeEvents(EventGeneric)
+	defer generic.Close()
+
+	key := []byte("key-1")
+	assert.Nil(t, db.Set(key, []byte("v")))
+	key[0] = 'K'
+	assert.Nil(t, db.SetFromReader([]byte("large"), bytes.NewReader(bytes.Repeat([]byte("a"), 100))))
+	ok, err := db.SetIf([]byte("key-1"), []byte("v2"), func(old []byte, exist bool) bool { return !exist })
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, db.Delete([]byte("key-1")))
+	// deleting a key which does not exist emits nothing.
+	assert.Nil(t, db.Delete([]byte("key-1")))
+
+	assert.Equal(t, &Event{Name: "set", Class: EventString, Key: []byte("key-1")}, <-all.C())
+	assert.Equal(t, &Event{Name: "set", Class: EventString, Key: []byte("large")}, <-all.C())
+	assert.Equal(t, &Event{Name: "del", Class: EventGeneric, Key: []byte("key-1")}, <-all.C())
+	assert.Equal(t, &Event{Name: "del", Class: EventGeneric, Key: []byte("key-1")}, <-generic.C())
+	assert.Equal(t, 0, len(all.C()))
+	assert.Equal(t, 0, len(generic.C()))
+
+	all.Close()
+	_, ok = <-all.C()
+	assert.False(t, ok)
+	assert.Nil(t, db.Set([]byte("key-2"), nil))
+
+	t.Run("slow-consumer", func(t *testing.T) {
+		opts := DefaultOptions(filepath.Join("/tmp", "yoimiya-events"))
+		opts.PubSubBufferSize = 1
+		opts.SlowConsumerPolicy = pubsub.DisconnectSlowConsumer
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		defer destroyDB(db)
+
+		s := db.SubscribeEvents(EventAll)
+		assert.Nil(t, db.Set([]byte("k1"), nil))
+		assert.Nil(t, db.Set([]byte("k2"), nil))
+		assert.Equal(t, pubsub.ErrSlowConsumer, s.Err())
+		assert.Equal(t, []byte("k1"), (<-s.C()).Key)
+		_, ok := <-s.C()
+		assert.False(t, ok)
+		assert.Equal(t, 0, len(db.notifier.subs))
+	})
+}
+
+func TestYoimiyaDB_NotifyKeyspaceEvents(t *testing.T) {
+	hub := pubsub.NewHub(16, pubsub.DropMessages)
+	opts := DefaultOptions(filepath.Join("/tmp", "yoimiya"))
+	opts.PubSub = hub
+	opts.NotifyKeyspaceEvents = "KE$"
+	opts.DBIndex = 3
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	s := hub.NewSubscription()
+	defer s.Close()
+	s.PSubscribe("__key*@3__:*")
+
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v1")))
+	// generic events are not published without 'g'.
+	assert.Nil(t, db.Delete([]byte("k1")))
+
+	assert.ElementsMatch(t, []*pubsub.Message{
+		{Channel: "__keyspace@3__:k1", Pattern: "__key*@3__:*", Payload: []byte("set")},
+		{Channel: "__keyevent@3__:set", Pattern: "__key*@3__:*", Payload: []byte("k1")},
+	}, []*pubsub.Message{<-s.C(), <-s.C()})
+	assert.Equal(t, 0, len(s.C()))
+
+	opts.NotifyKeyspaceEvents = "Kq"
+	_, err = Open(opts)
+	assert.Equal(t, ErrInvalidKeyspaceEvents, err)
+}
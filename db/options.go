@@ -0,0 +1,160 @@
+package db
+
+import (
+	"time"
+	"yoimiya/ioselector"
+	"yoimiya/logfile"
+	"yoimiya/pubsub"
+)
+
+// DataIndexMode the data index mode.
+type DataIndexMode int
+
+const (
+	// KeyValueMemMode key and value are both in memory, read operation will be very fast in this mode.
+	// Because there is no disk seek, just get value from the corresponding data structures in memory.
+	// This mode is suitable for scenarios where the value are relatively small.
+	KeyValueMemMode DataIndexMode = iota
+
+	// KeyOnlyMemMode only key in memory, there is a disk seek while getting a value.
+	// Because values are in log file on disk.
+	KeyOnlyMemMode
+)
+
+// SyncPolicy decides when writes are synced to disk.
+type SyncPolicy int8
+
+const (
+	// SyncNone writes are never synced explicitly, the OS decides when to flush them.
+	// Recent writes may be lost if the machine crashes.
+	SyncNone SyncPolicy = iota
+
+	// SyncAlways every write is synced before it returns.
+	SyncAlways
+
+	// SyncGroup concurrent writes are synced together by one fsync, within GroupCommitInterval or GroupCommitSize.
+	// Every write blocks until it is synced.
+	SyncGroup
+
+	// SyncEverySec log files are synced every second in background, writes don't wait for it.
+	// At most one second of writes may be lost if the machine crashes.
+	SyncEverySec
+)
+
+// Options for opening a db.
+type Options struct {
+	// DBPath db path, will be created automatically if not exist.
+	DBPath string
+
+	// IndexMode mode of index, support KeyValueMemMode and KeyOnlyMemMode now.
+	// In KeyOnlyMemMode the index only holds fid, offset and entry size, values are read from log files.
+	// Default value is KeyOnlyMemMode.
+	IndexMode DataIndexMode
+
+	// IoType file r/w io type, support FileIo, MMap, DirectIO and MemIO now.
+	// DirectIO bypasses the page cache, it is useful for bulk loading which would evict the whole page cache otherwise.
+	// MemIO keeps log files in memory, it is for tests, hint files are not written in MemIO.
+	// Default value is FileIo.
+	IoType logfile.IOType
+
+	// SyncPolicy decides when to sync writes from the OS buffer cache through to actual disk.
+	// Support SyncNone, SyncAlways, SyncGroup and SyncEverySec now, see SyncPolicy for details.
+	// Note that if it is just the process that crashes (and the machine does not) then no writes will be lost.
+	// Default value is SyncNone.
+	SyncPolicy SyncPolicy
+
+	// GroupCommitInterval in SyncGroup policy, writes in this time window are synced together by one fsync.
+	// Default value is 2ms.
+	GroupCommitInterval time.Duration
+
+	// GroupCommitSize in SyncGroup policy, writes will be synced immediately once the pending bytes reach this size.
+	// Default value is 1MB.
+	GroupCommitSize int
+
+	// LogFileSizeThreshold threshold size of each log file, active log file will be closed if reach the threshold.
+	// This option must be set to the same value as the first startup.
+	// Default value is 512MB.
+	LogFileSizeThreshold int64
+
+	// ValueCacheSize max memory in bytes used by the value cache, which caches the values read from log files.
+	// It only takes effect in KeyOnlyMemMode, and the values returned by Get must not be modified when it is enabled.
+	// Default value is 0, means the value cache is disabled.
+	ValueCacheSize int64
+
+	// Compression the compression type of values, support logfile.NoCompression and logfile.FlateCompression now,
+	// other compressors can be registered by logfile.RegisterCompressor.
+	// Files written with any compression type can always be read, as long as the compressor is registered.
+	// Default value is logfile.NoCompression.
+	Compression logfile.CompressionType
+
+	// CompressionThreshold only values whose size is not less than the threshold will be compressed.
+	// Default value is 4KB.
+	CompressionThreshold int
+
+	// ValueChunkSize values larger than it are split into chunks of this size, so they can be larger than a log file.
+	// It is limited to half of LogFileSizeThreshold, since a chunk must fit into one log file.
+	// Default value is 1MB.
+	ValueChunkSize int
+
+	// Checksum the checksum type of entries in new log files, existing log files keep the type in their file header.
+	// Support logfile.ChecksumIEEE and logfile.ChecksumCRC32C now, ChecksumCRC32C is much faster with hardware acceleration.
+	// Default value is logfile.ChecksumCRC32C.
+	Checksum logfile.ChecksumType
+
+	// KeyProvider provides keys to encrypt the keys and values in log files with AES-GCM.
+	// New log files are encrypted by its current key, older ones are decrypted by the key saved in their file header.
+	// Hint files contain keys in plaintext, so they won't be used if KeyProvider is set.
+	// Default value is nil, means log files are not encrypted.
+	KeyProvider logfile.KeyProvider
+
+	// WrapIOSelector if it is not nil, the io selectors of log files are wrapped by it.
+	// It is for tests, e.g. ioselector.FaultInjector Wrap can simulate disk faults and crashes.
+	// Default value is nil.
+	WrapIOSelector func(ioselector.IOSelector) ioselector.IOSelector
+
+	// PubSub the hub of Publish and Subscribe, several dbs can share one hub like the dbs of a server.
+	// Default value is nil, means the db creates its own hub with PubSubBufferSize and SlowConsumerPolicy.
+	PubSub *pubsub.Hub
+
+	// PubSubBufferSize max number of messages buffered for each subscription, it is ignored if PubSub is set.
+	// Default value is 1024.
+	PubSubBufferSize int
+
+	// SlowConsumerPolicy decides what to do when the buffer of a subscription is full, it is ignored if PubSub is set.
+	// Support pubsub.DropMessages and pubsub.DisconnectSlowConsumer now.
+	// Default value is pubsub.DropMessages.
+	SlowConsumerPolicy pubsub.SlowConsumerPolicy
+
+	// NotifyKeyspaceEvents the classes of keyspace events published to pub/sub channels, in the format of redis.
+	// 'K' publishes to "__keyspace@<DBIndex>__:<key>" with the event name as the message,
+	// 'E' publishes to "__keyevent@<DBIndex>__:<event>" with the key as the message,
+	// and the classes are 'g' generic, '$' string, 'l' list, 's' set, 'h' hash, 'z' sorted set,
+	// 'x' expired, 'e' evicted, or 'A' for all of them, e.g. "KEA". See EventClass for details.
+	// SubscribeEvents receives events no matter what it is.
+	// Default value is empty, means no events are published.
+	NotifyKeyspaceEvents string
+
+	// DBIndex the number of the db in the channels of keyspace events, it is useful when several dbs share one PubSub.
+	// Default value is 0.
+	DBIndex int
+}
+
+// DefaultOptions default options for opening a YoimiyaDB.
+func DefaultOptions(path string) Options {
+	return Options{
+		DBPath:               path,
+		IndexMode:            KeyOnlyMemMode,
+		IoType:               logfile.FileIo,
+		SyncPolicy:           SyncNone,
+		GroupCommitInterval:  2 * time.Millisecond,
+		GroupCommitSize:      1 << 20,
+		LogFileSizeThreshold: 512 << 20,
+		ValueCacheSize:       0,
+		Compression:          logfile.NoCompression,
+		CompressionThreshold: 4 << 10,
+		ValueChunkSize:       1 << 20,
+		Checksum:             logfile.ChecksumCRC32C,
+		PubSubBufferSize:     pubsub.DefaultBufferSize,
+		SlowConsumerPolicy:   pubsub.DropMessages,
+	}
+}
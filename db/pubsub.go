@@ -0,0 +1,44 @@
+package db
+
+import "yoimiya/pubsub"
+
+// Publish publishes payload to channel, and returns the number of subscriptions which receive the message.
+// Messages are not persisted, only the subscriptions at the moment receive them.
+func (db *YoimiyaDB) Publish(channel string, payload []byte) int {
+	return db.pubSub.Publish(channel, payload)
+}
+
+// Subscribe creates a subscription of the channels.
+// You must call Close of the subscription after using it, more channels and patterns can be subscribed later.
+func (db *YoimiyaDB) Subscribe(channels ...string) *pubsub.Subscription {
+	s := db.pubSub.NewSubscription()
+	if len(channels) > 0 {
+		s.Subscribe(channels...)
+	}
+	return s
+}
+
+// PSubscribe creates a subscription of the glob patterns, see pubsub.Match for the syntax.
+// You must call Close of the subscription after using it.
+func (db *YoimiyaDB) PSubscribe(patterns ...string) *pubsub.Subscription {
+	s := db.pubSub.NewSubscription()
+	if len(patterns) > 0 {
+		s.PSubscribe(patterns...)
+	}
+	return s
+}
+
+// PubSubChannels returns the active channels which match pattern, all of them if pattern is empty.
+func (db *YoimiyaDB) PubSubChannels(pattern string) []string {
+	return db.pubSub.Channels(pattern)
+}
+
+// PubSubNumSub returns the numbers of subscriptions of channels, pattern subscriptions are not counted.
+func (db *YoimiyaDB) PubSubNumSub(channels ...string) []int {
+	return db.pubSub.NumSub(channels...)
+}
+
+// PubSubNumPat returns the number of patterns subscribed.
+func (db *YoimiyaDB) PubSubNumPat() int {
+	return db.pubSub.NumPat()
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"yoimiya/pubsub"
+)
+
+func TestYoimiyaDB_Publish(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.PubSubBufferSize = 1
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	s1 := db.Subscribe("invalidate")
+	defer s1.Close()
+	s2 := db.PSubscribe("inval*")
+	defer s2.Close()
+
+	assert.Equal(t, 2, db.Publish("invalidate", []byte("key-1")))
+	assert.Equal(t, &pubsub.Message{Channel: "invalidate", Payload: []byte("key-1")}, <-s1.C())
+	assert.Equal(t, &pubsub.Message{Channel: "invalidate", Pattern: "inval*", Payload: []byte("key-1")}, <-s2.C())
+
+	// the buffer of one message is full, the second one is dropped.
+	assert.Equal(t, 2, db.Publish("invalidate", []byte("key-2")))
+	assert.Equal(t, 0, db.Publish("invalidate", []byte("key-3")))
+	assert.Equal(t, uint64(1), s1.Dropped())
+
+	assert.Equal(t, []string{"invalidate"}, db.PubSubChannels(""))
+	assert.Equal(t, []int{1, 0}, db.PubSubNumSub("invalidate", "other"))
+	assert.Equal(t, 1, db.PubSubNumPat())
+
+	t.Run("shared-hub", func(t *testing.T) {
+		hub := pubsub.NewHub(16, pubsub.DisconnectSlowConsumer)
+		opts := DefaultOptions(filepath.Join("/tmp", "yoimiya-pubsub"))
+		opts.PubSub = hub
+		other, err := Open(opts)
+		assert.Nil(t, err)
+		defer destroyDB(other)
+
+		s := hub.NewSubscription()
+		defer s.Close()
+		s.Subscribe("ch")
+		assert.Equal(t, 1, other.Publish("ch", nil))
+		assert.Equal(t, 0, db.Publish("ch", nil))
+	})
+}
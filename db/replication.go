@@ -0,0 +1,716 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"yoimiya/cache"
+	"yoimiya/ds"
+	"yoimiya/logfile"
+	"yoimiya/logger"
+)
+
+var (
+	// ErrReadOnly the db is a follower, it only accepts writes from its leader.
+	ErrReadOnly = errors.New("db is read only since it is a follower")
+
+	// ErrReplicationOutOfSync the log entries from leader don't follow the log files of follower.
+	ErrReplicationOutOfSync = errors.New("replication is out of sync with leader")
+
+	// ErrInvalidReplicationFrame the data from leader can't be parsed.
+	ErrInvalidReplicationFrame = errors.New("invalid replication frame")
+)
+
+const (
+	// replicationFrameSize max size of log entries in a data frame, a larger entry is sent in its own frame.
+	replicationFrameSize = 1 << 20
+
+	// replicationHeartbeat interval of heartbeats from leader,
+	// follower reconnects if nothing is received in three intervals.
+	replicationHeartbeat = time.Second
+
+	// replicationRetryInterval follower waits for it before reconnecting to leader.
+	replicationRetryInterval = time.Second
+
+	// replicationDialTimeout timeout of connecting to leader.
+	replicationDialTimeout = 5 * time.Second
+)
+
+// frame types of the replication stream, a frame is encoded as type(1) + payload size(4) + payload.
+const (
+	// frameFullSync payload: replication id. The follower drops its log files, which are sent again from the beginning.
+	frameFullSync byte = iota + 1
+
+	// frameContinue payload: replication id. The follower continues from its positions.
+	frameContinue
+
+	// frameFile payload: data type(1) + fid(4) + file header. The follower opens a new log file with the header.
+	frameFile
+
+	// frameData payload: data type(1) + fid(4) + offset(8) + log entries. The follower appends the entries.
+	frameData
+
+	// frameHeartbeat payload: (fid(4) + offset(8)) of every data type, the latest positions of leader.
+	frameHeartbeat
+
+	// frameSnapshotEnd payload: (fid(4) + offset(8)) of every data type, the positions of a snapshot.
+	// It ends a snapshot written by WriteSnapshot.
+	frameSnapshotEnd
+)
+
+// ReplicationInfo is the replication status of a db.
+type ReplicationInfo struct {
+	// ID the replication id which identifies the history of log files, a follower has the id of its leader.
+	ID string
+
+	// Leader the address of leader, it is empty if the db is not a follower.
+	Leader string
+
+	// Connected whether the follower is connected to its leader.
+	Connected bool
+
+	// LastContact the last time the follower received anything from its leader.
+	LastContact time.Time
+
+	// LagBytes how many bytes of log entries the follower is behind its leader, as of the last heartbeat.
+	LagBytes int64
+
+	// Followers the number of followers connected to the db.
+	Followers int
+
+	// FullSyncs the number of full syncs the db has done as a follower since it is opened.
+	FullSyncs int
+}
+
+// replication is the replication state of a db.
+type replication struct {
+	mu          sync.Mutex
+	id          string
+	leader      string
+	stop        chan struct{} // closed to stop following.
+	done        chan struct{} // closed when the follower goroutine exits.
+	connected   bool
+	lastContact time.Time
+	leaderPos   []Position // positions of leader in the last heartbeat.
+	followers   int
+	fullSyncs   int
+}
+
+// replicaCursor is the position of a data type sent to a follower.
+type replicaCursor struct {
+	pos    Position
+	opened bool // the follower has the log file of pos.
+}
+
+// ReplicationID returns the replication id of db, it is created if the db has never been a leader or follower.
+func (db *YoimiyaDB) ReplicationID() (string, error) {
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	if db.repl.id == "" {
+		if err := db.newReplicationIDLocked(); err != nil {
+			return "", err
+		}
+	}
+	return db.repl.id, nil
+}
+
+// ReplicationInfo returns the replication status of db.
+func (db *YoimiyaDB) ReplicationInfo() ReplicationInfo {
+	db.repl.mu.Lock()
+	info := ReplicationInfo{
+		ID:          db.repl.id,
+		Leader:      db.repl.leader,
+		Connected:   db.repl.connected,
+		LastContact: db.repl.lastContact,
+		Followers:   db.repl.followers,
+		FullSyncs:   db.repl.fullSyncs,
+	}
+	leaderPos := db.repl.leaderPos
+	db.repl.mu.Unlock()
+
+	for dataType, pos := range leaderPos {
+		info.LagBytes += db.logDistance(pos, db.LatestPosition(DataType(dataType)))
+	}
+	return info
+}
+
+// logDistance returns the bytes from b to a, the log files between them are counted as full.
+func (db *YoimiyaDB) logDistance(a, b Position) int64 {
+	switch {
+	case a.Fid == b.Fid && a.Offset > b.Offset:
+		return a.Offset - b.Offset
+	case a.Fid > b.Fid:
+		threshold := db.opts.LogFileSizeThreshold
+		return threshold - b.Offset + int64(a.Fid-b.Fid-1)*threshold + a.Offset
+	}
+	return 0
+}
+
+// ServeFollower streams the log files to a follower, which has the log files of replID up to positions,
+// the positions are indexed by DataType. Log entries are sent as they are in log files,
+// so the log files of follower are the same as the leader, including the positions.
+// If the follower can't continue from its positions, e.g. it is new or followed another leader,
+// it is told to do a full sync, and all the log files are sent from the beginning.
+// It blocks until ctx is done, the db is closed or writing to w fails.
+// The other side is Follow, package server serves it by the REPLSYNC command.
+func (db *YoimiyaDB) ServeFollower(ctx context.Context, w io.Writer, replID string, positions []Position) error {
+	id, err := db.ReplicationID()
+	if err != nil {
+		return err
+	}
+	db.repl.mu.Lock()
+	db.repl.followers++
+	db.repl.mu.Unlock()
+	defer func() {
+		db.repl.mu.Lock()
+		db.repl.followers--
+		db.repl.mu.Unlock()
+	}()
+
+	bw := bufio.NewWriter(w)
+	cursors := make([]replicaCursor, logFileTypeNum)
+	if replID == id && db.validPositions(positions) {
+		for i := range cursors {
+			cursors[i] = replicaCursor{pos: positions[i], opened: positions[i].Offset > 0}
+		}
+		err = writeFrame(bw, frameContinue, []byte(id))
+	} else {
+		err = writeFrame(bw, frameFullSync, []byte(id))
+	}
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(replicationHeartbeat)
+	defer ticker.Stop()
+	var lastBeat time.Time
+	unreported := true // data is sent since the last heartbeat.
+	for {
+		if db.isClosed() {
+			return ErrDBClosed
+		}
+		// get the signal before reading, so that a write after reading can't be missed.
+		wait := db.changes.wait()
+		var sent bool
+		for i := range cursors {
+			ok, err := db.sendLogRange(bw, DataType(i), &cursors[i], nil)
+			if err != nil {
+				return err
+			}
+			sent = sent || ok
+		}
+		unreported = unreported || sent
+		// heartbeat when caught up, or every interval during a long sync.
+		if (!sent && unreported) || time.Since(lastBeat) >= replicationHeartbeat {
+			if err := db.sendHeartbeat(bw); err != nil {
+				return err
+			}
+			lastBeat, unreported = time.Now(), false
+		}
+		if sent {
+			continue
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		select {
+		case <-wait:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// validPositions checks whether a follower can continue from positions.
+func (db *YoimiyaDB) validPositions(positions []Position) bool {
+	if len(positions) != logFileTypeNum {
+		return false
+	}
+	for dataType, pos := range positions {
+		if pos == (Position{}) {
+			continue
+		}
+		lf, writeAt := db.changeLogFile(DataType(dataType), pos.Fid)
+		if lf == nil || pos.Offset < lf.HeaderSize() || (writeAt >= 0 && pos.Offset > writeAt) {
+			return false
+		}
+	}
+	return true
+}
+
+// sendLogRange sends the next file header or log entries of dataType after the cursor,
+// it reports whether there is anything sent. If limit is not nil, nothing after it is sent.
+func (db *YoimiyaDB) sendLogRange(bw *bufio.Writer, dataType DataType, c *replicaCursor, limit *Position) (bool, error) {
+	lf, writeAt := db.changeLogFile(dataType, c.pos.Fid)
+	if lf == nil {
+		fids := db.logFileIds(dataType)
+		if len(fids) == 0 {
+			return false, nil
+		}
+		next, ok := nextFid(fids, c.pos.Fid)
+		if !ok || c.opened || (limit != nil && next > limit.Fid) {
+			return false, ErrPositionUnavailable
+		}
+		c.pos = Position{Fid: next}
+		if lf, writeAt = db.changeLogFile(dataType, next); lf == nil {
+			return false, ErrPositionUnavailable
+		}
+	}
+	if limit != nil && lf.Fid == limit.Fid {
+		writeAt = limit.Offset
+	}
+
+	prefix := make([]byte, 13)
+	prefix[0] = byte(dataType)
+	binary.BigEndian.PutUint32(prefix[1:5], lf.Fid)
+	if !c.opened {
+		header, err := lf.Read(0, uint32(lf.HeaderSize()))
+		if err != nil {
+			return false, err
+		}
+		c.pos.Offset, c.opened = lf.HeaderSize(), true
+		return true, writeFrame(bw, frameFile, prefix[:5], header)
+	}
+
+	// entries beyond WriteAt of the active log file may be being written.
+	end := c.pos.Offset
+	for end-c.pos.Offset < replicationFrameSize && (writeAt < 0 || end < writeAt) {
+		size, err := lf.ReadEntrySize(end)
+		if err == io.EOF || err == logfile.ErrEndOfEntry {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		end += size
+	}
+	if end > c.pos.Offset {
+		data, err := lf.Read(c.pos.Offset, uint32(end-c.pos.Offset))
+		if err != nil {
+			return false, err
+		}
+		binary.BigEndian.PutUint64(prefix[5:13], uint64(c.pos.Offset))
+		c.pos.Offset = end
+		return true, writeFrame(bw, frameData, prefix, data)
+	}
+
+	// the end of an archived log file, the follower opens the next one.
+	if writeAt >= 0 {
+		return false, nil
+	}
+	next, ok := nextFid(db.logFileIds(dataType), c.pos.Fid)
+	if !ok || (limit != nil && next > limit.Fid) {
+		return false, nil
+	}
+	c.pos, c.opened = Position{Fid: next}, false
+	return true, nil
+}
+
+func (db *YoimiyaDB) sendHeartbeat(bw *bufio.Writer) error {
+	positions := make([]Position, logFileTypeNum)
+	for i := range positions {
+		positions[i] = db.LatestPosition(DataType(i))
+	}
+	return writeFrame(bw, frameHeartbeat, encodePositions(positions))
+}
+
+// Follow makes the db a read-only follower of the leader at addr, which is a yoimiya-server,
+// and dbIndex is the index of the db to follow on the server. It returns at once, and syncs in background:
+// the log files of leader are copied first, then new log entries are streamed as they are written.
+// It reconnects after failures, and continues from its log files, until StopFollowing or Close is called.
+// The follower must be opened with the same LogFileSizeThreshold and KeyProvider as the leader.
+func (db *YoimiyaDB) Follow(addr string, dbIndex int) {
+	db.stopFollowing()
+	stop, done := make(chan struct{}), make(chan struct{})
+	db.repl.mu.Lock()
+	db.repl.leader, db.repl.stop, db.repl.done = addr, stop, done
+	db.repl.leaderPos = nil
+	db.repl.mu.Unlock()
+	atomic.StoreUint32(&db.readOnly, 1)
+	go db.follow(addr, dbIndex, stop, done)
+}
+
+// StopFollowing stops following the leader and makes the db writable, it is a no-op if the db is not a follower.
+// The db gets a new replication id, since its log files will diverge from the leader.
+func (db *YoimiyaDB) StopFollowing() error {
+	if !db.stopFollowing() {
+		return nil
+	}
+	atomic.StoreUint32(&db.readOnly, 0)
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	return db.newReplicationIDLocked()
+}
+
+// stopFollowing stops the follower goroutine, and reports whether the db was a follower.
+func (db *YoimiyaDB) stopFollowing() bool {
+	db.repl.mu.Lock()
+	stop, done := db.repl.stop, db.repl.done
+	db.repl.leader, db.repl.stop, db.repl.done = "", nil, nil
+	db.repl.connected, db.repl.leaderPos = false, nil
+	db.repl.mu.Unlock()
+	if stop == nil {
+		return false
+	}
+	close(stop)
+	<-done
+	return true
+}
+
+func (db *YoimiyaDB) follow(addr string, dbIndex int, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		err := db.syncFromLeader(addr, dbIndex, stop)
+		db.repl.mu.Lock()
+		db.repl.connected = false
+		db.repl.mu.Unlock()
+		if err == ErrReplicationOutOfSync {
+			// a full sync is needed, forget the replication id.
+			if err := db.setReplicationID(""); err != nil {
+				logger.Error("reset replication id err: %v", err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		logger.Warn("replication from %s err: %v, retrying in %v", addr, err, replicationRetryInterval)
+		select {
+		case <-stop:
+			return
+		case <-time.After(replicationRetryInterval):
+		}
+	}
+}
+
+// syncFromLeader connects to leader and applies the replication stream, until it fails or stop is closed.
+func (db *YoimiyaDB) syncFromLeader(addr string, dbIndex int, stop chan struct{}) error {
+	nc, err := net.DialTimeout("tcp", addr, replicationDialTimeout)
+	if err != nil {
+		return err
+	}
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-stop:
+		case <-finished:
+		}
+		_ = nc.Close()
+	}()
+
+	db.repl.mu.Lock()
+	args := []string{"REPLSYNC", strconv.Itoa(dbIndex), db.repl.id}
+	db.repl.mu.Unlock()
+	for i := 0; i < logFileTypeNum; i++ {
+		pos := db.LatestPosition(DataType(i))
+		args = append(args, strconv.FormatUint(uint64(pos.Fid), 10), strconv.FormatInt(pos.Offset, 10))
+	}
+	var req strings.Builder
+	fmt.Fprintf(&req, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&req, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_ = nc.SetWriteDeadline(time.Now().Add(replicationDialTimeout))
+	if _, err := io.WriteString(nc, req.String()); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(nc)
+	for {
+		_ = nc.SetReadDeadline(time.Now().Add(3 * replicationHeartbeat))
+		// the leader replies an error in RESP if the request is rejected.
+		if b, err := br.Peek(1); err == nil && b[0] == '-' {
+			line, _ := br.ReadString('\n')
+			return errors.New(strings.TrimSpace(line[1:]))
+		}
+		// a data frame may exceed replicationFrameSize by one entry, which is smaller than a log file.
+		typ, payload, err := readFrame(br, replicationFrameSize+db.opts.LogFileSizeThreshold)
+		if err != nil {
+			return err
+		}
+		if err := db.applyFrame(typ, payload); err != nil {
+			return err
+		}
+	}
+}
+
+func (db *YoimiyaDB) applyFrame(typ byte, payload []byte) error {
+	db.repl.mu.Lock()
+	db.repl.lastContact = time.Now()
+	db.repl.mu.Unlock()
+
+	switch typ {
+	case frameFullSync:
+		if err := db.dropLogFiles(); err != nil {
+			return err
+		}
+		if err := db.setReplicationID(string(payload)); err != nil {
+			return err
+		}
+		db.repl.mu.Lock()
+		db.repl.fullSyncs++
+		db.repl.mu.Unlock()
+		db.setConnected()
+	case frameContinue:
+		db.repl.mu.Lock()
+		id := db.repl.id
+		db.repl.mu.Unlock()
+		if id != string(payload) {
+			return ErrReplicationOutOfSync
+		}
+		db.setConnected()
+	case frameFile:
+		if len(payload) < 5 || int(payload[0]) >= logFileTypeNum {
+			return ErrInvalidReplicationFrame
+		}
+		return db.applyLogFile(DataType(payload[0]), binary.BigEndian.Uint32(payload[1:5]), payload[5:])
+	case frameData:
+		if len(payload) < 13 || int(payload[0]) >= logFileTypeNum {
+			return ErrInvalidReplicationFrame
+		}
+		fid, offset := binary.BigEndian.Uint32(payload[1:5]), int64(binary.BigEndian.Uint64(payload[5:13]))
+		return db.applyLogEntries(DataType(payload[0]), fid, offset, payload[13:])
+	case frameHeartbeat:
+		positions, err := decodePositions(payload)
+		if err != nil {
+			return err
+		}
+		db.repl.mu.Lock()
+		db.repl.leaderPos = positions
+		db.repl.mu.Unlock()
+	default:
+		return ErrInvalidReplicationFrame
+	}
+	return nil
+}
+
+func (db *YoimiyaDB) setConnected() {
+	db.repl.mu.Lock()
+	db.repl.connected = true
+	db.repl.mu.Unlock()
+}
+
+// applyLogFile archives the active log file and opens the log file of fid with the header from leader.
+func (db *YoimiyaDB) applyLogFile(dataType DataType, fid uint32, header []byte) error {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+	active := db.getActiveLogFile(dataType)
+	if active != nil && active.Fid >= fid {
+		return ErrReplicationOutOfSync
+	}
+	if active != nil {
+		if err := active.Sync(); err != nil {
+			return err
+		}
+	}
+	_, err := db.rotateLogFile(dataType, active, fid, header)
+	return err
+}
+
+// applyLogEntries appends the log entries from leader to the active log file, and updates indexes.
+func (db *YoimiyaDB) applyLogEntries(dataType DataType, fid uint32, offset int64, data []byte) error {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+	lf := db.getActiveLogFile(dataType)
+	if lf == nil || lf.Fid != fid || atomic.LoadInt64(&lf.WriteAt) != offset {
+		return ErrReplicationOutOfSync
+	}
+	if err := lf.Write(data); err != nil {
+		return err
+	}
+	for end := offset + int64(len(data)); offset < end; {
+		entry, esize, err := lf.ReadLogEntry(offset)
+		if err != nil {
+			return err
+		}
+		existed := dataType == String && db.strIndex.idxTree.Get(entry.Key) != nil
+		db.buildIndex(dataType, entry, &valuePos{fid: fid, offset: offset, entrySize: int(esize)})
+		db.notifyApplied(dataType, entry, existed)
+		offset += esize
+	}
+	switch {
+	case db.opts.SyncPolicy == SyncAlways:
+		if err := lf.Sync(); err != nil {
+			return err
+		}
+	case db.syncer != nil:
+		// writes of leader are not waited for.
+		db.syncer.add(lf, len(data))
+	}
+	db.changes.broadcast()
+	return nil
+}
+
+// notifyApplied emits the keyspace event of a log entry from leader, which is the same as the event on leader.
+// existed reports whether the key existed before the entry is applied, deleting a key which does not exist emits nothing.
+func (db *YoimiyaDB) notifyApplied(dataType DataType, ent *logfile.LogEntry, existed bool) {
+	if dataType != String {
+		return
+	}
+	switch ent.Type {
+	case logfile.TypeDelete:
+		if existed {
+			db.notify(EventGeneric, "del", ent.Key)
+		}
+	case logfile.TypeChunk:
+		// chunks are a part of the large value, the event is emitted with its manifest.
+	default:
+		db.notify(EventString, "set", ent.Key)
+	}
+}
+
+// dropLogFiles deletes all log files and indexes before a full sync.
+func (db *YoimiyaDB) dropLogFiles() error {
+	db.hintWg.Wait()
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+	// nothing is written to log files since the lock of index is held, so no more dirty files.
+	if db.syncer != nil {
+		_ = db.syncer.flush()
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for dataType, lf := range db.activeLogFiles {
+		if err := lf.Delete(); err != nil {
+			return err
+		}
+		delete(db.activeLogFiles, dataType)
+	}
+	for dataType, archived := range db.archivedLogFiles {
+		for fid, lf := range archived {
+			if err := lf.Delete(); err != nil {
+				return err
+			}
+			if err := logfile.DeleteHintFile(db.opts.DBPath, fid, logfile.FileType(dataType)); err != nil {
+				return err
+			}
+			delete(archived, fid)
+		}
+	}
+	db.strIndex.idxTree = ds.NewART()
+	// the values are cached by their positions, which will be reused.
+	if db.valueCache != nil {
+		db.valueCache = cache.NewLRUCache(db.opts.ValueCacheSize, cache.DefaultShardNum)
+	}
+	return nil
+}
+
+// loadReplicationID reads the replication id saved in db path, it is fine if the file doesn't exist.
+func (db *YoimiyaDB) loadReplicationID() error {
+	if db.opts.IoType == logfile.MemIO {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(db.opts.DBPath, replicationFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	db.repl.id = strings.TrimSpace(string(data))
+	return nil
+}
+
+func (db *YoimiyaDB) newReplicationIDLocked() error {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	return db.setReplicationIDLocked(hex.EncodeToString(buf))
+}
+
+func (db *YoimiyaDB) setReplicationID(id string) error {
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	return db.setReplicationIDLocked(id)
+}
+
+// setReplicationIDLocked saves the replication id in db path, the lock of replication must be held.
+func (db *YoimiyaDB) setReplicationIDLocked(id string) error {
+	if db.opts.IoType != logfile.MemIO {
+		path := filepath.Join(db.opts.DBPath, replicationFile)
+		if err := os.WriteFile(path+".tmp", []byte(id), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	db.repl.id = id
+	return nil
+}
+
+// encodePositions encodes the positions indexed by DataType, each is fid(4) + offset(8).
+func encodePositions(positions []Position) []byte {
+	buf := make([]byte, 12*len(positions))
+	for i, pos := range positions {
+		binary.BigEndian.PutUint32(buf[12*i:], pos.Fid)
+		binary.BigEndian.PutUint64(buf[12*i+4:], uint64(pos.Offset))
+	}
+	return buf
+}
+
+func decodePositions(buf []byte) ([]Position, error) {
+	if len(buf) != 12*logFileTypeNum {
+		return nil, ErrInvalidReplicationFrame
+	}
+	positions := make([]Position, logFileTypeNum)
+	for i := range positions {
+		positions[i].Fid = binary.BigEndian.Uint32(buf[12*i:])
+		positions[i].Offset = int64(binary.BigEndian.Uint64(buf[12*i+4:]))
+	}
+	return positions, nil
+}
+
+func writeFrame(bw *bufio.Writer, typ byte, payload ...[]byte) error {
+	var size int
+	for _, p := range payload {
+		size += len(p)
+	}
+	header := make([]byte, 5)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(size))
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	for _, p := range payload {
+		if _, err := bw.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFrame reads a frame whose payload is not larger than maxSize.
+func readFrame(br *bufio.Reader, maxSize int64) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if int64(size) > maxSize {
+		return 0, nil, ErrInvalidReplicationFrame
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
@@ -0,0 +1,238 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveLeader serves the REPLSYNC requests of followers on ln, like package server does.
+func serveLeader(leader *YoimiyaDB, ln net.Listener) {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer nc.Close()
+			args, err := readRequest(bufio.NewReader(nc))
+			if err != nil || len(args) < 3 {
+				return
+			}
+			var positions []Position
+			for i := 3; i+1 < len(args); i += 2 {
+				fid, _ := strconv.ParseUint(args[i], 10, 32)
+				offset, _ := strconv.ParseInt(args[i+1], 10, 64)
+				positions = append(positions, Position{Fid: uint32(fid), Offset: offset})
+			}
+			_ = leader.ServeFollower(context.Background(), nc, args[2], positions)
+		}()
+	}
+}
+
+// readRequest reads a RESP array of bulk strings.
+func readRequest(br *bufio.Reader) ([]string, error) {
+	readSize := func(prefix byte) (int, error) {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if len(line) < 3 || line[0] != prefix {
+			return 0, ErrInvalidReplicationFrame
+		}
+		return strconv.Atoi(strings.TrimSpace(line[1:]))
+	}
+	n, err := readSize('*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readSize('$')
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// trackingListener records the accepted connections, so that they can be closed to break the links.
+type trackingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	nc, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, nc)
+		l.mu.Unlock()
+	}
+	return nc, err
+}
+
+func (l *trackingListener) closeConns() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, nc := range l.conns {
+		_ = nc.Close()
+	}
+	l.conns = nil
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition is not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// caughtUp reports whether follower has the same log files as leader.
+func caughtUp(leader, follower *YoimiyaDB) bool {
+	for i := 0; i < logFileTypeNum; i++ {
+		if leader.LatestPosition(DataType(i)) != follower.LatestPosition(DataType(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestYoimiyaDB_Follow(t *testing.T) {
+	leaderOpts := DefaultOptions(filepath.Join("/tmp", "yoimiya-leader"))
+	leaderOpts.LogFileSizeThreshold = 256
+	leader, err := Open(leaderOpts)
+	assert.Nil(t, err)
+	defer destroyDB(leader)
+	followerOpts := DefaultOptions(filepath.Join("/tmp", "yoimiya-follower"))
+	followerOpts.LogFileSizeThreshold = 256
+	follower, err := Open(followerOpts)
+	assert.Nil(t, err)
+	defer destroyDB(follower)
+
+	// the data of follower is dropped by the full sync.
+	assert.Nil(t, follower.Set([]byte("stale"), []byte("v")))
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, leader.Set(GetKey(i), GetValue16B(i)))
+	}
+	assert.Greater(t, len(leader.logFileIds(String)), 1)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go serveLeader(leader, ln)
+
+	follower.Follow(ln.Addr().String(), 0)
+	waitFor(t, func() bool { return caughtUp(leader, follower) })
+	for i := 0; i < 20; i++ {
+		value, err := follower.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetValue16B(i), value)
+	}
+	_, err = follower.Get([]byte("stale"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, ErrReadOnly, follower.Set([]byte("k"), []byte("v")))
+
+	leaderID, err := leader.ReplicationID()
+	assert.Nil(t, err)
+	waitFor(t, func() bool {
+		info := follower.ReplicationInfo()
+		return info.Connected && info.LagBytes == 0
+	})
+	info := follower.ReplicationInfo()
+	assert.Equal(t, leaderID, info.ID)
+	assert.Equal(t, ln.Addr().String(), info.Leader)
+	assert.Equal(t, 1, leader.ReplicationInfo().Followers)
+
+	t.Run("stream", func(t *testing.T) {
+		events := follower.SubscribeEvents(EventAll)
+		defer events.Close()
+		assert.Nil(t, leader.Set([]byte("k1"), []byte("v1")))
+		assert.Nil(t, leader.Delete(GetKey(0)))
+		assert.Nil(t, leader.Delete([]byte("missing")))
+		waitFor(t, func() bool { return caughtUp(leader, follower) })
+		value, err := follower.Get([]byte("k1"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1"), value)
+		_, err = follower.Get(GetKey(0))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// the same events as leader.
+		assert.Equal(t, &Event{Name: "set", Class: EventString, Key: []byte("k1")}, <-events.C())
+		assert.Equal(t, &Event{Name: "del", Class: EventGeneric, Key: GetKey(0)}, <-events.C())
+		assert.Equal(t, 0, len(events.C()))
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		assert.Nil(t, ln.Close())
+		assert.Nil(t, follower.StopFollowing())
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		defer ln.Close()
+		go serveLeader(leader, ln)
+		assert.Nil(t, leader.Set([]byte("k2"), []byte("v2")))
+		fullSyncs := follower.ReplicationInfo().FullSyncs
+
+		follower.Follow(ln.Addr().String(), 0)
+		// the id was changed by StopFollowing, so it is a full sync.
+		waitFor(t, func() bool { return caughtUp(leader, follower) })
+		assert.Equal(t, leaderID, follower.ReplicationInfo().ID)
+		assert.Equal(t, fullSyncs+1, follower.ReplicationInfo().FullSyncs)
+
+		// with the same id, the follower continues from its log files after reconnecting.
+		fullSyncs = follower.ReplicationInfo().FullSyncs
+		assert.Nil(t, follower.StopFollowing())
+		assert.Nil(t, follower.setReplicationID(leaderID))
+		assert.Nil(t, leader.Set([]byte("k3"), []byte("v3")))
+		follower.Follow(ln.Addr().String(), 0)
+		waitFor(t, func() bool { return caughtUp(leader, follower) })
+		value, err := follower.Get([]byte("k3"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v3"), value)
+		assert.Equal(t, fullSyncs, follower.ReplicationInfo().FullSyncs)
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		tl := &trackingListener{Listener: ln}
+		defer tl.Close()
+		go serveLeader(leader, tl)
+		follower.Follow(ln.Addr().String(), 0)
+		waitFor(t, func() bool { return caughtUp(leader, follower) && follower.ReplicationInfo().Connected })
+		fullSyncs := follower.ReplicationInfo().FullSyncs
+
+		// the link is broken while both of them are up, the follower reconnects and continues.
+		tl.closeConns()
+		assert.Nil(t, leader.Set([]byte("k5"), []byte("v5")))
+		waitFor(t, func() bool { return caughtUp(leader, follower) })
+		value, err := follower.Get([]byte("k5"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v5"), value)
+		assert.Equal(t, fullSyncs, follower.ReplicationInfo().FullSyncs)
+		assert.Equal(t, leaderID, follower.ReplicationInfo().ID)
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		assert.Nil(t, follower.StopFollowing())
+		assert.Equal(t, "", follower.ReplicationInfo().Leader)
+		assert.NotEqual(t, leaderID, follower.ReplicationInfo().ID)
+		assert.Nil(t, follower.Set([]byte("k4"), []byte("v4")))
+	})
+}
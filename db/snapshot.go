@@ -0,0 +1,103 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ErrInvalidSnapshot the snapshot can't be restored, it is truncated or doesn't match its positions.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// SnapshotPositions syncs the log files, and returns the latest positions of all data types indexed by DataType.
+// Log files are append only, so the log entries up to the positions are a snapshot of the current db,
+// which can be written by WriteSnapshot at any time later, while the db is still being written.
+func (db *YoimiyaDB) SnapshotPositions() ([]Position, error) {
+	if err := db.Sync(); err != nil {
+		return nil, err
+	}
+	positions := make([]Position, logFileTypeNum)
+	for i := range positions {
+		positions[i] = db.LatestPosition(DataType(i))
+	}
+	return positions, nil
+}
+
+// WriteSnapshot writes the log files up to positions returned by SnapshotPositions to w.
+// The snapshot is in the same format as the replication stream, and can be restored by RestoreSnapshot.
+func (db *YoimiyaDB) WriteSnapshot(w io.Writer, positions []Position) error {
+	if len(positions) != logFileTypeNum {
+		return ErrInvalidSnapshot
+	}
+	bw := bufio.NewWriter(w)
+	for i := range positions {
+		// no log file of the data type when the snapshot was taken.
+		if positions[i] == (Position{}) {
+			continue
+		}
+		c := replicaCursor{}
+		for {
+			sent, err := db.sendLogRange(bw, DataType(i), &c, &positions[i])
+			if err != nil {
+				return err
+			}
+			if !sent {
+				break
+			}
+		}
+		if c.pos != positions[i] {
+			return ErrPositionUnavailable
+		}
+	}
+	if err := writeFrame(bw, frameSnapshotEnd, encodePositions(positions)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// RestoreSnapshot replaces all log files and indexes of db with the snapshot written by WriteSnapshot,
+// an empty snapshot leaves the db empty. It must not be called while the db is being written.
+// If it fails, the db is left with part of the snapshot, and should be restored again.
+func (db *YoimiyaDB) RestoreSnapshot(r io.Reader) error {
+	if err := db.dropLogFiles(); err != nil {
+		return err
+	}
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err == io.EOF {
+		return nil
+	}
+	for {
+		typ, payload, err := readFrame(br, replicationFrameSize+db.opts.LogFileSizeThreshold)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrInvalidSnapshot
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case typ == frameFile && len(payload) >= 5 && int(payload[0]) < logFileTypeNum:
+			err = db.applyLogFile(DataType(payload[0]), binary.BigEndian.Uint32(payload[1:5]), payload[5:])
+		case typ == frameData && len(payload) >= 13 && int(payload[0]) < logFileTypeNum:
+			fid, offset := binary.BigEndian.Uint32(payload[1:5]), int64(binary.BigEndian.Uint64(payload[5:13]))
+			err = db.applyLogEntries(DataType(payload[0]), fid, offset, payload[13:])
+		case typ == frameSnapshotEnd:
+			positions, err := decodePositions(payload)
+			if err != nil {
+				return err
+			}
+			for i, pos := range positions {
+				if db.LatestPosition(DataType(i)) != pos {
+					return ErrInvalidSnapshot
+				}
+			}
+			return db.Sync()
+		default:
+			return ErrInvalidSnapshot
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
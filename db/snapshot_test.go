@@ -0,0 +1,51 @@
+package db
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestYoimiyaDB_Snapshot(t *testing.T) {
+	opts := DefaultOptions(filepath.Join("/tmp", "yoimiya-snapshot-src"))
+	opts.LogFileSizeThreshold = 256
+	src, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(src)
+	dstOpts := DefaultOptions(filepath.Join("/tmp", "yoimiya-snapshot-dst"))
+	dstOpts.LogFileSizeThreshold = 256
+	dst, err := Open(dstOpts)
+	assert.Nil(t, err)
+	defer destroyDB(dst)
+
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, src.Set(GetKey(i), GetValue16B(i)))
+	}
+	assert.Nil(t, src.Delete(GetKey(0)))
+	positions, err := src.SnapshotPositions()
+	assert.Nil(t, err)
+	// the writes after taking the snapshot are not in it.
+	assert.Nil(t, src.Set([]byte("later"), []byte("v")))
+	assert.Nil(t, dst.Set([]byte("stale"), []byte("v")))
+
+	var buf bytes.Buffer
+	assert.Nil(t, src.WriteSnapshot(&buf, positions))
+	data := buf.Bytes()
+	assert.Nil(t, dst.RestoreSnapshot(bytes.NewReader(data)))
+	for i := 1; i < 20; i++ {
+		value, err := dst.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetValue16B(i), value)
+	}
+	for _, key := range [][]byte{GetKey(0), []byte("later"), []byte("stale")} {
+		_, err = dst.Get(key)
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	assert.Equal(t, positions[String], dst.LatestPosition(String))
+	assert.Nil(t, dst.Set([]byte("k"), []byte("v")))
+
+	assert.Equal(t, ErrInvalidSnapshot, dst.RestoreSnapshot(bytes.NewReader(data[:len(data)-1])))
+	assert.Nil(t, dst.RestoreSnapshot(bytes.NewReader(nil)))
+	assert.Empty(t, dst.Keys(nil, nil, 1))
+}
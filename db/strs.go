@@ -0,0 +1,127 @@
+package db
+
+import (
+	"bytes"
+	"yoimiya/logfile"
+)
+
+// Set set key to hold the string value. If key already holds a value, it is overwritten.
+// Values larger than ValueChunkSize are written in chunks, see SetFromReader.
+func (db *YoimiyaDB) Set(key, value []byte) error {
+	_, err := db.SetIf(key, value, nil)
+	return err
+}
+
+// SetIf set key to hold the string value if cond returns true, and reports whether the value is set.
+// cond is called with the current value of key, or nil and false if key does not exist.
+// No other write of strings can happen between calling cond and writing the value, so it can be used for compare-and-set.
+// A nil cond is always true.
+func (db *YoimiyaDB) SetIf(key, value []byte, cond func(old []byte, exist bool) bool) (bool, error) {
+	if len(value) > db.chunkSize() {
+		return db.setFromReader(key, bytes.NewReader(value), cond)
+	}
+	valuePos, err := db.set(key, value, cond)
+	if err != nil || valuePos == nil {
+		return false, err
+	}
+	// wait outside the lock, so that concurrent writers can be synced together.
+	return true, db.waitForSync(valuePos)
+}
+
+// set writes the value if cond is true, the returned position is nil if cond is false.
+func (db *YoimiyaDB) set(key, value []byte, cond func(old []byte, exist bool) bool) (*valuePos, error) {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	if ok, err := db.checkStrCond(key, cond); err != nil || !ok {
+		return nil, err
+	}
+	// write entry to log file.
+	entry := &logfile.LogEntry{Key: key, Value: value}
+	valuePos, err := db.writeLogEntry(entry, String)
+	if err != nil {
+		return nil, err
+	}
+	// set String index info, stored at adaptive radix tree.
+	if err = db.updateIndexTree(db.strIndex.idxTree, entry, valuePos, String); err != nil {
+		return nil, err
+	}
+	db.notify(EventString, "set", key)
+	return valuePos, nil
+}
+
+// checkStrCond calls cond with the current value of key, the lock of strIndex must be held.
+func (db *YoimiyaDB) checkStrCond(key []byte, cond func(old []byte, exist bool) bool) (bool, error) {
+	if cond == nil {
+		return true, nil
+	}
+	old, err := db.getVal(db.strIndex.idxTree, key, String)
+	if err == ErrKeyNotFound {
+		return cond(nil, false), nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return cond(old, true), nil
+}
+
+// Get get the value of key.
+// If the key does not exist the error ErrKeyNotFound is returned.
+func (db *YoimiyaDB) Get(key []byte) ([]byte, error) {
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+	return db.getVal(db.strIndex.idxTree, key, String)
+}
+
+// MGet get the values of all the given keys.
+// The value of a key which does not exist is nil, values are in the order of keys.
+// In KeyOnlyMemMode, values are read from each log file in one batch, which is faster than calling Get one by one.
+func (db *YoimiyaDB) MGet(keys [][]byte) ([][]byte, error) {
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+	return db.getVals(db.strIndex.idxTree, keys, String)
+}
+
+// Delete value at the given key.
+func (db *YoimiyaDB) Delete(key []byte) error {
+	_, err := db.DeleteIf(key, nil)
+	return err
+}
+
+// DeleteIf delete value at the given key if cond returns true, and reports whether the key is deleted.
+// cond is called just like SetIf, and a nil cond is always true.
+func (db *YoimiyaDB) DeleteIf(key []byte, cond func(old []byte, exist bool) bool) (bool, error) {
+	valuePos, err := db.delete(key, cond)
+	if err != nil || valuePos == nil {
+		return false, err
+	}
+	return true, db.waitForSync(valuePos)
+}
+
+// Keys returns at most count keys with prefix in lexicographical order.
+// If after is not nil, only the keys greater than after are returned, so that the keys can be scanned page by page.
+func (db *YoimiyaDB) Keys(prefix, after []byte, count int) [][]byte {
+	db.strIndex.mu.RLock()
+	defer db.strIndex.mu.RUnlock()
+	return db.strIndex.idxTree.PrefixScanAfter(prefix, after, count)
+}
+
+func (db *YoimiyaDB) delete(key []byte, cond func(old []byte, exist bool) bool) (*valuePos, error) {
+	db.strIndex.mu.Lock()
+	defer db.strIndex.mu.Unlock()
+
+	if ok, err := db.checkStrCond(key, cond); err != nil || !ok {
+		return nil, err
+	}
+	entry := &logfile.LogEntry{Key: key, Type: logfile.TypeDelete}
+	valuePos, err := db.writeLogEntry(entry, String)
+	if err != nil {
+		return nil, err
+	}
+	oldVal, deleted := db.strIndex.idxTree.Delete(key)
+	db.invalidateValueCache(oldVal, String)
+	if deleted {
+		db.notify(EventGeneric, "del", key)
+	}
+	return valuePos, nil
+}
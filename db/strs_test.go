@@ -0,0 +1,297 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"strings"
+	"testing"
+	"yoimiya/logfile"
+)
+
+func TestYoimiyaDB_Set(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		testYoimiyaDBSet(t, logfile.FileIo, KeyOnlyMemMode)
+	})
+
+	t.Run("mmap", func(t *testing.T) {
+		testYoimiyaDBSet(t, logfile.MMap, KeyOnlyMemMode)
+	})
+
+	t.Run("key-val-mem-mode", func(t *testing.T) {
+		testYoimiyaDBSet(t, logfile.FileIo, KeyValueMemMode)
+	})
+}
+
+func testYoimiyaDBSet(t *testing.T, ioType logfile.IOType, mode DataIndexMode) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.IoType = ioType
+	opts.IndexMode = mode
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	type args struct {
+		key   []byte
+		value []byte
+	}
+	tests := []struct {
+		name    string
+		db      *YoimiyaDB
+		args    args
+		wantErr bool
+	}{
+		{
+			"nil-key", db, args{key: nil, value: []byte("val-1")}, false,
+		},
+		{
+			"nil-value", db, args{key: []byte("key-1"), value: nil}, false,
+		},
+		{
+			"normal", db, args{key: []byte("key-1111"), value: []byte("value-1111")}, false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.db.Set(tt.args.key, tt.args.value); (err != nil) != tt.wantErr {
+				t.Errorf("Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestYoimiyaDB_Get(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		testYoimiyaDBGet(t, logfile.FileIo, KeyOnlyMemMode)
+	})
+
+	t.Run("mmap", func(t *testing.T) {
+		testYoimiyaDBGet(t, logfile.MMap, KeyOnlyMemMode)
+	})
+
+	t.Run("key-val-mem-mode", func(t *testing.T) {
+		testYoimiyaDBGet(t, logfile.MMap, KeyValueMemMode)
+	})
+}
+
+func testYoimiyaDBGet(t *testing.T, ioType logfile.IOType, mode DataIndexMode) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.IoType = ioType
+	opts.IndexMode = mode
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	_ = db.Set([]byte("k1"), []byte("v1"))
+	_ = db.Set([]byte("k2"), []byte("v2"))
+	_ = db.Set([]byte("k2"), []byte("v2-updated"))
+	_ = db.Set([]byte("k3"), []byte("v3"))
+	_ = db.Delete([]byte("k3"))
+
+	tests := []struct {
+		name    string
+		key     []byte
+		want    []byte
+		wantErr error
+	}{
+		{"normal", []byte("k1"), []byte("v1"), nil},
+		{"updated", []byte("k2"), []byte("v2-updated"), nil},
+		{"deleted", []byte("k3"), nil, ErrKeyNotFound},
+		{"not-exist", []byte("k4"), nil, ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.Get(tt.key)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestYoimiyaDB_Get_ValueCache(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.ValueCacheSize = 1 << 20
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	err = db.Set([]byte("k1"), []byte("v1"))
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		v, err := db.Get([]byte("k1"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1"), v)
+	}
+	stats := db.ValueCacheStats()
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(2), stats.Hits)
+
+	// the cached value of old position is invalidated after updating.
+	err = db.Set([]byte("k1"), []byte("v1-updated"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, db.ValueCacheStats().Entries)
+	v, err := db.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1-updated"), v)
+
+	err = db.Delete([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, db.ValueCacheStats().Entries)
+}
+
+func TestYoimiyaDB_Get_Compression(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.Compression = logfile.FlateCompression
+	opts.CompressionThreshold = 64
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	value := []byte(strings.Repeat("compressed-value", 64))
+	err = db.Set([]byte("k1"), value)
+	assert.Nil(t, err)
+	err = db.Set([]byte("k2"), []byte("v2"))
+	assert.Nil(t, err)
+	// compressed entry is smaller than the original value.
+	assert.Less(t, db.activeLogFiles[String].WriteAt, int64(len(value)))
+
+	v, err := db.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, v)
+
+	// reopen without compression, compressed values can still be read.
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	v, err = db.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, v)
+	v, err = db.Get([]byte("k2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), v)
+}
+
+func TestYoimiyaDB_MGet(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		testYoimiyaDBMGet(t, logfile.FileIo, KeyOnlyMemMode, 0)
+	})
+
+	t.Run("mmap", func(t *testing.T) {
+		testYoimiyaDBMGet(t, logfile.MMap, KeyOnlyMemMode, 0)
+	})
+
+	t.Run("key-val-mem-mode", func(t *testing.T) {
+		testYoimiyaDBMGet(t, logfile.FileIo, KeyValueMemMode, 0)
+	})
+
+	t.Run("value-cache", func(t *testing.T) {
+		testYoimiyaDBMGet(t, logfile.FileIo, KeyOnlyMemMode, 1<<20)
+	})
+}
+
+func testYoimiyaDBMGet(t *testing.T, ioType logfile.IOType, mode DataIndexMode, cacheSize int64) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.IoType = ioType
+	opts.IndexMode = mode
+	opts.ValueCacheSize = cacheSize
+	// values are spread across several log files.
+	opts.LogFileSizeThreshold = 4 << 10
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	var keys, values [][]byte
+	for i := 0; i < 500; i++ {
+		keys = append(keys, GetKey(i))
+		values = append(values, GetValue16B(i))
+		assert.Nil(t, db.Set(keys[i], values[i]))
+	}
+	// read some of them into the value cache.
+	for i := 0; i < 100; i++ {
+		_, err := db.Get(keys[i])
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Delete(keys[10]))
+	values[10] = nil
+
+	got, err := db.MGet(append(keys, []byte("not-exist")))
+	assert.Nil(t, err)
+	assert.Equal(t, append(values, nil), got)
+}
+
+func TestYoimiyaDB_SetIf(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.LogFileSizeThreshold = 64 << 10
+	opts.ValueChunkSize = 10 << 10
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	notExist := func(old []byte, exist bool) bool { return !exist }
+	equal := func(v []byte) func([]byte, bool) bool {
+		return func(old []byte, exist bool) bool { return exist && string(old) == string(v) }
+	}
+	large := []byte(strings.Repeat("l", 30<<10))
+
+	tests := []struct {
+		name  string
+		key   string
+		value []byte
+		cond  func([]byte, bool) bool
+		ok    bool
+	}{
+		{"create", "k1", []byte("v1"), notExist, true},
+		{"create-exist", "k1", []byte("v2"), notExist, false},
+		{"compare-mismatch", "k1", []byte("v2"), equal([]byte("v0")), false},
+		{"compare-match", "k1", []byte("v2"), equal([]byte("v1")), true},
+		{"large-match", "k1", large, equal([]byte("v2")), true},
+		{"large-mismatch", "k1", large, equal([]byte("v2")), false},
+		{"compare-large", "k1", []byte("v3"), equal(large), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _ := db.Get([]byte(tt.key))
+			ok, err := db.SetIf([]byte(tt.key), tt.value, tt.cond)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.ok, ok)
+			v, err := db.Get([]byte(tt.key))
+			assert.Nil(t, err)
+			if tt.ok {
+				assert.Equal(t, tt.value, v)
+			} else {
+				assert.Equal(t, before, v)
+			}
+		})
+	}
+
+	ok, err := db.DeleteIf([]byte("k1"), equal([]byte("v0")))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.DeleteIf([]byte("k1"), equal([]byte("v3")))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = db.Get([]byte("k1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestYoimiyaDB_Keys(t *testing.T) {
+	path := filepath.Join("/tmp", "yoimiya")
+	db, err := Open(DefaultOptions(path))
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	for _, key := range []string{"user:2", "user:1", "order:1", "user:3"} {
+		assert.Nil(t, db.Set([]byte(key), []byte("v")))
+	}
+	assert.Nil(t, db.Delete([]byte("user:3")))
+
+	assert.Equal(t, [][]byte{[]byte("user:1"), []byte("user:2")}, db.Keys([]byte("user:"), nil, 10))
+	assert.Equal(t, [][]byte{[]byte("user:2")}, db.Keys([]byte("user:"), []byte("user:1"), 10))
+	assert.Equal(t, [][]byte{[]byte("order:1")}, db.Keys(nil, nil, 1))
+}
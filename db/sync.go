@@ -0,0 +1,167 @@
+package db
+
+import (
+	"sync"
+	"time"
+	"yoimiya/logfile"
+	"yoimiya/logger"
+)
+
+type (
+	// syncer syncs the written log files in background according to SyncGroup and SyncEverySec policy.
+	syncer struct {
+		mu           sync.Mutex
+		policy       SyncPolicy
+		dirty        map[*logfile.LogFile]struct{} // log files with writes not synced yet.
+		batch        *syncBatch
+		pendingBytes int
+		interval     time.Duration
+		maxBytes     int
+		notifyCh     chan struct{} // a new batch is started.
+		fullCh       chan struct{} // pending bytes reach maxBytes.
+		closeCh      chan struct{}
+		wg           sync.WaitGroup
+	}
+
+	// syncBatch is a group of writes synced by one fsync, writers wait on done channel.
+	syncBatch struct {
+		done chan struct{}
+		err  error
+	}
+)
+
+func newSyncBatch() *syncBatch {
+	return &syncBatch{done: make(chan struct{})}
+}
+
+// newSyncer create a syncer and start its background goroutine, it returns nil if no background sync is needed.
+func newSyncer(opts Options) *syncer {
+	if opts.SyncPolicy != SyncGroup && opts.SyncPolicy != SyncEverySec {
+		return nil
+	}
+	s := &syncer{
+		policy:   opts.SyncPolicy,
+		dirty:    make(map[*logfile.LogFile]struct{}),
+		batch:    newSyncBatch(),
+		interval: opts.GroupCommitInterval,
+		maxBytes: opts.GroupCommitSize,
+		notifyCh: make(chan struct{}, 1),
+		fullCh:   make(chan struct{}, 1),
+		closeCh:  make(chan struct{}),
+	}
+	if s.policy == SyncEverySec {
+		s.interval = time.Second
+	}
+
+	s.wg.Add(1)
+	if s.policy == SyncGroup {
+		go s.runGroupCommit()
+	} else {
+		go s.runEverySec()
+	}
+	return s
+}
+
+// add records a write of size bytes to lf.
+// In SyncGroup policy, it returns the batch that the write belongs to, writer should wait until it is done.
+func (s *syncer) add(lf *logfile.LogFile, size int) *syncBatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dirty[lf] = struct{}{}
+	if s.policy != SyncGroup {
+		return nil
+	}
+	if s.pendingBytes == 0 {
+		notify(s.notifyCh)
+	}
+	s.pendingBytes += size
+	if s.maxBytes > 0 && s.pendingBytes >= s.maxBytes {
+		notify(s.fullCh)
+	}
+	return s.batch
+}
+
+// close stops the background goroutine, and syncs the pending writes.
+func (s *syncer) close() {
+	close(s.closeCh)
+	s.wg.Wait()
+}
+
+func (s *syncer) runGroupCommit() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.notifyCh:
+		case <-s.closeCh:
+			s.flush()
+			return
+		}
+
+		// wait for more writers to join the batch.
+		timer := time.NewTimer(s.interval)
+		select {
+		case <-timer.C:
+		case <-s.fullCh:
+		case <-s.closeCh:
+		}
+		timer.Stop()
+		s.flush()
+	}
+}
+
+func (s *syncer) runEverySec() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				logger.Error("sync log files err: %v", err)
+			}
+		case <-s.closeCh:
+			_ = s.flush()
+			return
+		}
+	}
+}
+
+// flush syncs all dirty log files, and wakes up the writers in current batch.
+func (s *syncer) flush() error {
+	s.mu.Lock()
+	batch, dirty := s.batch, s.dirty
+	s.batch = newSyncBatch()
+	s.dirty = make(map[*logfile.LogFile]struct{})
+	s.pendingBytes = 0
+	// the notification of the flushed batch is useless now.
+	select {
+	case <-s.fullCh:
+	default:
+	}
+	s.mu.Unlock()
+
+	for lf := range dirty {
+		if err := lf.Sync(); err != nil {
+			batch.err = err
+		}
+	}
+	close(batch.done)
+	return batch.err
+}
+
+// waitForSync blocks until the write at pos is synced in SyncGroup policy.
+func (db *YoimiyaDB) waitForSync(pos *valuePos) error {
+	if pos == nil || pos.syncBatch == nil {
+		return nil
+	}
+	<-pos.syncBatch.done
+	return pos.syncBatch.err
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"yoimiya/logfile"
+)
+
+func TestYoimiyaDB_SyncPolicy(t *testing.T) {
+	policies := map[string]SyncPolicy{
+		"none":     SyncNone,
+		"always":   SyncAlways,
+		"group":    SyncGroup,
+		"everysec": SyncEverySec,
+	}
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			testYoimiyaDBSyncPolicy(t, policy)
+		})
+	}
+}
+
+func testYoimiyaDBSyncPolicy(t *testing.T, policy SyncPolicy) {
+	path := filepath.Join("/tmp", "yoimiya")
+	opts := DefaultOptions(path)
+	opts.SyncPolicy = policy
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	writers, writeCount := 8, 50
+	wg := new(sync.WaitGroup)
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < writeCount; j++ {
+				err := db.Set(GetKey(n*writeCount+j), GetValue16B(j))
+				assert.Nil(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	err = db.Delete(GetKey(0))
+	assert.Nil(t, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+
+	_, err = db.Get(GetKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i < writers*writeCount; i++ {
+		v, err := db.Get(GetKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, GetValue16B(i%writeCount), v)
+	}
+}
+
+func TestSyncer_GroupCommit(t *testing.T) {
+	lf, err := logfile.OpenLogFile("/tmp", 1, 1<<20, logfile.Strs, logfile.FileIo)
+	assert.Nil(t, err)
+	defer func() {
+		_ = lf.Delete()
+	}()
+
+	opts := DefaultOptions("/tmp")
+	opts.SyncPolicy = SyncGroup
+	opts.GroupCommitInterval = 50 * time.Millisecond
+	opts.GroupCommitSize = 100
+	s := newSyncer(opts)
+	defer s.close()
+
+	// writes in the time window are in the same batch.
+	start := time.Now()
+	b1 := s.add(lf, 10)
+	b2 := s.add(lf, 10)
+	assert.Equal(t, b1, b2)
+	<-b1.done
+	assert.Nil(t, b1.err)
+	assert.GreaterOrEqual(t, time.Since(start), opts.GroupCommitInterval)
+
+	// a new batch is started after syncing, and will be synced immediately if it is full.
+	b3 := s.add(lf, 200)
+	assert.NotEqual(t, b1, b3)
+	select {
+	case <-b3.done:
+	case <-time.After(opts.GroupCommitInterval / 2):
+		t.Error("batch is not synced when it is full")
+	}
+}
+
+func TestSyncer_Close(t *testing.T) {
+	lf, err := logfile.OpenLogFile("/tmp", 1, 1<<20, logfile.Strs, logfile.FileIo)
+	assert.Nil(t, err)
+	defer func() {
+		_ = lf.Delete()
+	}()
+
+	assert.Nil(t, newSyncer(DefaultOptions("/tmp")))
+
+	opts := DefaultOptions("/tmp")
+	opts.SyncPolicy = SyncGroup
+	opts.GroupCommitInterval = time.Hour
+	s := newSyncer(opts)
+	b := s.add(lf, 10)
+	// pending writes are synced while closing.
+	s.close()
+	<-b.done
+	assert.Nil(t, b.err)
+}
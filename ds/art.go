@@ -1,6 +1,10 @@
 package ds
 
-import art "github.com/plar/go-adaptive-radix-tree"
+import (
+	"bytes"
+	art "github.com/plar/go-adaptive-radix-tree"
+	"math"
+)
 
 type AdaptiveRadixTree struct {
 	tree art.Tree
@@ -44,10 +48,55 @@ func (ds *AdaptiveRadixTree) PrefixScan(prefix []byte, count int) (keys [][]byte
 		return true
 	}
 
+	ds.forEachPrefix(prefix, cb)
+	return
+}
+
+// PrefixScanAfter returns at most count keys with prefix which are greater than after, in lexicographical order.
+// It is the same as PrefixScan if after is nil.
+//
+// It seeks to after instead of skipping the keys before it, so the cost of a page doesn't grow with the keys before.
+// The keys greater than after are the keys extending after, followed by the keys which share the first i bytes
+// of after and have a greater byte at i, for i from len(after)-1 down to len(prefix).
+func (ds *AdaptiveRadixTree) PrefixScanAfter(prefix, after []byte, count int) (keys [][]byte) {
+	if after == nil || bytes.Compare(after, prefix) < 0 {
+		return ds.PrefixScan(prefix, count)
+	}
+	// all keys with prefix are less than after.
+	if !bytes.HasPrefix(after, prefix) {
+		return nil
+	}
+
+	cb := func(node art.Node) bool {
+		if node.Kind() != art.Leaf {
+			return true
+		}
+		if count <= 0 {
+			return false
+		}
+		if bytes.Equal(node.Key(), after) {
+			return true
+		}
+		keys = append(keys, node.Key())
+		count--
+		return true
+	}
+
+	ds.forEachPrefix(after, cb)
+	seek := append([]byte(nil), after...)
+	for i := len(after) - 1; i >= len(prefix) && count > 0; i-- {
+		for b := int(after[i]) + 1; b <= math.MaxUint8 && count > 0; b++ {
+			seek[i] = byte(b)
+			ds.tree.ForEachPrefix(seek[:i+1], cb)
+		}
+	}
+	return
+}
+
+func (ds *AdaptiveRadixTree) forEachPrefix(prefix []byte, cb art.Callback) {
 	if len(prefix) == 0 {
 		ds.tree.ForEach(cb)
 	} else {
 		ds.tree.ForEachPrefix(prefix, cb)
 	}
-	return
 }
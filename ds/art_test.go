@@ -2,6 +2,7 @@ package ds
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"reflect"
 	"sort"
@@ -161,4 +162,73 @@ func TestAdaptiveRadixTreePrefixScan(t *testing.T) {
 
 	keys4 := tree.PrefixScan([]byte("a"), 5)
 	assert.Equal(t, 5, len(keys4))
-}
\ No newline at end of file
+}
+
+func TestAdaptiveRadixTreePrefixScanAfter(t *testing.T) {
+	tree := NewART()
+	tree.Put([]byte("aa"), 1)
+	tree.Put([]byte("ab"), 2)
+	tree.Put([]byte("ac"), 3)
+	tree.Put([]byte("b"), 4)
+
+	keys1 := tree.PrefixScanAfter([]byte("a"), nil, 2)
+	assert.Equal(t, [][]byte{[]byte("aa"), []byte("ab")}, keys1)
+
+	keys2 := tree.PrefixScanAfter([]byte("a"), []byte("ab"), 2)
+	assert.Equal(t, [][]byte{[]byte("ac")}, keys2)
+
+	keys3 := tree.PrefixScanAfter(nil, []byte("aa"), 10)
+	assert.Equal(t, [][]byte{[]byte("ab"), []byte("ac"), []byte("b")}, keys3)
+
+	// after is not a key, or out of the keys with prefix.
+	assert.Equal(t, [][]byte{[]byte("ac")}, tree.PrefixScanAfter([]byte("a"), []byte("abc"), 10))
+	assert.Equal(t, [][]byte{[]byte("aa")}, tree.PrefixScanAfter([]byte("a"), []byte("0"), 1))
+	assert.Equal(t, 0, len(tree.PrefixScanAfter([]byte("a"), []byte("b"), 10)))
+	assert.Equal(t, 0, len(tree.PrefixScanAfter([]byte("a"), []byte("ab"), 0)))
+
+	t.Run("paging", func(t *testing.T) {
+		tree := NewART()
+		var all [][]byte
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key-%d", i*7919%1000))
+			if i%3 == 0 {
+				key = append(key, 0, 0xff)
+			}
+			tree.Put(key, i)
+			all = append(all, key)
+		}
+		tree.Put([]byte("other"), nil)
+		sort.Slice(all, func(i, j int) bool {
+			return bytes.Compare(all[i], all[j]) < 0
+		})
+
+		var keys [][]byte
+		var after []byte
+		for {
+			page := tree.PrefixScanAfter([]byte("key-"), after, 7)
+			if len(page) == 0 {
+				break
+			}
+			keys = append(keys, page...)
+			after = page[len(page)-1]
+		}
+		assert.Equal(t, all, keys)
+	})
+}
+
+func BenchmarkAdaptiveRadixTreePrefixScanAfter(b *testing.B) {
+	tree := NewART()
+	for i := 0; i < 100000; i++ {
+		tree.Put([]byte(fmt.Sprintf("key-%09d", i)), nil)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// pages all over the keys.
+		n := i * 7919 % 100000
+		keys := tree.PrefixScanAfter([]byte("key-"), []byte(fmt.Sprintf("key-%09d", n)), 100)
+		if len(keys) == 0 && n != 99999 {
+			b.Fatal("no keys")
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+	"yoimiya/db"
+	"yoimiya/logger"
+)
+
+const (
+	// maxBodySize max size of a request body.
+	maxBodySize = 64 << 20
+
+	// scanPageSize number of values read from db at once when scanning.
+	scanPageSize = 100
+
+	stringsPath = "/v1/strings"
+	batchPath   = "/v1/batch/"
+)
+
+var (
+	// ErrNoDB the gateway needs one db at least.
+	ErrNoDB = errors.New("gateway: no db to serve")
+
+	errInvalidEncoding = errors.New("encoding must be utf8 or base64")
+	errInvalidDB       = errors.New("db index is out of range")
+	errNotUTF8         = errors.New("value is not valid utf8, use encoding=base64")
+)
+
+// Gateway serves the strings of dbs in HTTP with JSON bodies.
+//
+//	GET    /v1/strings/{key}                    get a value, the ETag header is the version of value.
+//	PUT    /v1/strings/{key}                    set a value from {"value": "..."}, If-Match and If-None-Match: * are supported.
+//	DELETE /v1/strings/{key}                    delete a key, If-Match is supported.
+//	GET    /v1/strings?prefix=&after=&limit=    scan the keys with prefix in order, values are streamed in NDJSON.
+//	POST   /v1/batch/get                        get the values of {"keys": [...]}.
+//	POST   /v1/batch/set                        set the values of {"items": [{"key": "", "value": "", "if_match": ""}]}.
+//	POST   /v1/batch/delete                     delete {"keys": [...]}.
+//
+// Keys in path must be escaped, so "/" in a key is "%2F". Query parameter db selects the db by index, 0 by default,
+// and encoding=base64 makes the keys and values in bodies base64 encoded, for binary data.
+// The version of a value is a hash of its content, conditional writes are atomic with other writes to the db.
+type Gateway struct {
+	dbs []*db.YoimiyaDB
+}
+
+// Item is a key value pair in requests and responses.
+type Item struct {
+	Key     string  `json:"key"`
+	Value   *string `json:"value,omitempty"`
+	Version string  `json:"version,omitempty"`
+
+	// IfMatch in batch set requests, the value is only set if the current version matches it, "*" means the key exists.
+	IfMatch string `json:"if_match,omitempty"`
+
+	// Found in batch get responses, whether the key exists.
+	Found *bool `json:"found,omitempty"`
+
+	// OK in batch set responses, whether the value is set.
+	OK *bool `json:"ok,omitempty"`
+}
+
+type keysRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type itemsRequest struct {
+	Items []*Item `json:"items"`
+}
+
+type itemsResponse struct {
+	Items []*Item `json:"items"`
+}
+
+type deleteResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// codec encodes and decodes keys and values in bodies.
+type codec struct {
+	base64 bool
+}
+
+// NewGateway create a new gateway for dbs, the dbs are not closed by the gateway.
+func NewGateway(dbs []*db.YoimiyaDB) (*Gateway, error) {
+	if len(dbs) == 0 {
+		return nil, ErrNoDB
+	}
+	return &Gateway{dbs: dbs}, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d, c, err := g.parseQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+	path := r.URL.EscapedPath()
+	switch {
+	case path == stringsPath:
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		g.scan(w, r, d, c)
+	case strings.HasPrefix(path, stringsPath+"/"):
+		key, err := url.PathUnescape(strings.TrimPrefix(path, stringsPath+"/"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			g.get(w, r, d, c, key)
+		case http.MethodPut:
+			g.set(w, r, d, c, key)
+		case http.MethodDelete:
+			g.delete(w, r, d, key)
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+		}
+	case strings.HasPrefix(path, batchPath):
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		switch strings.TrimPrefix(path, batchPath) {
+		case "get":
+			g.batchGet(w, r, d, c)
+		case "set":
+			g.batchSet(w, r, d, c)
+		case "delete":
+			g.batchDelete(w, r, d, c)
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (g *Gateway) parseQuery(r *http.Request) (*db.YoimiyaDB, codec, error) {
+	query := r.URL.Query()
+	var c codec
+	switch query.Get("encoding") {
+	case "", "utf8":
+	case "base64":
+		c.base64 = true
+	default:
+		return nil, c, errInvalidEncoding
+	}
+	index := 0
+	if s := query.Get("db"); s != "" {
+		var err error
+		if index, err = strconv.Atoi(s); err != nil || index < 0 || index >= len(g.dbs) {
+			return nil, c, errInvalidDB
+		}
+	}
+	return g.dbs[index], c, nil
+}
+
+func (g *Gateway) get(w http.ResponseWriter, r *http.Request, d *db.YoimiyaDB, c codec, key string) {
+	value, err := d.Get([]byte(key))
+	if err == db.ErrKeyNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	item, err := c.newItem([]byte(key), value)
+	if err != nil {
+		writeError(w, http.StatusNotAcceptable, err)
+		return
+	}
+	w.Header().Set("ETag", quoteETag(item.Version))
+	if noneMatch := r.Header.Get("If-None-Match"); noneMatch != "" && matchETag(noneMatch, item.Version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, item)
+}
+
+func (g *Gateway) set(w http.ResponseWriter, r *http.Request, d *db.YoimiyaDB, c codec, key string) {
+	var item Item
+	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if item.Value == nil {
+		writeError(w, http.StatusBadRequest, errors.New("value is required"))
+		return
+	}
+	value, err := c.decode(*item.Value)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ok, err := d.SetIf([]byte(key), value, writeCond(r.Header.Get("If-Match"), r.Header.Get("If-None-Match")))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusPreconditionFailed, errors.New("precondition failed"))
+		return
+	}
+	version := valueVersion(value)
+	w.Header().Set("ETag", quoteETag(version))
+	writeJSON(w, http.StatusOK, &Item{Key: c.encode([]byte(key)), Version: version})
+}
+
+func (g *Gateway) delete(w http.ResponseWriter, r *http.Request, d *db.YoimiyaDB, key string) {
+	var found bool
+	ifMatch := r.Header.Get("If-Match")
+	ok, err := d.DeleteIf([]byte(key), func(old []byte, exist bool) bool {
+		found = exist
+		return exist && (ifMatch == "" || matchETag(ifMatch, valueVersion(old)))
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, db.ErrKeyNotFound)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusPreconditionFailed, errors.New("precondition failed"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scan streams the items with prefix in NDJSON, the keys are read page by page, so that writes won't be blocked long.
+func (g *Gateway) scan(w http.ResponseWriter, r *http.Request, d *db.YoimiyaDB, c codec) {
+	query := r.URL.Query()
+	prefix, err := c.decode(query.Get("prefix"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var after []byte
+	if query.Has("after") {
+		if after, err = c.decode(query.Get("after")); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	limit := -1
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be a non-negative integer"))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for limit != 0 {
+		count := scanPageSize
+		if limit > 0 && limit < count {
+			count = limit
+		}
+		keys := d.Keys(prefix, after, count)
+		if len(keys) == 0 {
+			return
+		}
+		values, err := d.MGet(keys)
+		if err != nil {
+			// the status has been sent, so the error is the last line.
+			_ = encoder.Encode(&errorResponse{Error: err.Error()})
+			return
+		}
+		for i, key := range keys {
+			// deleted after the keys are read.
+			if values[i] == nil {
+				continue
+			}
+			item, err := c.newItem(key, values[i])
+			if err != nil {
+				_ = encoder.Encode(&errorResponse{Error: err.Error()})
+				return
+			}
+			if err := encoder.Encode(item); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if limit > 0 {
+			limit -= len(keys)
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+func (g *Gateway) batchGet(w http.ResponseWriter, r *http.Request, d *db.YoimiyaDB, c codec) {
+	keys, ok := c.decodeKeys(w, r)
+	if !ok {
+		return
+	}
+	values, err := d.MGet(keys)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resp := &itemsResponse{Items: make([]*Item, len(keys))}
+	for i, key := range keys {
+		found := values[i] != nil
+		if !found {
+			resp.Items[i] = &Item{Key: c.encode(key), Found: &found}
+			continue
+		}
+		if resp.Items[i], err = c.newItem(key, values[i]); err != nil {
+			writeError(w, http.StatusNotAcceptable, err)
+			return
+		}
+		resp.Items[i].Found = &found
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// batchSet sets the items one by one, it is not atomic, the result of each item is in the response.
+func (g *Gateway) batchSet(w http.ResponseWriter, r *http.Request, d *db.YoimiyaDB, c codec) {
+	var req itemsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	keys := make([][]byte, len(req.Items))
+	values := make([][]byte, len(req.Items))
+	for i, item := range req.Items {
+		var err error
+		if item == nil || item.Value == nil {
+			writeError(w, http.StatusBadRequest, errors.New("value is required"))
+			return
+		}
+		if keys[i], err = c.decode(item.Key); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if values[i], err = c.decode(*item.Value); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	resp := &itemsResponse{Items: make([]*Item, len(req.Items))}
+	for i, item := range req.Items {
+		ok, err := d.SetIf(keys[i], values[i], writeCond(item.IfMatch, ""))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		resp.Items[i] = &Item{Key: item.Key, OK: &ok}
+		if ok {
+			resp.Items[i].Version = valueVersion(values[i])
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (g *Gateway) batchDelete(w http.ResponseWriter, r *http.Request, d *db.YoimiyaDB, c codec) {
+	keys, ok := c.decodeKeys(w, r)
+	if !ok {
+		return
+	}
+	resp := &deleteResponse{}
+	for _, key := range keys {
+		ok, err := d.DeleteIf(key, func(old []byte, exist bool) bool {
+			return exist
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if ok {
+			resp.Deleted++
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// writeCond returns the condition of a write with the If-Match and If-None-Match headers.
+func writeCond(ifMatch, ifNoneMatch string) func(old []byte, exist bool) bool {
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+	return func(old []byte, exist bool) bool {
+		if ifMatch != "" && !(exist && matchETag(ifMatch, valueVersion(old))) {
+			return false
+		}
+		if ifNoneMatch != "" && exist && matchETag(ifNoneMatch, valueVersion(old)) {
+			return false
+		}
+		return true
+	}
+}
+
+// valueVersion returns the version of a value, which is the hex of the first 8 bytes of its sha256.
+func valueVersion(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:8])
+}
+
+func quoteETag(version string) string {
+	return `"` + version + `"`
+}
+
+// matchETag reports whether version matches the header of If-Match or If-None-Match, which is "*" or a list of ETags.
+// Weak ETags like W/"xxx" are compared as strong ones, since versions are content hashes.
+func matchETag(header, version string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || strings.Trim(tag, `"`) == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (c codec) decode(s string) ([]byte, error) {
+	if c.base64 {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
+func (c codec) encode(b []byte) string {
+	if c.base64 {
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return string(b)
+}
+
+func (c codec) newItem(key, value []byte) (*Item, error) {
+	if !c.base64 && (!utf8.Valid(key) || !utf8.Valid(value)) {
+		return nil, errNotUTF8
+	}
+	v := c.encode(value)
+	return &Item{Key: c.encode(key), Value: &v, Version: valueVersion(value)}, nil
+}
+
+// decodeKeys decodes the keys of a batch request, the error response is written if it returns false.
+func (c codec) decodeKeys(w http.ResponseWriter, r *http.Request) ([][]byte, bool) {
+	var req keysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	keys := make([][]byte, len(req.Keys))
+	for i, key := range req.Keys {
+		var err error
+		if keys[i], err = c.decode(key); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return nil, false
+		}
+	}
+	return keys, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("write response err: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &errorResponse{Error: err.Error()})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
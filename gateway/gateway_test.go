@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"yoimiya/db"
+)
+
+func newTestGateway(t *testing.T) (*httptest.Server, func()) {
+	path := filepath.Join("/tmp", "yoimiya-gateway")
+	d, err := db.Open(db.DefaultOptions(path))
+	assert.Nil(t, err)
+	g, err := NewGateway([]*db.YoimiyaDB{d})
+	assert.Nil(t, err)
+	ts := httptest.NewServer(g)
+	return ts, func() {
+		ts.Close()
+		_ = d.Close()
+		_ = os.RemoveAll(path)
+	}
+}
+
+func doRequest(t *testing.T, method, url, body string, header map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.Nil(t, err)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	buf := new(strings.Builder)
+	_, err = bufio.NewReader(resp.Body).WriteTo(buf)
+	assert.Nil(t, err)
+	return resp, buf.String()
+}
+
+func TestGateway_Strings(t *testing.T) {
+	ts, cleanup := newTestGateway(t)
+	defer cleanup()
+	url := ts.URL + "/v1/strings/a%2Fb"
+
+	resp, _ := doRequest(t, http.MethodGet, url, "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// create only.
+	resp, _ = doRequest(t, http.MethodPut, url, `{"value":"v1"}`, map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	etag1 := resp.Header.Get("ETag")
+	assert.Equal(t, quoteETag(valueVersion([]byte("v1"))), etag1)
+	resp, _ = doRequest(t, http.MethodPut, url, `{"value":"v2"}`, map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp, body := doRequest(t, http.MethodGet, url, "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag1, resp.Header.Get("ETag"))
+	assert.JSONEq(t, fmt.Sprintf(`{"key":"a/b","value":"v1","version":%s}`, etag1), body)
+	resp, _ = doRequest(t, http.MethodGet, url, "", map[string]string{"If-None-Match": etag1})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// compare and set.
+	resp, _ = doRequest(t, http.MethodPut, url, `{"value":"v2"}`, map[string]string{"If-Match": `"stale"`})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp, _ = doRequest(t, http.MethodPut, url, `{"value":"v2"}`, map[string]string{"If-Match": etag1})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	etag2 := resp.Header.Get("ETag")
+
+	// binary values.
+	resp, body = doRequest(t, http.MethodGet, url+"?encoding=base64", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, fmt.Sprintf(`{"key":"YS9i","value":"djI=","version":%s}`, etag2), body)
+
+	resp, _ = doRequest(t, http.MethodDelete, url, "", map[string]string{"If-Match": etag1})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp, _ = doRequest(t, http.MethodDelete, url, "", map[string]string{"If-Match": etag2})
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = doRequest(t, http.MethodDelete, url, "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodPut, url, `{"val":"v"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = doRequest(t, http.MethodPost, url, "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	resp, _ = doRequest(t, http.MethodGet, url+"?db=1", "", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGateway_Batch(t *testing.T) {
+	ts, cleanup := newTestGateway(t)
+	defer cleanup()
+
+	resp, body := doRequest(t, http.MethodPost, ts.URL+"/v1/batch/set",
+		`{"items":[{"key":"k1","value":"v1"},{"key":"k2","value":"v2"},{"key":"k3","value":"v3","if_match":"*"}]}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	v1, v2 := valueVersion([]byte("v1")), valueVersion([]byte("v2"))
+	assert.JSONEq(t, fmt.Sprintf(`{"items":[{"key":"k1","version":"%s","ok":true},{"key":"k2","version":"%s","ok":true},
+		{"key":"k3","ok":false}]}`, v1, v2), body)
+
+	resp, body = doRequest(t, http.MethodPost, ts.URL+"/v1/batch/get", `{"keys":["k1","k3"]}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, fmt.Sprintf(`{"items":[{"key":"k1","value":"v1","version":"%s","found":true},
+		{"key":"k3","found":false}]}`, v1), body)
+
+	resp, body = doRequest(t, http.MethodPost, ts.URL+"/v1/batch/delete", `{"keys":["k1","k3"]}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"deleted":1}`, body)
+
+	resp, _ = doRequest(t, http.MethodPost, ts.URL+"/v1/batch/set", `{"items":[{"key":"k1"}]}`, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = doRequest(t, http.MethodGet, ts.URL+"/v1/batch/get", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestGateway_Scan(t *testing.T) {
+	ts, cleanup := newTestGateway(t)
+	defer cleanup()
+
+	var items []string
+	for i := 0; i < 250; i++ {
+		items = append(items, fmt.Sprintf(`{"key":"user:%03d","value":"v%d"}`, i, i))
+	}
+	items = append(items, `{"key":"order:1","value":"v"}`)
+	resp, _ := doRequest(t, http.MethodPost, ts.URL+"/v1/batch/set", `{"items":[`+strings.Join(items, ",")+`]}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	scan := func(query string) []*Item {
+		resp, body := doRequest(t, http.MethodGet, ts.URL+"/v1/strings?"+query, "", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+		var result []*Item
+		for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+			if line == "" {
+				continue
+			}
+			item := &Item{}
+			assert.Nil(t, json.Unmarshal([]byte(line), item))
+			result = append(result, item)
+		}
+		return result
+	}
+
+	all := scan("prefix=user:")
+	assert.Equal(t, 250, len(all))
+	assert.Equal(t, "user:000", all[0].Key)
+	assert.Equal(t, "v0", *all[0].Value)
+	assert.Equal(t, "user:249", all[249].Key)
+
+	page := scan("prefix=user:&after=user:100&limit=120")
+	assert.Equal(t, 120, len(page))
+	assert.Equal(t, "user:101", page[0].Key)
+
+	assert.Equal(t, 251, len(scan("")))
+	assert.Equal(t, 0, len(scan("prefix=none")))
+}
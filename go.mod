@@ -6,11 +6,11 @@ require (
 	github.com/flower-corp/rosedb v1.1.1
 	github.com/plar/go-adaptive-radix-tree v1.0.4
 	github.com/stretchr/testify v1.7.2
+	golang.org/x/sys v0.0.0-20220928140112-f11e5e49a4ec
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/sys v0.0.0-20220928140112-f11e5e49a4ec // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
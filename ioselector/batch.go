@@ -0,0 +1,73 @@
+package ioselector
+
+import "sync"
+
+// batchReadWorkers number of goroutines issuing preads for FileIOSelector ReadBatch.
+// Reads are mostly waiting for disk, so it can be larger than the number of CPUs.
+const batchReadWorkers = 32
+
+// ReadReq is a read request in ReadBatch, Buf is filled with the data at Offset.
+// N and Err are the result of the read, just like the return values of Read.
+type ReadReq struct {
+	Buf    []byte
+	Offset int64
+	N      int
+	Err    error
+}
+
+var readPool struct {
+	once  sync.Once
+	tasks chan func()
+}
+
+// readBatch is the default ReadBatch implementation, which reads the requests one by one.
+func readBatch(s IOSelector, reqs []ReadReq) error {
+	for i := range reqs {
+		reqs[i].N, reqs[i].Err = s.Read(reqs[i].Buf, reqs[i].Offset)
+	}
+	return firstReadErr(reqs)
+}
+
+// readBatchConcurrently issues the reads of requests in the worker pool, and waits for all of them.
+// If all workers are busy, the read is done in the calling goroutine.
+func readBatchConcurrently(s IOSelector, reqs []ReadReq) error {
+	if len(reqs) <= 1 {
+		return readBatch(s, reqs)
+	}
+	readPool.once.Do(func() {
+		readPool.tasks = make(chan func())
+		for i := 0; i < batchReadWorkers; i++ {
+			go func() {
+				for task := range readPool.tasks {
+					task()
+				}
+			}()
+		}
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(len(reqs))
+	for i := range reqs {
+		req := &reqs[i]
+		task := func() {
+			defer wg.Done()
+			req.N, req.Err = s.Read(req.Buf, req.Offset)
+		}
+		select {
+		case readPool.tasks <- task:
+		default:
+			task()
+		}
+	}
+	wg.Wait()
+	return firstReadErr(reqs)
+}
+
+func firstReadErr(reqs []ReadReq) error {
+	for i := range reqs {
+		if reqs[i].Err != nil {
+			return reqs[i].Err
+		}
+	}
+	return nil
+}
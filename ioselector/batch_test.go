@@ -0,0 +1,57 @@
+package ioselector
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIOSelector_ReadBatch(t *testing.T) {
+	t.Run("fileIo", func(t *testing.T) {
+		testReadBatch(t, NewFileIOSelector)
+	})
+
+	t.Run("mmap", func(t *testing.T) {
+		testReadBatch(t, NewMMapSelector)
+	})
+
+	t.Run("directIo", func(t *testing.T) {
+		testReadBatch(t, NewDirectIOSelector)
+	})
+}
+
+func testReadBatch(t *testing.T, newSelector func(string, int64) (IOSelector, error)) {
+	path := filepath.Join("/tmp", "read-batch.txt")
+	defer func() { _ = os.Remove(path) }()
+	selector, err := newSelector(path, 1<<20)
+	assert.Nil(t, err)
+	defer func() { _ = selector.Close() }()
+
+	var reqs []ReadReq
+	for i := 0; i < 100; i++ {
+		data := []byte(fmt.Sprintf("yoimiya-%03d", i))
+		offset := int64(i * 1000)
+		_, err := selector.Write(data, offset)
+		assert.Nil(t, err)
+		reqs = append(reqs, ReadReq{Buf: make([]byte, len(data)), Offset: offset})
+	}
+	assert.Nil(t, selector.ReadBatch(reqs))
+	for i, req := range reqs {
+		assert.Nil(t, req.Err)
+		assert.Equal(t, len(req.Buf), req.N)
+		assert.Equal(t, fmt.Sprintf("yoimiya-%03d", i), string(req.Buf))
+	}
+
+	// the error of each request is returned in it.
+	reqs = []ReadReq{
+		{Buf: make([]byte, 11), Offset: 0},
+		{Buf: make([]byte, 11), Offset: 1 << 20},
+	}
+	assert.Equal(t, io.EOF, selector.ReadBatch(reqs))
+	assert.Nil(t, reqs[0].Err)
+	assert.Equal(t, "yoimiya-000", string(reqs[0].Buf))
+	assert.Equal(t, io.EOF, reqs[1].Err)
+}
@@ -0,0 +1,246 @@
+package ioselector
+
+import (
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// BlockSize offsets, sizes and memory addresses of direct I/O must be aligned to it.
+	BlockSize = 4096
+
+	// maxDirectIOSize the max size of a single aligned read or write.
+	maxDirectIOSize = 256 * BlockSize
+)
+
+// DirectIOSelector represents using direct I/O, which bypasses the page cache of the OS.
+// All I/O is done with aligned buffers, the block at the end of appended data is kept in memory
+// until it is full or Sync is called, so small appends won't write the same block again and again.
+// It is useful for large sequential workloads, like bulk loading, which would evict the whole page cache otherwise.
+type DirectIOSelector struct {
+	mu   sync.RWMutex
+	fd   *os.File
+	size int64 // logical size of the file, writing the whole tail block may make the file larger than it.
+
+	// tail is the cached block which starts at tailOff, tailDirty represents it is not written to disk yet.
+	tail      []byte
+	tailOff   int64
+	tailValid bool
+	tailDirty bool
+}
+
+// NewDirectIOSelector create a new direct io selector.
+func NewDirectIOSelector(fName string, fsize int64) (IOSelector, error) {
+	if fsize <= 0 {
+		return nil, ErrInvalidFsize
+	}
+	file, err := openDirectFile(fName, fsize)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &DirectIOSelector{fd: file, size: stat.Size(), tail: alignedBlock(BlockSize)}, nil
+}
+
+// Write copy slice b into the file at offset.
+// The partial blocks at both ends of b are merged with the data on disk, so offset needn't be aligned.
+func (dio *DirectIOSelector) Write(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+
+	if end := offset + int64(len(b)); end > dio.size {
+		dio.size = end
+	}
+	written := 0
+	for written < len(b) {
+		off := offset + int64(written)
+		blockOff := alignDown(off)
+		// write full blocks directly if the tail block is not involved.
+		if off == blockOff && int64(len(b)-written) >= BlockSize &&
+			!(dio.tailValid && dio.tailOff >= off && dio.tailOff < off+int64(len(b)-written)) {
+			n, err := dio.writeBlocks(b[written:], off)
+			written += n
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		if err := dio.loadTail(blockOff, off-blockOff, len(b)-written); err != nil {
+			return written, err
+		}
+		n := copy(dio.tail[off-blockOff:], b[written:])
+		written += n
+		dio.tailDirty = true
+		// the tail block is full, no need to keep it in memory.
+		if off-blockOff+int64(n) == BlockSize {
+			if err := dio.flushTail(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Read copy data from the file into slice b at offset, data in the cached tail block is also visible.
+// Just like os.File ReadAt, it returns io.EOF if fewer than len(b) bytes are read.
+func (dio *DirectIOSelector) Read(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	dio.mu.RLock()
+	defer dio.mu.RUnlock()
+
+	start, end := alignDown(offset), alignUp(offset+int64(len(b)))
+	buf := alignedBlock(int(end - start))
+	n, err := dio.fd.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	// the cached tail block is newer than the block on disk.
+	if dio.tailValid && dio.tailOff >= start && dio.tailOff < end {
+		copy(buf[dio.tailOff-start:], dio.tail)
+		if tailEnd := int(dio.tailOff - start + BlockSize); tailEnd > n {
+			n = tailEnd
+		}
+	}
+	if limit := int(dio.size - start); n > limit {
+		n = limit
+	}
+
+	if n <= int(offset-start) {
+		return 0, io.EOF
+	}
+	read := copy(b, buf[offset-start:n])
+	if read < len(b) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// ReadBatch reads the requests one by one.
+func (dio *DirectIOSelector) ReadBatch(reqs []ReadReq) error {
+	return readBatch(dio, reqs)
+}
+
+// Sync writes the cached tail block and commits the current contents of the file to stable storage.
+func (dio *DirectIOSelector) Sync() error {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+
+	if err := dio.flushTail(); err != nil {
+		return err
+	}
+	return dio.fd.Sync()
+}
+
+// Close writes the cached tail block and close the file.
+func (dio *DirectIOSelector) Close() error {
+	dio.mu.Lock()
+	defer dio.mu.Unlock()
+
+	if err := dio.flushTail(); err != nil {
+		return err
+	}
+	stat, err := dio.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() > dio.size {
+		if err := dio.fd.Truncate(dio.size); err != nil {
+			return err
+		}
+	}
+	return dio.fd.Close()
+}
+
+// Delete close and remove the file, the cached tail block is discarded.
+func (dio *DirectIOSelector) Delete() error {
+	dio.mu.Lock()
+	dio.tailValid, dio.tailDirty = false, false
+	dio.mu.Unlock()
+
+	if err := dio.fd.Close(); err != nil {
+		return err
+	}
+	return os.Remove(dio.fd.Name())
+}
+
+// writeBlocks writes the full blocks at the beginning of b to the file at the aligned offset.
+func (dio *DirectIOSelector) writeBlocks(b []byte, offset int64) (int, error) {
+	size := alignDown(int64(len(b)))
+	if size > maxDirectIOSize {
+		size = maxDirectIOSize
+	}
+	buf := alignedBlock(int(size))
+	copy(buf, b)
+	return dio.fd.WriteAt(buf, offset)
+}
+
+// loadTail makes the block at blockOff the tail block, the former tail block is written if it is dirty.
+// The block is read from disk unless the following write of size bytes at pos will cover it entirely.
+func (dio *DirectIOSelector) loadTail(blockOff, pos int64, size int) error {
+	if dio.tailValid && dio.tailOff == blockOff {
+		return nil
+	}
+	if err := dio.flushTail(); err != nil {
+		return err
+	}
+	dio.tailValid = false
+	if pos == 0 && size >= BlockSize {
+		dio.tailOff, dio.tailValid = blockOff, true
+		return nil
+	}
+
+	n, err := dio.fd.ReadAt(dio.tail, blockOff)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for i := n; i < BlockSize; i++ {
+		dio.tail[i] = 0
+	}
+	dio.tailOff, dio.tailValid = blockOff, true
+	return nil
+}
+
+func (dio *DirectIOSelector) flushTail() error {
+	if !dio.tailValid || !dio.tailDirty {
+		return nil
+	}
+	if _, err := dio.fd.WriteAt(dio.tail, dio.tailOff); err != nil {
+		return err
+	}
+	dio.tailDirty = false
+	return nil
+}
+
+// alignedBlock returns a byte slice of size whose address is aligned to BlockSize.
+func alignedBlock(size int) []byte {
+	buf := make([]byte, size+BlockSize)
+	remainder := int(uintptr(unsafe.Pointer(&buf[0])) & (BlockSize - 1))
+	start := 0
+	if remainder != 0 {
+		start = BlockSize - remainder
+	}
+	return buf[start : start+size : start+size]
+}
+
+func alignDown(n int64) int64 {
+	return n &^ (BlockSize - 1)
+}
+
+func alignUp(n int64) int64 {
+	return alignDown(n + BlockSize - 1)
+}
@@ -0,0 +1,19 @@
+package ioselector
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// openDirectFile open the file and turn data caching off by F_NOCACHE, there is no O_DIRECT on darwin.
+func openDirectFile(fName string, fSize int64) (*os.File, error) {
+	fd, err := openFile(fName, fSize)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unix.FcntlInt(fd.Fd(), unix.F_NOCACHE, 1); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return fd, nil
+}
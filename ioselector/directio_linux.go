@@ -0,0 +1,11 @@
+package ioselector
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirectFile open the file with O_DIRECT, so reads and writes bypass the page cache.
+func openDirectFile(fName string, fSize int64) (*os.File, error) {
+	return openFileWithFlag(fName, syscall.O_DIRECT, fSize)
+}
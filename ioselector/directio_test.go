@@ -0,0 +1,94 @@
+package ioselector
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirectIOSelector_WriteRead(t *testing.T) {
+	path := filepath.Join("/tmp", "directio-rw.txt")
+	defer func() { _ = os.Remove(path) }()
+	dio, err := NewDirectIOSelector(path, 100)
+	assert.Nil(t, err)
+
+	big := bytes.Repeat([]byte("yoimiya"), 3000)
+	tests := []struct {
+		name   string
+		data   []byte
+		offset int64
+	}{
+		{"small-unaligned", []byte("yoimiya"), 3},
+		{"cross-block", []byte("yoimiya"), BlockSize - 3},
+		{"append-big", big, BlockSize + 4},
+		{"aligned-blocks", bytes.Repeat([]byte("a"), 2*BlockSize), 8 * BlockSize},
+		{"overwrite", []byte("genshin"), 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := dio.Write(tt.data, tt.offset)
+			assert.Nil(t, err)
+			assert.Equal(t, len(tt.data), n)
+
+			b := make([]byte, len(tt.data))
+			n, err = dio.Read(b, tt.offset)
+			assert.Nil(t, err)
+			assert.Equal(t, len(tt.data), n)
+			assert.Equal(t, tt.data, b)
+		})
+	}
+
+	// data written before is not broken by later writes.
+	b := make([]byte, 7)
+	_, err = dio.Read(b, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("yoigens"), b)
+
+	// read beyond the end of file.
+	size := int64(10 * BlockSize)
+	n, err := dio.Read(make([]byte, 10), size-4)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, io.EOF, err)
+
+	assert.Nil(t, dio.Close())
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, size, stat.Size())
+}
+
+func TestDirectIOSelector_Reopen(t *testing.T) {
+	path := filepath.Join("/tmp", "directio-reopen.txt")
+	defer func() { _ = os.Remove(path) }()
+	dio, err := NewDirectIOSelector(path, 1000)
+	assert.Nil(t, err)
+	_, err = dio.Write([]byte("yoimiya"), 993)
+	assert.Nil(t, err)
+	assert.Nil(t, dio.Sync())
+	assert.Nil(t, dio.Close())
+
+	// the file is not extended by the padding of the tail block.
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), stat.Size())
+
+	fio, err := NewFileIOSelector(path, 1000)
+	assert.Nil(t, err)
+	defer func() { _ = fio.Close() }()
+	b := make([]byte, 7)
+	_, err = fio.Read(b, 993)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("yoimiya"), b)
+}
+
+func TestDirectIOSelector_Delete(t *testing.T) {
+	path := filepath.Join("/tmp", "directio-delete.txt")
+	dio, err := NewDirectIOSelector(path, 100)
+	assert.Nil(t, err)
+
+	assert.Nil(t, dio.Delete())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
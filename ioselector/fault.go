@@ -0,0 +1,229 @@
+package ioselector
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	// ErrInjectedFault the write is failed by FaultInjector.
+	ErrInjectedFault = errors.New("ioselector: injected fault")
+
+	// ErrCrashed the selector is unusable after a simulated crash.
+	ErrCrashed = errors.New("ioselector: simulated crash")
+)
+
+type writeFault int8
+
+const (
+	noFault writeFault = iota
+	failWrite
+	shortWrite
+	corruptWrite
+)
+
+// FaultInjector injects faults into the selectors wrapped by it, for testing error handling and crash recovery.
+// Faults are one-shot, each FailWrites, ShortWrites and CorruptWrites affects the next n writes of all wrapped selectors.
+type FaultInjector struct {
+	mu            sync.Mutex
+	failWrites    int
+	shortWrites   int
+	corruptWrites int
+	selectors     map[*FaultSelector]struct{}
+}
+
+// FaultSelector is an IOSelector wrapped by FaultInjector.
+// It remembers the data overwritten by writes since the last Sync, so that they can be dropped on a simulated crash.
+type FaultSelector struct {
+	mu       sync.Mutex
+	selector IOSelector
+	injector *FaultInjector
+	undo     []undoRecord
+	crashed  bool
+}
+
+// undoRecord is the data at offset before an un-synced write.
+type undoRecord struct {
+	offset int64
+	data   []byte
+}
+
+// NewFaultInjector create a new FaultInjector.
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{selectors: make(map[*FaultSelector]struct{})}
+}
+
+// Wrap returns a FaultSelector wrapping selector.
+func (fi *FaultInjector) Wrap(selector IOSelector) IOSelector {
+	fs := &FaultSelector{selector: selector, injector: fi}
+	fi.mu.Lock()
+	fi.selectors[fs] = struct{}{}
+	fi.mu.Unlock()
+	return fs
+}
+
+// FailWrites makes the next n writes fail with ErrInjectedFault, nothing is written.
+func (fi *FaultInjector) FailWrites(n int) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.failWrites = n
+}
+
+// ShortWrites makes the next n writes only write the first half of data, and return io.ErrShortWrite.
+func (fi *FaultInjector) ShortWrites(n int) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.shortWrites = n
+}
+
+// CorruptWrites makes the next n writes flip a byte in the middle of data silently.
+func (fi *FaultInjector) CorruptWrites(n int) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.corruptWrites = n
+}
+
+// Crash simulates a crash of the machine: all the un-synced writes of wrapped selectors are dropped,
+// and the selectors can't be used anymore, except Close and Delete.
+// Selectors wrapped after the crash work as usual, so the files can be opened again to test recovery.
+func (fi *FaultInjector) Crash() error {
+	fi.mu.Lock()
+	selectors := fi.selectors
+	fi.selectors = make(map[*FaultSelector]struct{})
+	fi.mu.Unlock()
+
+	var firstErr error
+	for fs := range selectors {
+		if err := fs.crash(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (fi *FaultInjector) nextWriteFault() writeFault {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	switch {
+	case fi.failWrites > 0:
+		fi.failWrites--
+		return failWrite
+	case fi.shortWrites > 0:
+		fi.shortWrites--
+		return shortWrite
+	case fi.corruptWrites > 0:
+		fi.corruptWrites--
+		return corruptWrite
+	}
+	return noFault
+}
+
+func (fi *FaultInjector) remove(fs *FaultSelector) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	delete(fi.selectors, fs)
+}
+
+// Write writes b at offset, with the fault injected if any.
+func (fs *FaultSelector) Write(b []byte, offset int64) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashed {
+		return 0, ErrCrashed
+	}
+
+	data := b
+	fault := fs.injector.nextWriteFault()
+	switch fault {
+	case failWrite:
+		return 0, ErrInjectedFault
+	case shortWrite:
+		data = b[:len(b)/2]
+	case corruptWrite:
+		if len(b) > 0 {
+			data = make([]byte, len(b))
+			copy(data, b)
+			data[len(data)/2] ^= 0xff
+		}
+	}
+
+	// remember the old data, bytes beyond the end of file are zeros.
+	old := make([]byte, len(data))
+	if _, err := fs.selector.Read(old, offset); err != nil && err != io.EOF {
+		return 0, err
+	}
+	fs.undo = append(fs.undo, undoRecord{offset: offset, data: old})
+
+	n, err := fs.selector.Write(data, offset)
+	if err == nil && fault == shortWrite {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// Read reads from the wrapped selector.
+func (fs *FaultSelector) Read(b []byte, offset int64) (int, error) {
+	fs.mu.Lock()
+	crashed := fs.crashed
+	fs.mu.Unlock()
+	if crashed {
+		return 0, ErrCrashed
+	}
+	return fs.selector.Read(b, offset)
+}
+
+// ReadBatch reads from the wrapped selector.
+func (fs *FaultSelector) ReadBatch(reqs []ReadReq) error {
+	fs.mu.Lock()
+	crashed := fs.crashed
+	fs.mu.Unlock()
+	if crashed {
+		for i := range reqs {
+			reqs[i].N, reqs[i].Err = 0, ErrCrashed
+		}
+		return ErrCrashed
+	}
+	return fs.selector.ReadBatch(reqs)
+}
+
+// Sync syncs the wrapped selector, writes before it won't be dropped by crash.
+func (fs *FaultSelector) Sync() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.crashed {
+		return ErrCrashed
+	}
+	if err := fs.selector.Sync(); err != nil {
+		return err
+	}
+	fs.undo = nil
+	return nil
+}
+
+// Close closes the wrapped selector.
+func (fs *FaultSelector) Close() error {
+	fs.injector.remove(fs)
+	return fs.selector.Close()
+}
+
+// Delete deletes the wrapped selector.
+func (fs *FaultSelector) Delete() error {
+	fs.injector.remove(fs)
+	return fs.selector.Delete()
+}
+
+// crash restores the data overwritten by un-synced writes in reverse order.
+func (fs *FaultSelector) crash() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.crashed = true
+	for i := len(fs.undo) - 1; i >= 0; i-- {
+		record := fs.undo[i]
+		if _, err := fs.selector.Write(record.data, record.offset); err != nil {
+			return err
+		}
+	}
+	fs.undo = nil
+	return nil
+}
@@ -0,0 +1,72 @@
+package ioselector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestFaultInjector_Writes(t *testing.T) {
+	fi := NewFaultInjector()
+	mem, err := NewMemSelector(filepath.Join("/tmp", "fault-writes.txt"), 100)
+	assert.Nil(t, err)
+	fs := fi.Wrap(mem)
+	defer func() { _ = fs.Delete() }()
+
+	fi.FailWrites(1)
+	n, err := fs.Write([]byte("yoimiya"), 0)
+	assert.Equal(t, ErrInjectedFault, err)
+	assert.Equal(t, 0, n)
+
+	fi.ShortWrites(1)
+	n, err = fs.Write([]byte("yoimiya"), 0)
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Equal(t, 3, n)
+
+	fi.CorruptWrites(1)
+	_, err = fs.Write([]byte("yoimiya"), 0)
+	assert.Nil(t, err)
+	b := make([]byte, 7)
+	_, err = fs.Read(b, 0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, []byte("yoimiya"), b)
+
+	// faults are one-shot.
+	_, err = fs.Write([]byte("yoimiya"), 0)
+	assert.Nil(t, err)
+	_, err = fs.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("yoimiya"), b)
+}
+
+func TestFaultInjector_Crash(t *testing.T) {
+	path := filepath.Join("/tmp", "fault-crash.txt")
+	fi := NewFaultInjector()
+	mem, err := NewMemSelector(path, 100)
+	assert.Nil(t, err)
+	fs := fi.Wrap(mem)
+
+	_, err = fs.Write([]byte("synced"), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Sync())
+	_, err = fs.Write([]byte("lost"), 6)
+	assert.Nil(t, err)
+	_, err = fs.Write([]byte("LOST"), 0)
+	assert.Nil(t, err)
+
+	assert.Nil(t, fi.Crash())
+	_, err = fs.Write([]byte("yoimiya"), 0)
+	assert.Equal(t, ErrCrashed, err)
+	assert.Equal(t, ErrCrashed, fs.Sync())
+	assert.Nil(t, fs.Close())
+
+	// only the synced data is left after crash.
+	mem, err = NewMemSelector(path, 100)
+	assert.Nil(t, err)
+	defer func() { _ = mem.Delete() }()
+	b := make([]byte, 10)
+	_, err = mem.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("synced\x00\x00\x00\x00"), b)
+}
@@ -20,6 +20,10 @@ type IOSelector interface {
 	// It returns the number of bytes read and an error, if any.
 	Read(b []byte, offset int64) (int, error)
 
+	// ReadBatch reads all the requests, the result of each read is set in its ReadReq.
+	// It returns the first error of the requests, if any.
+	ReadBatch(reqs []ReadReq) error
+
 	// Sync commits the current contents of the file to stable storage.
 	// Typically, this means flushing the file system's in-memory copy of recently written data to disk.
 	Sync() error
@@ -32,8 +36,20 @@ type IOSelector interface {
 	Delete() error
 }
 
+// Viewer is implemented by the IOSelector which can read without copying, like MMapSelector.
+type Viewer interface {
+	// View returns n bytes at offset which alias the underlying storage, the bytes must not be modified.
+	// They are only valid until release is called, and release must be called exactly once.
+	View(offset, n int64) (b []byte, release func(), err error)
+}
+
 func openFile(fName string, fSize int64) (*os.File, error) {
-	fd, err := os.OpenFile(fName, os.O_CREATE|os.O_RDWR, FilePerm)
+	return openFileWithFlag(fName, 0, fSize)
+}
+
+// openFileWithFlag open or create the file with extra flag, and make sure its size is at least fSize.
+func openFileWithFlag(fName string, flag int, fSize int64) (*os.File, error) {
+	fd, err := os.OpenFile(fName, os.O_CREATE|os.O_RDWR|flag, FilePerm)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,182 @@
+package ioselector
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// memFiles holds all the in-memory files by their names, so a file can be opened again after it is closed.
+var memFiles = struct {
+	sync.Mutex
+	files map[string]*memFile
+}{files: make(map[string]*memFile)}
+
+type memFile struct {
+	mu   sync.RWMutex
+	data []byte
+	size int64 // bytes between len(data) and size are zeros.
+}
+
+// MemSelector represents using a growable byte slice in memory as the file, nothing is written to disk.
+// Files are kept in memory until they are deleted, and can be opened again by their names after closed.
+// It is mainly for tests, see FaultInjector for simulating disk faults and crashes.
+type MemSelector struct {
+	name   string
+	file   *memFile
+	closed bool
+}
+
+// NewMemSelector create a new in-memory selector, it opens the in-memory file of fName if it exists.
+func NewMemSelector(fName string, fsize int64) (IOSelector, error) {
+	if fsize <= 0 {
+		return nil, ErrInvalidFsize
+	}
+	name := filepath.Clean(fName)
+	memFiles.Lock()
+	defer memFiles.Unlock()
+	file, ok := memFiles.files[name]
+	if !ok {
+		file = &memFile{}
+		memFiles.files[name] = file
+	}
+	file.mu.Lock()
+	if file.size < fsize {
+		file.size = fsize
+	}
+	file.mu.Unlock()
+	return &MemSelector{name: name, file: file}, nil
+}
+
+// MemFileNames returns the base names of in-memory files in dir, in sorted order.
+func MemFileNames(dir string) []string {
+	dir = filepath.Clean(dir)
+	memFiles.Lock()
+	defer memFiles.Unlock()
+	var names []string
+	for name := range memFiles.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RemoveMemFiles removes all the in-memory files in dir.
+func RemoveMemFiles(dir string) {
+	dir = filepath.Clean(dir)
+	memFiles.Lock()
+	defer memFiles.Unlock()
+	for name := range memFiles.files {
+		if filepath.Dir(name) == dir {
+			delete(memFiles.files, name)
+		}
+	}
+}
+
+// Write copy slice b into the file at offset, the file grows if necessary.
+func (mem *MemSelector) Write(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f := mem.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if mem.closed {
+		return 0, os.ErrClosed
+	}
+
+	end := offset + int64(len(b))
+	if end > int64(len(f.data)) {
+		if end > int64(cap(f.data)) {
+			newCap := 2 * int64(cap(f.data))
+			if newCap < end {
+				newCap = end
+			}
+			data := make([]byte, len(f.data), newCap)
+			copy(data, f.data)
+			f.data = data
+		}
+		f.data = f.data[:end]
+	}
+	if end > f.size {
+		f.size = end
+	}
+	return copy(f.data[offset:], b), nil
+}
+
+// Read copy data from the file into slice b at offset.
+// Just like os.File ReadAt, it returns io.EOF if fewer than len(b) bytes are read.
+func (mem *MemSelector) Read(b []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f := mem.file
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if mem.closed {
+		return 0, os.ErrClosed
+	}
+
+	if offset >= f.size {
+		return 0, io.EOF
+	}
+	n := len(b)
+	if remain := f.size - offset; int64(n) > remain {
+		n = int(remain)
+	}
+	copied := 0
+	if offset < int64(len(f.data)) {
+		copied = copy(b[:n], f.data[offset:])
+	}
+	for i := copied; i < n; i++ {
+		b[i] = 0
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// ReadBatch reads the requests one by one.
+func (mem *MemSelector) ReadBatch(reqs []ReadReq) error {
+	return readBatch(mem, reqs)
+}
+
+// Sync does nothing, there is no stable storage.
+func (mem *MemSelector) Sync() error {
+	mem.file.mu.RLock()
+	defer mem.file.mu.RUnlock()
+	if mem.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+// Close the selector, the data is kept in memory.
+func (mem *MemSelector) Close() error {
+	mem.file.mu.Lock()
+	defer mem.file.mu.Unlock()
+	if mem.closed {
+		return os.ErrClosed
+	}
+	mem.closed = true
+	return nil
+}
+
+// Delete the in-memory file.
+func (mem *MemSelector) Delete() error {
+	mem.file.mu.Lock()
+	mem.closed = true
+	mem.file.mu.Unlock()
+	memFiles.Lock()
+	defer memFiles.Unlock()
+	if memFiles.files[mem.name] != mem.file {
+		return os.ErrNotExist
+	}
+	delete(memFiles.files, mem.name)
+	return nil
+}
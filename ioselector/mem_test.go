@@ -0,0 +1,69 @@
+package ioselector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemSelector_WriteRead(t *testing.T) {
+	path := filepath.Join("/tmp", "mem-rw.txt")
+	mem, err := NewMemSelector(path, 100)
+	assert.Nil(t, err)
+	defer func() { _ = mem.Delete() }()
+
+	tests := []struct {
+		name    string
+		size    int
+		offset  int64
+		wantN   int
+		wantErr error
+	}{
+		{"written", 7, 10, 7, nil},
+		{"zeros", 5, 50, 5, nil},
+		{"partial", 10, 195, 5, io.EOF},
+		{"beyond-end", 1, 200, 0, io.EOF},
+	}
+	_, err = mem.Write([]byte("yoimiya"), 10)
+	assert.Nil(t, err)
+	// the file grows beyond fsize.
+	_, err = mem.Write([]byte("yoimiya"), 193)
+	assert.Nil(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := make([]byte, tt.size)
+			n, err := mem.Read(b, tt.offset)
+			assert.Equal(t, tt.wantN, n)
+			assert.Equal(t, tt.wantErr, err)
+		})
+	}
+}
+
+func TestMemSelector_Reopen(t *testing.T) {
+	path := filepath.Join("/tmp", "mem-reopen", "mem.txt")
+	mem, err := NewMemSelector(path, 100)
+	assert.Nil(t, err)
+	_, err = mem.Write([]byte("yoimiya"), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, mem.Close())
+	assert.Equal(t, os.ErrClosed, mem.Close())
+	_, err = mem.Read(make([]byte, 1), 0)
+	assert.Equal(t, os.ErrClosed, err)
+
+	assert.Equal(t, []string{"mem.txt"}, MemFileNames(filepath.Dir(path)))
+	mem, err = NewMemSelector(path, 100)
+	assert.Nil(t, err)
+	b := make([]byte, 7)
+	_, err = mem.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("yoimiya"), b)
+
+	assert.Nil(t, mem.Delete())
+	assert.Nil(t, MemFileNames(filepath.Dir(path)))
+	// nothing is written to disk.
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -3,17 +3,42 @@ package ioselector
 import (
 	"io"
 	"os"
+	"sync"
+	"yoimiya/logger"
 	"yoimiya/mmap"
 )
 
 // MMapSelector represents using memory-mapped file I/O
 type MMapSelector struct {
-	fd     *os.File
-	buf    []byte
-	bufLen int64
+	mu       sync.RWMutex // the mapping can't be read or written while it is remapped.
+	fd       *os.File
+	m        *mapping   // nil if the selector is closed.
+	retired  []*mapping // retired mappings which may still be referred by views.
+	growable bool
 }
 
+// mapping is a mapped region of the file.
+// It is retired when the file is remapped or closed, and unmapped when no view refers to it.
+type mapping struct {
+	mu      sync.Mutex
+	buf     []byte
+	refs    int
+	retired bool
+	release func() // releases a view, it is created once so that View won't allocate.
+}
+
+// NewMMapSelector create a new mmap selector, the file will be mapped with fsize.
 func NewMMapSelector(fname string, fsize int64) (IOSelector, error) {
+	return newMMapSelector(fname, fsize, false)
+}
+
+// NewGrowableMMapSelector create a new mmap selector just like NewMMapSelector,
+// but writing beyond the end of mapped region will extend the file and remap it, instead of returning io.EOF.
+func NewGrowableMMapSelector(fname string, fsize int64) (IOSelector, error) {
+	return newMMapSelector(fname, fsize, true)
+}
+
+func newMMapSelector(fname string, fsize int64, growable bool) (*MMapSelector, error) {
 	if fsize <= 0 {
 		return nil, ErrInvalidFsize
 	}
@@ -21,63 +46,249 @@ func NewMMapSelector(fname string, fsize int64) (IOSelector, error) {
 	if err != nil {
 		return nil, err
 	}
-	buf, err := mmap.Mmap(file, true, fsize)
+	m, err := newMapping(file, fsize)
 	if err != nil {
+		_ = file.Close()
 		return nil, err
 	}
-	return &MMapSelector{fd: file, buf: buf, bufLen: int64(len(buf))}, nil
+	return &MMapSelector{fd: file, m: m, growable: growable}, nil
+}
+
+func newMapping(fd *os.File, size int64) (*mapping, error) {
+	buf, err := mmap.Mmap(fd, true, size)
+	if err != nil {
+		return nil, err
+	}
+	m := &mapping{buf: buf}
+	m.release = m.releaseView
+	return m, nil
 }
 
 // Write copy slice b into mapped region(buf) at offset.
+// If the selector is growable, the mapped region will be extended to hold b, otherwise io.EOF is returned.
 func (ms *MMapSelector) Write(b []byte, offset int64) (int, error) {
 	length := int64(len(b))
 	if length <= 0 {
 		return 0, nil
 	}
-	if offset < 0 || length+offset > ms.bufLen {
+	if offset < 0 {
+		return 0, io.EOF
+	}
+
+	ms.mu.RLock()
+	if ms.m != nil && length+offset <= int64(len(ms.m.buf)) {
+		n := copy(ms.m.buf[offset:], b)
+		ms.mu.RUnlock()
+		return n, nil
+	}
+	ms.mu.RUnlock()
+
+	if !ms.growable {
 		return 0, io.EOF
 	}
-	return copy(ms.buf[offset:], b), nil
+	// double the size at least, so that appending won't remap too often.
+	size := ms.getLen() * 2
+	if size < offset+length {
+		size = offset + length
+	}
+	if err := ms.Grow(size); err != nil {
+		return 0, err
+	}
+	return ms.Write(b, offset)
 }
 
 // Read copy data from mapped region(buf) into slice b at offset.
+// Just like os.File ReadAt, if the end of mapped region is reached before b is filled, it returns the bytes read and io.EOF.
 func (ms *MMapSelector) Read(b []byte, offset int64) (int, error) {
-	if offset < 0 || offset >= ms.bufLen {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if ms.m == nil || offset < 0 || offset >= int64(len(ms.m.buf)) {
 		return 0, io.EOF
 	}
-	if offset+int64(len(b)) >= ms.bufLen {
-		return 0, io.EOF
+	n := copy(b, ms.m.buf[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// View returns n bytes at offset which alias the mapped region, nothing is copied.
+// The bytes must not be modified, and are only valid until release is called, release must be called exactly once.
+// The mapped region won't be unmapped by Grow, Close or Delete until all the views of it are released.
+// Just like Read, if the end of mapped region is reached, it returns the bytes before the end and io.EOF.
+func (ms *MMapSelector) View(offset, n int64) ([]byte, func(), error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if ms.m == nil || offset < 0 || offset >= int64(len(ms.m.buf)) {
+		return nil, nil, io.EOF
+	}
+	var err error
+	end := offset + n
+	if end > int64(len(ms.m.buf)) {
+		end, err = int64(len(ms.m.buf)), io.EOF
+	}
+	ms.m.mu.Lock()
+	ms.m.refs++
+	ms.m.mu.Unlock()
+	return ms.m.buf[offset:end:end], ms.m.release, err
+}
+
+// ReadBatch reads the requests one by one, there is nothing to wait for in mapped region.
+func (ms *MMapSelector) ReadBatch(reqs []ReadReq) error {
+	return readBatch(ms, reqs)
+}
+
+// Grow extends the file to size and remaps it, it does nothing if size is not larger than current size.
+func (ms *MMapSelector) Grow(size int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.m == nil {
+		return os.ErrClosed
+	}
+	if size <= int64(len(ms.m.buf)) {
+		return nil
+	}
+	if err := ms.fd.Truncate(size); err != nil {
+		return err
 	}
-	return copy(b, ms.buf[offset:]), nil
+	m, err := newMapping(ms.fd, size)
+	if err != nil {
+		return err
+	}
+	// the old mapping shares the same pages with the new one, so there is no need to sync it.
+	if err := ms.retireMapping(); err != nil {
+		return err
+	}
+	ms.m = m
+	return nil
 }
 
 // Sync synchronize the mapped buffer to the file's contents on disk.
 func (ms *MMapSelector) Sync() error {
-	return mmap.Msync(ms.buf)
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if ms.m == nil {
+		return os.ErrClosed
+	}
+	return mmap.Msync(ms.m.buf)
 }
 
 // Close sync/unmap mapped buffer and close fd.
+// If there are views not released, the mapped buffer is unmapped when they are released.
 func (ms *MMapSelector) Close() error {
-	if err := mmap.Msync(ms.buf); err != nil {
-		return nil
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.m == nil {
+		return os.ErrClosed
 	}
-	if err := mmap.Munmap(ms.buf); err != nil {
-		return nil
+	if err := mmap.Msync(ms.m.buf); err != nil {
+		return err
+	}
+	if err := ms.unmap(); err != nil {
+		return err
 	}
 	return ms.fd.Close()
 }
 
+// Delete unmap mapped buffer, and remove the file.
+// If there are views not released, the file is only removed, its pages stay valid until the views are released.
 func (ms *MMapSelector) Delete() error {
-	if err := mmap.Munmap(ms.buf); err != nil {
-		return nil
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.m != nil {
+		if err := ms.unmap(); err != nil {
+			return err
+		}
+		if err := ms.fd.Close(); err != nil {
+			return err
+		}
 	}
-	ms.buf = nil
+	// truncating a file still mapped by views makes reading them fault with SIGBUS,
+	// the views may refer to any retired mapping, since the selector may be closed or remapped before.
+	if !ms.viewed() {
+		if err := os.Truncate(ms.fd.Name(), 0); err != nil {
+			return err
+		}
+	}
+	return os.Remove(ms.fd.Name())
+}
 
-	if err := ms.fd.Truncate(0); err != nil {
-		return nil
+func (ms *MMapSelector) unmap() error {
+	if err := ms.retireMapping(); err != nil {
+		return err
+	}
+	ms.m = nil
+	return nil
+}
+
+// retireMapping retires the current mapping, and keeps the retired mappings which are still viewed.
+func (ms *MMapSelector) retireMapping() error {
+	if err := ms.m.retire(); err != nil {
+		return err
+	}
+	retired := ms.retired[:0]
+	for _, m := range append(ms.retired, ms.m) {
+		if m.viewed() {
+			retired = append(retired, m)
+		}
+	}
+	ms.retired = retired
+	return nil
+}
+
+// viewed reports whether there are views of any mapping not released.
+func (ms *MMapSelector) viewed() bool {
+	if ms.m != nil && ms.m.viewed() {
+		return true
+	}
+	for _, m := range ms.retired {
+		if m.viewed() {
+			return true
+		}
+	}
+	return false
+}
+
+func (ms *MMapSelector) getLen() int64 {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.m == nil {
+		return 0
 	}
-	if err := ms.fd.Close(); err != nil {
+	return int64(len(ms.m.buf))
+}
+
+// retire unmaps the mapping, or leaves it to the last view if there are views not released.
+func (m *mapping) retire() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retired = true
+	if m.refs > 0 {
 		return nil
 	}
-	return os.Remove(ms.fd.Name())
+	return mmap.Munmap(m.buf)
+}
+
+// viewed reports whether there are views not released.
+func (m *mapping) viewed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.refs > 0
+}
+
+func (m *mapping) releaseView() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refs--
+	if m.refs == 0 && m.retired {
+		if err := mmap.Munmap(m.buf); err != nil {
+			logger.Error("munmap err: %v", err)
+		}
+	}
 }
@@ -0,0 +1,180 @@
+package ioselector
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMMapSelector_Read(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-read.txt")
+	defer func() { _ = os.Remove(path) }()
+	ms, err := NewMMapSelector(path, 100)
+	assert.Nil(t, err)
+	defer func() { _ = ms.Close() }()
+
+	_, err = ms.Write([]byte("yoimiya"), 93)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name    string
+		size    int
+		offset  int64
+		wantN   int
+		wantErr error
+	}{
+		{"exact-end", 7, 93, 7, nil},
+		{"partial", 10, 93, 7, io.EOF},
+		{"at-end", 1, 100, 0, io.EOF},
+		{"beyond-end", 1, 200, 0, io.EOF},
+		{"negative", 1, -1, 0, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := make([]byte, tt.size)
+			n, err := ms.Read(b, tt.offset)
+			assert.Equal(t, tt.wantN, n)
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantN > 0 {
+				assert.Equal(t, []byte("yoimiya"), b[:tt.wantN])
+			}
+		})
+	}
+}
+
+func TestMMapSelector_Write(t *testing.T) {
+	t.Run("fixed", func(t *testing.T) {
+		path := filepath.Join("/tmp", "mmap-write.txt")
+		defer func() { _ = os.Remove(path) }()
+		ms, err := NewMMapSelector(path, 100)
+		assert.Nil(t, err)
+		defer func() { _ = ms.Close() }()
+
+		n, err := ms.Write([]byte("yoimiya"), 93)
+		assert.Nil(t, err)
+		assert.Equal(t, 7, n)
+		_, err = ms.Write([]byte("yoimiya"), 94)
+		assert.Equal(t, io.EOF, err)
+	})
+
+	t.Run("growable", func(t *testing.T) {
+		path := filepath.Join("/tmp", "mmap-grow.txt")
+		defer func() { _ = os.Remove(path) }()
+		ms, err := NewGrowableMMapSelector(path, 100)
+		assert.Nil(t, err)
+		defer func() { _ = ms.Close() }()
+
+		_, err = ms.Write([]byte("first"), 0)
+		assert.Nil(t, err)
+		n, err := ms.Write([]byte("yoimiya"), 98)
+		assert.Nil(t, err)
+		assert.Equal(t, 7, n)
+
+		stat, err := os.Stat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(200), stat.Size())
+
+		// data written before growing is kept.
+		b := make([]byte, 5)
+		_, err = ms.Read(b, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("first"), b)
+		b = make([]byte, 7)
+		_, err = ms.Read(b, 98)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("yoimiya"), b)
+	})
+}
+
+func TestMMapSelector_Close(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-close.txt")
+	defer func() { _ = os.Remove(path) }()
+	ms, err := NewMMapSelector(path, 100)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ms.Close())
+	assert.Equal(t, os.ErrClosed, ms.Close())
+	assert.Equal(t, os.ErrClosed, ms.Sync())
+	_, err = ms.Read(make([]byte, 1), 0)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMMapSelector_Delete(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-delete.txt")
+	ms, err := NewMMapSelector(path, 100)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ms.Delete())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMMapSelector_View(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-view.txt")
+	defer func() { _ = os.Remove(path) }()
+	selector, err := NewGrowableMMapSelector(path, 100)
+	assert.Nil(t, err)
+	ms := selector.(*MMapSelector)
+	_, err = ms.Write([]byte("yoimiya"), 93)
+	assert.Nil(t, err)
+
+	b, release, err := ms.View(93, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("yoimiya"), b)
+	// the view aliases the mapped region.
+	_, err = ms.Write([]byte("Y"), 93)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Yoimiya"), b)
+
+	partial, releasePartial, err := ms.View(95, 10)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []byte("imiya"), partial)
+	releasePartial()
+
+	// the old mapping is kept until the view is released.
+	_, err = ms.Write([]byte("genshin"), 200)
+	assert.Nil(t, err)
+	assert.Nil(t, ms.Close())
+	assert.Equal(t, []byte("Yoimiya"), b)
+	release()
+
+	_, _, err = ms.View(0, 1)
+	assert.Equal(t, io.EOF, err)
+
+	t.Run("delete", func(t *testing.T) {
+		selector, err := NewMMapSelector(path, 100)
+		assert.Nil(t, err)
+		ms := selector.(*MMapSelector)
+		_, err = ms.Write([]byte("yoimiya"), 0)
+		assert.Nil(t, err)
+		b, release, err := ms.View(0, 7)
+		assert.Nil(t, err)
+
+		// the file is removed, but the view is still readable until it is released.
+		assert.Nil(t, ms.Delete())
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+		assert.Equal(t, []byte("yoimiya"), b)
+		release()
+	})
+
+	t.Run("close-delete", func(t *testing.T) {
+		selector, err := NewMMapSelector(path, 100)
+		assert.Nil(t, err)
+		ms := selector.(*MMapSelector)
+		_, err = ms.Write([]byte("yoimiya"), 0)
+		assert.Nil(t, err)
+		b, release, err := ms.View(0, 7)
+		assert.Nil(t, err)
+
+		// the view refers to the retired mapping after closing, which must not be truncated by Delete.
+		assert.Nil(t, ms.Close())
+		assert.Nil(t, ms.Delete())
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+		assert.Equal(t, []byte("yoimiya"), b)
+		release()
+	})
+}
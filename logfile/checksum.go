@@ -0,0 +1,36 @@
+package logfile
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+// ErrUnsupportedChecksum unsupported checksum type.
+var ErrUnsupportedChecksum = errors.New("logfile: unsupported checksum type")
+
+// ChecksumType checksum algorithm of entries in log file, it is saved in the file header.
+type ChecksumType byte
+
+const (
+	// ChecksumIEEE CRC-32 with IEEE polynomial.
+	// Log files created before ChecksumType was introduced, including legacy ones, use it.
+	ChecksumIEEE ChecksumType = iota
+
+	// ChecksumCRC32C CRC-32 with Castagnoli polynomial, it is computed by SSE4.2 or ARMv8 CRC32 instructions if available,
+	// which is much faster than ChecksumIEEE.
+	ChecksumCRC32C
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crcTable returns the crc32 table of checksum type.
+func (ct ChecksumType) crcTable() (*crc32.Table, error) {
+	switch ct {
+	case ChecksumIEEE:
+		return crc32.IEEETable, nil
+	case ChecksumCRC32C:
+		return castagnoliTable, nil
+	default:
+		return nil, ErrUnsupportedChecksum
+	}
+}
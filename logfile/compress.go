@@ -0,0 +1,194 @@
+package logfile
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// CompressionType represents the algorithm used to compress the value of an entry.
+// It is stored in the type byte of an encoded entry, so there are at most 8 compression types.
+type CompressionType byte
+
+const (
+	// NoCompression the value is not compressed.
+	NoCompression CompressionType = iota
+
+	// FlateCompression the value is compressed by compress/flate, it is the default pure-go compressor.
+	FlateCompression
+)
+
+// maxFlateRatio the max ratio of the original size to the compressed size of deflate.
+const maxFlateRatio = 1032
+
+const (
+	// entryTypeMask low 4 bits of the type byte is EntryType.
+	entryTypeMask = 0x0f
+
+	// compressionShift bits 4-6 of the type byte is CompressionType.
+	compressionShift = 4
+	compressionMask  = 0x07
+)
+
+var (
+	// ErrUnsupportedCompression unsupported compression type, it must be registered before using.
+	ErrUnsupportedCompression = errors.New("logfile: unsupported compression type")
+
+	// ErrInvalidCompressedValue compressed value can't be decompressed.
+	ErrInvalidCompressedValue = errors.New("logfile: invalid compressed value")
+)
+
+// Compressor compresses and decompresses the value of entries.
+// Implementations must be safe for concurrent use.
+type Compressor interface {
+	// Type of the compressor, which is saved in entries to find the compressor while decompressing.
+	Type() CompressionType
+
+	// Compress src and returns the compressed data.
+	Compress(src []byte) ([]byte, error)
+
+	// Decompress src and returns the original data.
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	compressorsLock sync.RWMutex
+	compressors     = map[CompressionType]Compressor{
+		FlateCompression: NewFlateCompressor(flate.BestSpeed),
+	}
+)
+
+// RegisterCompressor registers a compressor, Snappy or zstd for example.
+// Compressor with the same type will be replaced, and NoCompression can't be registered.
+func RegisterCompressor(c Compressor) error {
+	typ := c.Type()
+	if typ == NoCompression || typ > compressionMask {
+		return ErrUnsupportedCompression
+	}
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	compressors[typ] = c
+	return nil
+}
+
+// UnregisterCompressor removes the registered compressor of typ, entries compressed by it can't be read then.
+func UnregisterCompressor(typ CompressionType) {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	delete(compressors, typ)
+}
+
+// GetCompressor returns the registered compressor of typ.
+func GetCompressor(typ CompressionType) (Compressor, error) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	c, ok := compressors[typ]
+	if !ok {
+		return nil, ErrUnsupportedCompression
+	}
+	return c, nil
+}
+
+// CompressEntry returns a copy of the entry whose value is compressed by c,
+// the compression type is saved in the type of the returned entry.
+// If the value is shorter than threshold, or compression doesn't make it smaller, e is returned as it is.
+func CompressEntry(e *LogEntry, c Compressor, threshold int) (*LogEntry, error) {
+	if e == nil || c == nil || len(e.Value) == 0 || len(e.Value) < threshold {
+		return e, nil
+	}
+	compressed, err := c.Compress(e.Value)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) >= len(e.Value) {
+		return e, nil
+	}
+	return &LogEntry{
+		Key:       e.Key,
+		Value:     compressed,
+		ExpiredAt: e.ExpiredAt,
+		Type:      e.Type&entryTypeMask | EntryType(c.Type())<<compressionShift,
+	}, nil
+}
+
+// decompressEntry decompresses the value of e in place if it is compressed, and removes the compression type in e.Type.
+func decompressEntry(e *LogEntry) error {
+	typ := CompressionType(e.Type>>compressionShift) & compressionMask
+	e.Type &= entryTypeMask
+	if typ == NoCompression {
+		return nil
+	}
+	c, err := GetCompressor(typ)
+	if err != nil {
+		return err
+	}
+	value, err := c.Decompress(e.Value)
+	if err != nil {
+		return err
+	}
+	e.Value = value
+	return nil
+}
+
+// FlateCompressor is a pure-go compressor using compress/flate.
+type FlateCompressor struct {
+	level   int
+	writers sync.Pool
+}
+
+// NewFlateCompressor create a new FlateCompressor with the given compression level, see compress/flate.
+func NewFlateCompressor(level int) *FlateCompressor {
+	return &FlateCompressor{level: level}
+}
+
+// Type returns FlateCompression.
+func (fc *FlateCompressor) Type() CompressionType {
+	return FlateCompression
+}
+
+// Compress src, the original size is saved as a varint before the compressed data.
+func (fc *FlateCompressor) Compress(src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, binary.MaxVarintLen64+len(src)/2))
+	var sizeBuf [binary.MaxVarintLen64]byte
+	buf.Write(sizeBuf[:binary.PutUvarint(sizeBuf[:], uint64(len(src)))])
+
+	var w *flate.Writer
+	if v := fc.writers.Get(); v != nil {
+		w = v.(*flate.Writer)
+		w.Reset(buf)
+	} else {
+		var err error
+		if w, err = flate.NewWriter(buf, fc.level); err != nil {
+			return nil, err
+		}
+	}
+	defer fc.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress src which is compressed by Compress.
+func (fc *FlateCompressor) Decompress(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	// the size is checked before allocating, a corrupted one may be huge.
+	if n <= 0 || size > uint64(len(src)-n)*maxFlateRatio {
+		return nil, ErrInvalidCompressedValue
+	}
+	r := flate.NewReader(bytes.NewReader(src[n:]))
+	defer r.Close()
+
+	dst := make([]byte, size)
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return nil, ErrInvalidCompressedValue
+	}
+	return dst, nil
+}
@@ -0,0 +1,158 @@
+package logfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type reverseCompressor struct{}
+
+func (rc reverseCompressor) Type() CompressionType {
+	return 7
+}
+
+func (rc reverseCompressor) Compress(src []byte) ([]byte, error) {
+	dst := make([]byte, 0, len(src))
+	for i := len(src) - 1; i >= 0; i-- {
+		if src[i] != 'a' {
+			dst = append(dst, src[i])
+		}
+	}
+	return dst, nil
+}
+
+func (rc reverseCompressor) Decompress(src []byte) ([]byte, error) {
+	dst := make([]byte, 0, len(src))
+	for i := len(src) - 1; i >= 0; i-- {
+		dst = append(dst, src[i])
+	}
+	return dst, nil
+}
+
+func TestFlateCompressor(t *testing.T) {
+	c, err := GetCompressor(FlateCompression)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name string
+		src  []byte
+	}{
+		{"empty", []byte{}},
+		{"normal", []byte("some data")},
+		{"repeated", bytes.Repeat([]byte("some data"), 1024)},
+		{"zeros", make([]byte, 1<<20)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed, err := c.Compress(tt.src)
+			assert.Nil(t, err)
+			got, err := c.Decompress(compressed)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.src, got)
+		})
+	}
+
+	_, err = c.Decompress(nil)
+	assert.Equal(t, ErrInvalidCompressedValue, err)
+
+	// a corrupted size which is too large for the compressed data.
+	compressed, err := c.Compress([]byte("some data"))
+	assert.Nil(t, err)
+	var sizeBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(sizeBuf[:], 1<<40)
+	_, err = c.Decompress(append(sizeBuf[:n], compressed[1:]...))
+	assert.Equal(t, ErrInvalidCompressedValue, err)
+}
+
+func TestCompressEntry(t *testing.T) {
+	c, err := GetCompressor(FlateCompression)
+	assert.Nil(t, err)
+	value := bytes.Repeat([]byte("some data"), 100)
+
+	tests := []struct {
+		name           string
+		e              *LogEntry
+		threshold      int
+		wantCompressed bool
+	}{
+		{"nil", nil, 0, false},
+		{"no-value", &LogEntry{Key: []byte("k1")}, 0, false},
+		{"below-threshold", &LogEntry{Key: []byte("k1"), Value: value}, len(value) + 1, false},
+		{"not-smaller", &LogEntry{Key: []byte("k1"), Value: []byte("v1")}, 0, false},
+		{"normal", &LogEntry{Key: []byte("k1"), Value: value}, len(value), true},
+		{"type-delete", &LogEntry{Key: []byte("k1"), Value: value, Type: TypeDelete}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CompressEntry(tt.e, c, tt.threshold)
+			assert.Nil(t, err)
+			if !tt.wantCompressed {
+				assert.Equal(t, tt.e, got)
+				return
+			}
+			assert.Less(t, len(got.Value), len(tt.e.Value))
+			assert.Equal(t, tt.e.Type, got.Type&entryTypeMask)
+
+			err = decompressEntry(got)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.e, got)
+		})
+	}
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	err := RegisterCompressor(reverseCompressor{})
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		UnregisterCompressor(reverseCompressor{}.Type())
+	})
+
+	e := &LogEntry{Key: []byte("k1"), Value: []byte("vaaa")}
+	got, err := CompressEntry(e, reverseCompressor{}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), got.Value)
+	assert.Equal(t, EntryType(7<<compressionShift), got.Type)
+
+	_, err = GetCompressor(6)
+	assert.Equal(t, ErrUnsupportedCompression, err)
+
+	UnregisterCompressor(reverseCompressor{}.Type())
+	_, err = GetCompressor(reverseCompressor{}.Type())
+	assert.Equal(t, ErrUnsupportedCompression, err)
+	assert.Equal(t, ErrUnsupportedCompression, decompressEntry(got))
+}
+
+func TestReadLogEntry_Compressed(t *testing.T) {
+	lf, err := OpenLogFile("/tmp", 1, 1<<20, Strs, FileIo)
+	assert.Nil(t, err)
+	defer func() {
+		if lf != nil {
+			_ = lf.Delete()
+		}
+	}()
+
+	c, err := GetCompressor(FlateCompression)
+	assert.Nil(t, err)
+	entries := []*LogEntry{
+		{Key: []byte("k1"), Value: bytes.Repeat([]byte("v1"), 1024)},
+		{Key: []byte("k2"), Value: []byte("v2"), ExpiredAt: 443434211},
+		{Key: []byte("k3"), Value: bytes.Repeat([]byte("v3"), 1024), Type: TypeListMeta},
+	}
+	var values [][]byte
+	for _, e := range entries {
+		ce, err := CompressEntry(e, c, 64)
+		assert.Nil(t, err)
+		v, _ := EncodeEntry(ce)
+		values = append(values, v)
+	}
+	offsets := writeSomeData(lf, values)
+
+	for i, e := range entries {
+		got, size, err := lf.ReadLogEntry(offsets[i])
+		assert.Nil(t, err)
+		assert.Equal(t, e, got)
+		assert.Equal(t, int64(len(values[i])), size)
+	}
+}
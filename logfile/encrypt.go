@@ -0,0 +1,170 @@
+package logfile
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+const (
+	// entryEncryptedFlag the highest bit of the type byte, represents the key and value of entry are encrypted.
+	entryEncryptedFlag EntryType = 1 << 7
+
+	// saltSize random salt saved in each encrypted entry, mixed into the nonce.
+	saltSize = 4
+)
+
+var (
+	// ErrKeyProviderRequired log file is encrypted, but no key provider is given.
+	ErrKeyProviderRequired = errors.New("logfile: key provider is required for encrypted log file")
+
+	// ErrEncryptionKeyNotFound the key provider can't find the key of log file.
+	ErrEncryptionKeyNotFound = errors.New("logfile: encryption key not found")
+
+	// ErrDecryptFailed entry can't be decrypted, the key is wrong or the entry is corrupted.
+	ErrDecryptFailed = errors.New("logfile: decrypt entry failed")
+)
+
+// KeyProvider provides the AES keys for encrypting log files.
+// Every key has an id, which is saved in the file header, so older files can still be decrypted after key rotation.
+// Keys must be 16, 24 or 32 bytes to select AES-128, AES-192, or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the key and its id for encrypting new log files.
+	CurrentKey() (keyID uint32, key []byte, err error)
+
+	// Key returns the key of the given id, for decrypting existing log files.
+	Key(keyID uint32) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider which keeps all keys in memory.
+type StaticKeyProvider struct {
+	mu        sync.RWMutex
+	keys      map[uint32][]byte
+	currentID uint32
+}
+
+// NewStaticKeyProvider create a new StaticKeyProvider, key is the current key and keyID is its id.
+func NewStaticKeyProvider(keyID uint32, key []byte) *StaticKeyProvider {
+	return &StaticKeyProvider{
+		keys:      map[uint32][]byte{keyID: key},
+		currentID: keyID,
+	}
+}
+
+// Rotate adds a new key and makes it the current key, older keys are kept for decrypting.
+func (kp *StaticKeyProvider) Rotate(keyID uint32, key []byte) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	kp.keys[keyID] = key
+	kp.currentID = keyID
+}
+
+// AddKey adds an older key, it won't be used to encrypt new log files.
+func (kp *StaticKeyProvider) AddKey(keyID uint32, key []byte) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	kp.keys[keyID] = key
+}
+
+// CurrentKey returns the current key and its id.
+func (kp *StaticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	return kp.currentID, kp.keys[kp.currentID], nil
+}
+
+// Key returns the key of the given id.
+func (kp *StaticKeyProvider) Key(keyID uint32) ([]byte, error) {
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	key, ok := kp.keys[keyID]
+	if !ok {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newNonceBase() (nonce [nonceBaseSize]byte, err error) {
+	_, err = rand.Read(nonce[:])
+	return
+}
+
+// EncryptEntry returns a copy of the entry whose key and value are encrypted, it will be written at offset of the log file.
+// If the log file is not encrypted, e is returned as it is.
+// The encrypted entry has no key, and its value look like:
+// +--------+------------------------------------------------+
+// |  salt  |  AES-GCM(key size(varint) + key + value) + tag |
+// +--------+------------------------------------------------+
+// The nonce of AES-GCM is nonce base of log file xor (offset + salt), type and expiredAt are authenticated too.
+func (lf *LogFile) EncryptEntry(e *LogEntry, offset int64) (*LogEntry, error) {
+	if e == nil || lf.aead == nil {
+		return e, nil
+	}
+	plaintext := make([]byte, binary.MaxVarintLen32+len(e.Key)+len(e.Value))
+	index := binary.PutUvarint(plaintext, uint64(len(e.Key)))
+	index += copy(plaintext[index:], e.Key)
+	index += copy(plaintext[index:], e.Value)
+
+	value := make([]byte, saltSize, saltSize+index+lf.aead.Overhead())
+	if _, err := rand.Read(value); err != nil {
+		return nil, err
+	}
+	encEnt := &LogEntry{ExpiredAt: e.ExpiredAt, Type: e.Type | entryEncryptedFlag}
+	nonce := lf.entryNonce(offset, value[:saltSize])
+	encEnt.Value = lf.aead.Seal(value, nonce, plaintext[:index], entryAdditionalData(encEnt))
+	return encEnt, nil
+}
+
+// decryptEntry decrypts the key and value of e in place if it is encrypted, and removes the encrypted flag in e.Type.
+func (lf *LogFile) decryptEntry(e *LogEntry, offset int64) error {
+	if e.Type&entryEncryptedFlag == 0 {
+		return nil
+	}
+	if lf.aead == nil {
+		return ErrKeyProviderRequired
+	}
+	if len(e.Value) < saltSize {
+		return ErrDecryptFailed
+	}
+	nonce := lf.entryNonce(offset, e.Value[:saltSize])
+	plaintext, err := lf.aead.Open(nil, nonce, e.Value[saltSize:], entryAdditionalData(e))
+	if err != nil {
+		return ErrDecryptFailed
+	}
+	kSize, n := binary.Uvarint(plaintext)
+	if n <= 0 || uint64(len(plaintext)-n) < kSize {
+		return ErrDecryptFailed
+	}
+	e.Key = plaintext[n : n+int(kSize)]
+	e.Value = plaintext[n+int(kSize):]
+	e.Type &^= entryEncryptedFlag
+	return nil
+}
+
+func (lf *LogFile) entryNonce(offset int64, salt []byte) []byte {
+	nonce := make([]byte, nonceBaseSize)
+	copy(nonce, lf.header.nonceBase[:])
+	binary.LittleEndian.PutUint64(nonce[:8], binary.LittleEndian.Uint64(nonce[:8])^uint64(offset))
+	for i := 0; i < saltSize; i++ {
+		nonce[8+i] ^= salt[i]
+	}
+	return nonce
+}
+
+func entryAdditionalData(e *LogEntry) []byte {
+	ad := make([]byte, 9)
+	ad[0] = byte(e.Type)
+	binary.LittleEndian.PutUint64(ad[1:], uint64(e.ExpiredAt))
+	return ad
+}
@@ -0,0 +1,143 @@
+package logfile
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	testKey1 = bytes.Repeat([]byte{1}, 32)
+	testKey2 = bytes.Repeat([]byte{2}, 16)
+)
+
+func TestOpenLogFileWithOptions_Encrypted(t *testing.T) {
+	t.Run("fileIo", func(t *testing.T) {
+		testOpenLogFileWithOptionsEncrypted(t, FileIo)
+	})
+
+	t.Run("mmap", func(t *testing.T) {
+		testOpenLogFileWithOptionsEncrypted(t, MMap)
+	})
+}
+
+func testOpenLogFileWithOptionsEncrypted(t *testing.T, ioType IOType) {
+	kp := NewStaticKeyProvider(1, testKey1)
+	lf, err := OpenLogFileWithOptions("/tmp", 1, 1<<20, Strs, ioType, FileOptions{KeyProvider: kp})
+	assert.Nil(t, err)
+	defer func() {
+		if lf != nil {
+			_ = lf.Delete()
+		}
+	}()
+	assert.Equal(t, int64(FileHeaderSize), lf.HeaderSize())
+	assert.Equal(t, int64(FileHeaderSize), lf.WriteAt)
+
+	entries := []*LogEntry{
+		{Key: []byte("k1"), Value: []byte("some data"), ExpiredAt: 443434211},
+		{Key: []byte("k2"), Value: []byte{}, Type: TypeDelete},
+		{Key: []byte{}, Value: []byte{}},
+	}
+	offsets := writeSomeEntries(t, lf, entries)
+
+	// rotate the key, the log file is still decrypted by the older key.
+	kp.Rotate(2, testKey2)
+	err = lf.Close()
+	assert.Nil(t, err)
+	lf, err = OpenLogFileWithOptions("/tmp", 1, 1<<20, Strs, ioType, FileOptions{KeyProvider: kp})
+	assert.Nil(t, err)
+	for i, e := range entries {
+		got, _, err := lf.ReadLogEntry(offsets[i])
+		assert.Nil(t, err)
+		assert.Equal(t, e, got)
+	}
+
+	// key of the log file is missing.
+	err = lf.Close()
+	assert.Nil(t, err)
+	_, err = OpenLogFileWithOptions("/tmp", 1, 1<<20, Strs, ioType, FileOptions{KeyProvider: NewStaticKeyProvider(2, testKey2)})
+	assert.Equal(t, ErrEncryptionKeyNotFound, err)
+	_, err = OpenLogFile("/tmp", 1, 1<<20, Strs, ioType)
+	assert.Equal(t, ErrKeyProviderRequired, err)
+
+	lf, err = OpenLogFileWithOptions("/tmp", 1, 1<<20, Strs, ioType, FileOptions{KeyProvider: kp})
+	assert.Nil(t, err)
+}
+
+func TestOpenLogFileWithOptions_Unencrypted(t *testing.T) {
+	lf, err := OpenLogFile("/tmp", 1, 1<<20, Strs, FileIo)
+	assert.Nil(t, err)
+	defer func() {
+		if lf != nil {
+			_ = lf.Delete()
+		}
+	}()
+	e := &LogEntry{Key: []byte("k1"), Value: []byte("v1")}
+	offsets := writeSomeEntries(t, lf, []*LogEntry{e})
+	err = lf.Close()
+	assert.Nil(t, err)
+
+	// existing log file is kept unencrypted.
+	lf, err = OpenLogFileWithOptions("/tmp", 1, 1<<20, Strs, FileIo, FileOptions{KeyProvider: NewStaticKeyProvider(1, testKey1)})
+	assert.Nil(t, err)
+	assert.False(t, lf.Header().Encrypted)
+	got, _, err := lf.ReadLogEntry(offsets[0])
+	assert.Nil(t, err)
+	assert.Equal(t, e, got)
+}
+
+func TestReadLogEntry_Encrypted(t *testing.T) {
+	path := filepath.Join("/tmp", "log.strs.000000001")
+	lf, err := OpenLogFileWithOptions("/tmp", 1, 1<<20, Strs, FileIo, FileOptions{KeyProvider: NewStaticKeyProvider(1, testKey1)})
+	assert.Nil(t, err)
+	defer func() {
+		if lf != nil {
+			_ = lf.Delete()
+		}
+	}()
+
+	e := &LogEntry{Key: []byte("secret-key"), Value: []byte("secret-value"), ExpiredAt: 443434211}
+	offsets := writeSomeEntries(t, lf, []*LogEntry{e, e})
+	err = lf.Sync()
+	assert.Nil(t, err)
+
+	// plaintext is not in log file.
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(data, []byte("secret")))
+
+	// the same entry at different offsets are encrypted differently.
+	buf1, err := lf.Read(offsets[0], uint32(offsets[1]-offsets[0]))
+	assert.Nil(t, err)
+	buf2, err := lf.Read(offsets[1], uint32(offsets[1]-offsets[0]))
+	assert.Nil(t, err)
+	assert.NotEqual(t, buf1, buf2)
+
+	// corrupted entry is detected by crc.
+	_, err = lf.IoSelector.Write([]byte{buf1[len(buf1)-1] + 1}, offsets[1]-1)
+	assert.Nil(t, err)
+	_, _, err = lf.ReadLogEntry(offsets[0])
+	assert.Equal(t, ErrInvalidCrc, err)
+
+	// entry moved to another offset can't be decrypted.
+	_, err = lf.IoSelector.Write(buf2, offsets[0])
+	assert.Nil(t, err)
+	_, _, err = lf.ReadLogEntry(offsets[0])
+	assert.Equal(t, ErrDecryptFailed, err)
+}
+
+func writeSomeEntries(t *testing.T, lf *LogFile, entries []*LogEntry) []int64 {
+	var offsets []int64
+	for _, e := range entries {
+		offset := lf.WriteAt
+		encEnt, err := lf.EncryptEntry(e, offset)
+		assert.Nil(t, err)
+		buf, _ := EncodeEntry(encEnt)
+		err = lf.Write(buf)
+		assert.Nil(t, err)
+		offsets = append(offsets, offset)
+	}
+	return offsets
+}
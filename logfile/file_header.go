@@ -0,0 +1,108 @@
+package logfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// FileHeaderSize size of the header block at the beginning of a log file, entries start after it.
+const FileHeaderSize = 64
+
+const (
+	// fileHeaderMagic identifies a log file with header block.
+	fileHeaderMagic uint32 = 0x4d494f59 // "YOIM" in little endian.
+
+	// FormatVersion current format version of log file, version 2 adds the checksum type.
+	// Log files without header block are LegacyFormatVersion, and version 1 log files use ChecksumIEEE.
+	FormatVersion = 2
+
+	// LegacyFormatVersion log files created before the header block was introduced, entries start at offset 0.
+	LegacyFormatVersion = 0
+
+	// nonceBaseSize size of the nonce base, which is the nonce size of AES-GCM.
+	nonceBaseSize = 12
+)
+
+const (
+	// headerFlagEncrypted entries in log file are encrypted.
+	headerFlagEncrypted byte = 1 << iota
+
+	// headerFlagCompressed values in log file may be compressed.
+	headerFlagCompressed
+)
+
+// ErrInvalidFileHeader the header block of log file is corrupted or unsupported.
+var ErrInvalidFileHeader = errors.New("logfile: invalid file header")
+
+// FileHeader is the header block of a log file.
+// The encoded file header look like:
+// +-------+---------+-------+-------+-------------+--------+------------+-----+-----------+----------+----------+-----+
+// | magic | version | flags | ftype | compression | key id | nonce base | fid | createdAt | checksum | reserved | crc |
+// +-------+---------+-------+-------+-------------+--------+------------+-----+-----------+----------+----------+-----+
+// |   4   |    1    |   1   |   1   |      1      |   4    |     12     |  4  |     8     |    1     |    23    |  4  |
+// The crc checks all the fields before it.
+type FileHeader struct {
+	Version     byte
+	FileType    FileType
+	Fid         uint32
+	CreatedAt   int64 // unix nano.
+	Encrypted   bool
+	Compression CompressionType // compression type used when the log file was created.
+	KeyID       uint32
+	Checksum    ChecksumType // checksum type of entries.
+	nonceBase   [nonceBaseSize]byte
+}
+
+func (h *FileHeader) encode() []byte {
+	buf := make([]byte, FileHeaderSize)
+	binary.LittleEndian.PutUint32(buf[0:4], fileHeaderMagic)
+	buf[4] = h.Version
+	if h.Encrypted {
+		buf[5] |= headerFlagEncrypted
+	}
+	if h.Compression != NoCompression {
+		buf[5] |= headerFlagCompressed
+	}
+	buf[6] = byte(h.FileType)
+	buf[7] = byte(h.Compression)
+	binary.LittleEndian.PutUint32(buf[8:12], h.KeyID)
+	copy(buf[12:24], h.nonceBase[:])
+	binary.LittleEndian.PutUint32(buf[24:28], h.Fid)
+	binary.LittleEndian.PutUint64(buf[28:36], uint64(h.CreatedAt))
+	buf[36] = byte(h.Checksum)
+
+	crc := crc32.ChecksumIEEE(buf[:FileHeaderSize-4])
+	binary.LittleEndian.PutUint32(buf[FileHeaderSize-4:], crc)
+	return buf
+}
+
+// decodeFileHeader decodes the header block of log file.
+// It returns nil if buf doesn't start with the magic number, which means there is no header block in log file.
+func decodeFileHeader(buf []byte) (*FileHeader, error) {
+	if len(buf) < FileHeaderSize || binary.LittleEndian.Uint32(buf[0:4]) != fileHeaderMagic {
+		return nil, nil
+	}
+	crc := crc32.ChecksumIEEE(buf[:FileHeaderSize-4])
+	if crc != binary.LittleEndian.Uint32(buf[FileHeaderSize-4:FileHeaderSize]) {
+		return nil, ErrInvalidFileHeader
+	}
+	h := &FileHeader{
+		Version:     buf[4],
+		Encrypted:   buf[5]&headerFlagEncrypted != 0,
+		FileType:    FileType(buf[6]),
+		Compression: CompressionType(buf[7]),
+		KeyID:       binary.LittleEndian.Uint32(buf[8:12]),
+		Fid:         binary.LittleEndian.Uint32(buf[24:28]),
+		CreatedAt:   int64(binary.LittleEndian.Uint64(buf[28:36])),
+		Checksum:    ChecksumType(buf[36]),
+	}
+	if h.Version == LegacyFormatVersion || h.Version > FormatVersion {
+		return nil, ErrInvalidFileHeader
+	}
+	if _, err := h.Checksum.crcTable(); err != nil {
+		return nil, ErrInvalidFileHeader
+	}
+	copy(h.nonceBase[:], buf[12:24])
+	return h, nil
+}
@@ -0,0 +1,165 @@
+package logfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+)
+
+// HintFileSuffix suffix of hint file, e.g. log.strs.000000001.hint.
+const HintFileSuffix = ".hint"
+
+// maxHintHeaderSize max hint entry header size.
+// crc32(4) + type(1) + fid(5) + offset(10) + entrySize(10) + expiredAt(10) + kSize(5) = 45
+const maxHintHeaderSize = 45
+
+// ErrInvalidHint hint file is truncated or its crc is invalid.
+var ErrInvalidHint = errors.New("logfile: invalid hint file")
+
+// HintEntry is the position info of a LogEntry, without its value.
+// Hint entries are written in the same order as the entries in log file, so indexes can be rebuilt by replaying them.
+type HintEntry struct {
+	Key       []byte
+	Fid       uint32
+	Offset    int64
+	EntrySize int64
+	ExpiredAt int64
+	Type      EntryType
+}
+
+// EncodeHintEntry will encode hint entry into a byte slice.
+// The encoded hint entry look like:
+// +-------+--------+-------+----------+--------------+-------------+------------+-------+
+// |  crc  |  type  |  fid  |  offset  |  entry size  |  expiredAt  |  key size  |  key  |
+// +-------+--------+-------+----------+--------------+-------------+------------+-------+
+// The crc checks all the fields after it.
+func EncodeHintEntry(h *HintEntry) []byte {
+	if h == nil {
+		return nil
+	}
+	buf := make([]byte, maxHintHeaderSize+len(h.Key))
+	buf[4] = byte(h.Type)
+	var index = 5
+	index += binary.PutUvarint(buf[index:], uint64(h.Fid))
+	index += binary.PutVarint(buf[index:], h.Offset)
+	index += binary.PutVarint(buf[index:], h.EntrySize)
+	index += binary.PutVarint(buf[index:], h.ExpiredAt)
+	index += binary.PutVarint(buf[index:], int64(len(h.Key)))
+	index += copy(buf[index:], h.Key)
+
+	crc := crc32.ChecksumIEEE(buf[4:index])
+	binary.LittleEndian.PutUint32(buf[:4], crc)
+	return buf[:index]
+}
+
+// decodeHintEntry returns the hint entry and its size in buf.
+func decodeHintEntry(buf []byte) (*HintEntry, int, error) {
+	if len(buf) <= 5 {
+		return nil, 0, ErrInvalidHint
+	}
+	h := &HintEntry{Type: EntryType(buf[4])}
+	var index = 5
+	fid, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil, 0, ErrInvalidHint
+	}
+	h.Fid = uint32(fid)
+	index += n
+
+	var fields = []*int64{&h.Offset, &h.EntrySize, &h.ExpiredAt}
+	for _, field := range fields {
+		v, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			return nil, 0, ErrInvalidHint
+		}
+		*field = v
+		index += n
+	}
+
+	kSize, n := binary.Varint(buf[index:])
+	if n <= 0 || kSize < 0 || int64(len(buf)-index-n) < kSize {
+		return nil, 0, ErrInvalidHint
+	}
+	index += n
+	h.Key = buf[index : index+int(kSize)]
+	index += int(kSize)
+
+	if crc := crc32.ChecksumIEEE(buf[4:index]); crc != binary.LittleEndian.Uint32(buf[:4]) {
+		return nil, 0, ErrInvalidHint
+	}
+	return h, index, nil
+}
+
+// WriteHintFile writes the hint entries of a log file into its hint file.
+// Entries are written into a temporary file first, and then renamed to the hint file,
+// so a hint file is either complete or absent.
+func WriteHintFile(path string, fid uint32, ftype FileType, entries []*HintEntry) error {
+	fileName, err := getLogFileName(path, fid, ftype)
+	if err != nil {
+		return err
+	}
+	fileName += HintFileSuffix
+
+	var buf []byte
+	for _, h := range entries {
+		buf = append(buf, EncodeHintEntry(h)...)
+	}
+	tmpName := fileName + ".tmp"
+	fd, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fd.Write(buf); err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+// ReadHintFile reads all hint entries in the hint file of a log file.
+// If the hint file does not exist, the error satisfies os.IsNotExist.
+// If the hint file is corrupted, ErrInvalidHint will be returned.
+func ReadHintFile(path string, fid uint32, ftype FileType) ([]*HintEntry, error) {
+	fileName, err := getLogFileName(path, fid, ftype)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(fileName + HintFileSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*HintEntry
+	for len(buf) > 0 {
+		h, n, err := decodeHintEntry(buf)
+		if err != nil {
+			return nil, err
+		}
+		if h.Fid != fid {
+			return nil, ErrInvalidHint
+		}
+		entries = append(entries, h)
+		buf = buf[n:]
+	}
+	return entries, nil
+}
+
+// DeleteHintFile deletes the hint file of a log file, it is not an error if the hint file does not exist.
+func DeleteHintFile(path string, fid uint32, ftype FileType) error {
+	fileName, err := getLogFileName(path, fid, ftype)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(fileName + HintFileSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
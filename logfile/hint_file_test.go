@@ -0,0 +1,95 @@
+package logfile
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeHintEntry(t *testing.T) {
+	tests := []struct {
+		name string
+		h    *HintEntry
+	}{
+		{
+			"no-fields", &HintEntry{Key: []byte{}},
+		},
+		{
+			"normal", &HintEntry{Key: []byte("k1"), Fid: 3, Offset: 1024, EntrySize: 37, ExpiredAt: 443434211},
+		},
+		{
+			"type-delete", &HintEntry{Key: []byte("k2"), Fid: 1 << 30, Offset: 1 << 40, EntrySize: 12, Type: TypeDelete},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := EncodeHintEntry(tt.h)
+			got, n, err := decodeHintEntry(buf)
+			assert.Nil(t, err)
+			assert.Equal(t, len(buf), n)
+			if !reflect.DeepEqual(got, tt.h) {
+				t.Errorf("decodeHintEntry() got = %v, want %v", got, tt.h)
+			}
+		})
+	}
+
+	assert.Nil(t, EncodeHintEntry(nil))
+}
+
+func Test_decodeHintEntry(t *testing.T) {
+	buf := EncodeHintEntry(&HintEntry{Key: []byte("k1"), Fid: 3, Offset: 1024, EntrySize: 37})
+
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"nil", nil},
+		{"truncated", buf[:len(buf)-1]},
+		{"corrupted", append(append([]byte{}, buf[:len(buf)-1]...), 'x')},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeHintEntry(tt.buf)
+			assert.Equal(t, ErrInvalidHint, err)
+		})
+	}
+}
+
+func TestWriteHintFile(t *testing.T) {
+	path := filepath.Join("/tmp", "hint-test")
+	err := os.MkdirAll(path, os.ModePerm)
+	assert.Nil(t, err)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+
+	entries := []*HintEntry{
+		{Key: []byte("k1"), Fid: 1, Offset: 0, EntrySize: 20},
+		{Key: []byte("k2"), Fid: 1, Offset: 20, EntrySize: 30, ExpiredAt: 443434211},
+		{Key: []byte("k1"), Fid: 1, Offset: 50, EntrySize: 10, Type: TypeDelete},
+	}
+	err = WriteHintFile(path, 1, Strs, entries)
+	assert.Nil(t, err)
+
+	got, err := ReadHintFile(path, 1, Strs)
+	assert.Nil(t, err)
+	assert.Equal(t, entries, got)
+
+	// not exist.
+	_, err = ReadHintFile(path, 2, Strs)
+	assert.True(t, os.IsNotExist(err))
+
+	// hint file of another log file.
+	err = os.Rename(filepath.Join(path, "log.strs.000000001.hint"), filepath.Join(path, "log.strs.000000002.hint"))
+	assert.Nil(t, err)
+	_, err = ReadHintFile(path, 2, Strs)
+	assert.Equal(t, ErrInvalidHint, err)
+
+	err = DeleteHintFile(path, 2, Strs)
+	assert.Nil(t, err)
+	err = DeleteHintFile(path, 2, Strs)
+	assert.Nil(t, err)
+}
@@ -2,6 +2,7 @@ package logfile
 
 import (
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
 )
 
@@ -10,7 +11,9 @@ import (
 //   4    +    1    +    5    +    5    +    10    =    25
 const MaxHeaderSize = 25
 
-// EntryType type of entry
+// EntryType type of entry.
+// Only the low 4 bits are used by entry type, the high bits of the type byte are reserved for flags,
+// bits 4-6 is CompressionType, and bit 7 means the entry is encrypted.
 type EntryType byte
 
 const (
@@ -19,8 +22,31 @@ const (
 
 	// TypeListMeta represents entry is list meta.
 	TypeListMeta
+
+	// TypeChunk represents entry is a chunk of a large value, it is not indexed by its key.
+	TypeChunk
+
+	// TypeChunkManifest represents the value of entry lists the chunks of a large value.
+	TypeChunkManifest
 )
 
+// String returns the name of entry type, flags in the high bits are ignored.
+func (t EntryType) String() string {
+	switch t & entryTypeMask {
+	case 0:
+		return "normal"
+	case TypeDelete:
+		return "delete"
+	case TypeListMeta:
+		return "list-meta"
+	case TypeChunk:
+		return "chunk"
+	case TypeChunkManifest:
+		return "chunk-manifest"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t&entryTypeMask))
+}
+
 // LogEntry is the data will be appended in log file.
 type LogEntry struct {
 	Key       []byte
@@ -44,7 +70,12 @@ type entryHeader struct {
 // +-------+--------+------------+--------------+------------+-------+---------+
 // |-------------------------HEADER--------------------------|
 //         |-------------------------------crc check---------------------------|
+// The crc is computed with ChecksumIEEE, use LogFile EncodeEntry to encode with the checksum type of a log file.
 func EncodeEntry(e *LogEntry) ([]byte, int) {
+	return encodeEntry(e, crc32.IEEETable)
+}
+
+func encodeEntry(e *LogEntry, crcTable *crc32.Table) ([]byte, int) {
 	if e == nil {
 		return nil, 0
 	}
@@ -64,7 +95,7 @@ func EncodeEntry(e *LogEntry) ([]byte, int) {
 	// value.
 	copy(buf[index+len(e.Key):], e.Value)
 
-	crc := crc32.ChecksumIEEE(buf[4:])
+	crc := crc32.Checksum(buf[4:], crcTable)
 	binary.LittleEndian.PutUint32(buf[:4], crc)
 	return buf, size
 }
@@ -79,25 +110,35 @@ func decodeHeader(buf []byte) (*entryHeader, int64) {
 		typ:   EntryType(buf[4]),
 	}
 	var index = 5
+	// the header is corrupted or incomplete if a varint can't be decoded.
 	keySize, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
 	header.kSize = uint32(keySize)
 	index += n
 
 	valueSize, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
 	header.vSize = uint32(valueSize)
 	index += n
 
 	expiredAt, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
 	header.expiredAt = expiredAt
 	return header, int64(index + n)
 }
 
-func getEntryCrc(e *LogEntry, header []byte) uint32 {
+func getEntryCrc(e *LogEntry, header []byte, crcTable *crc32.Table) uint32 {
 	if e == nil {
 		return 0
 	}
-	crc := crc32.ChecksumIEEE(header[:])
-	crc = crc32.Update(crc, crc32.IEEETable, e.Key)
-	crc = crc32.Update(crc, crc32.IEEETable, e.Value)
+	crc := crc32.Checksum(header[:], crcTable)
+	crc = crc32.Update(crc, crcTable, e.Key)
+	crc = crc32.Update(crc, crcTable, e.Value)
 	return crc
 }
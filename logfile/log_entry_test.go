@@ -1,6 +1,7 @@
 package logfile
 
 import (
+	"hash/crc32"
 	"reflect"
 	"testing"
 )
@@ -69,6 +70,12 @@ func Test_decodeHeader(t *testing.T) {
 		{
 			"no-fields", args{buf: []byte{28, 223, 68, 33, 0, 0, 0, 0}}, &entryHeader{crc32: 558161692}, 8,
 		},
+		{
+			"incomplete-varint", args{buf: []byte{28, 223, 68, 33, 0, 0, 128}}, nil, 0,
+		},
+		{
+			"overflow-varint", args{buf: []byte{28, 223, 68, 33, 0, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255}}, nil, 0,
+		},
 		{
 			"normal", args{buf: []byte{101, 208, 223, 156, 0, 4, 14, 198, 147, 242, 166, 3}},
 			&entryHeader{crc32: 2631913573, typ: 0, kSize: 2, vSize: 7, expiredAt: 443434211}, 12,
@@ -111,7 +118,7 @@ func Test_getEntryCrc(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := getEntryCrc(tt.args.e, tt.args.h); got != tt.want {
+			if got := getEntryCrc(tt.args.e, tt.args.h, crc32.IEEETable); got != tt.want {
 				t.Errorf("getEntryCrc() got = %v, want %v", got, tt.want)
 			}
 		})
@@ -1,13 +1,19 @@
 package logfile
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"errors"
 	"fmt"
-	"github.com/flower-corp/rosedb/ioselector"
 	"hash/crc32"
+	"io"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+	"yoimiya/ioselector"
 )
 
 var (
@@ -17,6 +23,9 @@ var (
 	// ErrWriteSizeNotEqual write size is not equal to entry size.
 	ErrWriteSizeNotEqual = errors.New("logfile: write size is not equal to entry size")
 
+	// ErrReadSizeNotEqual read size is not equal to entry size.
+	ErrReadSizeNotEqual = errors.New("logfile: read size is not equal to entry size")
+
 	// ErrEndOfEntry end of entry in log file.
 	ErrEndOfEntry = errors.New("logfile: end of entry in log file")
 
@@ -33,6 +42,9 @@ const (
 
 	// FilePrefix log file prefix.
 	FilePrefix = "log."
+
+	// discardBlockSize size of the blocks read and zeroed by DiscardTail and IsTornTail.
+	discardBlockSize = 4096
 )
 
 const (
@@ -64,7 +76,7 @@ var (
 	}
 )
 
-// IOType represents different types of file io: FileIO(standard file io) and MMap(Memory Map).
+// IOType represents different types of file io: FileIO(standard file io), MMap(Memory Map), DirectIO and MemIO.
 type IOType int8
 
 const (
@@ -73,6 +85,12 @@ const (
 
 	// MMap Memory Map
 	MMap
+
+	// DirectIO file io bypassing the page cache, see ioselector.DirectIOSelector.
+	DirectIO
+
+	// MemIO files are kept in memory and never written to disk, see ioselector.MemSelector.
+	MemIO
 )
 
 // LogFile is an abstraction of a disk file, entry's read and write will go through it.
@@ -81,46 +99,260 @@ type LogFile struct {
 	Fid        uint32
 	WriteAt    int64
 	IoSelector ioselector.IOSelector
+	header     *FileHeader // nil if it is a legacy log file without header block.
+	aead       cipher.AEAD // nil if log file is not encrypted.
+	crcTable   *crc32.Table
+}
+
+// FileOptions options for creating a new log file, they are saved in the file header.
+// Options of an existing log file are always read from its file header.
+type FileOptions struct {
+	// KeyProvider if it is not nil, entries will be encrypted by its current key.
+	// It is also required to open an encrypted log file.
+	KeyProvider KeyProvider
+
+	// Compression compression type of values in log file, it is only recorded in the file header,
+	// see CompressEntry for how to compress an entry.
+	Compression CompressionType
+
+	// Checksum checksum type of entries in log file.
+	Checksum ChecksumType
+
+	// ReadOnly open an existing log file in read only mode with FileIo whatever the io type is,
+	// nothing is written to the file, including the header block.
+	ReadOnly bool
+
+	// Header if it is not nil, a new log file is initialized with this encoded header block instead of a new one,
+	// so that the log file is a copy of another one, like the log files of a replica.
+	Header []byte
+
+	// WrapIOSelector if it is not nil, the io selector of log file is wrapped by it,
+	// e.g. ioselector.FaultInjector Wrap for injecting faults in tests.
+	WrapIOSelector func(ioselector.IOSelector) ioselector.IOSelector
 }
 
 // OpenLogFile open an existing or create a new log file.
 // FileSize must be a positive number.
 // And we will create io selector according to ioType.
 func OpenLogFile(path string, fid uint32, fsize int64, ftype FileType, ioType IOType) (lf *LogFile, err error) {
+	return OpenLogFileWithOptions(path, fid, fsize, ftype, ioType, FileOptions{})
+}
+
+// OpenLogFileWithOptions open an existing or create a new log file, just like OpenLogFile.
+// A new log file starts with a header block, which is created according to opts.
+// Existing log files without header block(LegacyFormatVersion) can still be opened, their entries start at offset 0.
+func OpenLogFileWithOptions(path string, fid uint32, fsize int64, ftype FileType,
+	ioType IOType, opts FileOptions) (lf *LogFile, err error) {
+
 	lf = &LogFile{Fid: fid}
-	fileName, err := lf.getLogFileName(path, fid, ftype)
+	fileName, err := getLogFileName(path, fid, ftype)
 	if err != nil {
 		return nil, err
 	}
 
 	var selector ioselector.IOSelector
-	switch ioType {
-	case FileIo:
+	switch {
+	case opts.ReadOnly:
+		if selector, err = ioselector.NewReadOnlyFileIOSelector(fileName); err != nil {
+			return
+		}
+	case ioType == FileIo:
 		if selector, err = ioselector.NewFileIOSelector(fileName, fsize); err != nil {
 			return
 		}
-	case MMap:
+	case ioType == MMap:
 		if selector, err = ioselector.NewMMapSelector(fileName, fsize); err != nil {
 			return
 		}
+	case ioType == DirectIO:
+		if selector, err = ioselector.NewDirectIOSelector(fileName, fsize); err != nil {
+			return
+		}
+	case ioType == MemIO:
+		if selector, err = ioselector.NewMemSelector(fileName, fsize); err != nil {
+			return
+		}
 	default:
 		return nil, ErrUnsupportedToType
 	}
+	if opts.WrapIOSelector != nil {
+		selector = opts.WrapIOSelector(selector)
+	}
 
 	lf.IoSelector = selector
+	if err = lf.initHeader(ftype, opts); err != nil {
+		_ = selector.Close()
+		return nil, err
+	}
 	return
 }
 
+// Header returns the file header, it is nil if the log file is in LegacyFormatVersion.
+func (lf *LogFile) Header() *FileHeader {
+	return lf.header
+}
+
+// HeaderSize returns the size of file header, the first entry is at this offset.
+// It is zero if there is no header block in log file.
+func (lf *LogFile) HeaderSize() int64 {
+	if lf.header == nil {
+		return 0
+	}
+	return FileHeaderSize
+}
+
+// initHeader reads the header block of log file, or writes it if the log file is new.
+func (lf *LogFile) initHeader(ftype FileType, opts FileOptions) error {
+	buf := make([]byte, FileHeaderSize)
+	if _, err := lf.IoSelector.Read(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	header, err := decodeFileHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case header == nil && !bytes.Equal(buf, make([]byte, FileHeaderSize)):
+		// legacy log file with entries but no header block.
+		lf.crcTable = crc32.IEEETable
+		return nil
+	case header == nil && opts.ReadOnly:
+		// empty log file, which can't be initialized in read only mode.
+		lf.crcTable = crc32.IEEETable
+		return nil
+	case header == nil && opts.Header != nil:
+		// new log file copied from another one, write the given header block.
+		if header, err = lf.copyHeader(ftype, opts); err != nil {
+			return err
+		}
+	case header == nil:
+		// new log file, write the header block.
+		if header, err = lf.writeHeader(ftype, opts); err != nil {
+			return err
+		}
+	default:
+		if err := lf.checkHeader(header, ftype, opts); err != nil {
+			return err
+		}
+	}
+	if lf.crcTable, err = header.Checksum.crcTable(); err != nil {
+		return err
+	}
+	lf.header = header
+	lf.WriteAt = FileHeaderSize
+	return nil
+}
+
+// checkHeader checks the header block read from log file, and prepares the cipher if it is encrypted.
+func (lf *LogFile) checkHeader(header *FileHeader, ftype FileType, opts FileOptions) error {
+	if header.FileType != ftype || header.Fid != lf.Fid {
+		return ErrInvalidFileHeader
+	}
+	if header.Encrypted {
+		if opts.KeyProvider == nil {
+			return ErrKeyProviderRequired
+		}
+		key, err := opts.KeyProvider.Key(header.KeyID)
+		if err != nil {
+			return err
+		}
+		if lf.aead, err = newAEAD(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyHeader writes opts.Header as the header block of a new log file.
+func (lf *LogFile) copyHeader(ftype FileType, opts FileOptions) (*FileHeader, error) {
+	if len(opts.Header) != FileHeaderSize {
+		return nil, ErrInvalidFileHeader
+	}
+	header, err := decodeFileHeader(opts.Header)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, ErrInvalidFileHeader
+	}
+	if err := lf.checkHeader(header, ftype, opts); err != nil {
+		return nil, err
+	}
+	n, err := lf.IoSelector.Write(opts.Header, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n != FileHeaderSize {
+		return nil, ErrWriteSizeNotEqual
+	}
+	if err := lf.IoSelector.Sync(); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+func (lf *LogFile) writeHeader(ftype FileType, opts FileOptions) (*FileHeader, error) {
+	header := &FileHeader{
+		Version:     FormatVersion,
+		FileType:    ftype,
+		Fid:         lf.Fid,
+		CreatedAt:   time.Now().UnixNano(),
+		Compression: opts.Compression,
+		Checksum:    opts.Checksum,
+	}
+	if _, err := opts.Checksum.crcTable(); err != nil {
+		return nil, err
+	}
+	if opts.KeyProvider != nil {
+		keyID, key, err := opts.KeyProvider.CurrentKey()
+		if err != nil {
+			return nil, err
+		}
+		if header.nonceBase, err = newNonceBase(); err != nil {
+			return nil, err
+		}
+		if lf.aead, err = newAEAD(key); err != nil {
+			return nil, err
+		}
+		header.Encrypted, header.KeyID = true, keyID
+	}
+
+	n, err := lf.IoSelector.Write(header.encode(), 0)
+	if err != nil {
+		return nil, err
+	}
+	if n != FileHeaderSize {
+		return nil, ErrWriteSizeNotEqual
+	}
+	if err := lf.IoSelector.Sync(); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// EncodeEntry encode entry into a byte slice just like package level EncodeEntry,
+// but the crc is computed with the checksum type of log file.
+func (lf *LogFile) EncodeEntry(e *LogEntry) ([]byte, int) {
+	return encodeEntry(e, lf.crcTable)
+}
+
 // ReadLogEntry read a logEntry from log file at offset.
 // It returns a LogEntry, entry size and an error, if any.
 // If offset is invalid, the error is io.EOF.
 func (lf *LogFile) ReadLogEntry(offset int64) (*LogEntry, int64, error) {
 	// read entry header.
-	headerBuf, err := lf.readBytes(offset, MaxHeaderSize)
-	if err != nil {
+	// the last entry may be shorter than MaxHeaderSize from the end of file, so a partial read is fine here.
+	headerBuf := make([]byte, MaxHeaderSize)
+	n, err := lf.IoSelector.Read(headerBuf, offset)
+	if err != nil && !(err == io.EOF && n > 0) {
 		return nil, 0, err
 	}
+	headerBuf = headerBuf[:n]
 	header, size := decodeHeader(headerBuf)
+	if header == nil {
+		return nil, 0, io.EOF
+	}
 	// the end of entries.
 	if header.crc32 == 0 && header.kSize == 0 && header.vSize == 0 {
 		return nil, 0, ErrEndOfEntry
@@ -143,13 +375,158 @@ func (lf *LogFile) ReadLogEntry(offset int64) (*LogEntry, int64, error) {
 		e.Value = kvBuf[kSize:]
 	}
 
-	// crc32 check.
-	if crc := getEntryCrc(e, headerBuf[crc32.Size:size]); crc != header.crc32 {
-		return nil, 0, ErrInvalidCrc
+	if err := lf.verifyEntry(e, headerBuf[crc32.Size:size], header.crc32, offset); err != nil {
+		return nil, 0, err
 	}
 	return e, entrySize, nil
 }
 
+// EntryView is a log entry read by ReadLogEntryView, its key and value may alias the mapped region of log file.
+// They are only valid until Release is called, copy them if they are needed after that.
+type EntryView struct {
+	LogEntry
+	release func()
+	aliased bool
+}
+
+// Aliased reports whether the value aliases the mapped region, and must be copied before Release.
+// A value decompressed into a new slice doesn't, while the key of a view always aliases the mapped region.
+func (v *EntryView) Aliased() bool {
+	return v.aliased
+}
+
+// Release releases the view of mapped region, it must be called exactly once.
+func (v *EntryView) Release() {
+	if v.release != nil {
+		v.release()
+		v.release = nil
+	}
+}
+
+// ReadLogEntryView read a logEntry from log file at offset just like ReadLogEntry, but without copying
+// if the io selector supports ioselector.Viewer, and the entry is not encrypted or compressed.
+// Otherwise, it falls back to ReadLogEntry, and Release of the returned view does nothing.
+func (lf *LogFile) ReadLogEntryView(offset int64) (EntryView, int64, error) {
+	viewer, ok := lf.IoSelector.(ioselector.Viewer)
+	if !ok || lf.aead != nil {
+		e, size, err := lf.ReadLogEntry(offset)
+		if err != nil {
+			return EntryView{}, 0, err
+		}
+		return EntryView{LogEntry: *e}, size, nil
+	}
+
+	// the last entry may be shorter than MaxHeaderSize from the end of file, so a partial view is fine here.
+	headerBuf, release, err := viewer.View(offset, MaxHeaderSize)
+	if err != nil && !(err == io.EOF && len(headerBuf) > 0) {
+		return EntryView{}, 0, err
+	}
+	header, size := decodeHeader(headerBuf)
+	release()
+	if header == nil {
+		return EntryView{}, 0, io.EOF
+	}
+	if header.crc32 == 0 && header.kSize == 0 && header.vSize == 0 {
+		return EntryView{}, 0, ErrEndOfEntry
+	}
+
+	kSize, vSize := int64(header.kSize), int64(header.vSize)
+	entrySize := size + kSize + vSize
+	buf, release, err := viewer.View(offset, entrySize)
+	if err != nil {
+		if release != nil {
+			release()
+		}
+		return EntryView{}, 0, err
+	}
+	v := EntryView{
+		LogEntry: LogEntry{
+			Key:       buf[size : size+kSize],
+			Value:     buf[size+kSize:],
+			ExpiredAt: header.expiredAt,
+			Type:      header.typ,
+		},
+		release: release,
+	}
+	// a compressed value is decompressed into a new slice.
+	raw := v.Value
+	if err := lf.verifyEntry(&v.LogEntry, buf[crc32.Size:size], header.crc32, offset); err != nil {
+		v.Release()
+		return EntryView{}, 0, err
+	}
+	v.aliased = len(raw) > 0 && len(v.Value) > 0 && &v.Value[0] == &raw[0]
+	return v, entrySize, nil
+}
+
+// ReadEntrySize reads the header of entry at offset and returns the entry size, the crc is not checked.
+// It is useful for skipping a corrupted entry, but the size may be wrong if the header is corrupted too.
+func (lf *LogFile) ReadEntrySize(offset int64) (int64, error) {
+	headerBuf := make([]byte, MaxHeaderSize)
+	n, err := lf.IoSelector.Read(headerBuf, offset)
+	if err != nil && !(err == io.EOF && n > 0) {
+		return 0, err
+	}
+	header, size := decodeHeader(headerBuf[:n])
+	if header == nil || size <= crc32.Size {
+		return 0, io.EOF
+	}
+	if header.crc32 == 0 && header.kSize == 0 && header.vSize == 0 {
+		return 0, ErrEndOfEntry
+	}
+	return size + int64(header.kSize) + int64(header.vSize), nil
+}
+
+// ReadLogEntries read the logEntries at offsets in one batch, sizes are the entry sizes returned by ReadLogEntry.
+// The reads are issued together by IoSelector ReadBatch, which is faster than calling ReadLogEntry one by one.
+// It returns the entries in the order of offsets, and the first error, if any.
+func (lf *LogFile) ReadLogEntries(offsets, sizes []int64) ([]*LogEntry, error) {
+	if len(offsets) != len(sizes) {
+		return nil, ErrReadSizeNotEqual
+	}
+	reqs := make([]ioselector.ReadReq, len(offsets))
+	for i := range reqs {
+		reqs[i] = ioselector.ReadReq{Buf: make([]byte, sizes[i]), Offset: offsets[i]}
+	}
+	if err := lf.IoSelector.ReadBatch(reqs); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*LogEntry, len(reqs))
+	for i, req := range reqs {
+		header, size := decodeHeader(req.Buf)
+		if header == nil {
+			return nil, io.EOF
+		}
+		kSize, vSize := int64(header.kSize), int64(header.vSize)
+		if size+kSize+vSize != int64(len(req.Buf)) {
+			return nil, ErrReadSizeNotEqual
+		}
+		e := &LogEntry{
+			Key:       req.Buf[size : size+kSize],
+			Value:     req.Buf[size+kSize:],
+			ExpiredAt: header.expiredAt,
+			Type:      header.typ,
+		}
+		if err := lf.verifyEntry(e, req.Buf[crc32.Size:size], header.crc32, req.Offset); err != nil {
+			return nil, err
+		}
+		entries[i] = e
+	}
+	return entries, nil
+}
+
+// verifyEntry checks the crc of entry read at offset, then decrypts and decompresses its key and value if necessary.
+// The crc is computed with the stored bytes, headerBuf is the encoded header without crc.
+func (lf *LogFile) verifyEntry(e *LogEntry, headerBuf []byte, crc uint32, offset int64) error {
+	if getEntryCrc(e, headerBuf, lf.crcTable) != crc {
+		return ErrInvalidCrc
+	}
+	if err := lf.decryptEntry(e, offset); err != nil {
+		return err
+	}
+	return decompressEntry(e)
+}
+
 // Read a byte slice in the log file at offset, slice length is the given size.
 // It returns the byte slice and err, if any.
 func (lf *LogFile) Read(offset int64, size uint32) ([]byte, error) {
@@ -171,12 +548,15 @@ func (lf *LogFile) Write(buf []byte) error {
 	}
 	offset := atomic.LoadInt64(&lf.WriteAt)
 	n, err := lf.IoSelector.Write(buf, offset)
+	if err == nil && n != len(buf) {
+		err = ErrWriteSizeNotEqual
+	}
 	if err != nil {
+		// the bytes may be written partially, zero them so that they won't be read as entries after reopening,
+		// and the next write which may be shorter won't leave them after it.
+		_, _ = lf.IoSelector.Write(make([]byte, len(buf)), offset)
 		return err
 	}
-	if n != len(buf) {
-		return ErrWriteSizeNotEqual
-	}
 
 	atomic.AddInt64(&lf.WriteAt, int64(n))
 	return nil
@@ -198,13 +578,132 @@ func (lf *LogFile) Delete() error {
 	return lf.IoSelector.Delete()
 }
 
+// IsTornTail reports whether the unreadable entry at offset is the last thing written to the log file,
+// like an entry written partially before a crash, which was never acknowledged and can be discarded by DiscardTail.
+// It returns false if anything is written after the claimed end of the entry, or a valid entry can be found
+// in the bytes written after offset, the log file is corrupted in the middle then, and nothing should be discarded.
+// It reads from offset to the end of file, so it is only meant for the unreadable entry found while opening a db.
+func (lf *LogFile) IsTornTail(offset int64) (bool, error) {
+	end, fileEnd, err := lf.writtenEnd(offset)
+	if err != nil {
+		return false, err
+	}
+	if esize, err := lf.ReadEntrySize(offset); err == nil && offset+esize < end {
+		return false, nil
+	}
+
+	// the size of entry may be corrupted, so look for the entries which follow it.
+	written, err := lf.readBytes(offset, end-offset)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	for pos := 1; pos < len(written); pos++ {
+		if lf.isValidEntry(written[pos:], fileEnd-offset-int64(pos)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// isValidEntry reports whether buf starts with a valid entry, the bytes after buf are zeros up to limit.
+// Only the crc is checked, the entry is not decrypted or decompressed.
+func (lf *LogFile) isValidEntry(buf []byte, limit int64) bool {
+	if len(buf) < MaxHeaderSize {
+		padded := make([]byte, MaxHeaderSize)
+		copy(padded, buf)
+		buf = padded
+	}
+	header, hsize := decodeHeader(buf)
+	if header == nil || header.crc32 == 0 || header.typ&entryTypeMask > TypeChunkManifest {
+		return false
+	}
+	esize := hsize + int64(header.kSize) + int64(header.vSize)
+	if esize > limit {
+		return false
+	}
+	n := esize
+	if n > int64(len(buf)) {
+		n = int64(len(buf))
+	}
+	crc := crc32.Checksum(buf[crc32.Size:n], lf.crcTable)
+	if remain := esize - n; remain > 0 {
+		zeros := make([]byte, discardBlockSize)
+		for ; remain > 0; remain -= int64(len(zeros)) {
+			if remain < int64(len(zeros)) {
+				zeros = zeros[:remain]
+			}
+			crc = crc32.Update(crc, lf.crcTable, zeros)
+		}
+	}
+	return crc == header.crc32
+}
+
+// writtenEnd returns the end of the bytes written from offset, which are followed by zeros to the end of file,
+// and the end of file.
+func (lf *LogFile) writtenEnd(offset int64) (end, fileEnd int64, err error) {
+	end = offset
+	buf := make([]byte, 64*discardBlockSize)
+	for pos := offset; ; pos += int64(len(buf)) {
+		n, err := lf.IoSelector.Read(buf, pos)
+		if err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		for i := n - 1; i >= 0; i-- {
+			if buf[i] != 0 {
+				end = pos + int64(i) + 1
+				break
+			}
+		}
+		if n < len(buf) {
+			return end, pos + int64(n), nil
+		}
+	}
+}
+
+// DiscardTail discards the bytes from offset, which are an entry written partially before a crash,
+// after the last valid entry of the active log file, see IsTornTail. All bytes written from offset are zeroed,
+// so that offset is read as the end of entries again, and WriteAt is set to offset.
+func (lf *LogFile) DiscardTail(offset int64) error {
+	end, _, err := lf.writtenEnd(offset)
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, discardBlockSize)
+	for pos := offset; pos < end; pos += int64(len(zeros)) {
+		if end-pos < int64(len(zeros)) {
+			zeros = zeros[:end-pos]
+		}
+		if _, err := lf.IoSelector.Write(zeros, pos); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&lf.WriteAt, offset)
+	return nil
+}
+
 func (lf *LogFile) readBytes(offset, n int64) (buf []byte, err error) {
 	buf = make([]byte, n)
 	_, err = lf.IoSelector.Read(buf, offset)
 	return
 }
 
-func (lf *LogFile) getLogFileName(path string, fid uint32, ftype FileType) (name string, err error) {
+// ParseFileName parses the file type and fid from the name of a log file, like "log.strs.000000001".
+// It returns false if name is not a log file name.
+func ParseFileName(name string) (FileType, uint32, bool) {
+	for ftype, prefix := range FileNamesMap {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		fid, err := strconv.ParseUint(name[len(prefix):], 10, 32)
+		if err != nil {
+			return 0, 0, false
+		}
+		return ftype, uint32(fid), true
+	}
+	return 0, 0, false
+}
+
+func getLogFileName(path string, fid uint32, ftype FileType) (name string, err error) {
 	if _, ok := FileNamesMap[ftype]; !ok {
 		return "", ErrUnsupportedLogFileType
 	}
@@ -1,11 +1,16 @@
 package logfile
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sync/atomic"
 	"testing"
+	"yoimiya/ioselector"
 )
 
 func TestOpenLogFile(t *testing.T) {
@@ -16,6 +21,14 @@ func TestOpenLogFile(t *testing.T) {
 	t.Run("mmap", func(t *testing.T) {
 		testOpenLogFile(t, MMap)
 	})
+
+	t.Run("directIo", func(t *testing.T) {
+		testOpenLogFile(t, DirectIO)
+	})
+
+	t.Run("memIo", func(t *testing.T) {
+		testOpenLogFile(t, MemIO)
+	})
 }
 
 func testOpenLogFile(t *testing.T, ioType IOType) {
@@ -69,6 +82,14 @@ func TestWrite(t *testing.T) {
 	t.Run("mmap", func(t *testing.T) {
 		testWrite(t, MMap)
 	})
+
+	t.Run("directIo", func(t *testing.T) {
+		testWrite(t, DirectIO)
+	})
+
+	t.Run("memIo", func(t *testing.T) {
+		testWrite(t, MemIO)
+	})
 }
 
 func testWrite(t *testing.T, ioType IOType) {
@@ -123,6 +144,14 @@ func TestRead(t *testing.T) {
 	t.Run("mmap", func(t *testing.T) {
 		testRead(t, MMap)
 	})
+
+	t.Run("directIo", func(t *testing.T) {
+		testRead(t, DirectIO)
+	})
+
+	t.Run("memIo", func(t *testing.T) {
+		testRead(t, MemIO)
+	})
 }
 
 func testRead(t *testing.T, ioType IOType) {
@@ -208,6 +237,14 @@ func TestReadLogEntry(t *testing.T) {
 	t.Run("mmap", func(t *testing.T) {
 		testLogFileReadLogEntry(t, MMap)
 	})
+
+	t.Run("directIo", func(t *testing.T) {
+		testLogFileReadLogEntry(t, DirectIO)
+	})
+
+	t.Run("memIo", func(t *testing.T) {
+		testLogFileReadLogEntry(t, MemIO)
+	})
 }
 
 func testLogFileReadLogEntry(t *testing.T, ioType IOType) {
@@ -303,6 +340,53 @@ func testLogFileReadLogEntry(t *testing.T, ioType IOType) {
 	}
 }
 
+func TestReadLogEntries(t *testing.T) {
+	t.Run("fileIo", func(t *testing.T) {
+		testReadLogEntries(t, FileIo)
+	})
+
+	t.Run("mmap", func(t *testing.T) {
+		testReadLogEntries(t, MMap)
+	})
+
+	t.Run("directIo", func(t *testing.T) {
+		testReadLogEntries(t, DirectIO)
+	})
+
+	t.Run("memIo", func(t *testing.T) {
+		testReadLogEntries(t, MemIO)
+	})
+}
+
+func testReadLogEntries(t *testing.T, ioType IOType) {
+	lf, err := OpenLogFile("/tmp", 1, 1<<20, Strs, ioType)
+	assert.Nil(t, err)
+	defer func() {
+		if lf != nil {
+			_ = lf.Delete()
+		}
+	}()
+
+	var entries []*LogEntry
+	var offsets, sizes []int64
+	for i := 0; i < 50; i++ {
+		e := &LogEntry{Key: []byte(fmt.Sprintf("key-%d", i)), Value: []byte(fmt.Sprintf("value-%d", i))}
+		buf, size := EncodeEntry(e)
+		offsets = append(offsets, lf.WriteAt)
+		sizes = append(sizes, int64(size))
+		assert.Nil(t, lf.Write(buf))
+		entries = append(entries, e)
+	}
+
+	got, err := lf.ReadLogEntries(offsets, sizes)
+	assert.Nil(t, err)
+	assert.Equal(t, entries, got)
+
+	// wrong entry size.
+	_, err = lf.ReadLogEntries(offsets[:1], []int64{sizes[0] + 1})
+	assert.Equal(t, ErrReadSizeNotEqual, err)
+}
+
 func TestSync(t *testing.T) {
 	sync := func(ioType IOType) {
 		lf, err := OpenLogFile("/tmp", 0, 100, Hash, ioType)
@@ -323,6 +407,14 @@ func TestSync(t *testing.T) {
 	t.Run("mmap", func(t *testing.T) {
 		sync(MMap)
 	})
+
+	t.Run("directIo", func(t *testing.T) {
+		sync(DirectIO)
+	})
+
+	t.Run("memIo", func(t *testing.T) {
+		sync(MemIO)
+	})
 }
 
 func TestClose(t *testing.T) {
@@ -345,6 +437,14 @@ func TestClose(t *testing.T) {
 	t.Run("mmap", func(t *testing.T) {
 		closeLf(MMap)
 	})
+
+	t.Run("directIo", func(t *testing.T) {
+		closeLf(DirectIO)
+	})
+
+	t.Run("memIo", func(t *testing.T) {
+		closeLf(MemIO)
+	})
 }
 
 func TestDelete(t *testing.T) {
@@ -362,4 +462,373 @@ func TestDelete(t *testing.T) {
 	t.Run("mmap", func(t *testing.T) {
 		deleteLf(MMap)
 	})
+
+	t.Run("directIo", func(t *testing.T) {
+		deleteLf(DirectIO)
+	})
+
+	t.Run("memIo", func(t *testing.T) {
+		deleteLf(MemIO)
+	})
+}
+
+func TestOpenLogFile_Header(t *testing.T) {
+	lf, err := OpenLogFile("/tmp", 3, 1<<20, Hash, FileIo)
+	assert.Nil(t, err)
+	defer func() {
+		if lf != nil {
+			_ = lf.Delete()
+		}
+	}()
+
+	header := lf.Header()
+	assert.NotNil(t, header)
+	assert.Equal(t, byte(FormatVersion), header.Version)
+	assert.Equal(t, Hash, header.FileType)
+	assert.Equal(t, uint32(3), header.Fid)
+	assert.NotEqual(t, int64(0), header.CreatedAt)
+	assert.False(t, header.Encrypted)
+	assert.Equal(t, int64(FileHeaderSize), lf.HeaderSize())
+	assert.Equal(t, int64(FileHeaderSize), lf.WriteAt)
+
+	e := &LogEntry{Key: []byte("k1"), Value: []byte("v1")}
+	buf, _ := EncodeEntry(e)
+	err = lf.Write(buf)
+	assert.Nil(t, err)
+	got, _, err := lf.ReadLogEntry(FileHeaderSize)
+	assert.Nil(t, err)
+	assert.Equal(t, e, got)
+
+	// reopen, the header is read from the log file.
+	err = lf.Close()
+	assert.Nil(t, err)
+	lf, err = OpenLogFile("/tmp", 3, 1<<20, Hash, FileIo)
+	assert.Nil(t, err)
+	assert.Equal(t, header, lf.Header())
+
+	// corrupted header.
+	_, err = lf.IoSelector.Write([]byte{0xff}, 8)
+	assert.Nil(t, err)
+	err = lf.Close()
+	assert.Nil(t, err)
+	lf, err = OpenLogFile("/tmp", 3, 1<<20, Hash, FileIo)
+	assert.Equal(t, ErrInvalidFileHeader, err)
+
+	err = os.Remove(filepath.Join("/tmp", "Log.hash.000000003"))
+	assert.Nil(t, err)
+
+	// header of another log file.
+	lf, err = OpenLogFile("/tmp", 3, 1<<20, Hash, FileIo)
+	assert.Nil(t, err)
+	err = lf.Close()
+	assert.Nil(t, err)
+	lf = nil
+	err = os.Rename(filepath.Join("/tmp", "Log.hash.000000003"), filepath.Join("/tmp", "Log.hash.000000004"))
+	assert.Nil(t, err)
+	_, err = OpenLogFile("/tmp", 4, 1<<20, Hash, FileIo)
+	assert.Equal(t, ErrInvalidFileHeader, err)
+	_ = os.Remove(filepath.Join("/tmp", "Log.hash.000000004"))
+}
+
+func TestOpenLogFile_CopyHeader(t *testing.T) {
+	src, err := OpenLogFileWithOptions("/tmp", 6, 1<<20, Sets, FileIo, FileOptions{Checksum: ChecksumIEEE})
+	assert.Nil(t, err)
+	defer func() {
+		_ = src.Delete()
+	}()
+	e := &LogEntry{Key: []byte("k1"), Value: []byte("v1")}
+	buf, _ := src.EncodeEntry(e)
+	assert.Nil(t, src.Write(buf))
+	header, err := src.Read(0, FileHeaderSize)
+	assert.Nil(t, err)
+
+	dir := filepath.Join("/tmp", "yoimiya-copy")
+	assert.Nil(t, os.MkdirAll(dir, os.ModePerm))
+	defer os.RemoveAll(dir)
+
+	// the options in the copied header win over the given ones.
+	dst, err := OpenLogFileWithOptions(dir, 6, 1<<20, Sets, FileIo, FileOptions{Header: header, Checksum: ChecksumCRC32C})
+	assert.Nil(t, err)
+	assert.Equal(t, src.Header(), dst.Header())
+	assert.Nil(t, dst.Write(buf))
+	got, _, err := dst.ReadLogEntry(FileHeaderSize)
+	assert.Nil(t, err)
+	assert.Equal(t, e, got)
+	assert.Nil(t, dst.Close())
+
+	_, err = OpenLogFileWithOptions(dir, 7, 1<<20, Sets, FileIo, FileOptions{Header: header})
+	assert.Equal(t, ErrInvalidFileHeader, err)
+	_, err = OpenLogFileWithOptions(dir, 8, 1<<20, Sets, FileIo, FileOptions{Header: header[:8]})
+	assert.Equal(t, ErrInvalidFileHeader, err)
+}
+
+func TestOpenLogFile_Legacy(t *testing.T) {
+	// a legacy log file starts with entries directly.
+	e := &LogEntry{Key: []byte("k1"), Value: []byte("v1"), ExpiredAt: 443434211}
+	buf, _ := EncodeEntry(e)
+	path := filepath.Join("/tmp", "log.strs.000000005")
+	err := os.WriteFile(path, buf, 0644)
+	assert.Nil(t, err)
+
+	lf, err := OpenLogFile("/tmp", 5, 1<<20, Strs, FileIo)
+	assert.Nil(t, err)
+	defer func() {
+		if lf != nil {
+			_ = lf.Delete()
+		}
+	}()
+	assert.Nil(t, lf.Header())
+	assert.Equal(t, int64(0), lf.HeaderSize())
+	assert.Equal(t, int64(0), lf.WriteAt)
+
+	got, size, err := lf.ReadLogEntry(0)
+	assert.Nil(t, err)
+	assert.Equal(t, e, got)
+	assert.Equal(t, int64(len(buf)), size)
+	_, _, err = lf.ReadLogEntry(size)
+	assert.Equal(t, ErrEndOfEntry, err)
+}
+
+func TestOpenLogFile_Checksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum ChecksumType
+		wantErr  error
+	}{
+		{"ieee", ChecksumIEEE, nil},
+		{"crc32c", ChecksumCRC32C, nil},
+		{"unsupported", ChecksumType(100), ErrUnsupportedChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := FileOptions{Checksum: tt.checksum}
+			lf, err := OpenLogFileWithOptions("/tmp", 6, 1<<20, Strs, FileIo, opts)
+			assert.Equal(t, tt.wantErr, err)
+			if err != nil {
+				_ = os.Remove(filepath.Join("/tmp", "log.strs.000000006"))
+				return
+			}
+			defer func() { _ = lf.Delete() }()
+			assert.Equal(t, tt.checksum, lf.Header().Checksum)
+
+			e := &LogEntry{Key: []byte("k1"), Value: []byte("v1")}
+			buf, _ := lf.EncodeEntry(e)
+			assert.Nil(t, lf.Write(buf))
+			assert.Nil(t, lf.Close())
+
+			// the checksum type is read from the file header.
+			lf, err = OpenLogFileWithOptions("/tmp", 6, 1<<20, Strs, FileIo, FileOptions{})
+			assert.Nil(t, err)
+			got, _, err := lf.ReadLogEntry(lf.HeaderSize())
+			assert.Nil(t, err)
+			assert.Equal(t, e, got)
+		})
+	}
+}
+
+func TestOpenLogFile_ChecksumMismatch(t *testing.T) {
+	lf, err := OpenLogFileWithOptions("/tmp", 7, 1<<20, Strs, FileIo, FileOptions{Checksum: ChecksumCRC32C})
+	assert.Nil(t, err)
+	defer func() { _ = lf.Delete() }()
+
+	// entry encoded with ChecksumIEEE can't pass the check of ChecksumCRC32C.
+	buf, _ := EncodeEntry(&LogEntry{Key: []byte("k1"), Value: []byte("v1")})
+	assert.Nil(t, lf.Write(buf))
+	_, _, err = lf.ReadLogEntry(lf.HeaderSize())
+	assert.Equal(t, ErrInvalidCrc, err)
+}
+
+func TestOpenLogFile_Version1(t *testing.T) {
+	// log files in version 1 have no checksum type, and use ChecksumIEEE.
+	header := &FileHeader{Version: 1, FileType: Strs, Fid: 8}
+	e := &LogEntry{Key: []byte("k1"), Value: []byte("v1")}
+	buf, _ := EncodeEntry(e)
+	path := filepath.Join("/tmp", "log.strs.000000008")
+	err := os.WriteFile(path, append(header.encode(), buf...), 0644)
+	assert.Nil(t, err)
+
+	lf, err := OpenLogFile("/tmp", 8, 1<<20, Strs, FileIo)
+	assert.Nil(t, err)
+	defer func() { _ = lf.Delete() }()
+	assert.Equal(t, byte(1), lf.Header().Version)
+	assert.Equal(t, ChecksumIEEE, lf.Header().Checksum)
+	got, _, err := lf.ReadLogEntry(FileHeaderSize)
+	assert.Nil(t, err)
+	assert.Equal(t, e, got)
+}
+
+func TestReadLogEntryView(t *testing.T) {
+	t.Run("fileIo", func(t *testing.T) {
+		testReadLogEntryView(t, FileIo)
+	})
+
+	t.Run("mmap", func(t *testing.T) {
+		testReadLogEntryView(t, MMap)
+	})
+}
+
+func testReadLogEntryView(t *testing.T, ioType IOType) {
+	lf, err := OpenLogFile("/tmp", 1, 1<<20, Strs, ioType)
+	assert.Nil(t, err)
+	defer func() {
+		if lf != nil {
+			_ = lf.Delete()
+		}
+	}()
+
+	compressor, err := GetCompressor(FlateCompression)
+	assert.Nil(t, err)
+	compressedValue := bytes.Repeat([]byte("compressed"), 100)
+	compressed, err := CompressEntry(&LogEntry{Key: []byte("k2"), Value: compressedValue}, compressor, 0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, compressedValue, compressed.Value)
+	entries := []*LogEntry{
+		{Key: []byte("k1"), Value: []byte("v1"), ExpiredAt: 443434211},
+		compressed,
+		{Key: []byte("k3"), Type: TypeDelete},
+	}
+	var offsets []int64
+	for _, e := range entries {
+		offsets = append(offsets, lf.WriteAt)
+		buf, _ := lf.EncodeEntry(e)
+		assert.Nil(t, lf.Write(buf))
+	}
+
+	for i, offset := range offsets {
+		want, wantSize, err := lf.ReadLogEntry(offset)
+		assert.Nil(t, err)
+		v, size, err := lf.ReadLogEntryView(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, wantSize, size)
+		assert.Equal(t, want.Key, v.Key)
+		assert.Equal(t, want.Value, v.Value)
+		assert.Equal(t, want.Type, v.Type)
+		assert.Equal(t, want.ExpiredAt, v.ExpiredAt)
+		// values in mapped region are read without copying, unless they are decompressed or empty.
+		assert.Equal(t, ioType == MMap && i == 0, v.Aliased())
+		if i == 1 {
+			assert.Equal(t, compressedValue, v.Value)
+		}
+		v.Release()
+	}
+
+	_, _, err = lf.ReadLogEntryView(lf.WriteAt)
+	assert.Equal(t, ErrEndOfEntry, err)
+}
+
+func TestParseFileName(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		ftype    FileType
+		fid      uint32
+		ok       bool
+	}{
+		{"strs", "log.strs.000000001", Strs, 1, true},
+		{"list", "Log.list.000000100", List, 100, true},
+		{"hint", "log.strs.000000001" + HintFileSuffix, 0, 0, false},
+		{"unknown-type", "log.xxx.000000001", 0, 0, false},
+		{"no-fid", "log.strs.", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ftype, fid, ok := ParseFileName(tt.fileName)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.ftype, ftype)
+			assert.Equal(t, tt.fid, fid)
+		})
+	}
+}
+
+func TestLogFile_DiscardTail(t *testing.T) {
+	lf, err := OpenLogFile("/tmp", 9, 1<<20, Strs, FileIo)
+	assert.Nil(t, err)
+	defer func() { _ = lf.Delete() }()
+
+	e := &LogEntry{Key: []byte("k1"), Value: []byte("v1")}
+	buf, _ := lf.EncodeEntry(e)
+	assert.Nil(t, lf.Write(buf))
+	// half of a large entry is written before crash.
+	torn, _ := lf.EncodeEntry(&LogEntry{Key: []byte("k2"), Value: bytes.Repeat([]byte("v"), 10000)})
+	tail := lf.WriteAt
+	_, err = lf.IoSelector.Write(torn[:len(torn)/2], tail)
+	assert.Nil(t, err)
+	_, _, err = lf.ReadLogEntry(tail)
+	assert.Equal(t, ErrInvalidCrc, err)
+	ok, err := lf.IsTornTail(tail)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	assert.Nil(t, lf.DiscardTail(tail))
+	assert.Equal(t, tail, lf.WriteAt)
+	_, _, err = lf.ReadLogEntry(tail)
+	assert.Equal(t, ErrEndOfEntry, err)
+	got, _, err := lf.ReadLogEntry(lf.HeaderSize())
+	assert.Nil(t, err)
+	assert.Equal(t, e, got)
+}
+
+func TestLogFile_IsTornTail(t *testing.T) {
+	lf, err := OpenLogFile("/tmp", 10, 1<<20, Strs, FileIo)
+	assert.Nil(t, err)
+	defer func() { _ = lf.Delete() }()
+
+	var offsets []int64
+	for i := 0; i < 10; i++ {
+		offsets = append(offsets, lf.WriteAt)
+		// the value of the last entry ends with zeros.
+		buf, _ := lf.EncodeEntry(&LogEntry{Key: []byte{'k', byte(i)}, Value: make([]byte, 8)})
+		assert.Nil(t, lf.Write(buf))
+	}
+	corrupt := func(offset int64, b []byte) {
+		_, err := lf.IoSelector.Write(b, offset)
+		assert.Nil(t, err)
+	}
+
+	// the crc of an entry in the middle is corrupted.
+	corrupt(offsets[5], []byte{0xff})
+	torn, err := lf.IsTornTail(offsets[5])
+	assert.Nil(t, err)
+	assert.False(t, torn)
+
+	// the value size claims the entry ends after all the entries.
+	corrupt(offsets[5]+crc32.Size+1+1, []byte{0xfe, 0x7f})
+	torn, err = lf.IsTornTail(offsets[5])
+	assert.Nil(t, err)
+	assert.False(t, torn)
+
+	// the last entry is still valid, though its zeros are not distinguishable from the free space.
+	corrupt(offsets[8]+crc32.Size+1+1, []byte{0xfe, 0x7f})
+	torn, err = lf.IsTornTail(offsets[8])
+	assert.Nil(t, err)
+	assert.False(t, torn)
+
+	corrupt(offsets[9], []byte{0xff})
+	torn, err = lf.IsTornTail(offsets[9])
+	assert.Nil(t, err)
+	assert.True(t, torn)
+}
+
+func TestLogFile_Write_Failed(t *testing.T) {
+	lf, err := OpenLogFile("/tmp", 11, 1<<20, Strs, FileIo)
+	assert.Nil(t, err)
+	defer func() { _ = lf.Delete() }()
+	fi := ioselector.NewFaultInjector()
+	lf.IoSelector = fi.Wrap(lf.IoSelector)
+
+	long, _ := lf.EncodeEntry(&LogEntry{Key: []byte("k1"), Value: bytes.Repeat([]byte("v"), 1000)})
+	fi.ShortWrites(1)
+	assert.NotNil(t, lf.Write(long))
+	offset := lf.WriteAt
+	assert.Equal(t, lf.HeaderSize(), offset)
+
+	// nothing of the failed write is left after the next shorter write.
+	e := &LogEntry{Key: []byte("k2"), Value: []byte("v2")}
+	buf, size := lf.EncodeEntry(e)
+	assert.Nil(t, lf.Write(buf))
+	got, _, err := lf.ReadLogEntry(offset)
+	assert.Nil(t, err)
+	assert.Equal(t, e, got)
+	_, _, err = lf.ReadLogEntry(offset + int64(size))
+	assert.Equal(t, ErrEndOfEntry, err)
 }
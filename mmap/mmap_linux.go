@@ -0,0 +1,30 @@
+package mmap
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+func mmap(fd *os.File, writable bool, size int64) ([]byte, error) {
+	typ := unix.PROT_READ
+	if writable {
+		typ |= unix.PROT_WRITE
+	}
+	return unix.Mmap(int(fd.Fd()), 0, int(size), typ, unix.MAP_SHARED)
+}
+
+func munmap(b []byte) error {
+	return unix.Munmap(b)
+}
+
+func madvise(b []byte, readAhead bool) error {
+	advice := unix.MADV_NORMAL
+	if !readAhead {
+		advice = unix.MADV_RANDOM
+	}
+	return unix.Madvise(b, advice)
+}
+
+func msync(b []byte) error {
+	return unix.Msync(b, unix.MS_SYNC)
+}
@@ -0,0 +1,82 @@
+package pubsub
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Buffer is the bounded buffer of a subscriber, the values which can't be buffered are handled by its policy.
+// It is used by Subscription and the keyspace event subscriptions of db, so they treat slow consumers the same.
+type Buffer[T any] struct {
+	ch     chan T
+	policy SlowConsumerPolicy
+
+	mu      sync.Mutex
+	closed  bool
+	err     error
+	dropped uint64
+}
+
+// NewBuffer create a buffer of size values, DefaultBufferSize is used if size is not positive.
+func NewBuffer[T any](size int, policy SlowConsumerPolicy) *Buffer[T] {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &Buffer[T]{ch: make(chan T, size), policy: policy}
+}
+
+// C returns the channel of buffered values, it is closed when the buffer is closed.
+func (b *Buffer[T]) C() <-chan T {
+	return b.ch
+}
+
+// Dropped returns the number of values dropped since the buffer is full, in DropMessages policy.
+func (b *Buffer[T]) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// Err returns ErrSlowConsumer if the buffer is closed for slow consumer, otherwise the error given to Close.
+func (b *Buffer[T]) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// Closed reports whether the buffer is closed.
+func (b *Buffer[T]) Closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// Close closes the channel of values, and err will be returned by Err. It does nothing if the buffer is closed.
+func (b *Buffer[T]) Close(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed, b.err = true, err
+		close(b.ch)
+	}
+}
+
+// Deliver sends v without blocking.
+// It reports whether v is buffered, and whether the buffer is closed for slow consumer by this call.
+func (b *Buffer[T]) Deliver(v T) (buffered, disconnected bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false, false
+	}
+	select {
+	case b.ch <- v:
+		return true, false
+	default:
+	}
+	if b.policy == DropMessages {
+		atomic.AddUint64(&b.dropped, 1)
+		return false, false
+	}
+	b.closed, b.err = true, ErrSlowConsumer
+	close(b.ch)
+	return false, true
+}
@@ -0,0 +1,51 @@
+package pubsub
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBuffer(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		b := NewBuffer[int](1, DropMessages)
+		buffered, disconnected := b.Deliver(1)
+		assert.True(t, buffered)
+		assert.False(t, disconnected)
+		buffered, disconnected = b.Deliver(2)
+		assert.False(t, buffered)
+		assert.False(t, disconnected)
+		assert.Equal(t, uint64(1), b.Dropped())
+		assert.Equal(t, 1, <-b.C())
+		assert.False(t, b.Closed())
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		b := NewBuffer[int](1, DisconnectSlowConsumer)
+		b.Deliver(1)
+		buffered, disconnected := b.Deliver(2)
+		assert.False(t, buffered)
+		assert.True(t, disconnected)
+		assert.True(t, b.Closed())
+		assert.Equal(t, ErrSlowConsumer, b.Err())
+		// the buffered values can still be received.
+		assert.Equal(t, 1, <-b.C())
+		_, ok := <-b.C()
+		assert.False(t, ok)
+
+		buffered, disconnected = b.Deliver(3)
+		assert.False(t, buffered)
+		assert.False(t, disconnected)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		b := NewBuffer[int](0, DisconnectSlowConsumer)
+		assert.Equal(t, DefaultBufferSize, cap(b.ch))
+		err := errors.New("closed")
+		b.Close(err)
+		b.Close(nil)
+		assert.Equal(t, err, b.Err())
+		_, ok := <-b.C()
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,44 @@
+package pubsub
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "news.sport", true},
+		{"news.*", "news.sport", true},
+		{"news.*", "news.", true},
+		{"news.*", "new", false},
+		{"*.sport", "news.sport", true},
+		{"n**s*t", "news.sport", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`h[\]]llo`, "h]llo", true},
+		{"a/*", "a/b/c", true},
+		{"h[ab", "ha", true},
+		{"trailing\\", "trailing\\", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"|"+tt.s, func(t *testing.T) {
+			assert.Equal(t, tt.want, Match(tt.pattern, tt.s))
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package pubsub
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// DefaultBufferSize default number of messages buffered for each subscription.
+const DefaultBufferSize = 1024
+
+// ErrSlowConsumer the subscription is closed since its buffer is full, in DisconnectSlowConsumer policy.
+var ErrSlowConsumer = errors.New("pubsub: subscription closed for slow consumer")
+
+// SlowConsumerPolicy decides what to do when the buffer of a subscription is full.
+type SlowConsumerPolicy int8
+
+const (
+	// DropMessages the messages which can't be buffered are dropped, the publisher is never blocked.
+	DropMessages SlowConsumerPolicy = iota
+
+	// DisconnectSlowConsumer the subscription is closed, and its Err is ErrSlowConsumer.
+	DisconnectSlowConsumer
+)
+
+// Message is a message received by a subscription.
+type Message struct {
+	Channel string
+
+	// Pattern the pattern matched by Channel, it is empty if the message is received by channel subscription.
+	Pattern string
+
+	Payload []byte
+}
+
+// Hub dispatches the published messages to subscriptions by channels and glob patterns.
+type Hub struct {
+	mu         sync.RWMutex
+	channels   map[string]map[*Subscription]struct{}
+	patterns   map[string]map[*Subscription]struct{}
+	bufferSize int
+	policy     SlowConsumerPolicy
+}
+
+// Subscription receives the messages of the channels and patterns it subscribed.
+// A subscription without any channel or pattern is still open, and can subscribe again, until Close is called.
+type Subscription struct {
+	hub *Hub
+	buf *Buffer[*Message]
+
+	mu       sync.Mutex
+	channels map[string]struct{}
+	patterns map[string]struct{}
+}
+
+// NewHub create a new hub, bufferSize is the number of messages buffered for each subscription.
+func NewHub(bufferSize int, policy SlowConsumerPolicy) *Hub {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	return &Hub{
+		channels:   make(map[string]map[*Subscription]struct{}),
+		patterns:   make(map[string]map[*Subscription]struct{}),
+		bufferSize: bufferSize,
+		policy:     policy,
+	}
+}
+
+// NewSubscription create a subscription without any channel or pattern.
+func (h *Hub) NewSubscription() *Subscription {
+	return &Subscription{
+		hub:      h,
+		buf:      NewBuffer[*Message](h.bufferSize, h.policy),
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+}
+
+// Publish publishes payload to channel, and returns the number of subscriptions which receive the message.
+// A subscription receives the message once for each of its channels and patterns that match.
+func (h *Hub) Publish(channel string, payload []byte) int {
+	var received int
+	var slow []*Subscription
+	deliver := func(s *Subscription, msg *Message) {
+		ok, disconnect := s.buf.Deliver(msg)
+		if ok {
+			received++
+		}
+		if disconnect {
+			slow = append(slow, s)
+		}
+	}
+
+	h.mu.RLock()
+	if subs := h.channels[channel]; len(subs) > 0 {
+		msg := &Message{Channel: channel, Payload: payload}
+		for s := range subs {
+			deliver(s, msg)
+		}
+	}
+	for pattern, subs := range h.patterns {
+		if Match(pattern, channel) {
+			msg := &Message{Channel: channel, Pattern: pattern, Payload: payload}
+			for s := range subs {
+				deliver(s, msg)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, s := range slow {
+		h.remove(s)
+	}
+	return received
+}
+
+// Channels returns the channels which have subscribers and match pattern in order, all of them if pattern is empty.
+func (h *Hub) Channels(pattern string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var channels []string
+	for channel := range h.channels {
+		if pattern == "" || Match(pattern, channel) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// NumSub returns the numbers of subscriptions of channels, patterns are not counted.
+func (h *Hub) NumSub(channels ...string) []int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	nums := make([]int, len(channels))
+	for i, channel := range channels {
+		nums[i] = len(h.channels[channel])
+	}
+	return nums
+}
+
+// NumPat returns the number of patterns subscribed.
+func (h *Hub) NumPat() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.patterns)
+}
+
+func (h *Hub) addLocked(m map[string]map[*Subscription]struct{}, key string, s *Subscription) {
+	subs := m[key]
+	if subs == nil {
+		subs = make(map[*Subscription]struct{})
+		m[key] = subs
+	}
+	subs[s] = struct{}{}
+}
+
+func (h *Hub) delLocked(m map[string]map[*Subscription]struct{}, key string, s *Subscription) {
+	subs := m[key]
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(m, key)
+	}
+}
+
+// remove removes all the channels and patterns of a closed subscription.
+func (h *Hub) remove(s *Subscription) {
+	s.mu.Lock()
+	channels, patterns := s.channels, s.patterns
+	s.channels, s.patterns = make(map[string]struct{}), make(map[string]struct{})
+	s.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for channel := range channels {
+		h.delLocked(h.channels, channel, s)
+	}
+	for pattern := range patterns {
+		h.delLocked(h.patterns, pattern, s)
+	}
+}
+
+// C returns the channel of messages, it is closed when the subscription is closed.
+func (s *Subscription) C() <-chan *Message {
+	return s.buf.C()
+}
+
+// Subscribe subscribes the channels, and returns the number of channels and patterns subscribed now.
+func (s *Subscription) Subscribe(channels ...string) int {
+	return s.update(s.hub.channels, func() map[string]struct{} { return s.channels }, channels, true)
+}
+
+// PSubscribe subscribes the glob patterns, see Match for the syntax.
+// It returns the number of channels and patterns subscribed now.
+func (s *Subscription) PSubscribe(patterns ...string) int {
+	return s.update(s.hub.patterns, func() map[string]struct{} { return s.patterns }, patterns, true)
+}
+
+// Unsubscribe unsubscribes the channels, or all channels if none is given.
+// It returns the number of channels and patterns subscribed now.
+func (s *Subscription) Unsubscribe(channels ...string) int {
+	if len(channels) == 0 {
+		channels = s.Channels()
+	}
+	return s.update(s.hub.channels, func() map[string]struct{} { return s.channels }, channels, false)
+}
+
+// PUnsubscribe unsubscribes the patterns, or all patterns if none is given.
+// It returns the number of channels and patterns subscribed now.
+func (s *Subscription) PUnsubscribe(patterns ...string) int {
+	if len(patterns) == 0 {
+		patterns = s.Patterns()
+	}
+	return s.update(s.hub.patterns, func() map[string]struct{} { return s.patterns }, patterns, false)
+}
+
+// Channels returns the channels subscribed in order.
+func (s *Subscription) Channels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.channels)
+}
+
+// Patterns returns the patterns subscribed in order.
+func (s *Subscription) Patterns() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.patterns)
+}
+
+// Count returns the number of channels and patterns subscribed.
+func (s *Subscription) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.channels) + len(s.patterns)
+}
+
+// Dropped returns the number of messages dropped since the buffer is full, in DropMessages policy.
+func (s *Subscription) Dropped() uint64 {
+	return s.buf.Dropped()
+}
+
+// Err returns ErrSlowConsumer if the subscription is closed for slow consumer, otherwise nil.
+func (s *Subscription) Err() error {
+	return s.buf.Err()
+}
+
+// Close unsubscribes all channels and patterns, and closes the channel of messages.
+func (s *Subscription) Close() {
+	s.buf.Close(nil)
+	s.hub.remove(s)
+}
+
+// update adds or removes keys in the channels or patterns of hub and subscription.
+// The lock of hub is always held before the lock of subscription, the same as Publish.
+func (s *Subscription) update(m map[string]map[*Subscription]struct{}, own func() map[string]struct{},
+	keys []string, subscribe bool) int {
+
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buf.Closed() {
+		return 0
+	}
+	for _, key := range keys {
+		_, ok := own()[key]
+		switch {
+		case subscribe && !ok:
+			own()[key] = struct{}{}
+			s.hub.addLocked(m, key, s)
+		case !subscribe && ok:
+			delete(own(), key)
+			s.hub.delLocked(m, key, s)
+		}
+	}
+	return len(s.channels) + len(s.patterns)
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
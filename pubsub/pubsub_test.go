@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestHub_Publish(t *testing.T) {
+	hub := NewHub(16, DropMessages)
+	s1 := hub.NewSubscription()
+	defer s1.Close()
+	s2 := hub.NewSubscription()
+	defer s2.Close()
+
+	assert.Equal(t, 2, s1.Subscribe("news", "sport", "news"))
+	assert.Equal(t, 1, s2.PSubscribe("news.*"))
+	assert.Equal(t, 2, s2.Subscribe("news.tech"))
+
+	assert.Equal(t, 1, hub.Publish("news", []byte("m1")))
+	// s2 receives it twice, by the channel and the pattern.
+	assert.Equal(t, 2, hub.Publish("news.tech", []byte("m2")))
+	assert.Equal(t, 0, hub.Publish("weather", []byte("m3")))
+
+	assert.Equal(t, &Message{Channel: "news", Payload: []byte("m1")}, <-s1.C())
+	received := []*Message{<-s2.C(), <-s2.C()}
+	assert.ElementsMatch(t, []*Message{
+		{Channel: "news.tech", Payload: []byte("m2")},
+		{Channel: "news.tech", Pattern: "news.*", Payload: []byte("m2")},
+	}, received)
+
+	assert.Equal(t, []string{"news", "news.tech", "sport"}, hub.Channels(""))
+	assert.Equal(t, []string{"news.tech"}, hub.Channels("news.*"))
+	assert.Equal(t, []int{1, 1, 0}, hub.NumSub("news", "news.tech", "weather"))
+	assert.Equal(t, 1, hub.NumPat())
+
+	assert.Equal(t, 1, s1.Unsubscribe("news"))
+	assert.Equal(t, 0, s1.Unsubscribe())
+	assert.Equal(t, 1, s2.PUnsubscribe())
+	assert.Equal(t, []string{"news.tech"}, hub.Channels(""))
+	assert.Equal(t, 0, hub.NumPat())
+	assert.Equal(t, 0, hub.Publish("news", []byte("m4")))
+
+	s2.Close()
+	assert.Empty(t, hub.Channels(""))
+	_, ok := <-s2.C()
+	assert.False(t, ok)
+	assert.Equal(t, 0, s2.Subscribe("news"))
+}
+
+func TestHub_SlowConsumer(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		hub := NewHub(2, DropMessages)
+		s := hub.NewSubscription()
+		defer s.Close()
+		s.Subscribe("ch")
+		for i := 0; i < 5; i++ {
+			hub.Publish("ch", []byte{byte(i)})
+		}
+		assert.Equal(t, uint64(3), s.Dropped())
+		assert.Nil(t, s.Err())
+		assert.Equal(t, []byte{0}, (<-s.C()).Payload)
+		assert.Equal(t, []byte{1}, (<-s.C()).Payload)
+		assert.Equal(t, 1, hub.Publish("ch", []byte{5}))
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		hub := NewHub(2, DisconnectSlowConsumer)
+		s := hub.NewSubscription()
+		s.Subscribe("ch")
+		for i := 0; i < 3; i++ {
+			hub.Publish("ch", []byte{byte(i)})
+		}
+		assert.Equal(t, ErrSlowConsumer, s.Err())
+		assert.Equal(t, []int{0}, hub.NumSub("ch"))
+		// the buffered messages can still be read.
+		var n int
+		for range s.C() {
+			n++
+		}
+		assert.Equal(t, 2, n)
+		s.Close()
+	})
+}
+
+func TestHub_Concurrent(t *testing.T) {
+	hub := NewHub(1024, DropMessages)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				hub.Publish("ch", nil)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s := hub.NewSubscription()
+				s.Subscribe("ch")
+				s.PSubscribe("c*")
+				s.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, hub.Channels(""))
+	assert.Equal(t, 0, hub.NumPat())
+}
@@ -0,0 +1,92 @@
+package raft
+
+import "yoimiya/logger"
+
+// runApplier applies the committed entries to the state machine in order,
+// and takes a snapshot every SnapshotThreshold entries.
+func (n *Node) runApplier() {
+	defer n.wg.Done()
+	for {
+		n.applyMu.Lock()
+		n.mu.Lock()
+		for !n.closed && n.lastApplied >= n.commitIndex {
+			// the lock of applying is released while waiting, so that a snapshot can be restored.
+			n.applyMu.Unlock()
+			n.cond.Wait()
+			n.mu.Unlock()
+			n.applyMu.Lock()
+			n.mu.Lock()
+		}
+		if n.closed {
+			n.mu.Unlock()
+			n.applyMu.Unlock()
+			return
+		}
+		entries := n.entriesFrom(n.lastApplied+1, maxEntriesPerRequest)
+		if last := len(entries) - 1; last >= 0 && entries[last].Index > n.commitIndex {
+			entries = entries[:n.commitIndex-n.lastApplied]
+		}
+		n.mu.Unlock()
+
+		results := make([]interface{}, len(entries))
+		for i, e := range entries {
+			if e.Type == EntryCommand {
+				results[i] = n.fsm.Apply(e.Data)
+			}
+		}
+
+		n.mu.Lock()
+		for i, e := range entries {
+			if p := n.pending[e.Index]; p != nil {
+				if p.term == e.Term {
+					p.ch <- proposalResult{value: results[i]}
+				} else {
+					p.ch <- proposalResult{err: ErrLeadershipLost}
+				}
+				delete(n.pending, e.Index)
+			}
+		}
+		if len(entries) > 0 {
+			n.lastApplied = entries[len(entries)-1].Index
+			n.cond.Broadcast()
+		}
+		snapshot := n.lastApplied-n.snap.Index >= n.cfg.SnapshotThreshold
+		n.mu.Unlock()
+
+		if snapshot {
+			n.logError(n.takeSnapshot())
+		}
+		n.applyMu.Unlock()
+	}
+}
+
+// takeSnapshot saves a snapshot of the applied entries, and compacts the log. The lock of applying must be held.
+func (n *Node) takeSnapshot() error {
+	n.mu.Lock()
+	index := n.lastApplied
+	n.mu.Unlock()
+
+	handle, err := n.fsm.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	term, ok := n.termAt(index)
+	if !ok || index <= n.snap.Index {
+		return nil
+	}
+	meta := snapshotMeta{Index: index, Term: term, Servers: n.configAt(index), Handle: handle}
+	log := append([]Entry(nil), n.log[index-n.snap.Index:]...)
+	// the entries up to the snapshot are skipped if it crashes before the log is rewritten.
+	if err := n.storage.saveSnapshot(meta); err != nil {
+		return err
+	}
+	if err := n.storage.rewriteLog(log); err != nil {
+		return err
+	}
+	n.snap, n.log = meta, log
+	logger.Info("raft: %s takes snapshot at %d", n.id, index)
+	return nil
+}
@@ -0,0 +1,202 @@
+package raft
+
+import (
+	"time"
+	"yoimiya/logger"
+)
+
+// run drives the election timeout of followers and candidates, and the quorum check of the leader.
+func (n *Node) run() {
+	defer n.wg.Done()
+	interval := n.cfg.ElectionTimeout / 20
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stopCh:
+			return
+		case <-ticker.C:
+		}
+		n.tick()
+	}
+}
+
+func (n *Node) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	now := time.Now()
+	if n.state == Leader {
+		// a leader which can't reach a majority steps down, so that a read index is never served
+		// by a stale leader, and it doesn't reject the votes of the new election.
+		if now.Sub(n.leaderSince) < n.cfg.ElectionTimeout {
+			return
+		}
+		acks := 0
+		if n.isMember(n.id) {
+			acks++
+		}
+		for _, p := range n.peers {
+			if now.Sub(p.lastAck) < n.cfg.ElectionTimeout {
+				acks++
+			}
+		}
+		if acks < n.quorum() {
+			logger.Warn("raft: leader %s lost the quorum in term %d, step down", n.id, n.term)
+			n.logError(n.becomeFollower(n.term))
+		}
+		return
+	}
+	// a node which is not in the cluster never starts an election, it is being added, or was removed.
+	if now.After(n.electionDeadline) && n.isMember(n.id) {
+		n.startElection()
+	}
+}
+
+// startElection starts a new term, and asks for the votes of the other servers.
+func (n *Node) startElection() {
+	if err := n.setTerm(n.term+1, n.id); err != nil {
+		logger.Error("raft: start election err: %v", err)
+		return
+	}
+	n.state = Candidate
+	n.leaderID = ""
+	n.resetElectionTimer()
+	term := n.term
+	logger.Info("raft: %s starts election in term %d", n.id, term)
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	req := &RequestVoteRequest{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	for _, s := range n.servers {
+		if s.ID == n.id {
+			continue
+		}
+		n.wg.Add(1)
+		go func(s Server) {
+			defer n.wg.Done()
+			var resp RequestVoteResponse
+			if err := n.trans.call(s.Addr, "RequestVote", req, &resp, n.cfg.ElectionTimeout); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.closed {
+				return
+			}
+			if resp.Term > n.term {
+				n.logError(n.becomeFollower(resp.Term))
+				return
+			}
+			if n.state != Candidate || n.term != term || !resp.VoteGranted {
+				return
+			}
+			if votes++; votes == n.quorum() {
+				n.becomeLeader()
+			}
+		}(s)
+	}
+}
+
+// becomeLeader starts replicating to the peers, and appends a no-op entry,
+// the entries of previous terms are committed along with it.
+func (n *Node) becomeLeader() {
+	logger.Info("raft: %s becomes leader in term %d", n.id, n.term)
+	n.state = Leader
+	n.leaderID = n.id
+	n.leaderSince = time.Now()
+	n.peers = make(map[string]*peer)
+
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Type: EntryNoop}
+	if err := n.appendLocal(e); err != nil {
+		logger.Error("raft: append no-op entry err: %v", err)
+		n.logError(n.becomeFollower(n.term))
+		return
+	}
+	n.termStart = e.Index
+	n.syncPeers()
+	n.advanceCommit()
+	n.cond.Broadcast()
+}
+
+// becomeFollower steps down to a follower, the term is updated if it is newer.
+func (n *Node) becomeFollower(term uint64) error {
+	if term > n.term {
+		if err := n.setTerm(term, ""); err != nil {
+			return err
+		}
+		n.leaderID = ""
+	}
+	if n.state == Leader {
+		n.stopPeers()
+		n.leaderID = ""
+	}
+	n.state = Follower
+	n.resetElectionTimer()
+	n.cond.Broadcast()
+	return nil
+}
+
+// acceptLeader is called on a request from the leader of term.
+func (n *Node) acceptLeader(term uint64, leaderID string) error {
+	if term > n.term || n.state != Follower {
+		if err := n.becomeFollower(term); err != nil {
+			return err
+		}
+	}
+	n.leaderID = leaderID
+	n.lastLeaderContact = time.Now()
+	n.resetElectionTimer()
+	return nil
+}
+
+func (n *Node) handleRequestVote(req *RequestVoteRequest, resp *RequestVoteResponse) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp.Term = n.term
+	if n.closed || req.Term < n.term {
+		return nil
+	}
+	// a server removed from the cluster, or partitioned from the leader, keeps starting elections,
+	// they are ignored while the leader is alive.
+	if req.Term > n.term && (n.state == Leader ||
+		(n.leaderID != "" && time.Since(n.lastLeaderContact) < n.cfg.ElectionTimeout)) {
+		return nil
+	}
+	if req.Term > n.term {
+		if err := n.becomeFollower(req.Term); err != nil {
+			return err
+		}
+		resp.Term = n.term
+	}
+
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		(req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == req.CandidateID) && upToDate {
+		if err := n.setTerm(n.term, req.CandidateID); err != nil {
+			return err
+		}
+		resp.VoteGranted = true
+		n.resetElectionTimer()
+	}
+	return nil
+}
+
+func (n *Node) logError(err error) {
+	if err != nil {
+		logger.Error("raft: %s err: %v", n.id, err)
+	}
+}
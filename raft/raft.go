@@ -0,0 +1,670 @@
+// Package raft implements the raft consensus algorithm, so that a state machine is replicated across nodes
+// by a replicated log: leader election, log replication, log compaction by snapshots,
+// linearizable reads by read index, and membership changes of one server at a time.
+//
+// The state machine is expected to be persistent, like a YoimiyaDB, see StateMachine.
+// Nodes talk to each other by net/rpc over TCP.
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"yoimiya/logger"
+)
+
+var (
+	// ErrNotLeader the request can only be served by the leader, see Node.Leader.
+	ErrNotLeader = errors.New("raft: not leader")
+
+	// ErrNoLeader there is no known leader, usually an election is in progress.
+	ErrNoLeader = errors.New("raft: no known leader")
+
+	// ErrLeadershipLost the leader lost its leadership before the entry was committed,
+	// the entry may or may not be committed by the next leader.
+	ErrLeadershipLost = errors.New("raft: leadership lost")
+
+	// ErrClosed the node is closed.
+	ErrClosed = errors.New("raft: node closed")
+
+	// ErrTimeout a request to another node timed out.
+	ErrTimeout = errors.New("raft: request timed out")
+
+	// ErrConfigChangeInProgress the last membership change is not committed yet.
+	ErrConfigChangeInProgress = errors.New("raft: membership change in progress")
+
+	// ErrServerExists the server is already in the cluster.
+	ErrServerExists = errors.New("raft: server already exists")
+
+	// ErrServerNotFound the server is not in the cluster.
+	ErrServerNotFound = errors.New("raft: server not found")
+)
+
+const (
+	// maxEntriesPerRequest max number of entries in an AppendEntries request.
+	maxEntriesPerRequest = 256
+
+	// snapshotChunkSize size of the chunks of a snapshot sent by InstallSnapshot.
+	snapshotChunkSize = 1 << 20
+)
+
+// State is the role of a node.
+type State int32
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+// Server is a member of the cluster.
+type Server struct {
+	ID   string
+	Addr string
+}
+
+// EntryType is the type of log entry.
+type EntryType uint8
+
+const (
+	// EntryCommand a command applied to the state machine.
+	EntryCommand EntryType = iota + 1
+
+	// EntryNoop appended by a new leader, so that the entries of previous terms are committed.
+	EntryNoop
+
+	// EntryConfig the servers of the cluster, which takes effect once it is appended.
+	EntryConfig
+)
+
+// Entry is an entry of the replicated log.
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+// StateMachine is replicated by raft, the committed commands are applied in the same order on every node.
+//
+// The state machine is expected to be persistent: raft doesn't copy its state for snapshots,
+// a snapshot is only a handle returned by Snapshot, and the state of the handle is written by WriteSnapshot
+// when a follower needs it. After restarting, the state must include the latest snapshot,
+// and the entries after the snapshot are applied again, so applying a command twice in order must be harmless.
+type StateMachine interface {
+	// Apply applies a committed command, the result is returned by Node.Apply on the leader.
+	Apply(cmd []byte) interface{}
+
+	// Snapshot makes the current state durable, and returns a handle of it.
+	Snapshot() ([]byte, error)
+
+	// WriteSnapshot writes the state of handle to w, it may be called concurrently with Apply.
+	WriteSnapshot(handle []byte, w io.Writer) error
+
+	// Restore replaces the state with the snapshot read from r, and returns the handle of the new state.
+	// An empty snapshot resets the state.
+	Restore(r io.Reader) ([]byte, error)
+}
+
+// Config of a node.
+type Config struct {
+	// ID the unique id of the node in the cluster.
+	ID string
+
+	// Dir the directory where the raft state and log are persisted.
+	Dir string
+
+	// Servers the servers to bootstrap a new cluster with, including the node itself.
+	// It is only used if there is no state in Dir. A node without servers waits to be added by AddServer.
+	Servers []Server
+
+	// HeartbeatInterval interval of heartbeats from the leader.
+	HeartbeatInterval time.Duration
+
+	// ElectionTimeout a follower starts an election if it hears nothing from the leader for a random time
+	// between ElectionTimeout and twice of it. It is also the timeout of requests between nodes.
+	ElectionTimeout time.Duration
+
+	// SnapshotTimeout timeout of sending a chunk of snapshot, including restoring the snapshot on the last chunk.
+	SnapshotTimeout time.Duration
+
+	// SnapshotThreshold a snapshot is taken and the log is compacted after this number of entries are applied.
+	SnapshotThreshold uint64
+}
+
+// DefaultConfig returns the default config of a node.
+func DefaultConfig(id, dir string) Config {
+	return Config{
+		ID:                id,
+		Dir:               dir,
+		HeartbeatInterval: 100 * time.Millisecond,
+		ElectionTimeout:   time.Second,
+		SnapshotTimeout:   time.Minute,
+		SnapshotThreshold: 8192,
+	}
+}
+
+// Status is the status of a node.
+type Status struct {
+	ID            string
+	State         State
+	Term          uint64
+	Leader        string
+	CommitIndex   uint64
+	LastApplied   uint64
+	LastIndex     uint64
+	SnapshotIndex uint64
+	Servers       []Server
+}
+
+// Node is a member of a raft cluster.
+type Node struct {
+	id      string
+	cfg     Config
+	fsm     StateMachine
+	storage *storage
+	trans   *transport
+
+	mu       sync.Mutex
+	cond     *sync.Cond // broadcast when commit index, applied index, acks or state change.
+	state    State
+	term     uint64
+	votedFor string
+	leaderID string
+	log      []Entry // entries after the snapshot.
+	snap     snapshotMeta
+
+	commitIndex uint64
+	lastApplied uint64
+
+	servers     []Server // the latest configuration, which may not be committed.
+	configIndex uint64   // index of the latest configuration, 0 if it is from the snapshot.
+
+	electionDeadline  time.Time
+	lastLeaderContact time.Time
+
+	// leader only.
+	peers       map[string]*peer
+	termStart   uint64 // index of the no-op entry of the term.
+	leaderSince time.Time
+	readRound   uint64 // incremented by each read index request.
+
+	pending  map[uint64]*proposal
+	incoming *incomingSnapshot
+
+	applyMu sync.Mutex // serializes the state machine access of applying and restoring.
+	closed  bool
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// proposal waits for an entry proposed by this node to be applied.
+type proposal struct {
+	term uint64
+	ch   chan proposalResult
+}
+
+type proposalResult struct {
+	value interface{}
+	err   error
+}
+
+// incomingSnapshot is a snapshot being received.
+type incomingSnapshot struct {
+	index, term uint64
+	offset      int64
+	file        *os.File
+}
+
+// Open opens a node, which serves the other nodes on ln. The state in cfg.Dir is loaded if it exists,
+// otherwise a new cluster is bootstrapped with cfg.Servers.
+// fsm must be the state machine the node applied to before restarting.
+func Open(cfg Config, ln net.Listener, fsm StateMachine) (*Node, error) {
+	def := DefaultConfig(cfg.ID, cfg.Dir)
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = def.HeartbeatInterval
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = def.ElectionTimeout
+	}
+	if cfg.SnapshotTimeout <= 0 {
+		cfg.SnapshotTimeout = def.SnapshotTimeout
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = def.SnapshotThreshold
+	}
+
+	st, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		id:      cfg.ID,
+		cfg:     cfg,
+		fsm:     fsm,
+		storage: st,
+		pending: make(map[uint64]*proposal),
+		stopCh:  make(chan struct{}),
+	}
+	n.cond = sync.NewCond(&n.mu)
+	if err := n.load(); err != nil {
+		_ = st.close()
+		return nil, err
+	}
+	if n.trans, err = newTransport(ln, n); err != nil {
+		_ = st.close()
+		return nil, err
+	}
+	n.resetElectionTimer()
+
+	n.wg.Add(2)
+	go n.run()
+	go n.runApplier()
+	return n, nil
+}
+
+// load loads the persisted state, or bootstraps a new cluster.
+func (n *Node) load() error {
+	exists, err := n.storage.exists()
+	if err != nil {
+		return err
+	}
+	if !exists && len(n.cfg.Servers) > 0 {
+		n.snap = snapshotMeta{Servers: append([]Server(nil), n.cfg.Servers...)}
+		if err := n.storage.saveSnapshot(n.snap); err != nil {
+			return err
+		}
+	}
+
+	hs, err := n.storage.loadHardState()
+	if err != nil {
+		return err
+	}
+	n.term, n.votedFor = hs.Term, hs.VotedFor
+	if n.snap, err = n.storage.loadSnapshot(); err != nil {
+		return err
+	}
+
+	if n.storage.restoring() {
+		// the state machine was being restored when it crashed, it is reset,
+		// and gets the snapshot again from the leader.
+		logger.Warn("raft: state machine of %s was being restored, reset it", n.id)
+		n.snap = snapshotMeta{Servers: n.snap.Servers}
+		if err := n.storage.rewriteLog(nil); err != nil {
+			return err
+		}
+		if err := n.storage.saveSnapshot(n.snap); err != nil {
+			return err
+		}
+		if _, err := n.fsm.Restore(bytes.NewReader(nil)); err != nil {
+			return err
+		}
+		if err := n.storage.setRestoring(false); err != nil {
+			return err
+		}
+	} else if n.log, err = n.storage.loadEntries(n.snap.Index); err != nil {
+		return err
+	}
+	n.commitIndex, n.lastApplied = n.snap.Index, n.snap.Index
+	n.reloadConfig()
+	return nil
+}
+
+// Close stops the node, the state machine is not closed.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	n.stopPeers()
+	n.cond.Broadcast()
+	n.mu.Unlock()
+
+	close(n.stopCh)
+	n.trans.close()
+	n.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.incoming != nil {
+		_ = n.incoming.file.Close()
+		n.incoming = nil
+	}
+	return n.storage.close()
+}
+
+// Status returns the status of the node.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.id,
+		State:         n.state,
+		Term:          n.term,
+		Leader:        n.leaderID,
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		LastIndex:     n.lastIndex(),
+		SnapshotIndex: n.snap.Index,
+		Servers:       append([]Server(nil), n.servers...),
+	}
+}
+
+// Leader returns the id and address of the leader, they are empty if the leader is unknown.
+func (n *Node) Leader() (string, string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaderID, n.serverAddr(n.leaderID)
+}
+
+// Apply proposes a command, and returns the result of the state machine after it is applied.
+// It must be called on the leader, otherwise ErrNotLeader is returned.
+// If ctx is done or ErrLeadershipLost is returned, the command may still be applied later.
+func (n *Node) Apply(ctx context.Context, cmd []byte) (interface{}, error) {
+	return n.propose(ctx, EntryCommand, cmd, nil)
+}
+
+// ReadIndex returns after the state machine of this node applied all the entries committed before the call,
+// so that a read from the state machine after it is linearizable. The leader confirms it is still the leader
+// by a round of heartbeats, and a follower asks the leader for the commit index.
+func (n *Node) ReadIndex(ctx context.Context) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return 0, ErrClosed
+	}
+
+	var index uint64
+	if n.state == Leader {
+		var err error
+		if index, err = n.leaderReadIndex(ctx); err != nil {
+			return 0, err
+		}
+	} else {
+		addr := n.serverAddr(n.leaderID)
+		if addr == "" {
+			return 0, ErrNoLeader
+		}
+		n.mu.Unlock()
+		var resp ReadIndexResponse
+		err := n.trans.call(addr, "ReadIndex", &ReadIndexRequest{}, &resp, n.cfg.ElectionTimeout)
+		n.mu.Lock()
+		if err != nil {
+			return 0, err
+		}
+		index = resp.Index
+	}
+	if err := n.waitLocked(ctx, func() bool { return n.lastApplied >= index }); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// AddServer adds a server to the cluster, it returns after the new configuration is committed.
+// It must be called on the leader, and only one membership change is allowed at a time.
+// The new server should be opened without Servers, it gets the log or a snapshot from the leader.
+func (n *Node) AddServer(ctx context.Context, server Server) error {
+	_, err := n.propose(ctx, EntryConfig, nil, func(servers []Server) ([]Server, error) {
+		for _, s := range servers {
+			if s.ID == server.ID {
+				return nil, ErrServerExists
+			}
+		}
+		return append(servers, server), nil
+	})
+	return err
+}
+
+// RemoveServer removes a server from the cluster, it returns after the new configuration is committed.
+// A removed leader steps down after that.
+func (n *Node) RemoveServer(ctx context.Context, id string) error {
+	_, err := n.propose(ctx, EntryConfig, nil, func(servers []Server) ([]Server, error) {
+		for i, s := range servers {
+			if s.ID == id {
+				return append(servers[:i], servers[i+1:]...), nil
+			}
+		}
+		return nil, ErrServerNotFound
+	})
+	return err
+}
+
+// propose appends an entry on the leader, and waits for it to be applied.
+// For configuration entries, change returns the new servers from the current ones.
+func (n *Node) propose(ctx context.Context, typ EntryType, data []byte,
+	change func([]Server) ([]Server, error)) (interface{}, error) {
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n.state != Leader {
+		n.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	if change != nil {
+		// a new configuration is allowed after the last one and an entry of this term are committed.
+		if n.configIndex > n.commitIndex || n.termStart > n.commitIndex {
+			n.mu.Unlock()
+			return nil, ErrConfigChangeInProgress
+		}
+		servers, err := change(append([]Server(nil), n.servers...))
+		if err != nil {
+			n.mu.Unlock()
+			return nil, err
+		}
+		data = encodeServers(servers)
+	}
+
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Type: typ, Data: data}
+	if err := n.appendLocal(e); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	p := &proposal{term: e.Term, ch: make(chan proposalResult, 1)}
+	n.pending[e.Index] = p
+	n.advanceCommit()
+	n.triggerPeers()
+	n.mu.Unlock()
+
+	select {
+	case r := <-p.ch:
+		return r.value, r.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.pending, e.Index)
+		n.mu.Unlock()
+		return nil, ctx.Err()
+	case <-n.stopCh:
+		return nil, ErrClosed
+	}
+}
+
+// waitLocked waits until cond is true, ctx is done or the node is closed, the lock must be held.
+func (n *Node) waitLocked(ctx context.Context, cond func() bool) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.mu.Lock()
+			n.cond.Broadcast()
+			n.mu.Unlock()
+		case <-done:
+		}
+	}()
+	for !cond() {
+		if n.closed {
+			return ErrClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n.cond.Wait()
+	}
+	return nil
+}
+
+func (n *Node) lastIndex() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Index
+	}
+	return n.snap.Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Term
+	}
+	return n.snap.Term
+}
+
+// termAt returns the term of the entry at index, and reports whether it is known.
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	if index == n.snap.Index {
+		return n.snap.Term, true
+	}
+	if index < n.snap.Index || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[index-n.snap.Index-1].Term, true
+}
+
+// entriesFrom returns at most max entries from index.
+func (n *Node) entriesFrom(index uint64, max int) []Entry {
+	if index <= n.snap.Index || index > n.lastIndex() {
+		return nil
+	}
+	entries := n.log[index-n.snap.Index-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+// appendLocal persists and appends entries to the log.
+func (n *Node) appendLocal(entries ...Entry) error {
+	if err := n.storage.appendEntries(entries); err != nil {
+		return err
+	}
+	n.log = append(n.log, entries...)
+	for _, e := range entries {
+		if e.Type == EntryConfig {
+			n.reloadConfig()
+			break
+		}
+	}
+	return nil
+}
+
+// truncateLog deletes the entries from index.
+func (n *Node) truncateLog(index uint64) error {
+	log := append([]Entry(nil), n.log[:index-n.snap.Index-1]...)
+	if err := n.storage.rewriteLog(log); err != nil {
+		return err
+	}
+	n.log = log
+	n.reloadConfig()
+	return nil
+}
+
+// reloadConfig sets the servers by the latest configuration entry or the snapshot.
+func (n *Node) reloadConfig() {
+	n.servers, n.configIndex = n.snap.Servers, 0
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if n.log[i].Type == EntryConfig {
+			n.servers, n.configIndex = decodeServers(n.log[i].Data), n.log[i].Index
+			break
+		}
+	}
+	if n.state == Leader {
+		n.syncPeers()
+	}
+}
+
+// configAt returns the servers of the configuration at index.
+func (n *Node) configAt(index uint64) []Server {
+	for i := len(n.log) - 1; i >= 0; i-- {
+		if e := n.log[i]; e.Index <= index && e.Type == EntryConfig {
+			return decodeServers(e.Data)
+		}
+	}
+	return n.snap.Servers
+}
+
+func (n *Node) isMember(id string) bool {
+	return n.serverAddr(id) != ""
+}
+
+func (n *Node) serverAddr(id string) string {
+	for _, s := range n.servers {
+		if s.ID == id {
+			return s.Addr
+		}
+	}
+	return ""
+}
+
+func (n *Node) quorum() int {
+	return len(n.servers)/2 + 1
+}
+
+// setTerm persists the term and vote before they are used.
+func (n *Node) setTerm(term uint64, votedFor string) error {
+	if err := n.storage.saveHardState(hardState{Term: term, VotedFor: votedFor}); err != nil {
+		return err
+	}
+	n.term, n.votedFor = term, votedFor
+	return nil
+}
+
+func (n *Node) resetElectionTimer() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// failPending fails the proposals up to index, whose entries are replaced by a snapshot.
+func (n *Node) failPending(index uint64) {
+	for i, p := range n.pending {
+		if i <= index {
+			p.ch <- proposalResult{err: ErrLeadershipLost}
+			delete(n.pending, i)
+		}
+	}
+}
+
+func encodeServers(servers []Server) []byte {
+	var buf bytes.Buffer
+	_ = gob.NewEncoder(&buf).Encode(servers)
+	return buf.Bytes()
+}
+
+func decodeServers(data []byte) []Server {
+	var servers []Server
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&servers); err != nil {
+		logger.Error("raft: decode servers err: %v", err)
+	}
+	return servers
+}
@@ -0,0 +1,406 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStateMachine is a map of strings, commands are "key=value".
+// It is kept by the tests across restarts of the node, just like a persistent state machine.
+type memStateMachine struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func newMemStateMachine() *memStateMachine {
+	return &memStateMachine{data: make(map[string]string)}
+}
+
+func (m *memStateMachine) Apply(cmd []byte) interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kv := strings.SplitN(string(cmd), "=", 2)
+	m.data[kv[0]] = kv[1]
+	return len(m.data)
+}
+
+func (m *memStateMachine) Snapshot() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(m.data)
+	return buf.Bytes(), err
+}
+
+func (m *memStateMachine) WriteSnapshot(handle []byte, w io.Writer) error {
+	_, err := w.Write(handle)
+	return err
+}
+
+func (m *memStateMachine) Restore(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.data = make(map[string]string)
+	if len(data) > 0 {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&m.data)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return m.Snapshot()
+}
+
+func (m *memStateMachine) get(key string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.data[key]
+}
+
+// testCluster runs nodes in process over loopback.
+type testCluster struct {
+	t         *testing.T
+	dir       string
+	threshold uint64
+	nodes     map[string]*Node
+	fsms      map[string]*memStateMachine
+	addrs     map[string]string
+}
+
+func newTestCluster(t *testing.T, name string, size int, threshold uint64) *testCluster {
+	c := &testCluster{
+		t:         t,
+		dir:       filepath.Join("/tmp", "yoimiya-raft-"+name),
+		threshold: threshold,
+		nodes:     make(map[string]*Node),
+		fsms:      make(map[string]*memStateMachine),
+		addrs:     make(map[string]string),
+	}
+	_ = os.RemoveAll(c.dir)
+	var servers []Server
+	for i := 0; i < size; i++ {
+		id := fmt.Sprintf("n%d", i)
+		c.listen(id)
+		servers = append(servers, Server{ID: id, Addr: c.addrs[id]})
+	}
+	for _, s := range servers {
+		c.start(s.ID, servers)
+	}
+	return c
+}
+
+// listen reserves an address for id.
+func (c *testCluster) listen(id string) {
+	addr := c.addrs[id]
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	ln, err := net.Listen("tcp", addr)
+	assert.Nil(c.t, err)
+	c.addrs[id] = ln.Addr().String()
+	_ = ln.Close()
+}
+
+func (c *testCluster) config(id string, servers []Server) Config {
+	cfg := DefaultConfig(id, filepath.Join(c.dir, id))
+	cfg.Servers = servers
+	cfg.HeartbeatInterval = 20 * time.Millisecond
+	cfg.ElectionTimeout = 200 * time.Millisecond
+	cfg.SnapshotThreshold = c.threshold
+	return cfg
+}
+
+// start opens the node of id, with the state machine it had before.
+func (c *testCluster) start(id string, servers []Server) *Node {
+	if c.fsms[id] == nil {
+		c.fsms[id] = newMemStateMachine()
+	}
+	ln, err := net.Listen("tcp", c.addrs[id])
+	assert.Nil(c.t, err)
+	n, err := Open(c.config(id, servers), ln, c.fsms[id])
+	assert.Nil(c.t, err)
+	c.nodes[id] = n
+	return n
+}
+
+func (c *testCluster) stop(id string) {
+	assert.Nil(c.t, c.nodes[id].Close())
+	delete(c.nodes, id)
+}
+
+func (c *testCluster) close() {
+	for id, n := range c.nodes {
+		assert.Nil(c.t, n.Close())
+		delete(c.nodes, id)
+	}
+	_ = os.RemoveAll(c.dir)
+}
+
+// leader waits for a leader which all the running nodes agree on.
+func (c *testCluster) leader() *Node {
+	var leader *Node
+	waitFor(c.t, func() bool {
+		leader = nil
+		var leaderID string
+		for _, n := range c.nodes {
+			st := n.Status()
+			if st.State == Leader {
+				leader = n
+			}
+			if leaderID == "" {
+				leaderID = st.Leader
+			}
+			if st.Leader == "" || st.Leader != leaderID {
+				return false
+			}
+		}
+		return leader != nil && leader.id == leaderID
+	})
+	return leader
+}
+
+func (c *testCluster) apply(cmd string) {
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		_, err := c.leader().Apply(ctx, []byte(cmd))
+		cancel()
+		if err == nil {
+			return
+		}
+	}
+	c.t.Fatalf("apply %s failed", cmd)
+}
+
+// converged waits for the state machines of all running nodes to have key=value.
+func (c *testCluster) converged(key, value string) {
+	waitFor(c.t, func() bool {
+		for id := range c.nodes {
+			if c.fsms[id].get(key) != value {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNode_Replication(t *testing.T) {
+	c := newTestCluster(t, "replication", 3, 1000)
+	defer c.close()
+
+	leader := c.leader()
+	result, err := leader.Apply(context.Background(), []byte("a=1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, result)
+	c.converged("a", "1")
+
+	for _, n := range c.nodes {
+		if n != leader {
+			_, err := n.Apply(context.Background(), []byte("b=1"))
+			assert.Equal(t, ErrNotLeader, err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		c.apply(fmt.Sprintf("k%d=%d", i, i))
+	}
+	c.converged("k99", "99")
+	st := leader.Status()
+	assert.Equal(t, 3, len(st.Servers))
+	assert.Equal(t, st.CommitIndex, st.LastIndex)
+}
+
+func TestNode_Failover(t *testing.T) {
+	c := newTestCluster(t, "failover", 3, 1000)
+	defer c.close()
+
+	c.apply("a=1")
+	old := c.leader()
+	term := old.Status().Term
+	c.stop(old.id)
+
+	// the remaining majority elects a new leader, and keeps the committed entries.
+	leader := c.leader()
+	assert.NotEqual(t, old.id, leader.id)
+	assert.True(t, leader.Status().Term > term)
+	c.apply("b=2")
+	c.converged("a", "1")
+	c.converged("b", "2")
+
+	// the old leader catches up after restarting.
+	c.start(old.id, nil)
+	c.apply("c=3")
+	c.converged("b", "2")
+	c.converged("c", "3")
+
+	// restarting all the nodes loads the log.
+	for id := range c.nodes {
+		c.stop(id)
+		c.fsms[id] = newMemStateMachine()
+		c.start(id, nil)
+	}
+	c.converged("a", "1")
+	c.converged("c", "3")
+}
+
+func TestNode_ReadIndex(t *testing.T) {
+	c := newTestCluster(t, "read-index", 3, 1000)
+	defer c.close()
+
+	leader := c.leader()
+	for i := 0; i < 20; i++ {
+		_, err := leader.Apply(context.Background(), []byte(fmt.Sprintf("a=%d", i)))
+		assert.Nil(t, err)
+		// a read on any node after the write is done sees it.
+		for id, n := range c.nodes {
+			index, err := n.ReadIndex(context.Background())
+			assert.Nil(t, err)
+			assert.True(t, index > 0)
+			assert.Equal(t, fmt.Sprint(i), c.fsms[id].get("a"))
+		}
+	}
+
+	// the leader can't confirm its leadership without a majority.
+	for id, n := range c.nodes {
+		if n != leader {
+			c.stop(id)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := leader.ReadIndex(ctx)
+	assert.NotNil(t, err)
+}
+
+func TestNode_Snapshot(t *testing.T) {
+	c := newTestCluster(t, "snapshot", 3, 10)
+	defer c.close()
+
+	leader := c.leader()
+	var follower string
+	for id, n := range c.nodes {
+		if n != leader {
+			follower = id
+		}
+	}
+	c.stop(follower)
+	for i := 0; i < 50; i++ {
+		c.apply(fmt.Sprintf("k%d=%d", i, i))
+	}
+	waitFor(t, func() bool { return leader.Status().SnapshotIndex > 10 })
+
+	// the entries the follower needs are compacted, it gets a snapshot.
+	c.fsms[follower] = newMemStateMachine()
+	c.start(follower, nil)
+	c.converged("k0", "0")
+	c.converged("k49", "49")
+	assert.True(t, c.nodes[follower].Status().SnapshotIndex > 0)
+
+	// the state after the snapshot is restored is kept after restarting.
+	c.stop(follower)
+	c.start(follower, nil)
+	c.apply("after=1")
+	c.converged("after", "1")
+	assert.Equal(t, "49", c.fsms[follower].get("k49"))
+}
+
+func TestNode_Membership(t *testing.T) {
+	c := newTestCluster(t, "membership", 3, 20)
+	defer c.close()
+
+	for i := 0; i < 50; i++ {
+		c.apply(fmt.Sprintf("k%d=%d", i, i))
+	}
+
+	// a new server gets the snapshot and the log from the leader.
+	leader := c.leader()
+	c.listen("n3")
+	c.start("n3", nil)
+	err := leader.AddServer(context.Background(), Server{ID: "n3", Addr: c.addrs["n3"]})
+	assert.Nil(t, err)
+	err = leader.AddServer(context.Background(), Server{ID: "n3", Addr: c.addrs["n3"]})
+	assert.Equal(t, ErrServerExists, err)
+	c.apply("added=1")
+	c.converged("k0", "0")
+	c.converged("added", "1")
+	assert.Equal(t, 4, len(c.nodes["n3"].Status().Servers))
+
+	// the removed leader steps down, and the others elect a new one.
+	err = leader.RemoveServer(context.Background(), leader.id)
+	assert.Nil(t, err)
+	removed := leader.id
+	waitFor(t, func() bool { return c.nodes[removed].Status().State == Follower })
+	c.stop(removed)
+	leader = c.leader()
+	assert.NotEqual(t, removed, leader.id)
+	assert.Equal(t, 3, len(leader.Status().Servers))
+	c.apply("removed=1")
+	c.converged("removed", "1")
+
+	err = leader.RemoveServer(context.Background(), removed)
+	assert.Equal(t, ErrServerNotFound, err)
+	for id, n := range c.nodes {
+		if n != leader {
+			err = n.AddServer(context.Background(), Server{ID: "x", Addr: c.addrs[id]})
+			assert.Equal(t, ErrNotLeader, err)
+		}
+	}
+}
+
+func TestStorage_LoadEntries(t *testing.T) {
+	dir := filepath.Join("/tmp", "yoimiya-raft-storage")
+	_ = os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	s, err := openStorage(dir)
+	assert.Nil(t, err)
+
+	var entries []Entry
+	for i := uint64(1); i <= 10; i++ {
+		entries = append(entries, Entry{Index: i, Term: 1, Type: EntryCommand, Data: []byte(fmt.Sprint(i))})
+	}
+	assert.Nil(t, s.appendEntries(entries))
+	loaded, err := s.loadEntries(4)
+	assert.Nil(t, err)
+	assert.Equal(t, entries[4:], loaded)
+
+	// a torn record at the end is truncated.
+	info, err := s.log.Stat()
+	assert.Nil(t, err)
+	assert.Nil(t, s.log.Truncate(info.Size()-3))
+	loaded, err = s.loadEntries(0)
+	assert.Nil(t, err)
+	assert.Equal(t, entries[:9], loaded)
+	assert.Nil(t, s.appendEntries(entries[9:]))
+	loaded, err = s.loadEntries(0)
+	assert.Nil(t, err)
+	assert.Equal(t, entries, loaded)
+
+	// a corrupted record in the middle is not.
+	_, err = s.log.WriteAt([]byte{0xff}, recordHeaderSize+entryHeaderSize)
+	assert.Nil(t, err)
+	_, err = s.loadEntries(0)
+	assert.Equal(t, ErrCorruptedLog, err)
+	assert.Nil(t, s.close())
+}
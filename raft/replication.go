@@ -0,0 +1,484 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"yoimiya/logger"
+)
+
+// errSnapshotOffset a chunk of snapshot doesn't follow the received ones, the leader sends the snapshot again.
+var errSnapshotOffset = errors.New("raft: unexpected snapshot offset")
+
+// peer is the replication progress of a server, kept by the leader.
+type peer struct {
+	server     Server
+	nextIndex  uint64
+	matchIndex uint64
+	ackRound   uint64    // the latest read round acknowledged.
+	lastAck    time.Time // the latest successful reply.
+	trigger    chan struct{}
+	stop       chan struct{}
+}
+
+// syncPeers starts replicating to the new servers in the configuration, and stops the removed ones.
+func (n *Node) syncPeers() {
+	for id, p := range n.peers {
+		if !n.isMember(id) {
+			close(p.stop)
+			delete(n.peers, id)
+		}
+	}
+	for _, s := range n.servers {
+		if s.ID == n.id || n.peers[s.ID] != nil {
+			continue
+		}
+		p := &peer{
+			server:    s,
+			nextIndex: n.lastIndex() + 1,
+			lastAck:   time.Now(),
+			trigger:   make(chan struct{}, 1),
+			stop:      make(chan struct{}),
+		}
+		n.peers[s.ID] = p
+		n.wg.Add(1)
+		go n.replicate(p, n.term)
+	}
+}
+
+func (n *Node) stopPeers() {
+	for _, p := range n.peers {
+		close(p.stop)
+	}
+	n.peers = nil
+}
+
+// triggerPeers wakes up the replicators to send new entries or heartbeats now.
+func (n *Node) triggerPeers() {
+	for _, p := range n.peers {
+		select {
+		case p.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate sends entries to a peer until the leadership of term is over or the peer is removed.
+func (n *Node) replicate(p *peer, term uint64) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if !n.replicateOnce(p, term) {
+			select {
+			case <-p.stop:
+				return
+			case <-p.trigger:
+			case <-ticker.C:
+			}
+			continue
+		}
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+	}
+}
+
+// replicateOnce sends one AppendEntries request, or a snapshot, to the peer,
+// and reports whether there are more to send right away.
+func (n *Node) replicateOnce(p *peer, term uint64) bool {
+	n.mu.Lock()
+	if n.state != Leader || n.term != term {
+		n.mu.Unlock()
+		return false
+	}
+	if p.nextIndex <= n.snap.Index {
+		meta := n.snap
+		n.mu.Unlock()
+		return n.sendSnapshot(p, term, meta)
+	}
+	prev := p.nextIndex - 1
+	prevTerm, _ := n.termAt(prev)
+	req := &AppendEntriesRequest{
+		Term:         term,
+		LeaderID:     n.id,
+		PrevLogIndex: prev,
+		PrevLogTerm:  prevTerm,
+		Entries:      n.entriesFrom(p.nextIndex, maxEntriesPerRequest),
+		LeaderCommit: n.commitIndex,
+	}
+	round := n.readRound
+	n.mu.Unlock()
+
+	var resp AppendEntriesResponse
+	err := n.trans.call(p.server.Addr, "AppendEntries", req, &resp, n.cfg.ElectionTimeout)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil || !n.ack(p, term, resp.Term, round) {
+		return false
+	}
+	if !resp.Success {
+		// retry from where the follower asked, but never before the entries known to match.
+		next := resp.NextIndex
+		if next == 0 || next >= p.nextIndex {
+			next = p.nextIndex - 1
+		}
+		if next <= p.matchIndex {
+			next = p.matchIndex + 1
+		}
+		p.nextIndex = next
+		return true
+	}
+	if match := prev + uint64(len(req.Entries)); match > p.matchIndex {
+		p.matchIndex = match
+	}
+	if p.nextIndex <= p.matchIndex {
+		p.nextIndex = p.matchIndex + 1
+	}
+	n.advanceCommit()
+	return p.nextIndex <= n.lastIndex()
+}
+
+// ack handles a reply of a peer, and reports whether this node is still the leader of term.
+func (n *Node) ack(p *peer, term, replyTerm, round uint64) bool {
+	if n.closed {
+		return false
+	}
+	if replyTerm > n.term {
+		n.logError(n.becomeFollower(replyTerm))
+		return false
+	}
+	if n.state != Leader || n.term != term {
+		return false
+	}
+	p.lastAck = time.Now()
+	if round > p.ackRound {
+		p.ackRound = round
+		n.cond.Broadcast()
+	}
+	return true
+}
+
+// sendSnapshot sends the snapshot to the peer in chunks, the data is written by the state machine while it is sent.
+func (n *Node) sendSnapshot(p *peer, term uint64, meta snapshotMeta) bool {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		_ = pw.CloseWithError(n.fsm.WriteSnapshot(meta.Handle, pw))
+	}()
+
+	n.mu.Lock()
+	round := n.readRound
+	n.mu.Unlock()
+
+	logger.Info("raft: %s sends snapshot at %d to %s", n.id, meta.Index, p.server.ID)
+	buf := make([]byte, snapshotChunkSize)
+	var offset int64
+	for {
+		size, err := io.ReadFull(pr, buf)
+		done := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !done {
+			logger.Error("raft: write snapshot at %d err: %v", meta.Index, err)
+			return false
+		}
+		req := &InstallSnapshotRequest{
+			Term:      term,
+			LeaderID:  n.id,
+			LastIndex: meta.Index,
+			LastTerm:  meta.Term,
+			Servers:   meta.Servers,
+			Offset:    offset,
+			Data:      buf[:size],
+			Done:      done,
+		}
+		var resp InstallSnapshotResponse
+		err = n.trans.call(p.server.Addr, "InstallSnapshot", req, &resp, n.cfg.SnapshotTimeout)
+
+		n.mu.Lock()
+		if err != nil || !n.ack(p, term, resp.Term, round) {
+			n.mu.Unlock()
+			if err != nil {
+				logger.Warn("raft: send snapshot to %s err: %v", p.server.ID, err)
+			}
+			return false
+		}
+		if done {
+			if meta.Index > p.matchIndex {
+				p.matchIndex = meta.Index
+			}
+			p.nextIndex = p.matchIndex + 1
+			n.advanceCommit()
+			n.mu.Unlock()
+			return true
+		}
+		n.mu.Unlock()
+		offset += int64(size)
+	}
+}
+
+// advanceCommit commits the latest entry of the current term replicated on a majority.
+// The entries of previous terms are committed only along with it.
+func (n *Node) advanceCommit() {
+	if n.state != Leader {
+		return
+	}
+	for i := n.lastIndex(); i > n.commitIndex; i-- {
+		if t, _ := n.termAt(i); t != n.term {
+			break
+		}
+		count := 0
+		if n.isMember(n.id) {
+			count++
+		}
+		for _, p := range n.peers {
+			if p.matchIndex >= i {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = i
+			n.cond.Broadcast()
+			n.triggerPeers()
+			break
+		}
+	}
+	// a leader removed from the cluster steps down once the configuration is committed.
+	if n.configIndex <= n.commitIndex && !n.isMember(n.id) {
+		logger.Info("raft: leader %s is removed from the cluster, step down", n.id)
+		n.logError(n.becomeFollower(n.term))
+	}
+}
+
+func (n *Node) handleAppendEntries(req *AppendEntriesRequest, resp *AppendEntriesResponse) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp.Term = n.term
+	if n.closed || req.Term < n.term {
+		return nil
+	}
+	if err := n.acceptLeader(req.Term, req.LeaderID); err != nil {
+		return err
+	}
+	resp.Term = n.term
+
+	prev, entries := req.PrevLogIndex, req.Entries
+	if prev < n.snap.Index {
+		// the entries in the snapshot are committed, so they match the leader.
+		skip := n.snap.Index - prev
+		if skip >= uint64(len(entries)) {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prev = n.snap.Index
+	} else if prev > n.lastIndex() {
+		resp.NextIndex = n.lastIndex() + 1
+		return nil
+	} else if t, _ := n.termAt(prev); t != req.PrevLogTerm {
+		// skip all the entries of the conflicting term.
+		i := prev
+		for i > n.snap.Index+1 {
+			if pt, _ := n.termAt(i - 1); pt != t {
+				break
+			}
+			i--
+		}
+		resp.NextIndex = i
+		return nil
+	}
+
+	for i, e := range entries {
+		if t, ok := n.termAt(e.Index); ok {
+			if t == e.Term {
+				continue
+			}
+			if err := n.truncateLog(e.Index); err != nil {
+				return err
+			}
+		}
+		if err := n.appendLocal(entries[i:]...); err != nil {
+			return err
+		}
+		break
+	}
+
+	if lastNew := prev + uint64(len(entries)); req.LeaderCommit > n.commitIndex && lastNew > n.commitIndex {
+		n.commitIndex = lastNew
+		if req.LeaderCommit < lastNew {
+			n.commitIndex = req.LeaderCommit
+		}
+		n.cond.Broadcast()
+	}
+	resp.Success = true
+	return nil
+}
+
+func (n *Node) handleInstallSnapshot(req *InstallSnapshotRequest, resp *InstallSnapshotResponse) error {
+	n.mu.Lock()
+	resp.Term = n.term
+	if n.closed || req.Term < n.term {
+		n.mu.Unlock()
+		return nil
+	}
+	if err := n.acceptLeader(req.Term, req.LeaderID); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	resp.Term = n.term
+	// the log already has the entries of the snapshot.
+	if t, ok := n.termAt(req.LastIndex); (ok && t == req.LastTerm) || req.LastIndex < n.snap.Index {
+		n.mu.Unlock()
+		return nil
+	}
+
+	in := n.incoming
+	if req.Offset == 0 {
+		if in != nil {
+			_ = in.file.Close()
+		}
+		f, err := os.OpenFile(filepath.Join(n.cfg.Dir, incomingFile), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+		if err != nil {
+			n.mu.Unlock()
+			return err
+		}
+		in = &incomingSnapshot{index: req.LastIndex, term: req.LastTerm, file: f}
+		n.incoming = in
+	} else if in == nil || in.index != req.LastIndex || in.term != req.LastTerm || in.offset != req.Offset {
+		n.mu.Unlock()
+		return errSnapshotOffset
+	}
+	if _, err := in.file.Write(req.Data); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	in.offset += int64(len(req.Data))
+	if !req.Done {
+		n.mu.Unlock()
+		return nil
+	}
+	n.incoming = nil
+	n.mu.Unlock()
+	return n.restoreSnapshot(req, in.file)
+}
+
+// restoreSnapshot replaces the state machine and the log with the received snapshot.
+func (n *Node) restoreSnapshot(req *InstallSnapshotRequest, f *os.File) error {
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	if n.closed || n.term != req.Term {
+		n.mu.Unlock()
+		return ErrLeadershipLost
+	}
+	if t, ok := n.termAt(req.LastIndex); ok && t == req.LastTerm {
+		n.mu.Unlock()
+		return nil
+	}
+	if err := n.storage.setRestoring(true); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	n.mu.Unlock()
+
+	logger.Info("raft: %s restores snapshot at %d", n.id, req.LastIndex)
+	handle, err := n.restoreStateMachine(f)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		// the state machine is broken, it is reset when the node is opened again.
+		logger.Error("raft: restore snapshot at %d err: %v, close %s", req.LastIndex, err, n.id)
+		go n.Close()
+		return err
+	}
+	meta := snapshotMeta{Index: req.LastIndex, Term: req.LastTerm, Servers: req.Servers, Handle: handle}
+	if err := n.storage.rewriteLog(nil); err != nil {
+		return err
+	}
+	if err := n.storage.saveSnapshot(meta); err != nil {
+		return err
+	}
+	if err := n.storage.setRestoring(false); err != nil {
+		return err
+	}
+	n.snap, n.log = meta, nil
+	n.lastApplied = meta.Index
+	if n.commitIndex < meta.Index {
+		n.commitIndex = meta.Index
+	}
+	n.reloadConfig()
+	n.failPending(meta.Index)
+	n.cond.Broadcast()
+	return nil
+}
+
+func (n *Node) restoreStateMachine(f *os.File) ([]byte, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return n.fsm.Restore(f)
+}
+
+// leaderReadIndex returns the commit index after confirming the leadership by a round of heartbeats.
+func (n *Node) leaderReadIndex(ctx context.Context) (uint64, error) {
+	term := n.term
+	lost := func() bool { return n.state != Leader || n.term != term }
+	// the commit index is up to date only after an entry of the term is committed.
+	if err := n.waitLocked(ctx, func() bool { return lost() || n.commitIndex >= n.termStart }); err != nil {
+		return 0, err
+	}
+	if lost() {
+		return 0, ErrLeadershipLost
+	}
+	index := n.commitIndex
+
+	n.readRound++
+	round := n.readRound
+	n.triggerPeers()
+	acked := func() bool {
+		count := 0
+		if n.isMember(n.id) {
+			count++
+		}
+		for _, p := range n.peers {
+			if p.ackRound >= round {
+				count++
+			}
+		}
+		return count >= n.quorum()
+	}
+	if err := n.waitLocked(ctx, func() bool { return lost() || acked() }); err != nil {
+		return 0, err
+	}
+	if lost() {
+		return 0, ErrLeadershipLost
+	}
+	return index, nil
+}
+
+func (n *Node) handleReadIndex(req *ReadIndexRequest, resp *ReadIndexResponse) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	defer cancel()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return ErrClosed
+	}
+	if n.state != Leader {
+		return ErrNotLeader
+	}
+	index, err := n.leaderReadIndex(ctx)
+	resp.Index = index
+	return err
+}
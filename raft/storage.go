@@ -0,0 +1,277 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	stateFile     = "STATE"
+	snapshotFile  = "SNAPSHOT"
+	logFile       = "LOG"
+	restoringFile = "RESTORING"
+	incomingFile  = "SNAPSHOT.incoming"
+
+	// recordHeaderSize size(4) + crc(4) of a log record, the record is index(8) + term(8) + type(1) + data.
+	recordHeaderSize = 8
+	entryHeaderSize  = 17
+)
+
+// ErrCorruptedLog a record in the middle of the raft log is corrupted.
+var ErrCorruptedLog = errors.New("raft: corrupted log")
+
+// hardState is the state which must be persisted before replying to any request.
+type hardState struct {
+	Term     uint64
+	VotedFor string
+}
+
+// snapshotMeta describes the latest snapshot, the data of the snapshot is kept by the state machine,
+// and Handle is what the state machine returned for it.
+type snapshotMeta struct {
+	Index   uint64
+	Term    uint64
+	Servers []Server
+	Handle  []byte
+}
+
+// storage persists the hard state, the snapshot meta and the log entries after the snapshot in a directory.
+// It is guarded by the lock of Node.
+type storage struct {
+	dir string
+	log *os.File
+}
+
+func openStorage(dir string) (*storage, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &storage{dir: dir, log: f}, nil
+}
+
+func (s *storage) close() error {
+	return s.log.Close()
+}
+
+// exists reports whether there is any persisted state, a new node is bootstrapped only if there is none.
+func (s *storage) exists() (bool, error) {
+	for _, name := range []string{stateFile, snapshotFile} {
+		if _, err := os.Stat(filepath.Join(s.dir, name)); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	info, err := s.log.Stat()
+	if err != nil {
+		return false, err
+	}
+	return info.Size() > 0, nil
+}
+
+func (s *storage) loadHardState() (hardState, error) {
+	var hs hardState
+	err := s.loadFile(stateFile, &hs)
+	return hs, err
+}
+
+func (s *storage) saveHardState(hs hardState) error {
+	return s.saveFile(stateFile, hs)
+}
+
+func (s *storage) loadSnapshot() (snapshotMeta, error) {
+	var meta snapshotMeta
+	err := s.loadFile(snapshotFile, &meta)
+	return meta, err
+}
+
+func (s *storage) saveSnapshot(meta snapshotMeta) error {
+	return s.saveFile(snapshotFile, meta)
+}
+
+// loadFile decodes the file into v, it is fine if the file doesn't exist.
+func (s *storage) loadFile(name string, v interface{}) error {
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// saveFile replaces the file with v atomically.
+func (s *storage) saveFile(name string, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, name)
+	if err := writeFileSync(path+".tmp", buf.Bytes()); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// loadEntries reads the log entries after index, a torn record at the end of log, written by a crash, is truncated.
+func (s *storage) loadEntries(after uint64) ([]Entry, error) {
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	info, err := s.log.Stat()
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(s.log)
+	var entries []Entry
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		size, crc := binary.BigEndian.Uint32(header), binary.BigEndian.Uint32(header[4:])
+		if offset+recordHeaderSize+int64(size) > info.Size() {
+			break
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(br, record); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		if crc32.ChecksumIEEE(record) != crc || size < entryHeaderSize {
+			// only the last record can be torn, more records after a corrupted one mean the log is corrupted.
+			if _, err := br.Peek(1); err != io.EOF {
+				return nil, ErrCorruptedLog
+			}
+			break
+		}
+		offset += recordHeaderSize + int64(size)
+		e := decodeEntry(record)
+		// the log may not be compacted yet when the snapshot was saved.
+		if e.Index > after {
+			entries = append(entries, e)
+		}
+	}
+	if err := s.log.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if _, err := s.log.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// appendEntries appends entries to the log and syncs it.
+func (s *storage) appendEntries(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		encodeEntry(&buf, e)
+	}
+	if _, err := s.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewriteLog replaces the log with entries, it is called when the log is truncated or compacted.
+func (s *storage) rewriteLog(entries []Entry) error {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		encodeEntry(&buf, e)
+	}
+	path := filepath.Join(s.dir, logFile)
+	if err := writeFileSync(path+".tmp", buf.Bytes()); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		_ = f.Close()
+		return err
+	}
+	_ = s.log.Close()
+	s.log = f
+	return nil
+}
+
+// setRestoring marks that the state machine is being restored from a snapshot, or the restoring is done.
+func (s *storage) setRestoring(restoring bool) error {
+	path := filepath.Join(s.dir, restoringFile)
+	if restoring {
+		return writeFileSync(path, nil)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *storage) restoring() bool {
+	_, err := os.Stat(filepath.Join(s.dir, restoringFile))
+	return err == nil
+}
+
+func encodeEntry(buf *bytes.Buffer, e Entry) {
+	record := make([]byte, recordHeaderSize+entryHeaderSize+len(e.Data))
+	binary.BigEndian.PutUint64(record[recordHeaderSize:], e.Index)
+	binary.BigEndian.PutUint64(record[recordHeaderSize+8:], e.Term)
+	record[recordHeaderSize+16] = byte(e.Type)
+	copy(record[recordHeaderSize+entryHeaderSize:], e.Data)
+	binary.BigEndian.PutUint32(record, uint32(len(record)-recordHeaderSize))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(record[recordHeaderSize:]))
+	buf.Write(record)
+}
+
+func decodeEntry(record []byte) Entry {
+	e := Entry{
+		Index: binary.BigEndian.Uint64(record),
+		Term:  binary.BigEndian.Uint64(record[8:]),
+		Type:  EntryType(record[16]),
+	}
+	if len(record) > entryHeaderSize {
+		e.Data = record[entryHeaderSize:]
+	}
+	return e
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
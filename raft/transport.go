@@ -0,0 +1,223 @@
+package raft
+
+import (
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// RequestVoteRequest is sent by candidates to gather votes.
+type RequestVoteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// AppendEntriesRequest is sent by the leader to replicate log entries, and as heartbeats without entries.
+type AppendEntriesRequest struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// AppendEntriesResponse if it is not successful, NextIndex is where the leader should retry from,
+// so that a conflicting term is skipped in one round trip.
+type AppendEntriesResponse struct {
+	Term      uint64
+	Success   bool
+	NextIndex uint64
+}
+
+// InstallSnapshotRequest is sent by the leader in chunks when the entries a follower needs are compacted.
+type InstallSnapshotRequest struct {
+	Term      uint64
+	LeaderID  string
+	LastIndex uint64
+	LastTerm  uint64
+	Servers   []Server
+	Offset    int64
+	Data      []byte
+	Done      bool
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+// ReadIndexRequest is sent by followers to get a read index from the leader.
+type ReadIndexRequest struct{}
+
+type ReadIndexResponse struct {
+	Index uint64
+}
+
+// service exposes the handlers of Node by net/rpc.
+type service struct {
+	n *Node
+}
+
+func (s *service) RequestVote(req *RequestVoteRequest, resp *RequestVoteResponse) error {
+	return s.n.handleRequestVote(req, resp)
+}
+
+func (s *service) AppendEntries(req *AppendEntriesRequest, resp *AppendEntriesResponse) error {
+	return s.n.handleAppendEntries(req, resp)
+}
+
+func (s *service) InstallSnapshot(req *InstallSnapshotRequest, resp *InstallSnapshotResponse) error {
+	return s.n.handleInstallSnapshot(req, resp)
+}
+
+func (s *service) ReadIndex(req *ReadIndexRequest, resp *ReadIndexResponse) error {
+	return s.n.handleReadIndex(req, resp)
+}
+
+// transport sends and serves the requests between nodes by net/rpc over TCP,
+// one connection is kept for each peer, and dialed again after a network error.
+type transport struct {
+	ln  net.Listener
+	srv *rpc.Server
+
+	mu      sync.Mutex
+	clients map[string]*rpc.Client
+	conns   map[net.Conn]struct{} // accepted connections.
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func newTransport(ln net.Listener, n *Node) (*transport, error) {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Raft", &service{n}); err != nil {
+		return nil, err
+	}
+	t := &transport{
+		ln:      ln,
+		srv:     srv,
+		clients: make(map[string]*rpc.Client),
+		conns:   make(map[net.Conn]struct{}),
+	}
+	t.wg.Add(1)
+	go t.serve()
+	return t, nil
+}
+
+func (t *transport) serve() {
+	defer t.wg.Done()
+	for {
+		nc, err := t.ln.Accept()
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			_ = nc.Close()
+			return
+		}
+		t.conns[nc] = struct{}{}
+		t.wg.Add(1)
+		t.mu.Unlock()
+		go func() {
+			defer t.wg.Done()
+			t.srv.ServeConn(nc)
+			t.mu.Lock()
+			delete(t.conns, nc)
+			t.mu.Unlock()
+		}()
+	}
+}
+
+// call calls the method of the node at addr, it fails if there is no reply in timeout.
+func (t *transport) call(addr, method string, req, resp interface{}, timeout time.Duration) error {
+	client, err := t.client(addr, timeout)
+	if err != nil {
+		return err
+	}
+	call := client.Go("Raft."+method, req, resp, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-timer.C:
+		err = ErrTimeout
+	}
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		// the connection may be broken, or the reply will arrive late and mismatch the next call.
+		t.mu.Lock()
+		if t.clients[addr] == client {
+			delete(t.clients, addr)
+		}
+		t.mu.Unlock()
+		_ = client.Close()
+	}
+	return remoteError(err)
+}
+
+// remoteError returns the error of this package for the error replied by a remote node.
+func remoteError(err error) error {
+	if se, ok := err.(rpc.ServerError); ok {
+		for _, e := range []error{ErrNotLeader, ErrNoLeader, ErrLeadershipLost, ErrClosed, ErrTimeout} {
+			if string(se) == e.Error() {
+				return e
+			}
+		}
+	}
+	return err
+}
+
+func (t *transport) client(addr string, timeout time.Duration) (*rpc.Client, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if client := t.clients[addr]; client != nil {
+		t.mu.Unlock()
+		return client, nil
+	}
+	t.mu.Unlock()
+
+	nc, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	client := rpc.NewClient(nc)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		_ = client.Close()
+		return nil, ErrClosed
+	}
+	if existing := t.clients[addr]; existing != nil {
+		_ = client.Close()
+		return existing, nil
+	}
+	t.clients[addr] = client
+	return client, nil
+}
+
+func (t *transport) close() {
+	t.mu.Lock()
+	t.closed = true
+	_ = t.ln.Close()
+	for nc := range t.conns {
+		_ = nc.Close()
+	}
+	for addr, client := range t.clients {
+		_ = client.Close()
+		delete(t.clients, addr)
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+}
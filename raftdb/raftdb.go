@@ -0,0 +1,180 @@
+// Package raftdb replicates a YoimiyaDB across 3 or 5 nodes by raft, for strongly consistent metadata storage.
+// Writes go through the replicated log of raft and are applied to the db on every node,
+// the log files of the db are the state machine, and snapshots are the log files up to some positions.
+// Reads are linearizable by the read index of raft.
+package raftdb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"yoimiya/db"
+	"yoimiya/raft"
+)
+
+// ErrInvalidCommand the command in the raft log can't be decoded.
+var ErrInvalidCommand = errors.New("raftdb: invalid command")
+
+const (
+	opSet byte = iota + 1
+	opDelete
+)
+
+// DB is a YoimiyaDB replicated by raft.
+type DB struct {
+	db   *db.YoimiyaDB
+	node *raft.Node
+}
+
+// Open opens the db with opts, and the raft node with cfg which serves the other nodes on ln.
+// The raft state is kept in the raft directory of the db path if cfg.Dir is empty.
+func Open(cfg raft.Config, ln net.Listener, opts db.Options) (*DB, error) {
+	if cfg.Dir == "" {
+		cfg.Dir = filepath.Join(opts.DBPath, "raft")
+	}
+	d, err := db.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	node, err := raft.Open(cfg, ln, &stateMachine{db: d})
+	if err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+	return &DB{db: d, node: node}, nil
+}
+
+// Close closes the raft node and the db.
+func (d *DB) Close() error {
+	if err := d.node.Close(); err != nil {
+		_ = d.db.Close()
+		return err
+	}
+	return d.db.Close()
+}
+
+// Node returns the raft node, for the status and membership changes of the cluster.
+func (d *DB) Node() *raft.Node {
+	return d.node
+}
+
+// Local returns the local db, which must not be written directly.
+// Reads from it are not linearizable, it may fall behind the leader.
+func (d *DB) Local() *db.YoimiyaDB {
+	return d.db
+}
+
+// Set set key to hold the string value, it must be called on the leader, otherwise raft.ErrNotLeader is returned.
+// It returns after the write is committed and applied.
+func (d *DB) Set(ctx context.Context, key, value []byte) error {
+	return d.apply(ctx, encodeCommand(opSet, key, value))
+}
+
+// Delete value at the given key, it must be called on the leader.
+func (d *DB) Delete(ctx context.Context, key []byte) error {
+	return d.apply(ctx, encodeCommand(opDelete, key, nil))
+}
+
+// Get get the value of key, it sees all the writes committed before it is called.
+// If the key does not exist the error db.ErrKeyNotFound is returned.
+func (d *DB) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if _, err := d.node.ReadIndex(ctx); err != nil {
+		return nil, err
+	}
+	return d.db.Get(key)
+}
+
+// Keys returns at most count keys with prefix greater than after, it is linearizable like Get.
+func (d *DB) Keys(ctx context.Context, prefix, after []byte, count int) ([][]byte, error) {
+	if _, err := d.node.ReadIndex(ctx); err != nil {
+		return nil, err
+	}
+	return d.db.Keys(prefix, after, count), nil
+}
+
+func (d *DB) apply(ctx context.Context, cmd []byte) error {
+	result, err := d.node.Apply(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	if err, ok := result.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// encodeCommand encodes a command as op(1) + key size(uvarint) + key + value.
+func encodeCommand(op byte, key, value []byte) []byte {
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(key)+len(value))
+	buf[0] = op
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(key)))
+	n += copy(buf[n:], key)
+	n += copy(buf[n:], value)
+	return buf[:n]
+}
+
+func decodeCommand(cmd []byte) (op byte, key, value []byte, err error) {
+	if len(cmd) < 2 {
+		return 0, nil, nil, ErrInvalidCommand
+	}
+	size, n := binary.Uvarint(cmd[1:])
+	if n <= 0 || uint64(len(cmd)-1-n) < size {
+		return 0, nil, nil, ErrInvalidCommand
+	}
+	key = cmd[1+n : 1+n+int(size)]
+	return cmd[0], key, cmd[1+n+int(size):], nil
+}
+
+// stateMachine applies the commands to the db, its snapshot handle is the encoded positions of the log files.
+type stateMachine struct {
+	db *db.YoimiyaDB
+}
+
+func (sm *stateMachine) Apply(cmd []byte) interface{} {
+	op, key, value, err := decodeCommand(cmd)
+	if err != nil {
+		return err
+	}
+	switch op {
+	case opSet:
+		return sm.db.Set(key, value)
+	case opDelete:
+		return sm.db.Delete(key)
+	}
+	return ErrInvalidCommand
+}
+
+func (sm *stateMachine) Snapshot() ([]byte, error) {
+	positions, err := sm.db.SnapshotPositions()
+	if err != nil {
+		return nil, err
+	}
+	handle := make([]byte, 12*len(positions))
+	for i, pos := range positions {
+		binary.BigEndian.PutUint32(handle[12*i:], pos.Fid)
+		binary.BigEndian.PutUint64(handle[12*i+4:], uint64(pos.Offset))
+	}
+	return handle, nil
+}
+
+func (sm *stateMachine) WriteSnapshot(handle []byte, w io.Writer) error {
+	if len(handle)%12 != 0 {
+		return db.ErrInvalidSnapshot
+	}
+	positions := make([]db.Position, len(handle)/12)
+	for i := range positions {
+		positions[i].Fid = binary.BigEndian.Uint32(handle[12*i:])
+		positions[i].Offset = int64(binary.BigEndian.Uint64(handle[12*i+4:]))
+	}
+	return sm.db.WriteSnapshot(w, positions)
+}
+
+func (sm *stateMachine) Restore(r io.Reader) ([]byte, error) {
+	if err := sm.db.RestoreSnapshot(r); err != nil {
+		return nil, err
+	}
+	return sm.Snapshot()
+}
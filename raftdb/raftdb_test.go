@@ -0,0 +1,169 @@
+package raftdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"yoimiya/db"
+	"yoimiya/raft"
+)
+
+const testDir = "/tmp/yoimiya-raftdb"
+
+func openTestDB(t *testing.T, id string, ln net.Listener, servers []raft.Server) *DB {
+	cfg := raft.DefaultConfig(id, "")
+	cfg.Servers = servers
+	cfg.HeartbeatInterval = 20 * time.Millisecond
+	cfg.ElectionTimeout = 200 * time.Millisecond
+	cfg.SnapshotThreshold = 20
+	opts := db.DefaultOptions(filepath.Join(testDir, id))
+	opts.LogFileSizeThreshold = 256
+	d, err := Open(cfg, ln, opts)
+	assert.Nil(t, err)
+	return d
+}
+
+func listen(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	return ln
+}
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%03d", i))
+}
+
+func testValue(i int) []byte {
+	return []byte(fmt.Sprintf("value-%03d", i))
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func leaderOf(t *testing.T, dbs map[string]*DB) *DB {
+	var leader *DB
+	waitFor(t, func() bool {
+		for _, d := range dbs {
+			if d.Node().Status().State == raft.Leader {
+				leader = d
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func TestDB(t *testing.T) {
+	_ = os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	var servers []raft.Server
+	lns := make(map[string]net.Listener)
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("n%d", i)
+		lns[id] = listen(t)
+		servers = append(servers, raft.Server{ID: id, Addr: lns[id].Addr().String()})
+	}
+	dbs := make(map[string]*DB)
+	for _, s := range servers {
+		dbs[s.ID] = openTestDB(t, s.ID, lns[s.ID], servers)
+	}
+	defer func() {
+		for _, d := range dbs {
+			assert.Nil(t, d.Close())
+		}
+	}()
+
+	ctx := context.Background()
+	leader := leaderOf(t, dbs)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, leader.Set(ctx, testKey(i), testValue(i)))
+	}
+	assert.Nil(t, leader.Delete(ctx, testKey(0)))
+
+	t.Run("read", func(t *testing.T) {
+		for _, d := range dbs {
+			value, err := d.Get(ctx, testKey(99))
+			assert.Nil(t, err)
+			assert.Equal(t, testValue(99), value)
+			_, err = d.Get(ctx, testKey(0))
+			assert.Equal(t, db.ErrKeyNotFound, err)
+			keys, err := d.Keys(ctx, nil, nil, 1000)
+			assert.Nil(t, err)
+			assert.Equal(t, 99, len(keys))
+		}
+	})
+
+	t.Run("not-leader", func(t *testing.T) {
+		for _, d := range dbs {
+			if d != leader {
+				assert.Equal(t, raft.ErrNotLeader, d.Set(ctx, []byte("k"), []byte("v")))
+			}
+		}
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		// the log is compacted, a new node gets the log files of the leader as a snapshot.
+		waitFor(t, func() bool { return leader.Node().Status().SnapshotIndex > 0 })
+		ln := listen(t)
+		dbs["n3"] = openTestDB(t, "n3", ln, nil)
+		err := leader.Node().AddServer(ctx, raft.Server{ID: "n3", Addr: ln.Addr().String()})
+		assert.Nil(t, err)
+		assert.Nil(t, leader.Set(ctx, []byte("added"), []byte("1")))
+		waitFor(t, func() bool { return len(dbs["n3"].Node().Status().Servers) == 4 })
+
+		value, err := dbs["n3"].Get(ctx, []byte("added"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("1"), value)
+		assert.True(t, dbs["n3"].Node().Status().SnapshotIndex > 0)
+		for i := 1; i < 100; i++ {
+			value, err := dbs["n3"].Local().Get(testKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, testValue(i), value)
+		}
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		var old string
+		for id, d := range dbs {
+			if d == leader {
+				old = id
+			}
+		}
+		assert.Nil(t, leader.Close())
+		delete(dbs, old)
+
+		leader = leaderOf(t, dbs)
+		assert.Nil(t, leader.Set(ctx, []byte("failover"), []byte("1")))
+		for _, d := range dbs {
+			value, err := d.Get(ctx, []byte("failover"))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("1"), value)
+		}
+	})
+}
+
+func TestCommand(t *testing.T) {
+	cmd := encodeCommand(opSet, []byte("key"), []byte("value"))
+	op, key, value, err := decodeCommand(cmd)
+	assert.Nil(t, err)
+	assert.Equal(t, opSet, op)
+	assert.Equal(t, []byte("key"), key)
+	assert.Equal(t, []byte("value"), value)
+
+	_, _, _, err = decodeCommand(cmd[:3])
+	assert.Equal(t, ErrInvalidCommand, err)
+}
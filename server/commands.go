@@ -0,0 +1,373 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"yoimiya/db"
+	"yoimiya/pubsub"
+)
+
+// version the server version reported by HELLO.
+const version = "1.0.0"
+
+// command is a command supported by the server.
+type command struct {
+	name string
+
+	// arity number of arguments including the command name, -n means n at least.
+	arity int
+
+	handler func(c *conn, args [][]byte)
+}
+
+var commands = make(map[string]*command)
+
+func init() {
+	for _, cmd := range []*command{
+		// connection.
+		{"ping", -1, pingCommand},
+		{"echo", 2, echoCommand},
+		{"select", 2, selectCommand},
+		{"hello", -1, helloCommand},
+		{"quit", 1, quitCommand},
+		{"command", -1, commandCommand},
+
+		// strings.
+		{"set", -3, setCommand},
+		{"get", 2, getCommand},
+		{"mset", -3, msetCommand},
+		{"mget", -2, mgetCommand},
+		{"del", -2, delCommand},
+		{"exists", -2, existsCommand},
+		{"strlen", 2, strlenCommand},
+		{"scan", -2, scanCommand},
+
+		// pub/sub.
+		{"subscribe", -2, subscribeCommand},
+		{"psubscribe", -2, psubscribeCommand},
+		{"unsubscribe", -1, unsubscribeCommand},
+		{"punsubscribe", -1, punsubscribeCommand},
+		{"publish", 3, publishCommand},
+		{"pubsub", -2, pubsubCommand},
+
+		// replication.
+		{"replsync", -3, replsyncCommand},
+		{"role", 1, roleCommand},
+	} {
+		commands[cmd.name] = cmd
+	}
+}
+
+// CommandNames returns the names of supported commands in alphabetical order.
+func CommandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// execute executes a command and writes the reply.
+func (c *conn) execute(args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		c.w.WriteError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		c.w.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+	// in RESP2 the replies can't be told from messages, so only a few commands are allowed while subscribing.
+	if c.w.proto < 3 && c.subscribing() && !allowedWhileSubscribing[name] {
+		c.w.WriteError(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT "+
+			"are allowed in this context", name))
+		return
+	}
+	cmd.handler(c, args)
+}
+
+func (c *conn) getDB() *db.YoimiyaDB {
+	return c.srv.dbs[c.db]
+}
+
+// writeDBError writes the error returned by db.
+func (c *conn) writeDBError(err error) {
+	if err == db.ErrReadOnly {
+		c.w.WriteError("READONLY You can't write against a read only replica.")
+		return
+	}
+	c.w.WriteError("ERR " + err.Error())
+}
+
+func pingCommand(c *conn, args [][]byte) {
+	if c.w.proto < 3 && c.subscribing() {
+		if len(args) > 2 {
+			c.w.WriteError("ERR wrong number of arguments for 'ping' command")
+			return
+		}
+		c.w.WriteArray(2)
+		c.w.WriteBulkString("pong")
+		if len(args) == 2 {
+			c.w.WriteBulk(args[1])
+		} else {
+			c.w.WriteBulkString("")
+		}
+		return
+	}
+	switch len(args) {
+	case 1:
+		c.w.WriteSimpleString("PONG")
+	case 2:
+		c.w.WriteBulk(args[1])
+	default:
+		c.w.WriteError("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func echoCommand(c *conn, args [][]byte) {
+	c.w.WriteBulk(args[1])
+}
+
+func selectCommand(c *conn, args [][]byte) {
+	index, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		c.w.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+	if index < 0 || index >= len(c.srv.dbs) {
+		c.w.WriteError("ERR DB index is out of range")
+		return
+	}
+	c.db = index
+	c.w.WriteSimpleString("OK")
+}
+
+// helloCommand switches the protocol version, AUTH is not supported, SETNAME is accepted but ignored.
+func helloCommand(c *conn, args [][]byte) {
+	proto := c.w.proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			c.w.WriteError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v != 2 && v != 3 {
+			c.w.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+	}
+	for i := 2; i < len(args); i++ {
+		if strings.EqualFold(string(args[i]), "setname") && i+1 < len(args) {
+			i++
+			continue
+		}
+		c.w.WriteError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i]))
+		return
+	}
+
+	c.w.proto = proto
+	c.w.WriteMap(6)
+	c.w.WriteBulkString("server")
+	c.w.WriteBulkString("yoimiya")
+	c.w.WriteBulkString("version")
+	c.w.WriteBulkString(version)
+	c.w.WriteBulkString("proto")
+	c.w.WriteInteger(int64(proto))
+	c.w.WriteBulkString("mode")
+	c.w.WriteBulkString("standalone")
+	c.w.WriteBulkString("role")
+	c.w.WriteBulkString(c.role())
+	c.w.WriteBulkString("modules")
+	c.w.WriteArray(0)
+}
+
+func quitCommand(c *conn, args [][]byte) {
+	c.quit = true
+	c.w.WriteSimpleString("OK")
+}
+
+// commandCommand replies the number of commands for COMMAND COUNT, and an empty array for the others,
+// it is enough for clients which call COMMAND or COMMAND DOCS on connecting.
+func commandCommand(c *conn, args [][]byte) {
+	if len(args) == 2 && strings.EqualFold(string(args[1]), "count") {
+		c.w.WriteInteger(int64(len(commands)))
+		return
+	}
+	c.w.WriteArray(0)
+}
+
+// setCommand sets the value, options like EX and NX are not supported.
+func setCommand(c *conn, args [][]byte) {
+	if len(args) > 3 {
+		c.w.WriteError("ERR syntax error")
+		return
+	}
+	if err := c.getDB().Set(args[1], args[2]); err != nil {
+		c.writeDBError(err)
+		return
+	}
+	c.w.WriteSimpleString("OK")
+}
+
+func getCommand(c *conn, args [][]byte) {
+	value, err := c.getDB().Get(args[1])
+	if err == db.ErrKeyNotFound {
+		c.w.WriteNull()
+		return
+	}
+	if err != nil {
+		c.writeDBError(err)
+		return
+	}
+	c.w.WriteBulk(value)
+}
+
+// msetCommand sets the keys one by one, it is not atomic.
+func msetCommand(c *conn, args [][]byte) {
+	if len(args)%2 != 1 {
+		c.w.WriteError("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	for i := 1; i < len(args); i += 2 {
+		if err := c.getDB().Set(args[i], args[i+1]); err != nil {
+			c.writeDBError(err)
+			return
+		}
+	}
+	c.w.WriteSimpleString("OK")
+}
+
+func mgetCommand(c *conn, args [][]byte) {
+	values, err := c.getDB().MGet(args[1:])
+	if err != nil {
+		c.writeDBError(err)
+		return
+	}
+	c.w.WriteArray(len(values))
+	for _, value := range values {
+		if value == nil {
+			c.w.WriteNull()
+		} else {
+			c.w.WriteBulk(value)
+		}
+	}
+}
+
+func delCommand(c *conn, args [][]byte) {
+	var deleted int64
+	for _, key := range args[1:] {
+		// the existence is checked with the delete atomically, so a key is counted once by concurrent DELs.
+		ok, err := c.getDB().DeleteIf(key, func(_ []byte, exist bool) bool {
+			return exist
+		})
+		if err != nil {
+			c.writeDBError(err)
+			return
+		}
+		if ok {
+			deleted++
+		}
+	}
+	c.w.WriteInteger(deleted)
+}
+
+func existsCommand(c *conn, args [][]byte) {
+	var count int64
+	for _, key := range args[1:] {
+		exist, err := keyExists(c.getDB(), key)
+		if err != nil {
+			c.writeDBError(err)
+			return
+		}
+		if exist {
+			count++
+		}
+	}
+	c.w.WriteInteger(count)
+}
+
+func strlenCommand(c *conn, args [][]byte) {
+	value, err := c.getDB().Get(args[1])
+	if err != nil && err != db.ErrKeyNotFound {
+		c.writeDBError(err)
+		return
+	}
+	c.w.WriteInteger(int64(len(value)))
+}
+
+// scanCommand scans the keys in lexicographical order, with the options MATCH and COUNT.
+// The cursor is the hex of the last key scanned, "0" to start, and "0" is replied when the scan is finished.
+// The literal prefix of the MATCH pattern is used to seek the keys, so a pattern like "user:*" is efficient.
+func scanCommand(c *conn, args [][]byte) {
+	var after []byte
+	if cursor := string(args[1]); cursor != "0" {
+		var err error
+		if after, err = hex.DecodeString(cursor); err != nil || len(after) == 0 {
+			c.w.WriteError("ERR invalid cursor")
+			return
+		}
+	}
+	pattern, count := "", 10
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			c.w.WriteError("ERR syntax error")
+			return
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = string(args[i+1])
+		case "count":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n <= 0 {
+				c.w.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			count = n
+		default:
+			c.w.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	keys := c.getDB().Keys(globPrefix(pattern), after, count)
+	cursor := "0"
+	if len(keys) == count {
+		cursor = hex.EncodeToString(keys[len(keys)-1])
+	}
+	matched := keys[:0]
+	for _, key := range keys {
+		if pattern == "" || pubsub.Match(pattern, string(key)) {
+			matched = append(matched, key)
+		}
+	}
+	c.w.WriteArray(2)
+	c.w.WriteBulkString(cursor)
+	c.w.WriteArray(len(matched))
+	for _, key := range matched {
+		c.w.WriteBulk(key)
+	}
+}
+
+// globPrefix returns the literal prefix of a glob pattern, before any special character.
+func globPrefix(pattern string) []byte {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		pattern = pattern[:i]
+	}
+	return []byte(pattern)
+}
+
+// keyExists checks whether key exists, GetReader is used so that large values won't be read.
+func keyExists(d *db.YoimiyaDB, key []byte) (bool, error) {
+	_, err := d.GetReader(key)
+	if err == db.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
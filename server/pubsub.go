@@ -0,0 +1,183 @@
+package server
+
+import (
+	"strings"
+	"yoimiya/pubsub"
+)
+
+// allowedWhileSubscribing the commands allowed in RESP2 when the connection subscribes any channel or pattern.
+var allowedWhileSubscribing = map[string]bool{
+	"subscribe":    true,
+	"psubscribe":   true,
+	"unsubscribe":  true,
+	"punsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+}
+
+// subscribing reports whether the connection subscribes any channel or pattern.
+func (c *conn) subscribing() bool {
+	return c.sub != nil && c.sub.Count() > 0
+}
+
+// subscription returns the subscription of the connection, it is created on the first call,
+// and the messages are written to the connection by a new goroutine since then.
+// Channels are shared by all dbs of the server, no matter which db is selected, the same as redis.
+func (c *conn) subscription() *pubsub.Subscription {
+	if c.sub == nil {
+		c.sub = c.srv.dbs[0].Subscribe()
+		c.pumpDone = make(chan struct{})
+		go c.pump(c.sub)
+	}
+	return c.sub
+}
+
+// pump writes the messages of sub until it is closed, the messages are flushed when there are no more.
+// The connection is closed if sub is closed for slow consumer.
+func (c *conn) pump(sub *pubsub.Subscription) {
+	defer close(c.pumpDone)
+	for msg := range sub.C() {
+		c.wmu.Lock()
+		c.writeMessage(msg)
+		for len(sub.C()) > 0 {
+			if msg, ok := <-sub.C(); ok {
+				c.writeMessage(msg)
+			}
+		}
+		err := c.w.Flush()
+		c.wmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	if sub.Err() != nil {
+		_ = c.nc.Close()
+	}
+}
+
+// closeSubscription closes the subscription and waits for the pump goroutine, it is called when the connection ends.
+func (c *conn) closeSubscription() {
+	if c.sub != nil {
+		c.sub.Close()
+		<-c.pumpDone
+	}
+}
+
+func (c *conn) writeMessage(msg *pubsub.Message) {
+	if msg.Pattern != "" {
+		c.w.WritePush(4)
+		c.w.WriteBulkString("pmessage")
+		c.w.WriteBulkString(msg.Pattern)
+	} else {
+		c.w.WritePush(3)
+		c.w.WriteBulkString("message")
+	}
+	c.w.WriteBulkString(msg.Channel)
+	c.w.WriteBulk(msg.Payload)
+}
+
+// writeSubscribeReply writes the reply of (P)(UN)SUBSCRIBE for a channel or pattern, nil channel is written as null.
+func (c *conn) writeSubscribeReply(kind string, channel []byte, count int) {
+	c.w.WritePush(3)
+	c.w.WriteBulkString(kind)
+	if channel == nil {
+		c.w.WriteNull()
+	} else {
+		c.w.WriteBulk(channel)
+	}
+	c.w.WriteInteger(int64(count))
+}
+
+func subscribeCommand(c *conn, args [][]byte) {
+	sub := c.subscription()
+	for _, channel := range args[1:] {
+		c.writeSubscribeReply("subscribe", channel, sub.Subscribe(string(channel)))
+	}
+}
+
+func psubscribeCommand(c *conn, args [][]byte) {
+	sub := c.subscription()
+	for _, pattern := range args[1:] {
+		c.writeSubscribeReply("psubscribe", pattern, sub.PSubscribe(string(pattern)))
+	}
+}
+
+// unsubscribeCommand unsubscribes the channels, or all channels without arguments.
+// A reply is written for each channel, or a reply with null channel if there is no channel to unsubscribe.
+func unsubscribeCommand(c *conn, args [][]byte) {
+	c.unsubscribe("unsubscribe", args[1:], func(sub *pubsub.Subscription) []string {
+		return sub.Channels()
+	}, func(sub *pubsub.Subscription, channel string) int {
+		return sub.Unsubscribe(channel)
+	})
+}
+
+// punsubscribeCommand unsubscribes the patterns, or all patterns without arguments.
+func punsubscribeCommand(c *conn, args [][]byte) {
+	c.unsubscribe("punsubscribe", args[1:], func(sub *pubsub.Subscription) []string {
+		return sub.Patterns()
+	}, func(sub *pubsub.Subscription, pattern string) int {
+		return sub.PUnsubscribe(pattern)
+	})
+}
+
+func (c *conn) unsubscribe(kind string, names [][]byte, all func(*pubsub.Subscription) []string,
+	unsubscribe func(*pubsub.Subscription, string) int) {
+
+	if len(names) == 0 && c.sub != nil {
+		for _, name := range all(c.sub) {
+			names = append(names, []byte(name))
+		}
+	}
+	if len(names) == 0 {
+		count := 0
+		if c.sub != nil {
+			count = c.sub.Count()
+		}
+		c.writeSubscribeReply(kind, nil, count)
+		return
+	}
+	for _, name := range names {
+		count := 0
+		if c.sub != nil {
+			count = unsubscribe(c.sub, string(name))
+		}
+		c.writeSubscribeReply(kind, name, count)
+	}
+}
+
+func publishCommand(c *conn, args [][]byte) {
+	c.w.WriteInteger(int64(c.srv.dbs[0].Publish(string(args[1]), args[2])))
+}
+
+// pubsubCommand supports the subcommands CHANNELS, NUMSUB and NUMPAT.
+func pubsubCommand(c *conn, args [][]byte) {
+	d := c.srv.dbs[0]
+	switch sub := strings.ToLower(string(args[1])); {
+	case sub == "channels" && len(args) <= 3:
+		pattern := ""
+		if len(args) == 3 {
+			pattern = string(args[2])
+		}
+		channels := d.PubSubChannels(pattern)
+		c.w.WriteArray(len(channels))
+		for _, channel := range channels {
+			c.w.WriteBulkString(channel)
+		}
+	case sub == "numsub":
+		channels := make([]string, len(args)-2)
+		for i, channel := range args[2:] {
+			channels[i] = string(channel)
+		}
+		nums := d.PubSubNumSub(channels...)
+		c.w.WriteArray(2 * len(channels))
+		for i, channel := range channels {
+			c.w.WriteBulkString(channel)
+			c.w.WriteInteger(int64(nums[i]))
+		}
+	case sub == "numpat" && len(args) == 2:
+		c.w.WriteInteger(int64(d.PubSubNumPat()))
+	default:
+		c.w.WriteError("ERR unknown subcommand or wrong number of arguments for '" + string(args[1]) + "'")
+	}
+}
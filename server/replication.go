@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"yoimiya/db"
+	"yoimiya/logger"
+)
+
+// replsyncCommand streams the log files of a db to a follower, see db.YoimiyaDB.Follow for the other side.
+// Usage: REPLSYNC <db index> <replication id> [<fid> <offset>]...
+// The connection is taken over by the replication stream, and is closed when the stream ends.
+func replsyncCommand(c *conn, args [][]byte) {
+	index, err := strconv.Atoi(string(args[1]))
+	if err != nil || index < 0 || index >= len(c.srv.dbs) {
+		c.w.WriteError("ERR DB index is out of range")
+		return
+	}
+	if len(args)%2 != 1 {
+		c.w.WriteError("ERR wrong number of arguments for 'replsync' command")
+		return
+	}
+	var positions []db.Position
+	for i := 3; i < len(args); i += 2 {
+		fid, err1 := strconv.ParseUint(string(args[i]), 10, 32)
+		offset, err2 := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err1 != nil || err2 != nil || offset < 0 {
+			c.w.WriteError("ERR invalid replication position")
+			return
+		}
+		positions = append(positions, db.Position{Fid: uint32(fid), Offset: offset})
+	}
+
+	c.quit = true
+	if err := c.w.Flush(); err != nil {
+		return
+	}
+	// frames may be written to the connection already, a RESP error would be read as a corrupted frame,
+	// so the error is only logged, and the follower reconnects after the connection is closed.
+	err = c.srv.dbs[index].ServeFollower(c.srv.ctx, c.nc, string(args[2]), positions)
+	if err != nil && !c.srv.isClosed() {
+		logger.Warn("replicate to %s err: %v", c.nc.RemoteAddr(), err)
+	}
+}
+
+// roleCommand replies the replication role of the selected db.
+// A leader replies "master", the number of connected followers and an empty array of followers.
+// A follower replies "slave", the host and port of its leader, the state of the link,
+// and how many bytes of log entries it is behind its leader instead of the replication offset.
+func roleCommand(c *conn, args [][]byte) {
+	info := c.getDB().ReplicationInfo()
+	if info.Leader == "" {
+		c.w.WriteArray(3)
+		c.w.WriteBulkString("master")
+		c.w.WriteInteger(int64(info.Followers))
+		c.w.WriteArray(0)
+		return
+	}
+	host, port, err := net.SplitHostPort(info.Leader)
+	if err != nil {
+		host, port = info.Leader, "0"
+	}
+	portNum, _ := strconv.Atoi(port)
+	state := "connect"
+	if info.Connected {
+		state = "connected"
+	}
+	c.w.WriteArray(5)
+	c.w.WriteBulkString("slave")
+	c.w.WriteBulkString(host)
+	c.w.WriteInteger(int64(portNum))
+	c.w.WriteBulkString(state)
+	c.w.WriteInteger(info.LagBytes)
+}
+
+// role returns the role of the selected db reported by HELLO.
+func (c *conn) role() string {
+	if c.getDB().ReplicationInfo().Leader != "" {
+		return "replica"
+	}
+	return "master"
+}
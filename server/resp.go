@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	// maxBulkLen max length of a bulk string in request, the same as redis.
+	maxBulkLen = 512 << 20
+
+	// maxArgs max number of arguments of a command.
+	maxArgs = 1 << 20
+
+	// maxInlineLen max length of an inline command.
+	maxInlineLen = 64 << 10
+)
+
+var (
+	// ErrProtocol the request can't be parsed as RESP.
+	ErrProtocol = errors.New("server: protocol error")
+)
+
+// reader reads commands in RESP from a connection.
+// A command is either an array of bulk strings, or an inline command separated by spaces, like "PING\r\n".
+type reader struct {
+	rd *bufio.Reader
+}
+
+// writer writes replies in RESP2 or RESP3, the replies are buffered until Flush.
+type writer struct {
+	wr    *bufio.Writer
+	proto int
+	num   []byte // buffer for formatting numbers.
+}
+
+func newReader(rd io.Reader) *reader {
+	return &reader{rd: bufio.NewReader(rd)}
+}
+
+func newWriter(wr io.Writer) *writer {
+	return &writer{wr: bufio.NewWriter(wr), proto: 2}
+}
+
+// ReadCommand reads the next command, an empty command is returned for an empty inline line.
+func (r *reader) ReadCommand() ([][]byte, error) {
+	b, err := r.rd.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != '*' {
+		return r.readInline()
+	}
+
+	n, err := r.readLength('*')
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > maxArgs {
+		return nil, ErrProtocol
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		size, err := r.readLength('$')
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 || size > maxBulkLen {
+			return nil, ErrProtocol
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r.rd, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, ErrProtocol
+		}
+		args[i] = buf[:size]
+	}
+	return args, nil
+}
+
+// Buffered returns the number of bytes can be read without waiting, it is used to detect pipelined commands.
+func (r *reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+func (r *reader) readInline() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Fields(line), nil
+}
+
+// readLength reads a line like "*3\r\n" or "$5\r\n", prefix is the expected type byte.
+func (r *reader) readLength(prefix byte) (int, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 2 || line[0] != prefix {
+		return 0, ErrProtocol
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		return 0, ErrProtocol
+	}
+	return n, nil
+}
+
+// readLine reads a line without the trailing "\r\n", a single "\n" is accepted too.
+func (r *reader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.rd.ReadSlice('\n')
+		line = append(line, frag...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		if len(line) > maxInlineLen {
+			return nil, ErrProtocol
+		}
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// WriteSimpleString writes a status reply like "+OK".
+func (w *writer) WriteSimpleString(s string) {
+	w.writeLine('+', s)
+}
+
+// WriteError writes an error reply, msg should start with an error code like "ERR".
+func (w *writer) WriteError(msg string) {
+	w.writeLine('-', msg)
+}
+
+// WriteInteger writes an integer reply.
+func (w *writer) WriteInteger(n int64) {
+	w.writeNumber(':', n)
+}
+
+// WriteBulk writes a bulk string reply.
+func (w *writer) WriteBulk(b []byte) {
+	w.writeNumber('$', int64(len(b)))
+	_, _ = w.wr.Write(b)
+	_, _ = w.wr.WriteString("\r\n")
+}
+
+// WriteBulkString writes a bulk string reply.
+func (w *writer) WriteBulkString(s string) {
+	w.writeNumber('$', int64(len(s)))
+	_, _ = w.wr.WriteString(s)
+	_, _ = w.wr.WriteString("\r\n")
+}
+
+// WriteNull writes a null reply, which is "$-1" in RESP2 and "_" in RESP3.
+func (w *writer) WriteNull() {
+	if w.proto >= 3 {
+		_, _ = w.wr.WriteString("_\r\n")
+		return
+	}
+	_, _ = w.wr.WriteString("$-1\r\n")
+}
+
+// WriteArray writes the header of an array reply with n elements, the elements must be written after it.
+func (w *writer) WriteArray(n int) {
+	w.writeNumber('*', int64(n))
+}
+
+// WriteMap writes the header of a map reply with n pairs, the keys and values must be written after it in turn.
+// It is written as an array of 2n elements in RESP2.
+func (w *writer) WriteMap(n int) {
+	if w.proto >= 3 {
+		w.writeNumber('%', int64(n))
+		return
+	}
+	w.writeNumber('*', int64(2*n))
+}
+
+// WritePush writes the header of a push reply with n elements, like the messages of pub/sub.
+// It is written as an array in RESP2.
+func (w *writer) WritePush(n int) {
+	if w.proto >= 3 {
+		w.writeNumber('>', int64(n))
+		return
+	}
+	w.writeNumber('*', int64(n))
+}
+
+// Flush writes the buffered replies to connection.
+func (w *writer) Flush() error {
+	return w.wr.Flush()
+}
+
+func (w *writer) writeLine(prefix byte, s string) {
+	_ = w.wr.WriteByte(prefix)
+	_, _ = w.wr.WriteString(s)
+	_, _ = w.wr.WriteString("\r\n")
+}
+
+func (w *writer) writeNumber(prefix byte, n int64) {
+	w.num = strconv.AppendInt(w.num[:0], n, 10)
+	_ = w.wr.WriteByte(prefix)
+	_, _ = w.wr.Write(w.num)
+	_, _ = w.wr.WriteString("\r\n")
+}
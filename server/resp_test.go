@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReader_ReadCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    [][]byte
+		wantErr error
+	}{
+		{"array", "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", [][]byte{[]byte("GET"), []byte("k")}, nil},
+		{"empty-bulk", "*2\r\n$4\r\nECHO\r\n$0\r\n\r\n", [][]byte{[]byte("ECHO"), {}}, nil},
+		{"binary-bulk", "*1\r\n$4\r\na\r\nb\r\n", [][]byte{[]byte("a\r\nb")}, nil},
+		{"inline", "SET  k v\r\n", [][]byte{[]byte("SET"), []byte("k"), []byte("v")}, nil},
+		{"inline-lf", "PING\n", [][]byte{[]byte("PING")}, nil},
+		{"empty-inline", "\r\n", [][]byte{}, nil},
+		{"invalid-length", "*x\r\n", nil, ErrProtocol},
+		{"negative-length", "*1\r\n$-2\r\n", nil, ErrProtocol},
+		{"missing-crlf", "*1\r\n$1\r\nab\r\n", nil, ErrProtocol},
+		{"not-bulk", "*1\r\n+OK\r\n", nil, ErrProtocol},
+		{"eof", "", nil, io.EOF},
+		{"unexpected-eof", "*1\r\n$5\r\nab", nil, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newReader(strings.NewReader(tt.input)).ReadCommand()
+			assert.Equal(t, tt.wantErr, err)
+			if tt.wantErr == nil {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReader_Pipeline(t *testing.T) {
+	r := newReader(strings.NewReader("PING\r\n*1\r\n$4\r\nPING\r\n"))
+	_, err := r.ReadCommand()
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, r.Buffered())
+	_, err = r.ReadCommand()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, r.Buffered())
+}
+
+func TestWriter(t *testing.T) {
+	write := func(w *writer) {
+		w.WriteSimpleString("OK")
+		w.WriteError("ERR oops")
+		w.WriteInteger(-12)
+		w.WriteBulk([]byte("v"))
+		w.WriteNull()
+		w.WriteMap(1)
+		w.WriteBulkString("k")
+		w.WriteArray(0)
+	}
+
+	t.Run("resp2", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		w := newWriter(buf)
+		write(w)
+		assert.Nil(t, w.Flush())
+		assert.Equal(t, "+OK\r\n-ERR oops\r\n:-12\r\n$1\r\nv\r\n$-1\r\n*2\r\n$1\r\nk\r\n*0\r\n", buf.String())
+	})
+
+	t.Run("resp3", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		w := newWriter(buf)
+		w.proto = 3
+		write(w)
+		assert.Nil(t, w.Flush())
+		assert.Equal(t, "+OK\r\n-ERR oops\r\n:-12\r\n$1\r\nv\r\n_\r\n%1\r\n$1\r\nk\r\n*0\r\n", buf.String())
+	})
+}
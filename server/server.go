@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"yoimiya/db"
+	"yoimiya/logger"
+	"yoimiya/pubsub"
+)
+
+var (
+	// ErrServerClosed is returned by Serve after Shutdown or Close.
+	ErrServerClosed = errors.New("server: server closed")
+
+	// ErrNoDB the server needs one db at least.
+	ErrNoDB = errors.New("server: no db to serve")
+)
+
+// Server serves the dbs in RESP, so that redis clients can work with it.
+// Each connection is served by its own goroutine, pipelined commands are executed in order and replied together.
+// The dbs are numbered by their index, and can be switched by SELECT, the same as redis.
+// Pub/sub commands go through the first db, so the dbs should share one pubsub.Hub if keyspace events are published.
+type Server struct {
+	dbs []*db.YoimiyaDB
+
+	ctx    context.Context // done when the server is closed, it stops the replication streams.
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup // running connections.
+}
+
+// conn is a client connection.
+type conn struct {
+	srv *Server
+	nc  net.Conn
+	r   *reader
+	w   *writer
+	db  int // the selected db.
+
+	wmu      sync.Mutex           // guards w, messages of pub/sub are written by another goroutine.
+	sub      *pubsub.Subscription // nil until the first (P)SUBSCRIBE.
+	pumpDone chan struct{}        // closed when the goroutine writing messages exits.
+
+	mu   sync.Mutex
+	busy bool // executing commands, it won't be closed by Shutdown until the replies are sent.
+	quit bool // the connection will be closed after the replies are sent.
+}
+
+// NewServer create a new server for dbs, the dbs are not closed by the server.
+func NewServer(dbs []*db.YoimiyaDB) (*Server, error) {
+	if len(dbs) == 0 {
+		return nil, ErrNoDB
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		dbs:       dbs,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*conn]struct{}),
+	}, nil
+}
+
+// ListenAndServe listens on the network address, network can be "tcp" or "unix", and then calls Serve.
+func (s *Server) ListenAndServe(network, addr string) error {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln and serves them, it blocks until ln fails or the server is closed.
+// ln is closed when Serve returns, it always returns a non-nil error, ErrServerClosed after Shutdown or Close.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+		_ = ln.Close()
+	}()
+
+	var delay time.Duration
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			// retry temporary errors like too many open files, the same as net/http.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				logger.Warn("accept err: %v, retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		if err := s.ServeConn(nc); err != nil {
+			return err
+		}
+	}
+}
+
+// ServeConn serves a connection in a new goroutine, it is useful for connections which are not from a listener,
+// like an end of net.Pipe. nc is closed if the server is closed.
+func (s *Server) ServeConn(nc net.Conn) error {
+	c := &conn{srv: s, nc: nc, r: newReader(nc), w: newWriter(nc)}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = nc.Close()
+		return ErrServerClosed
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	go c.serve()
+	return nil
+}
+
+// Shutdown stops accepting connections, and closes the connections after their executing commands are replied.
+// If ctx is done before all connections are closed, the rest of connections are closed at once and ctx.Err is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.close()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.closeIdleConns()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			s.closeConns()
+			<-done
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the listeners and all connections immediately.
+func (s *Server) Close() error {
+	s.close()
+	s.closeConns()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cancel()
+	for ln := range s.listeners {
+		_ = ln.Close()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) closeIdleConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.mu.Lock()
+		if !c.busy {
+			// unblock the reading, the connection goroutine will exit.
+			_ = c.nc.SetReadDeadline(time.Now())
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		_ = c.nc.Close()
+	}
+}
+
+func (s *Server) removeConn(c *conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// serve reads and executes commands until the connection is closed.
+// Replies are flushed when there is no more pipelined command in the read buffer.
+func (c *conn) serve() {
+	defer func() {
+		_ = c.nc.Close()
+		c.closeSubscription()
+		c.srv.removeConn(c)
+	}()
+
+	for {
+		args, err := c.r.ReadCommand()
+		if err != nil {
+			if err == ErrProtocol {
+				c.wmu.Lock()
+				c.w.WriteError("ERR Protocol error")
+				_ = c.w.Flush()
+				c.wmu.Unlock()
+			} else if err != io.EOF && !c.srv.isClosed() {
+				logger.Warn("read command from %s err: %v", c.nc.RemoteAddr(), err)
+			}
+			return
+		}
+		c.setBusy(true)
+		c.wmu.Lock()
+		if len(args) > 0 {
+			c.execute(args)
+		}
+		if c.r.Buffered() > 0 && !c.quit {
+			c.wmu.Unlock()
+			continue
+		}
+		err = c.w.Flush()
+		c.wmu.Unlock()
+		c.setBusy(false)
+		if err != nil || c.quit || c.srv.isClosed() {
+			return
+		}
+	}
+}
+
+func (c *conn) setBusy(busy bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.busy = busy
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+	"yoimiya/db"
+)
+
+func newTestServer(t *testing.T, dbNum int) (*Server, string, func()) {
+	path := filepath.Join("/tmp", "yoimiya-server")
+	var dbs []*db.YoimiyaDB
+	for i := 0; i < dbNum; i++ {
+		d, err := db.Open(db.DefaultOptions(filepath.Join(path, strconv.Itoa(i))))
+		assert.Nil(t, err)
+		dbs = append(dbs, d)
+	}
+	srv, err := NewServer(dbs)
+	assert.Nil(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	return srv, ln.Addr().String(), func() {
+		_ = srv.Close()
+		assert.Equal(t, ErrServerClosed, <-served)
+		for _, d := range dbs {
+			_ = d.Close()
+		}
+		_ = os.RemoveAll(path)
+	}
+}
+
+// roundTrip sends the raw requests, and reads the replies of the same length as want.
+func roundTrip(t *testing.T, nc net.Conn, req, want string) {
+	_, err := nc.Write([]byte(req))
+	assert.Nil(t, err)
+	got := make([]byte, len(want))
+	_ = nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(nc, got)
+	assert.Nil(t, err)
+	assert.Equal(t, want, string(got))
+}
+
+func TestServer_Commands(t *testing.T) {
+	_, addr, cleanup := newTestServer(t, 2)
+	defer cleanup()
+	nc, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer nc.Close()
+
+	tests := []struct {
+		name string
+		req  string
+		want string
+	}{
+		{"ping", "PING\r\n", "+PONG\r\n"},
+		{"ping-msg", "*2\r\n$4\r\nping\r\n$2\r\nhi\r\n", "$2\r\nhi\r\n"},
+		{"echo", "ECHO yoimiya\r\n", "$7\r\nyoimiya\r\n"},
+		{"set", "*3\r\n$3\r\nSET\r\n$2\r\nk1\r\n$2\r\nv1\r\n", "+OK\r\n"},
+		{"get", "GET k1\r\n", "$2\r\nv1\r\n"},
+		{"get-not-found", "GET k2\r\n", "$-1\r\n"},
+		{"set-options", "SET k1 v1 EX 10\r\n", "-ERR syntax error\r\n"},
+		{"mset", "MSET k2 v2 k3 v3\r\n", "+OK\r\n"},
+		{"mget", "MGET k1 k4 k3\r\n", "*3\r\n$2\r\nv1\r\n$-1\r\n$2\r\nv3\r\n"},
+		{"strlen", "STRLEN k1\r\n", ":2\r\n"},
+		{"exists", "EXISTS k1 k2 k4\r\n", ":2\r\n"},
+		{"scan", "SCAN 0 COUNT 2\r\n", "*2\r\n$4\r\n6b32\r\n*2\r\n$2\r\nk1\r\n$2\r\nk2\r\n"},
+		{"scan-cursor", "SCAN 6b32 COUNT 2\r\n", "*2\r\n$1\r\n0\r\n*1\r\n$2\r\nk3\r\n"},
+		{"scan-match", "SCAN 0 MATCH k[13]\r\n", "*2\r\n$1\r\n0\r\n*2\r\n$2\r\nk1\r\n$2\r\nk3\r\n"},
+		{"scan-invalid-cursor", "SCAN xyz\r\n", "-ERR invalid cursor\r\n"},
+		{"del", "DEL k1 k4\r\n", ":1\r\n"},
+		{"get-deleted", "GET k1\r\n", "$-1\r\n"},
+		{"unknown", "FOO\r\n", "-ERR unknown command 'FOO'\r\n"},
+		{"wrong-arity", "GET\r\n", "-ERR wrong number of arguments for 'get' command\r\n"},
+		{"select-out-of-range", "SELECT 2\r\n", "-ERR DB index is out of range\r\n"},
+		{"select", "SELECT 1\r\n", "+OK\r\n"},
+		{"get-other-db", "GET k2\r\n", "$-1\r\n"},
+		{"select-back", "SELECT 0\r\n", "+OK\r\n"},
+		{"get-db0", "GET k2\r\n", "$2\r\nv2\r\n"},
+		{"pipeline", "SET p 1\r\nGET p\r\nPING\r\n", "+OK\r\n$1\r\n1\r\n+PONG\r\n"},
+		{"hello3", "HELLO 3\r\n", "%6\r\n$6\r\nserver\r\n$7\r\nyoimiya\r\n$7\r\nversion\r\n$5\r\n1.0.0\r\n" +
+			"$5\r\nproto\r\n:3\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n"},
+		{"resp3-null", "GET k1\r\n", "_\r\n"},
+		{"quit", "QUIT\r\n", "+OK\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roundTrip(t, nc, tt.req, tt.want)
+		})
+	}
+
+	// the connection is closed after QUIT.
+	_, err = nc.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServer_ProtocolError(t *testing.T) {
+	_, addr, cleanup := newTestServer(t, 1)
+	defer cleanup()
+	nc, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer nc.Close()
+
+	roundTrip(t, nc, "*1\r\n$x\r\n", "-ERR Protocol error\r\n")
+	_, err = nc.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	srv, addr, cleanup := newTestServer(t, 1)
+	defer cleanup()
+	nc, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer nc.Close()
+	roundTrip(t, nc, "SET k v\r\n", "+OK\r\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, srv.Shutdown(ctx))
+
+	// the idle connection is closed, and new connections are refused.
+	_, err = nc.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	_, err = net.Dial("tcp", addr)
+	assert.NotNil(t, err)
+}
+
+func TestServer_ServeConn(t *testing.T) {
+	srv, _, cleanup := newTestServer(t, 1)
+	defer cleanup()
+	client, nc := net.Pipe()
+	defer client.Close()
+	assert.Nil(t, srv.ServeConn(nc))
+	roundTrip(t, client, "SET k v\r\nGET k\r\n", "+OK\r\n$1\r\nv\r\n")
+
+	assert.Nil(t, srv.Close())
+	assert.Equal(t, ErrServerClosed, srv.ServeConn(nc))
+}
+
+func TestServer_PubSub(t *testing.T) {
+	_, addr, cleanup := newTestServer(t, 2)
+	defer cleanup()
+	dial := func() net.Conn {
+		nc, err := net.Dial("tcp", addr)
+		assert.Nil(t, err)
+		return nc
+	}
+	subscriber, publisher, resp3 := dial(), dial(), dial()
+	defer subscriber.Close()
+	defer publisher.Close()
+	defer resp3.Close()
+
+	roundTrip(t, subscriber, "SUBSCRIBE news sport\r\n",
+		"*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$5\r\nsport\r\n:2\r\n")
+	roundTrip(t, subscriber, "PSUBSCRIBE n*\r\n", "*3\r\n$10\r\npsubscribe\r\n$2\r\nn*\r\n:3\r\n")
+	roundTrip(t, subscriber, "GET k\r\n",
+		"-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n")
+	roundTrip(t, subscriber, "PING\r\n", "*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+
+	// channels are shared by dbs.
+	roundTrip(t, publisher, "SELECT 1\r\nPUBLISH news hello\r\n", "+OK\r\n:2\r\n")
+	roundTrip(t, subscriber, "", "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n"+
+		"*4\r\n$8\r\npmessage\r\n$2\r\nn*\r\n$4\r\nnews\r\n$5\r\nhello\r\n")
+
+	roundTrip(t, publisher, "PUBSUB CHANNELS\r\n", "*2\r\n$4\r\nnews\r\n$5\r\nsport\r\n")
+	roundTrip(t, publisher, "PUBSUB NUMSUB news other\r\n", "*4\r\n$4\r\nnews\r\n:1\r\n$5\r\nother\r\n:0\r\n")
+	roundTrip(t, publisher, "PUBSUB NUMPAT\r\n", ":1\r\n")
+	roundTrip(t, publisher, "PUBSUB FOO\r\n", "-ERR unknown subcommand or wrong number of arguments for 'FOO'\r\n")
+
+	// in RESP3 messages are pushed, and other commands are allowed.
+	roundTrip(t, resp3, "HELLO 3\r\nSUBSCRIBE sport\r\nGET k\r\n", "%6\r\n$6\r\nserver\r\n$7\r\nyoimiya\r\n"+
+		"$7\r\nversion\r\n$5\r\n1.0.0\r\n$5\r\nproto\r\n:3\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n"+
+		"$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n"+">3\r\n$9\r\nsubscribe\r\n$5\r\nsport\r\n:1\r\n_\r\n")
+	roundTrip(t, publisher, "PUBLISH sport goal\r\n", ":2\r\n")
+	roundTrip(t, resp3, "", ">3\r\n$7\r\nmessage\r\n$5\r\nsport\r\n$4\r\ngoal\r\n")
+	roundTrip(t, subscriber, "", "*3\r\n$7\r\nmessage\r\n$5\r\nsport\r\n$4\r\ngoal\r\n")
+
+	roundTrip(t, subscriber, "UNSUBSCRIBE\r\n",
+		"*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:2\r\n*3\r\n$11\r\nunsubscribe\r\n$5\r\nsport\r\n:1\r\n")
+	roundTrip(t, subscriber, "PUNSUBSCRIBE\r\n", "*3\r\n$12\r\npunsubscribe\r\n$2\r\nn*\r\n:0\r\n")
+	roundTrip(t, subscriber, "PUNSUBSCRIBE\r\n", "*3\r\n$12\r\npunsubscribe\r\n$-1\r\n:0\r\n")
+	roundTrip(t, subscriber, "GET k\r\n", "$-1\r\n")
+	roundTrip(t, publisher, "PUBLISH news hello\r\n", ":0\r\n")
+}
+
+func TestServer_Replication(t *testing.T) {
+	srv, addr, cleanup := newTestServer(t, 2)
+	defer cleanup()
+	nc, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer nc.Close()
+	roundTrip(t, nc, "SELECT 1\r\nSET k1 v1\r\n", "+OK\r\n+OK\r\n")
+
+	path := filepath.Join("/tmp", "yoimiya-replica")
+	replica, err := db.Open(db.DefaultOptions(path))
+	assert.Nil(t, err)
+	defer func() {
+		_ = replica.Close()
+		_ = os.RemoveAll(path)
+	}()
+	replica.Follow(addr, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if value, err := replica.Get([]byte("k1")); err == nil {
+			assert.Equal(t, []byte("v1"), value)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replica is not synced in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	roundTrip(t, nc, "ROLE\r\n", "*3\r\n$6\r\nmaster\r\n:1\r\n*0\r\n")
+	roundTrip(t, nc, "REPLSYNC 2 id\r\n", "-ERR DB index is out of range\r\n")
+	roundTrip(t, nc, "REPLSYNC 1 id 1\r\n", "-ERR wrong number of arguments for 'replsync' command\r\n")
+
+	// the writes to a replica are rejected.
+	replicaSrv, err := NewServer([]*db.YoimiyaDB{replica})
+	assert.Nil(t, err)
+	defer replicaSrv.Close()
+	client, rc := net.Pipe()
+	defer client.Close()
+	assert.Nil(t, replicaSrv.ServeConn(rc))
+	roundTrip(t, client, "SET k2 v2\r\n", "-READONLY You can't write against a read only replica.\r\n")
+	roundTrip(t, client, "GET k1\r\n", "$2\r\nv1\r\n")
+	_, port, _ := net.SplitHostPort(addr)
+	want := fmt.Sprintf("*5\r\n$5\r\nslave\r\n$9\r\n127.0.0.1\r\n:%s\r\n$9\r\nconnected\r\n:0\r\n", port)
+	roundTrip(t, client, "ROLE\r\n", want)
+
+	// the replication streams are stopped by closing the server.
+	assert.Nil(t, srv.Close())
+}